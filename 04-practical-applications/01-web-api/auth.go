@@ -0,0 +1,120 @@
+package webapi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	security "golang-examples/04-practical-applications/07-security"
+)
+
+// contextKey 请求上下文键类型，避免与其他包冲突
+type contextKey string
+
+const authUserKey contextKey = "auth_user"
+
+// LoginRequest 登录请求
+type LoginRequest struct {
+	Username string `json:"username" validate:"required"`
+	Password string `json:"password" validate:"required"`
+}
+
+// LoginResponse 登录响应
+type LoginResponse struct {
+	Token     string   `json:"token"`
+	TokenType string   `json:"token_type"`
+	Username  string   `json:"username"`
+	Roles     []string `json:"roles"`
+}
+
+// AuthUserFromContext 获取认证中间件写入上下文的当前用户
+func AuthUserFromContext(ctx context.Context) (*security.User, bool) {
+	user, ok := ctx.Value(authUserKey).(*security.User)
+	return user, ok
+}
+
+// loginHandler 用户名密码登录，签发JWT令牌
+func (s *Server) loginHandler(w http.ResponseWriter, r *http.Request) {
+	if s.config.Auth == nil {
+		writeProblem(w, r, NewProblem(http.StatusNotFound, CodeNotFound, "未启用认证"))
+		return
+	}
+
+	var req LoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeProblem(w, r, NewProblem(http.StatusBadRequest, CodeInvalidJSON, "无效的JSON数据"))
+		return
+	}
+
+	token, user, err := s.config.Auth.Login(req.Username, req.Password)
+	if err != nil {
+		// 不区分用户不存在和密码错误，避免泄露账号信息
+		writeProblem(w, r, NewProblem(http.StatusUnauthorized, CodeUnauthorized, "用户名或密码错误"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(LoginResponse{
+		Token:     token,
+		TokenType: "Bearer",
+		Username:  user.Username,
+		Roles:     user.Roles,
+	})
+}
+
+// authMiddleware 认证中间件，校验 Authorization: Bearer 令牌
+//
+// 未配置 AuthService 时直接放行。
+func (s *Server) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.config.Auth == nil || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		header := r.Header.Get("Authorization")
+		token, found := strings.CutPrefix(header, "Bearer ")
+		if !found || strings.TrimSpace(token) == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="user-api"`)
+			writeProblem(w, r, NewProblem(http.StatusUnauthorized, CodeUnauthorized, "缺少认证令牌"))
+			return
+		}
+
+		user, err := s.config.Auth.ValidateToken(strings.TrimSpace(token))
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="user-api", error="invalid_token"`)
+			writeProblem(w, r, NewProblem(http.StatusUnauthorized, CodeUnauthorized, "无效的认证令牌"))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), authUserKey, user)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requireRole 角色守卫，要求当前用户拥有指定角色
+//
+// 未配置 AuthService 时直接放行。
+func (s *Server) requireRole(role string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.config.Auth == nil {
+			next(w, r)
+			return
+		}
+
+		user, ok := AuthUserFromContext(r.Context())
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="user-api"`)
+			writeProblem(w, r, NewProblem(http.StatusUnauthorized, CodeUnauthorized, "缺少认证令牌"))
+			return
+		}
+
+		if !s.config.Auth.HasRole(user, role) {
+			writeProblem(w, r, NewProblem(http.StatusForbidden, CodeForbidden, "权限不足: 需要角色 "+role))
+			return
+		}
+
+		next(w, r)
+	}
+}
@@ -0,0 +1,347 @@
+package webapi
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 批量导入导出支持的媒体类型
+const (
+	NDJSONContentType = "application/x-ndjson"
+	CSVContentType    = "text/csv"
+)
+
+// maxBatchSize 单次批量创建或导入的最大条目数
+const maxBatchSize = 10000
+
+// maxImportLineSize NDJSON 导入时单行的最大长度
+const maxImportLineSize = 64 * 1024
+
+// csvColumns 导出CSV的列顺序，导入时按表头识别 name、email、age 列
+var csvColumns = []string{"id", "name", "email", "age", "version", "created_at", "updated_at", "deleted_at"}
+
+// BatchResult 批量操作中单个条目的结果
+type BatchResult struct {
+	Index  int      `json:"index"` // 条目在请求中的位置，从0开始
+	Status int      `json:"status"`
+	User   *User    `json:"user,omitempty"`
+	Error  *Problem `json:"error,omitempty"`
+}
+
+// BatchResponse 批量操作结果，部分条目失败不影响其他条目
+type BatchResponse struct {
+	Succeeded int           `json:"succeeded"`
+	Failed    int           `json:"failed"`
+	Results   []BatchResult `json:"results"`
+}
+
+// add 记录一个条目的结果
+func (b *BatchResponse) add(ctx context.Context, user *User, err error) {
+	result := BatchResult{Index: len(b.Results)}
+	if err != nil {
+		problem := problemFromError(ctx, err)
+		result.Status = problem.Status
+		result.Error = &problem
+		b.Failed++
+	} else {
+		result.Status = http.StatusCreated
+		result.User = user
+		b.Succeeded++
+	}
+	b.Results = append(b.Results, result)
+}
+
+// writeBatchResponse 全部成功返回201，否则返回207并由各条目给出状态
+func writeBatchResponse(w http.ResponseWriter, r *http.Request, response *BatchResponse) {
+	status := http.StatusCreated
+	if response.Failed > 0 {
+		status = http.StatusMultiStatus
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		LoggerFromContext(r.Context()).Error("编码响应失败", "error", err)
+	}
+}
+
+// errBatchTooLarge 条目数超过 maxBatchSize
+var errBatchTooLarge = fmt.Errorf("单次最多处理 %d 个用户", maxBatchSize)
+
+// batchItem 从请求体中读取的一个条目，Err 不为空表示该条目无法解析
+type batchItem struct {
+	User *User
+	Err  error
+}
+
+// batchReader 逐个读取条目，返回 io.EOF 表示结束，其他错误表示整个请求无法继续
+type batchReader func() (batchItem, error)
+
+// createEach 读取全部条目后逐个创建，单个条目失败不影响其他条目
+//
+// 先完整读取再写入，请求体格式错误或条目过多时不会留下部分写入的数据。
+func (h *UserHandler) createEach(ctx context.Context, next batchReader) (*BatchResponse, error) {
+	var items []batchItem
+	for {
+		item, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(items) >= maxBatchSize {
+			return nil, errBatchTooLarge
+		}
+		items = append(items, item)
+	}
+
+	response := &BatchResponse{Results: make([]BatchResult, 0, len(items))}
+	for _, item := range items {
+		if item.Err == nil {
+			item.Err = h.service.CreateUser(ctx, item.User)
+		}
+		response.add(ctx, item.User, item.Err)
+	}
+	return response, nil
+}
+
+// invalidItem 构造字段校验失败的条目
+func invalidItem(user *User, field, message string) batchItem {
+	verr := &ValidationError{}
+	verr.Add(field, message)
+	return batchItem{User: user, Err: verr}
+}
+
+// writeBatchError 输出导致整个批量请求失败的错误
+func writeBatchError(w http.ResponseWriter, r *http.Request, err error, code string) {
+	if errors.Is(err, errBatchTooLarge) {
+		writeProblem(w, r, NewProblem(http.StatusRequestEntityTooLarge, CodeBatchTooLarge, err.Error()))
+		return
+	}
+	writeProblem(w, r, NewProblem(http.StatusBadRequest, code, err.Error()))
+}
+
+// CreateUsersBatch 批量创建用户，请求体为用户数组，按条目返回结果
+//
+// 单个条目字段类型错误只导致该条目失败，JSON语法错误则整个请求失败。
+func (h *UserHandler) CreateUsersBatch(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+		writeProblem(w, r, NewProblem(http.StatusBadRequest, CodeInvalidJSON, "请求体必须是用户数组"))
+		return
+	}
+
+	response, err := h.createEach(r.Context(), func() (batchItem, error) {
+		if !decoder.More() {
+			return batchItem{}, io.EOF
+		}
+
+		var user User
+		if err := decoder.Decode(&user); err != nil {
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &typeErr) {
+				return invalidItem(&user, typeErr.Field, typeErr.Field+" 类型错误"), nil
+			}
+			return batchItem{}, fmt.Errorf("无效的JSON数据: %v", err)
+		}
+		return batchItem{User: &user}, nil
+	})
+	if err != nil {
+		writeBatchError(w, r, err, CodeInvalidJSON)
+		return
+	}
+
+	writeBatchResponse(w, r, response)
+}
+
+// ImportUsers 从 NDJSON 或 CSV 上传导入用户，按条目返回结果
+//
+// CSV 第一行必须是表头，按列名识别 name、email、age，其他列被忽略。
+func (h *UserHandler) ImportUsers(w http.ResponseWriter, r *http.Request) {
+	// 上传耗时与数据量成正比，不受服务器 ReadTimeout 限制；不支持的写入器忽略即可
+	http.NewResponseController(w).SetReadDeadline(time.Time{})
+
+	var next batchReader
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch contentType {
+	case NDJSONContentType:
+		next = ndjsonUserReader(r.Body)
+	case CSVContentType:
+		var err error
+		if next, err = csvUserReader(r.Body); err != nil {
+			writeProblem(w, r, NewProblem(http.StatusBadRequest, CodeInvalidImport, err.Error()))
+			return
+		}
+	default:
+		writeProblem(w, r, NewProblem(http.StatusUnsupportedMediaType, CodeUnsupportedMedia,
+			"导入仅支持 "+NDJSONContentType+" 和 "+CSVContentType))
+		return
+	}
+
+	response, err := h.createEach(r.Context(), next)
+	if err != nil {
+		writeBatchError(w, r, err, CodeInvalidImport)
+		return
+	}
+
+	writeBatchResponse(w, r, response)
+}
+
+// ndjsonUserReader 逐行解析 NDJSON，空行被跳过，无法解析的行只导致该条目失败
+func ndjsonUserReader(body io.Reader) batchReader {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 4096), maxImportLineSize)
+
+	return func() (batchItem, error) {
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+
+			var user User
+			if err := json.Unmarshal([]byte(line), &user); err != nil {
+				return invalidItem(&user, "", "无效的JSON行: "+err.Error()), nil
+			}
+			return batchItem{User: &user}, nil
+		}
+
+		if err := scanner.Err(); err != nil {
+			return batchItem{}, fmt.Errorf("读取NDJSON失败: %v", err)
+		}
+		return batchItem{}, io.EOF
+	}
+}
+
+// csvUserReader 解析CSV表头并返回逐行读取用户的函数
+func csvUserReader(body io.Reader) (batchReader, error) {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return func() (batchItem, error) { return batchItem{}, io.EOF }, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("读取CSV表头失败: %v", err)
+	}
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, required := range []string{"name", "email"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("CSV缺少必需的列: %s", required)
+		}
+	}
+
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	return func() (batchItem, error) {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return batchItem{}, io.EOF
+		}
+		if err != nil {
+			return batchItem{}, fmt.Errorf("CSV格式错误: %v", err)
+		}
+
+		user := &User{Name: field(record, "name"), Email: field(record, "email")}
+		if raw := field(record, "age"); raw != "" {
+			age, err := strconv.Atoi(raw)
+			if err != nil {
+				return invalidItem(user, "age", "age 必须是整数"), nil
+			}
+			user.Age = age
+		}
+		return batchItem{User: user}, nil
+	}, nil
+}
+
+// ExportUsers 以 NDJSON 或 CSV 流式导出全部用户
+//
+// 格式由 format 查询参数（ndjson、csv）或 Accept 头决定，默认 NDJSON。
+// 数据按页从仓库读取并逐条写出，不会一次性加载全部用户。
+func (h *UserHandler) ExportUsers(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "ndjson"
+		if strings.Contains(r.Header.Get("Accept"), CSVContentType) {
+			format = "csv"
+		}
+	}
+
+	var write func(User) error
+	var flush func() error
+	switch format {
+	case "ndjson":
+		w.Header().Set("Content-Type", NDJSONContentType)
+		w.Header().Set("Content-Disposition", `attachment; filename="users.ndjson"`)
+		encoder := json.NewEncoder(w)
+		write = func(user User) error { return encoder.Encode(user) }
+		flush = func() error { return nil }
+	case "csv":
+		w.Header().Set("Content-Type", CSVContentType+"; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="users.csv"`)
+		writer := csv.NewWriter(w)
+		writer.Write(csvColumns)
+		write = func(user User) error {
+			return writer.Write(userCSVRecord(user))
+		}
+		flush = func() error {
+			writer.Flush()
+			return writer.Error()
+		}
+	default:
+		verr := &ValidationError{}
+		verr.Add("format", "不支持的导出格式: "+format)
+		writeError(w, r, verr)
+		return
+	}
+
+	// 导出耗时与数据量成正比，不受服务器 WriteTimeout 限制；不支持的写入器忽略即可
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	// 每写完一页推送给客户端，避免数据堆积在缓冲区中
+	flusher, _ := w.(http.Flusher)
+	count := 0
+	err := h.service.ForEachUser(r.Context(), func(user User) error {
+		if err := write(user); err != nil {
+			return err
+		}
+		if count++; count%maxPerPage == 0 {
+			if err := flush(); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		// 响应头已发出，只能记录日志并中断输出
+		LoggerFromContext(r.Context()).Error("导出用户失败", "error", err)
+	}
+}
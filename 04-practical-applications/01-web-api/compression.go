@@ -0,0 +1,279 @@
+package webapi
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// CompressionConfig 响应压缩配置
+type CompressionConfig struct {
+	MinSize int // 响应体小于该字节数时不压缩，压缩小响应得不偿失
+	Level   int // 压缩级别，0 或超出 gzip.HuffmanOnly～gzip.BestCompression 的值使用默认级别；不需要压缩时不配置 Compression 即可
+}
+
+// DefaultCompressionConfig 默认压缩配置：1KB以上的响应使用默认级别压缩
+func DefaultCompressionConfig() CompressionConfig {
+	return CompressionConfig{MinSize: 1024, Level: gzip.DefaultCompression}
+}
+
+// negotiateEncoding 按 Accept-Encoding 选择 gzip 或 deflate，都不可接受时返回空字符串
+//
+// q 值相同时优先 gzip；"*" 可匹配任一编码。
+func negotiateEncoding(header string) string {
+	if header == "" {
+		return ""
+	}
+
+	ranges := parseAccept(header)
+	best, bestQ := "", 0.0
+	for _, encoding := range []string{"gzip", "deflate"} {
+		q, found := 0.0, false
+		for _, r := range ranges {
+			if r.mediaType == encoding {
+				q, found = r.q, true
+				break
+			}
+		}
+		if !found {
+			for _, r := range ranges {
+				if r.mediaType == "*" {
+					q = r.q
+					break
+				}
+			}
+		}
+		if q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// encodedETag 压缩后的表示使用不同的强ETag，如 "v3" -> "v3-gzip"
+//
+// 强ETag要求字节完全相同，压缩前后的表示不能共用同一个；弱ETag原样返回。
+func encodedETag(etag, encoding string) string {
+	if !strings.HasPrefix(etag, `"`) || !strings.HasSuffix(etag, `"`) {
+		return etag
+	}
+	return strings.TrimSuffix(etag, `"`) + "-" + encoding + `"`
+}
+
+// decodeETags 去掉条件请求头中ETag的编码后缀，处理器按未压缩表示的ETag比较
+//
+// 返回处理后的头和是否包含指定编码的ETag。
+func decodeETags(header, encoding string) (string, bool) {
+	tags := strings.Split(header, ",")
+	found := false
+	for i, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		for _, candidate := range []string{"gzip", "deflate"} {
+			if base, ok := strings.CutSuffix(tag, "-"+candidate+`"`); ok {
+				tag = base + `"`
+				found = found || candidate == encoding
+				break
+			}
+		}
+		tags[i] = tag
+	}
+	return strings.Join(tags, ", "), found
+}
+
+// compressWriter 延迟决定是否压缩的响应写入器
+//
+// 响应体先缓冲到 MinSize，超过后才开始压缩；响应结束时仍不足 MinSize 则原样输出。
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	config   CompressionConfig
+
+	// notModifiedEncoded 客户端用压缩表示的ETag发起 If-None-Match，304响应需返回同一ETag
+	notModifiedEncoded bool
+
+	status      int
+	buffer      []byte
+	encoder     io.WriteCloser
+	passthrough bool
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.status == 0 {
+		cw.status = code
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+
+	switch {
+	case cw.passthrough:
+		return cw.ResponseWriter.Write(b)
+	case cw.encoder != nil:
+		return cw.encoder.Write(b)
+	}
+
+	cw.buffer = append(cw.buffer, b...)
+	if len(cw.buffer) >= cw.config.MinSize {
+		if err := cw.start(); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// newEncoder 创建 gzip 或 deflate（zlib 格式）编码器
+//
+// 出错时返回 nil 接口，而不是包装了 nil 指针的接口。
+func newEncoder(w io.Writer, encoding string, level int) (io.WriteCloser, error) {
+	if encoding == "gzip" {
+		encoder, err := gzip.NewWriterLevel(w, level)
+		if err != nil {
+			return nil, err
+		}
+		return encoder, nil
+	}
+	encoder, err := zlib.NewWriterLevel(w, level)
+	if err != nil {
+		return nil, err
+	}
+	return encoder, nil
+}
+
+// start 确定输出方式并写出已缓冲的数据
+func (cw *compressWriter) start() error {
+	header := cw.Header()
+	compressible := header.Get("Content-Encoding") == "" &&
+		cw.status != http.StatusNoContent && cw.status != http.StatusNotModified &&
+		len(cw.buffer) > 0
+
+	if !compressible {
+		return cw.writePassthrough()
+	}
+
+	// 先创建编码器再写响应头，创建失败时还能原样输出
+	encoder, err := newEncoder(cw.ResponseWriter, cw.encoding, cw.config.Level)
+	if err != nil {
+		return cw.writePassthrough()
+	}
+	cw.encoder = encoder
+
+	header.Set("Content-Encoding", cw.encoding)
+	header.Del("Content-Length")
+	if etag := header.Get("ETag"); etag != "" {
+		header.Set("ETag", encodedETag(etag, cw.encoding))
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	_, err = cw.encoder.Write(cw.buffer)
+	cw.buffer = nil
+	return err
+}
+
+// writePassthrough 不压缩，原样写出响应头和已缓冲的数据
+func (cw *compressWriter) writePassthrough() error {
+	cw.passthrough = true
+	if cw.status == http.StatusNotModified && cw.notModifiedEncoded {
+		if etag := cw.Header().Get("ETag"); etag != "" {
+			cw.Header().Set("ETag", encodedETag(etag, cw.encoding))
+		}
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	// 204、304等响应不允许有响应体，即使是空写入也会返回错误
+	if len(cw.buffer) == 0 {
+		return nil
+	}
+	_, err := cw.ResponseWriter.Write(cw.buffer)
+	cw.buffer = nil
+	return err
+}
+
+// Flush 流式响应需要立即输出：尚未决定时直接开始压缩
+func (cw *compressWriter) Flush() {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	if !cw.passthrough && cw.encoder == nil {
+		if err := cw.start(); err != nil {
+			return
+		}
+	}
+	if flusher, ok := cw.encoder.(interface{ Flush() error }); ok {
+		flusher.Flush()
+	}
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap 供 http.ResponseController 访问底层写入器
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// close 结束响应：不足阈值的响应原样输出，已压缩的响应写出压缩尾部
+func (cw *compressWriter) close() error {
+	if cw.encoder != nil {
+		return cw.encoder.Close()
+	}
+	if cw.passthrough || cw.status == 0 {
+		return nil
+	}
+	return cw.writePassthrough()
+}
+
+// compressionMiddleware 按 Accept-Encoding 压缩响应，未配置时直接放行
+//
+// 压缩后的响应使用带编码后缀的ETag，条件请求头中的这类ETag在交给处理器前还原。
+func (s *Server) compressionMiddleware(next http.Handler) http.Handler {
+	if s.config.Compression == nil {
+		return next
+	}
+	config := *s.config.Compression
+	switch {
+	case config.Level == 0:
+		// gzip 和 zlib 的0级都表示不压缩，这里的0表示默认级别
+		config.Level = gzip.DefaultCompression
+	case config.Level < gzip.HuffmanOnly || config.Level > gzip.BestCompression:
+		// 无效级别会让每个压缩响应都无法创建编码器，构建时回退为默认级别
+		s.logger.Warn("压缩级别无效，使用默认级别", "level", config.Level)
+		config.Level = gzip.DefaultCompression
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if r.Header.Get("If-Match") != "" || r.Header.Get("If-None-Match") != "" {
+			r = r.Clone(r.Context())
+		}
+		if header := r.Header.Get("If-Match"); header != "" {
+			header, _ = decodeETags(header, encoding)
+			r.Header.Set("If-Match", header)
+		}
+		notModifiedEncoded := false
+		if header := r.Header.Get("If-None-Match"); header != "" {
+			header, notModifiedEncoded = decodeETags(header, encoding)
+			r.Header.Set("If-None-Match", header)
+		}
+
+		if encoding == "" || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding, config: config, notModifiedEncoded: notModifiedEncoded}
+		defer func() {
+			if err := cw.close(); err != nil {
+				LoggerFromContext(r.Context()).Error("压缩响应失败", "error", err)
+			}
+		}()
+
+		next.ServeHTTP(cw, r)
+	})
+}
@@ -0,0 +1,198 @@
+package webapi
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSConfig 跨域资源共享策略
+//
+// AllowedOrigins 中的条目可以是精确来源（如 "https://app.example.com"），
+// 也可以是通配子域（如 "https://*.example.com"，匹配任意层级子域但不匹配 example.com 本身）。
+// "*" 表示允许任意来源，但在 AllowCredentials 为 true 时不生效，避免任意站点携带凭证访问。
+type CORSConfig struct {
+	AllowedOrigins   []string
+	AllowedMethods   []string      // 为空时使用 DefaultCORSConfig 中的方法
+	AllowedHeaders   []string      // 预检请求允许的请求头，为空时使用默认值
+	ExposedHeaders   []string      // 允许浏览器脚本读取的响应头
+	AllowCredentials bool          // 是否允许携带Cookie和Authorization等凭证
+	MaxAge           time.Duration // 预检结果缓存时间，0 表示不发送 Access-Control-Max-Age
+}
+
+// DefaultCORSConfig 默认跨域策略：仅允许指定来源，不允许凭证，预检结果缓存10分钟
+func DefaultCORSConfig(origins ...string) CORSConfig {
+	return CORSConfig{
+		AllowedOrigins: origins,
+		AllowedMethods: []string{
+			http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete,
+		},
+		AllowedHeaders: []string{
+			"Content-Type", "Authorization", "If-Match", "If-None-Match", RequestIDHeader,
+		},
+		ExposedHeaders: []string{
+			"ETag", "Link", "X-Total-Count", RequestIDHeader, "Retry-After",
+			"X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset",
+		},
+		MaxAge: 10 * time.Minute,
+	}
+}
+
+// corsPolicy 预处理后的跨域策略，避免每个请求重复解析配置
+type corsPolicy struct {
+	config    CORSConfig
+	anyOrigin bool
+	exact     map[string]bool
+	suffixes  []originPattern
+	methods   map[string]bool
+	headers   map[string]bool
+}
+
+// originPattern 通配子域来源，如 "https://*.example.com" 拆分为 scheme "https://" 和后缀 ".example.com"
+type originPattern struct {
+	scheme string
+	suffix string
+}
+
+// newCORSPolicy 根据配置构建跨域策略，未配置的方法和请求头使用默认值
+func newCORSPolicy(config CORSConfig) *corsPolicy {
+	defaults := DefaultCORSConfig()
+	if len(config.AllowedMethods) == 0 {
+		config.AllowedMethods = defaults.AllowedMethods
+	}
+	if len(config.AllowedHeaders) == 0 {
+		config.AllowedHeaders = defaults.AllowedHeaders
+	}
+
+	policy := &corsPolicy{
+		config:  config,
+		exact:   make(map[string]bool),
+		methods: make(map[string]bool),
+		headers: make(map[string]bool),
+	}
+	for _, origin := range config.AllowedOrigins {
+		origin = strings.ToLower(strings.TrimSpace(origin))
+		switch {
+		case origin == "*":
+			policy.anyOrigin = !config.AllowCredentials
+		case strings.Contains(origin, "://*."):
+			scheme, host, _ := strings.Cut(origin, "*")
+			policy.suffixes = append(policy.suffixes, originPattern{scheme: scheme, suffix: host})
+		case origin != "":
+			policy.exact[origin] = true
+		}
+	}
+	for _, method := range config.AllowedMethods {
+		policy.methods[strings.ToUpper(method)] = true
+	}
+	for _, header := range config.AllowedHeaders {
+		policy.headers[http.CanonicalHeaderKey(header)] = true
+	}
+	return policy
+}
+
+// allowOrigin 判断来源是否在允许列表中
+func (p *corsPolicy) allowOrigin(origin string) bool {
+	origin = strings.ToLower(origin)
+	if p.anyOrigin || p.exact[origin] {
+		return true
+	}
+	for _, pattern := range p.suffixes {
+		if !strings.HasPrefix(origin, pattern.scheme) || !strings.HasSuffix(origin, pattern.suffix) {
+			continue
+		}
+		// 通配部分必须是非空的主机名标签，不能借助路径或用户信息绕过
+		label := origin[len(pattern.scheme) : len(origin)-len(pattern.suffix)]
+		if label != "" && !strings.ContainsAny(label, "/@:?#") {
+			return true
+		}
+	}
+	return false
+}
+
+// allowHeaders 判断预检请求的 Access-Control-Request-Headers 是否全部被允许
+func (p *corsPolicy) allowHeaders(requested string) bool {
+	for _, header := range strings.Split(requested, ",") {
+		header = strings.TrimSpace(header)
+		if header != "" && !p.headers[http.CanonicalHeaderKey(header)] {
+			return false
+		}
+	}
+	return true
+}
+
+// setOriginHeaders 设置简单请求和预检请求共用的响应头
+func (p *corsPolicy) setOriginHeaders(h http.Header, origin string) {
+	if p.anyOrigin {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+	if p.config.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// corsMiddleware CORS中间件，未配置跨域策略时不发送任何CORS响应头
+//
+// 不在允许列表中的来源：预检请求返回403，普通请求照常处理但不带CORS头，由浏览器拦截响应。
+func (s *Server) corsMiddleware(next http.Handler) http.Handler {
+	if s.config.CORS == nil {
+		return next
+	}
+	policy := newCORSPolicy(*s.config.CORS)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 响应内容随 Origin 变化，缓存必须按 Origin 区分
+		w.Header().Add("Vary", "Origin")
+
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		requestMethod := r.Header.Get("Access-Control-Request-Method")
+		if r.Method == http.MethodOptions && requestMethod != "" {
+			policy.preflight(w, r, origin, requestMethod)
+			return
+		}
+
+		if policy.allowOrigin(origin) {
+			policy.setOriginHeaders(w.Header(), origin)
+			if len(policy.config.ExposedHeaders) > 0 {
+				w.Header().Set("Access-Control-Expose-Headers", strings.Join(policy.config.ExposedHeaders, ", "))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// preflight 处理预检请求，来源、方法或请求头任一不被允许时返回403
+func (p *corsPolicy) preflight(w http.ResponseWriter, r *http.Request, origin, method string) {
+	w.Header().Add("Vary", "Access-Control-Request-Method")
+	w.Header().Add("Vary", "Access-Control-Request-Headers")
+
+	requestedHeaders := r.Header.Get("Access-Control-Request-Headers")
+	switch {
+	case !p.allowOrigin(origin):
+		writeProblem(w, r, NewProblem(http.StatusForbidden, CodeCORSRejected, "不允许的跨域来源: "+origin))
+		return
+	case !p.methods[strings.ToUpper(method)]:
+		writeProblem(w, r, NewProblem(http.StatusForbidden, CodeCORSRejected, "不允许的跨域方法: "+method))
+		return
+	case !p.allowHeaders(requestedHeaders):
+		writeProblem(w, r, NewProblem(http.StatusForbidden, CodeCORSRejected, "不允许的跨域请求头: "+requestedHeaders))
+		return
+	}
+
+	header := w.Header()
+	p.setOriginHeaders(header, origin)
+	header.Set("Access-Control-Allow-Methods", strings.Join(p.config.AllowedMethods, ", "))
+	header.Set("Access-Control-Allow-Headers", strings.Join(p.config.AllowedHeaders, ", "))
+	if p.config.MaxAge > 0 {
+		header.Set("Access-Control-Max-Age", strconv.Itoa(int(p.config.MaxAge/time.Second)))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
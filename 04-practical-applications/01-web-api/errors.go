@@ -0,0 +1,160 @@
+package webapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// 哨兵错误
+var (
+	ErrUserNotFound     = errors.New("用户不存在")
+	ErrUserNotDeleted   = errors.New("用户未被删除")
+	ErrDuplicateEmail   = errors.New("邮箱已被使用")
+	ErrRepositoryClosed = errors.New("仓库已关闭")
+	ErrVersionConflict  = errors.New("版本冲突")
+	ErrInvalidPatch     = errors.New("无效的补丁文档")
+	ErrPatchConflict    = errors.New("补丁无法应用")
+)
+
+// 稳定的错误码，客户端应依据错误码而不是错误信息做判断
+const (
+	CodeValidationFailed   = "validation_failed"
+	CodeUserNotFound       = "user_not_found"
+	CodeUserNotDeleted     = "user_not_deleted"
+	CodeDuplicateEmail     = "duplicate_email"
+	CodeInvalidID          = "invalid_id"
+	CodeInvalidJSON        = "invalid_json"
+	CodeMethodNotAllowed   = "method_not_allowed"
+	CodeUnauthorized       = "unauthorized"
+	CodeForbidden          = "forbidden"
+	CodeNotFound           = "not_found"
+	CodePreconditionFailed = "precondition_failed"
+	CodeInvalidPatch       = "invalid_patch"
+	CodePatchConflict      = "patch_conflict"
+	CodeUnsupportedMedia   = "unsupported_media_type"
+	CodeNotAcceptable      = "not_acceptable"
+	CodeRateLimited        = "rate_limited"
+	CodeCORSRejected       = "cors_rejected"
+	CodeBatchTooLarge      = "batch_too_large"
+	CodeBodyTooLarge       = "body_too_large"
+	CodeInvalidImport      = "invalid_import"
+	CodeRequestTimeout     = "request_timeout"
+	CodeClientClosed       = "client_closed_request"
+	CodeInternal           = "internal_error"
+)
+
+// statusClientClosedRequest 客户端在响应前断开连接（沿用 nginx 的非标准状态码499），只出现在日志和指标中
+const statusClientClosedRequest = 499
+
+// FieldError 单个字段的校验错误
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError 校验错误，包含所有不合法的字段
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, 0, len(e.Fields))
+	for _, field := range e.Fields {
+		messages = append(messages, field.Message)
+	}
+	return "数据校验失败: " + strings.Join(messages, "; ")
+}
+
+// Add 添加字段错误
+func (e *ValidationError) Add(field, message string) {
+	e.Fields = append(e.Fields, FieldError{Field: field, Message: message})
+}
+
+// HasErrors 是否存在字段错误
+func (e *ValidationError) HasErrors() bool {
+	return len(e.Fields) > 0
+}
+
+// Problem RFC 7807 问题详情（application/problem+json）
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Instance  string       `json:"instance,omitempty"`
+	Code      string       `json:"code"`
+	RequestID string       `json:"request_id,omitempty"` // 与 X-Request-ID 响应头一致，便于排查
+	Errors    []FieldError `json:"errors,omitempty"`
+}
+
+// NewProblem 创建问题详情，type 由错误码派生
+func NewProblem(status int, code, detail string) Problem {
+	return Problem{
+		Type:   "urn:user-api:problem:" + code,
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Code:   code,
+	}
+}
+
+// writeProblem 输出问题详情响应
+func writeProblem(w http.ResponseWriter, r *http.Request, problem Problem) {
+	if problem.Instance == "" {
+		problem.Instance = r.URL.Path
+	}
+	if problem.RequestID == "" {
+		problem.RequestID = RequestIDFromContext(r.Context())
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(problem.Status)
+	json.NewEncoder(w).Encode(problem)
+}
+
+// writeError 将服务层和仓库层的错误统一映射为问题详情响应
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	writeProblem(w, r, problemFromError(r.Context(), err))
+}
+
+// problemFromError 错误到问题详情的集中映射
+func problemFromError(ctx context.Context, err error) Problem {
+	var validationErr *ValidationError
+	switch {
+	case errors.As(err, &validationErr):
+		problem := NewProblem(http.StatusBadRequest, CodeValidationFailed, "请求数据校验失败")
+		problem.Errors = validationErr.Fields
+		return problem
+	case errors.Is(err, ErrUserNotFound):
+		return NewProblem(http.StatusNotFound, CodeUserNotFound, err.Error())
+	case errors.Is(err, ErrDuplicateEmail):
+		return NewProblem(http.StatusConflict, CodeDuplicateEmail, err.Error())
+	case errors.Is(err, ErrUserNotDeleted):
+		return NewProblem(http.StatusConflict, CodeUserNotDeleted, err.Error())
+	case errors.Is(err, ErrVersionConflict):
+		return NewProblem(http.StatusPreconditionFailed, CodePreconditionFailed, err.Error())
+	case errors.Is(err, ErrInvalidPatch):
+		return NewProblem(http.StatusBadRequest, CodeInvalidPatch, err.Error())
+	case errors.Is(err, ErrPatchConflict):
+		return NewProblem(http.StatusConflict, CodePatchConflict, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return NewProblem(http.StatusGatewayTimeout, CodeRequestTimeout, "请求处理超时")
+	case errors.Is(err, context.Canceled):
+		problem := NewProblem(statusClientClosedRequest, CodeClientClosed, "客户端已取消请求")
+		problem.Title = "Client Closed Request"
+		return problem
+	default:
+		// 内部错误只记录日志，不把细节暴露给客户端
+		LoggerFromContext(ctx).Error("内部错误", "error", err)
+		return NewProblem(http.StatusInternalServerError, CodeInternal, "服务器内部错误")
+	}
+}
+
+// methodNotAllowed 输出405问题详情
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, r, NewProblem(http.StatusMethodNotAllowed, CodeMethodNotAllowed, "方法不允许: "+r.Method))
+}
@@ -0,0 +1,77 @@
+package webapi
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ETag 根据版本号生成用户资源JSON表示的强ETag
+func ETag(user *User) string {
+	return fmt.Sprintf(`"v%d"`, user.Version)
+}
+
+// representationETag 按响应格式生成强ETag，如 "v3"、"v3-xml"、"v3-csv"
+//
+// 强ETag要求字节完全相同，同一版本的不同表示不能共用同一个ETag。
+func representationETag(user *User, formatter Formatter) string {
+	switch formatter.(type) {
+	case XMLFormatter:
+		return fmt.Sprintf(`"v%d-xml"`, user.Version)
+	case CSVFormatter:
+		return fmt.Sprintf(`"v%d-csv"`, user.Version)
+	default:
+		return ETag(user)
+	}
+}
+
+// matchesAnyRepresentation If-Match 比较的是资源版本，客户端可能持有任意一种表示的ETag
+func matchesAnyRepresentation(header string, user *User) bool {
+	for _, formatter := range userFormatters {
+		if etagMatches(header, representationETag(user, formatter)) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkVersion 检查期望版本，expected 为0表示不检查
+func checkVersion(existing *User, expected int) error {
+	if expected != 0 && existing.Version != expected {
+		return fmt.Errorf("%w: 用户 %d 当前版本为 %d，期望版本为 %d",
+			ErrVersionConflict, existing.ID, existing.Version, expected)
+	}
+	return nil
+}
+
+// etagMatches 判断 If-Match / If-None-Match 头中的ETag列表是否包含指定ETag
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// ifMatchVersion 根据 If-Match 头计算传给仓库的期望版本
+//
+// 没有 If-Match 时返回0（不检查）；ETag与当前版本不匹配时返回 ErrVersionConflict。
+// 仓库会在写入时再次检查版本，因此读取当前版本和写入之间的并发修改同样会被拒绝。
+func (h *UserHandler) ifMatchVersion(r *http.Request, id int) (int, error) {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return 0, nil
+	}
+
+	current, err := h.service.GetUser(r.Context(), id)
+	if err != nil {
+		return 0, err
+	}
+
+	if !matchesAnyRepresentation(header, current) {
+		return 0, fmt.Errorf("%w: If-Match %s 与当前版本 %s 不匹配", ErrVersionConflict, header, ETag(current))
+	}
+	return current.Version, nil
+}
@@ -0,0 +1,253 @@
+package webapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 用户变更事件类型，同时作为SSE的 event 字段
+const (
+	EventUserCreated  = "user.created"
+	EventUserUpdated  = "user.updated"
+	EventUserDeleted  = "user.deleted"
+	EventUserRestored = "user.restored"
+)
+
+// EventStreamContentType SSE响应的媒体类型
+const EventStreamContentType = "text/event-stream"
+
+// eventsPath 变更事件流端点，长连接不受 RequestTimeout 限制
+const eventsPath = "/users/events"
+
+// 事件缓冲默认值
+const (
+	defaultEventBufferSize  = 1000 // 保留最近的事件数，用于 Last-Event-ID 断点续传
+	subscriberEventCapacity = 64   // 单个订阅者积压的事件数上限，超过后断开该订阅者
+)
+
+// eventRetry 建议客户端断线后的重连间隔
+const eventRetry = 3 * time.Second
+
+// UserEvent 用户变更事件，删除事件不携带用户数据
+type UserEvent struct {
+	ID        int64     `json:"id"`
+	Type      string    `json:"type"`
+	UserID    int       `json:"user_id"`
+	User      *User     `json:"user,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// EventBroker 用户变更事件的发布订阅中心
+//
+// 事件ID从1开始单调递增，最近的事件保存在有界缓冲中，
+// 客户端重连时凭 Last-Event-ID 补发断线期间错过的事件。
+type EventBroker struct {
+	capacity    int
+	buffer      []UserEvent
+	lastID      int64
+	subscribers map[*EventSubscription]struct{}
+	mutex       sync.Mutex
+}
+
+// NewEventBroker 创建事件中心，capacity 为缓冲保留的事件数，不大于0时使用默认值
+func NewEventBroker(capacity int) *EventBroker {
+	if capacity <= 0 {
+		capacity = defaultEventBufferSize
+	}
+	return &EventBroker{
+		capacity:    capacity,
+		subscribers: make(map[*EventSubscription]struct{}),
+	}
+}
+
+// EventSubscription 一个订阅者的事件流
+type EventSubscription struct {
+	Events <-chan UserEvent // 订阅之后发布的事件；订阅者处理过慢时被关闭
+	Missed []UserEvent      // Last-Event-ID 之后、订阅之前的事件
+	Reset  bool             // 错过的事件已移出缓冲（或服务端已重启），客户端需要重新拉取全量数据
+	LastID int64            // 订阅时最新的事件ID
+
+	broker *EventBroker
+	events chan UserEvent
+}
+
+// Publish 发布事件并推送给所有订阅者，user 为nil表示不携带用户数据
+func (b *EventBroker) Publish(eventType string, userID int, user *User) UserEvent {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.lastID++
+	event := UserEvent{ID: b.lastID, Type: eventType, UserID: userID, Timestamp: time.Now()}
+	if user != nil {
+		snapshot := *user
+		event.User = &snapshot
+	}
+
+	b.buffer = append(b.buffer, event)
+	if len(b.buffer) > b.capacity {
+		b.buffer = b.buffer[len(b.buffer)-b.capacity:]
+	}
+
+	for sub := range b.subscribers {
+		select {
+		case sub.events <- event:
+		default:
+			// 不能让一个慢客户端阻塞发布者：断开它，客户端重连后从缓冲补发
+			b.remove(sub)
+		}
+	}
+	return event
+}
+
+// Subscribe 订阅 lastEventID 之后的事件，lastEventID 为0表示只接收新事件
+//
+// 补发事件的收集和订阅注册在同一把锁内完成，两者之间不会遗漏或重复事件。
+func (b *EventBroker) Subscribe(lastEventID int64) *EventSubscription {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	events := make(chan UserEvent, subscriberEventCapacity)
+	sub := &EventSubscription{Events: events, LastID: b.lastID, broker: b, events: events}
+
+	if lastEventID > 0 {
+		switch {
+		case lastEventID > b.lastID:
+			// 客户端的事件ID来自重启之前的服务端
+			sub.Reset = true
+		case len(b.buffer) > 0 && b.buffer[0].ID > lastEventID+1:
+			sub.Reset = true
+		default:
+			for _, event := range b.buffer {
+				if event.ID > lastEventID {
+					sub.Missed = append(sub.Missed, event)
+				}
+			}
+		}
+	}
+
+	b.subscribers[sub] = struct{}{}
+	return sub
+}
+
+// Close 取消订阅，可重复调用
+func (sub *EventSubscription) Close() {
+	sub.broker.mutex.Lock()
+	defer sub.broker.mutex.Unlock()
+	sub.broker.remove(sub)
+}
+
+// remove 移除订阅者并关闭其事件通道，调用方需持有锁
+func (b *EventBroker) remove(sub *EventSubscription) {
+	if _, ok := b.subscribers[sub]; ok {
+		delete(b.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+// Subscribers 当前订阅者数量
+func (b *EventBroker) Subscribers() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return len(b.subscribers)
+}
+
+// parseLastEventID 解析 Last-Event-ID 请求头，缺省为0
+func parseLastEventID(r *http.Request) (int64, error) {
+	value := strings.TrimSpace(r.Header.Get("Last-Event-ID"))
+	if value == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || id < 0 {
+		verr := &ValidationError{}
+		verr.Add("Last-Event-ID", "Last-Event-ID 必须是非负整数")
+		return 0, verr
+	}
+	return id, nil
+}
+
+// writeEvent 按SSE格式写出一个事件
+func writeEvent(w io.Writer, event UserEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+	return err
+}
+
+// eventsHandler 以SSE推送用户变更事件
+//
+// 客户端重连时浏览器会带上 Last-Event-ID，服务端补发缓冲中错过的事件；
+// 错过的事件已不在缓冲中时先发送 reset 事件，提示客户端重新拉取 /users。
+// 空闲时定期发送注释行作为心跳，避免代理因连接空闲而断开。
+func (s *Server) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	lastEventID, err := parseLastEventID(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	sub := s.handler.service.Events().Subscribe(lastEventID)
+	defer sub.Close()
+
+	// 长连接不受服务器 WriteTimeout 限制，不支持的写入器（如测试用的 ResponseRecorder）忽略即可
+	controller := http.NewResponseController(w)
+	controller.SetWriteDeadline(time.Time{})
+
+	header := w.Header()
+	header.Set("Content-Type", EventStreamContentType)
+	header.Set("Cache-Control", "no-cache")
+	header.Set("X-Accel-Buffering", "no") // 禁止 nginx 缓冲事件
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprintf(w, "retry: %d\n\n", eventRetry.Milliseconds())
+	if sub.Reset {
+		fmt.Fprintf(w, "id: %d\nevent: reset\ndata: {}\n\n", sub.LastID)
+	}
+	for _, event := range sub.Missed {
+		if err := writeEvent(w, event); err != nil {
+			return
+		}
+	}
+	if err := controller.Flush(); err != nil {
+		return
+	}
+
+	var heartbeat <-chan time.Time
+	if s.config.EventHeartbeat > 0 {
+		ticker := time.NewTicker(s.config.EventHeartbeat)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.stopping:
+			return
+		case event, ok := <-sub.Events:
+			if !ok {
+				// 积压过多被断开，客户端凭 Last-Event-ID 重连补发
+				return
+			}
+			if err := writeEvent(w, event); err != nil {
+				return
+			}
+		case <-heartbeat:
+			if _, err := io.WriteString(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		}
+		if err := controller.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,557 @@
+package webapi
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// 日志记录操作类型
+const (
+	logOpMeta = "meta"
+	logOpPut  = "put"
+)
+
+// minCompactRecords 触发压缩的最小日志记录数
+const minCompactRecords = 100
+
+// logRecord 追加日志中的一条记录（每行一个JSON）
+type logRecord struct {
+	Op     string `json:"op"`
+	User   *User  `json:"user,omitempty"`
+	NextID int    `json:"next_id,omitempty"`
+}
+
+// historyRecord 变更历史文件中的一条记录
+type historyRecord struct {
+	ID    int          `json:"id"`
+	Entry HistoryEntry `json:"entry"`
+}
+
+// FileUserRepository 文件持久化的用户仓库
+//
+// 每次修改以一行JSON追加到日志文件并立即fsync；日志中无效记录过多时，
+// 将当前数据写入临时文件后原子重命名替换原文件（压缩）。
+// 启动时重放日志恢复数据，崩溃导致的末尾残缺记录会被丢弃。
+//
+// 变更历史是只追加的审计记录，单独保存在 path+".history" 中，不参与压缩。
+type FileUserRepository struct {
+	path        string
+	file        *os.File
+	historyFile *os.File
+	users       map[int]*User
+	emails      emailIndex
+	history     map[int][]HistoryEntry
+	nextID      int
+	records     int
+	mutex       sync.RWMutex
+}
+
+// NewFileUserRepository 打开（或创建）文件用户仓库
+func NewFileUserRepository(path string) (*FileUserRepository, error) {
+	repo := &FileUserRepository{
+		path:    path,
+		users:   make(map[int]*User),
+		emails:  make(emailIndex),
+		history: make(map[int][]HistoryEntry),
+		nextID:  1,
+	}
+
+	existed, err := repo.load()
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range repo.users {
+		repo.emails.replace(nil, user)
+	}
+
+	// 重写为干净的快照，同时截掉残缺的末尾记录
+	if err := repo.compact(); err != nil {
+		return nil, err
+	}
+
+	if err := repo.openHistory(); err != nil {
+		repo.Close()
+		return nil, err
+	}
+
+	// 新建的仓库与内存仓库一样写入示例数据
+	if !existed {
+		for _, user := range seedUsers() {
+			if err := repo.Create(context.Background(), user); err != nil {
+				repo.Close()
+				return nil, err
+			}
+		}
+	}
+
+	return repo, nil
+}
+
+// load 重放日志文件，返回文件是否已存在
+func (r *FileUserRepository) load() (bool, error) {
+	existed, _, err := r.replay(r.path, func(line []byte) error {
+		var record logRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return err
+		}
+		r.apply(record)
+		return nil
+	})
+	return existed, err
+}
+
+// replay 逐行解码JSON文件，返回文件是否已存在和最后一条完整记录之后的偏移量
+//
+// 最后一行无法解码说明写入时崩溃，丢弃即可；中间的行损坏则返回错误。
+func (r *FileUserRepository) replay(path string, decode func(line []byte) error) (bool, int64, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, 0, nil
+	}
+	if err != nil {
+		return false, 0, fmt.Errorf("打开数据文件失败: %v", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	for lineNo := 1; ; lineNo++ {
+		raw, err := reader.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return true, offset, fmt.Errorf("读取数据文件失败: %v", err)
+		}
+		atEOF := errors.Is(err, io.EOF)
+
+		line := bytes.TrimSpace(raw)
+		if len(line) > 0 {
+			if decodeErr := decode(line); decodeErr != nil {
+				if atEOF || r.isTail(reader) {
+					return true, offset, nil
+				}
+				return true, offset, fmt.Errorf("数据文件 %s 第 %d 行损坏: %v", filepath.Base(path), lineNo, decodeErr)
+			}
+		}
+		offset += int64(len(raw))
+
+		if atEOF {
+			return true, offset, nil
+		}
+	}
+}
+
+// openHistory 加载变更历史并打开历史文件用于追加，截掉崩溃时残缺的末尾记录
+func (r *FileUserRepository) openHistory() error {
+	path := r.path + ".history"
+	existed, offset, err := r.replay(path, func(line []byte) error {
+		var record historyRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return err
+		}
+		r.history[record.ID] = append(r.history[record.ID], record.Entry)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if existed {
+		if err := os.Truncate(path, offset); err != nil {
+			return fmt.Errorf("截断历史文件失败: %v", err)
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("打开历史文件失败: %v", err)
+	}
+	r.historyFile = file
+	return nil
+}
+
+// isTail 判断读取器后面是否只剩空白内容
+func (r *FileUserRepository) isTail(reader *bufio.Reader) bool {
+	rest, _ := io.ReadAll(reader)
+	return len(bytes.TrimSpace(rest)) == 0
+}
+
+// apply 将日志记录应用到内存数据
+func (r *FileUserRepository) apply(record logRecord) {
+	switch record.Op {
+	case logOpMeta:
+		if record.NextID > r.nextID {
+			r.nextID = record.NextID
+		}
+	case logOpPut:
+		if record.User == nil {
+			return
+		}
+		user := *record.User
+		r.users[user.ID] = &user
+		if user.ID >= r.nextID {
+			r.nextID = user.ID + 1
+		}
+	}
+	r.records++
+}
+
+// append 追加一条日志记录并fsync，必须持有写锁
+func (r *FileUserRepository) append(record logRecord) error {
+	if err := appendJSONLine(r.file, record); err != nil {
+		return err
+	}
+	r.records++
+	return nil
+}
+
+// appendJSONLine 以一行JSON追加记录并fsync
+func appendJSONLine(file *os.File, record interface{}) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("编码日志记录失败: %v", err)
+	}
+	data = append(data, '\n')
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("读取数据文件信息失败: %v", err)
+	}
+
+	if _, err := file.Write(data); err != nil {
+		// 截掉写了一半的记录，避免后续记录接在残缺行后面
+		file.Truncate(info.Size())
+		return fmt.Errorf("写入数据文件失败: %v", err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("同步数据文件失败: %v", err)
+	}
+	return nil
+}
+
+// maybeCompact 无效记录过多时压缩日志，必须持有写锁
+//
+// 修改已经落盘，压缩失败不影响数据正确性，只记录日志下次再试。
+func (r *FileUserRepository) maybeCompact(ctx context.Context) {
+	if r.records <= minCompactRecords || r.records <= 2*len(r.users) {
+		return
+	}
+	if err := r.compact(); err != nil {
+		LoggerFromContext(ctx).Error("压缩数据文件失败", "path", r.path, "error", err)
+	}
+}
+
+// compact 将当前数据写入临时文件并原子替换日志文件，必须持有写锁
+func (r *FileUserRepository) compact() error {
+	dir := filepath.Dir(r.path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(r.path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("创建临时文件失败: %v", err)
+	}
+	defer os.Remove(tmp.Name()) // 重命名成功后删除不会生效
+
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+	records := []logRecord{{Op: logOpMeta, NextID: r.nextID}}
+	for _, user := range r.users {
+		records = append(records, logRecord{Op: logOpPut, User: user})
+	}
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			tmp.Close()
+			return fmt.Errorf("写入快照失败: %v", err)
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("写入快照失败: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("同步快照失败: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("关闭快照失败: %v", err)
+	}
+
+	// 部分平台不能重命名覆盖已打开的文件，先关闭旧文件
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+	renameErr := os.Rename(tmp.Name(), r.path)
+	if renameErr == nil {
+		syncDir(dir)
+	}
+
+	file, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("打开数据文件失败: %v", err)
+	}
+	r.file = file
+	if renameErr != nil {
+		return fmt.Errorf("替换数据文件失败: %v", renameErr)
+	}
+	r.records = len(records)
+	return nil
+}
+
+// syncDir 同步目录项，确保重命名本身也已落盘（部分平台不支持，忽略错误）
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// Close 关闭数据文件
+func (r *FileUserRepository) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.historyFile != nil {
+		r.historyFile.Close()
+		r.historyFile = nil
+	}
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// GetAll 返回所有未删除的用户
+func (r *FileUserRepository) GetAll(ctx context.Context) ([]User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	users := make([]User, 0, len(r.users))
+	for _, user := range r.users {
+		if user.DeletedAt == nil {
+			users = append(users, *user)
+		}
+	}
+	return users, nil
+}
+
+// List 按查询对象分页列出用户
+func (r *FileUserRepository) List(ctx context.Context, query UserQuery) (UserPage, error) {
+	if err := ctx.Err(); err != nil {
+		return UserPage{}, err
+	}
+
+	r.mutex.RLock()
+	users := make([]User, 0, len(r.users))
+	for _, user := range r.users {
+		users = append(users, *user)
+	}
+	r.mutex.RUnlock()
+
+	return query.Apply(users), nil
+}
+
+// ForEach 按ID升序遍历未删除的用户
+func (r *FileUserRepository) ForEach(ctx context.Context, fn func(User) error) error {
+	return forEachUser(ctx, &r.mutex, r.users, fn)
+}
+
+func (r *FileUserRepository) GetByID(ctx context.Context, id int) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	user, exists := r.users[id]
+	if !exists || user.DeletedAt != nil {
+		return nil, fmt.Errorf("%w: %d", ErrUserNotFound, id)
+	}
+
+	userCopy := *user
+	return &userCopy, nil
+}
+
+func (r *FileUserRepository) Create(ctx context.Context, user *User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.file == nil {
+		return ErrRepositoryClosed
+	}
+	if err := r.emails.check(user.Email, 0); err != nil {
+		return err
+	}
+
+	stored := *user
+	stored.ID = r.nextID
+	stored.Version = 1
+	stored.CreatedAt = time.Now()
+	stored.UpdatedAt = stored.CreatedAt
+	stored.DeletedAt = nil
+
+	// 先落盘再修改内存，写入失败时内存数据保持不变
+	if err := r.put(ctx, &stored, newHistoryEntry(ctx, HistoryCreate, nil, &stored)); err != nil {
+		return err
+	}
+
+	r.nextID++
+	*user = stored
+	r.maybeCompact(ctx)
+	return nil
+}
+
+func (r *FileUserRepository) Update(ctx context.Context, user *User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.file == nil {
+		return ErrRepositoryClosed
+	}
+
+	existing, exists := r.users[user.ID]
+	if !exists || existing.DeletedAt != nil {
+		return fmt.Errorf("%w: %d", ErrUserNotFound, user.ID)
+	}
+
+	if err := checkVersion(existing, user.Version); err != nil {
+		return err
+	}
+	if err := r.emails.check(user.Email, user.ID); err != nil {
+		return err
+	}
+
+	stored := *user
+	stored.Version = existing.Version + 1
+	stored.CreatedAt = existing.CreatedAt
+	stored.UpdatedAt = time.Now()
+	stored.DeletedAt = nil
+
+	if err := r.put(ctx, &stored, newHistoryEntry(ctx, HistoryUpdate, existing, &stored)); err != nil {
+		return err
+	}
+
+	*user = stored
+	r.maybeCompact(ctx)
+	return nil
+}
+
+func (r *FileUserRepository) Delete(ctx context.Context, id int) error {
+	return r.DeleteIfVersion(ctx, id, 0)
+}
+
+func (r *FileUserRepository) DeleteIfVersion(ctx context.Context, id, expectedVersion int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.file == nil {
+		return ErrRepositoryClosed
+	}
+
+	existing, exists := r.users[id]
+	if !exists || existing.DeletedAt != nil {
+		return fmt.Errorf("%w: %d", ErrUserNotFound, id)
+	}
+
+	if err := checkVersion(existing, expectedVersion); err != nil {
+		return err
+	}
+
+	deleted := softDeleted(existing)
+	if err := r.put(ctx, &deleted, newHistoryEntry(ctx, HistoryDelete, existing, &deleted)); err != nil {
+		return err
+	}
+
+	r.maybeCompact(ctx)
+	return nil
+}
+
+// Restore 恢复已删除的用户
+func (r *FileUserRepository) Restore(ctx context.Context, id int) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.file == nil {
+		return nil, ErrRepositoryClosed
+	}
+
+	existing, exists := r.users[id]
+	if !exists {
+		return nil, fmt.Errorf("%w: %d", ErrUserNotFound, id)
+	}
+	if existing.DeletedAt == nil {
+		return nil, fmt.Errorf("%w: %d", ErrUserNotDeleted, id)
+	}
+	if err := r.emails.check(existing.Email, id); err != nil {
+		return nil, err
+	}
+
+	restored := restoredUser(existing)
+	if err := r.put(ctx, &restored, newHistoryEntry(ctx, HistoryRestore, existing, &restored)); err != nil {
+		return nil, err
+	}
+
+	r.maybeCompact(ctx)
+	userCopy := restored
+	return &userCopy, nil
+}
+
+// History 返回用户的变更历史
+func (r *FileUserRepository) History(ctx context.Context, id int) ([]HistoryEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	if _, exists := r.users[id]; !exists {
+		return nil, fmt.Errorf("%w: %d", ErrUserNotFound, id)
+	}
+	return append([]HistoryEntry(nil), r.history[id]...), nil
+}
+
+// put 将用户落盘后写入内存并记录变更历史，必须持有写锁
+//
+// 用户数据写入成功后修改即已生效，历史文件写入失败只记录日志，不回滚修改。
+func (r *FileUserRepository) put(ctx context.Context, user *User, entry HistoryEntry) error {
+	if err := r.append(logRecord{Op: logOpPut, User: user}); err != nil {
+		return err
+	}
+	r.emails.replace(r.users[user.ID], user)
+	r.users[user.ID] = user
+
+	r.history[user.ID] = append(r.history[user.ID], entry)
+	if err := appendJSONLine(r.historyFile, historyRecord{ID: user.ID, Entry: entry}); err != nil {
+		LoggerFromContext(ctx).Error("写入变更历史失败", "user_id", user.ID, "error", err)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package webapi
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// 变更历史中的操作类型
+const (
+	HistoryCreate  = "create"
+	HistoryUpdate  = "update"
+	HistoryDelete  = "delete"
+	HistoryRestore = "restore"
+)
+
+// FieldChange 单个字段的变更，创建时 Old 为 null
+type FieldChange struct {
+	Field string      `json:"field" xml:"field"`
+	Old   interface{} `json:"old" xml:"old"`
+	New   interface{} `json:"new" xml:"new"`
+}
+
+// HistoryEntry 用户的一次变更记录
+type HistoryEntry struct {
+	Version   int           `json:"version" xml:"version"` // 变更后的版本号
+	Action    string        `json:"action" xml:"action"`
+	Actor     string        `json:"actor,omitempty" xml:"actor,omitempty"` // 执行操作的认证用户，未启用认证时为空
+	Changes   []FieldChange `json:"changes" xml:"change"`
+	Timestamp time.Time     `json:"timestamp" xml:"timestamp"`
+}
+
+// historyIgnoredFields 由仓库维护的元数据字段，不计入变更
+var historyIgnoredFields = map[string]bool{
+	"id": true, "version": true, "created_at": true, "updated_at": true,
+}
+
+// actorFromContext 获取执行操作的用户名，未认证时返回空字符串
+func actorFromContext(ctx context.Context) string {
+	if user, ok := AuthUserFromContext(ctx); ok {
+		return user.Username
+	}
+	return ""
+}
+
+// newHistoryEntry 比较变更前后的用户生成历史记录，before 为nil表示新建
+func newHistoryEntry(ctx context.Context, action string, before, after *User) HistoryEntry {
+	return HistoryEntry{
+		Version:   after.Version,
+		Action:    action,
+		Actor:     actorFromContext(ctx),
+		Changes:   diffUser(before, after),
+		Timestamp: after.UpdatedAt,
+	}
+}
+
+// diffUser 按JSON字段名列出取值不同的字段
+func diffUser(before, after *User) []FieldChange {
+	changes := []FieldChange{}
+	afterValue := reflect.ValueOf(after).Elem()
+	t := afterValue.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name == "" || name == "-" || historyIgnoredFields[name] {
+			continue
+		}
+
+		newValue := fieldValue(afterValue.Field(i))
+		var oldValue interface{}
+		if before != nil {
+			oldValue = fieldValue(reflect.ValueOf(before).Elem().Field(i))
+		}
+		if before == nil && newValue == nil {
+			continue
+		}
+		if before != nil && reflect.DeepEqual(oldValue, newValue) {
+			continue
+		}
+		changes = append(changes, FieldChange{Field: name, Old: oldValue, New: newValue})
+	}
+	return changes
+}
+
+// fieldValue 取字段值，nil指针返回nil，非nil指针解引用
+func fieldValue(v reflect.Value) interface{} {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	return v.Interface()
+}
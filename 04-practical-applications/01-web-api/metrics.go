@@ -0,0 +1,296 @@
+package webapi
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultLatencyBuckets 延迟直方图的桶上界（秒），与Prometheus客户端默认值一致
+var defaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// counterVec 带标签的计数器
+type counterVec struct {
+	name       string
+	help       string
+	labelNames []string
+	values     map[string]float64
+}
+
+// histogramVec 带标签的直方图
+type histogramVec struct {
+	name       string
+	help       string
+	labelNames []string
+	buckets    []float64
+	series     map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // 每个桶的累计计数
+	sum    float64
+	count  uint64
+}
+
+// Metrics 指标注册表，以Prometheus文本格式输出，不依赖第三方库
+type Metrics struct {
+	requests  *counterVec
+	latency   *histogramVec
+	repoOps   *counterVec
+	inFlight  int64
+	startTime time.Time
+	mutex     sync.Mutex
+}
+
+// NewMetrics 创建指标注册表
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests: &counterVec{
+			name:       "http_requests_total",
+			help:       "Total number of HTTP requests.",
+			labelNames: []string{"method", "route", "status"},
+			values:     make(map[string]float64),
+		},
+		latency: &histogramVec{
+			name:       "http_request_duration_seconds",
+			help:       "HTTP request latency in seconds.",
+			labelNames: []string{"method", "route", "status"},
+			buckets:    defaultLatencyBuckets,
+			series:     make(map[string]*histogram),
+		},
+		repoOps: &counterVec{
+			name:       "user_repository_operations_total",
+			help:       "Total number of user repository operations.",
+			labelNames: []string{"operation", "result"},
+			values:     make(map[string]float64),
+		},
+		startTime: time.Now(),
+	}
+}
+
+// labelKey 将标签值拼接为map键（标签值中不会出现\xff）
+func labelKey(values ...string) string {
+	return strings.Join(values, "\xff")
+}
+
+// ObserveRequest 记录一次HTTP请求
+func (m *Metrics) ObserveRequest(method, route string, status int, duration time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	key := labelKey(method, route, strconv.Itoa(status))
+	m.requests.values[key]++
+
+	h, ok := m.latency.series[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(m.latency.buckets))}
+		m.latency.series[key] = h
+	}
+	seconds := duration.Seconds()
+	for i, upper := range m.latency.buckets {
+		if seconds <= upper {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// ObserveRepositoryOperation 记录一次仓库操作
+func (m *Metrics) ObserveRepositoryOperation(operation string, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.repoOps.values[labelKey(operation, result)]++
+}
+
+// WriteTo 以Prometheus文本格式（version 0.0.4）输出所有指标
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var b strings.Builder
+
+	m.requests.write(&b)
+	m.latency.write(&b)
+
+	fmt.Fprintf(&b, "# HELP http_requests_in_flight Number of HTTP requests currently being served.\n")
+	fmt.Fprintf(&b, "# TYPE http_requests_in_flight gauge\n")
+	fmt.Fprintf(&b, "http_requests_in_flight %d\n", m.inFlight)
+
+	m.repoOps.write(&b)
+
+	fmt.Fprintf(&b, "# HELP process_uptime_seconds Time since the server started.\n")
+	fmt.Fprintf(&b, "# TYPE process_uptime_seconds gauge\n")
+	fmt.Fprintf(&b, "process_uptime_seconds %s\n", formatFloat(time.Since(m.startTime).Seconds()))
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func (c *counterVec) write(b *strings.Builder) {
+	fmt.Fprintf(b, "# HELP %s %s\n", c.name, c.help)
+	fmt.Fprintf(b, "# TYPE %s counter\n", c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(b, "%s{%s} %s\n", c.name, formatLabels(c.labelNames, key), formatFloat(c.values[key]))
+	}
+}
+
+func (h *histogramVec) write(b *strings.Builder) {
+	fmt.Fprintf(b, "# HELP %s %s\n", h.name, h.help)
+	fmt.Fprintf(b, "# TYPE %s histogram\n", h.name)
+	for _, key := range sortedKeys(h.series) {
+		series := h.series[key]
+		labels := formatLabels(h.labelNames, key)
+		for i, upper := range h.buckets {
+			fmt.Fprintf(b, "%s_bucket{%s,le=\"%s\"} %d\n", h.name, labels, formatFloat(upper), series.counts[i])
+		}
+		fmt.Fprintf(b, "%s_bucket{%s,le=\"+Inf\"} %d\n", h.name, labels, series.count)
+		fmt.Fprintf(b, "%s_sum{%s} %s\n", h.name, labels, formatFloat(series.sum))
+		fmt.Fprintf(b, "%s_count{%s} %d\n", h.name, labels, series.count)
+	}
+}
+
+// formatLabels 按标签名输出 name="value" 列表，并转义特殊字符
+func formatLabels(names []string, key string) string {
+	values := strings.Split(key, "\xff")
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, replacer.Replace(values[i]))
+	}
+	return strings.Join(pairs, ",")
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// unmatchedRoute 未匹配任何路由（404、405）的请求使用的路由标签
+const unmatchedRoute = "other"
+
+// metricsMiddleware 记录请求数、延迟和进行中的请求数
+//
+// 路由标签取 Router 匹配到的路由模式，如 /users/{id}，避免每个用户ID产生一组时间序列。
+func (s *Server) metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		r, matched := withRouteRecorder(r)
+
+		s.metrics.mutex.Lock()
+		s.metrics.inFlight++
+		s.metrics.mutex.Unlock()
+
+		wrapper := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		defer func() {
+			s.metrics.mutex.Lock()
+			s.metrics.inFlight--
+			s.metrics.mutex.Unlock()
+
+			route := matched.Pattern
+			if route == "" {
+				route = unmatchedRoute
+			}
+			s.metrics.ObserveRequest(r.Method, route, wrapper.statusCode, time.Since(start))
+		}()
+
+		next.ServeHTTP(wrapper, r)
+	})
+}
+
+// metricsHandler 输出Prometheus格式的指标
+func (s *Server) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	s.metrics.WriteTo(w)
+}
+
+// instrumentedRepository 统计操作次数的仓库装饰器
+type instrumentedRepository struct {
+	UserRepository
+	metrics *Metrics
+}
+
+// NewInstrumentedRepository 包装仓库，将每次操作计入指标
+func NewInstrumentedRepository(repo UserRepository, metrics *Metrics) UserRepository {
+	return &instrumentedRepository{UserRepository: repo, metrics: metrics}
+}
+
+func (r *instrumentedRepository) GetAll(ctx context.Context) ([]User, error) {
+	users, err := r.UserRepository.GetAll(ctx)
+	r.metrics.ObserveRepositoryOperation("get_all", err)
+	return users, err
+}
+
+func (r *instrumentedRepository) List(ctx context.Context, query UserQuery) (UserPage, error) {
+	page, err := r.UserRepository.List(ctx, query)
+	r.metrics.ObserveRepositoryOperation("list", err)
+	return page, err
+}
+
+func (r *instrumentedRepository) ForEach(ctx context.Context, fn func(User) error) error {
+	err := r.UserRepository.ForEach(ctx, fn)
+	r.metrics.ObserveRepositoryOperation("for_each", err)
+	return err
+}
+
+func (r *instrumentedRepository) GetByID(ctx context.Context, id int) (*User, error) {
+	user, err := r.UserRepository.GetByID(ctx, id)
+	r.metrics.ObserveRepositoryOperation("get", err)
+	return user, err
+}
+
+func (r *instrumentedRepository) Create(ctx context.Context, user *User) error {
+	err := r.UserRepository.Create(ctx, user)
+	r.metrics.ObserveRepositoryOperation("create", err)
+	return err
+}
+
+func (r *instrumentedRepository) Update(ctx context.Context, user *User) error {
+	err := r.UserRepository.Update(ctx, user)
+	r.metrics.ObserveRepositoryOperation("update", err)
+	return err
+}
+
+func (r *instrumentedRepository) Delete(ctx context.Context, id int) error {
+	err := r.UserRepository.Delete(ctx, id)
+	r.metrics.ObserveRepositoryOperation("delete", err)
+	return err
+}
+
+func (r *instrumentedRepository) DeleteIfVersion(ctx context.Context, id, expectedVersion int) error {
+	err := r.UserRepository.DeleteIfVersion(ctx, id, expectedVersion)
+	r.metrics.ObserveRepositoryOperation("delete", err)
+	return err
+}
+
+func (r *instrumentedRepository) Restore(ctx context.Context, id int) (*User, error) {
+	user, err := r.UserRepository.Restore(ctx, id)
+	r.metrics.ObserveRepositoryOperation("restore", err)
+	return user, err
+}
+
+func (r *instrumentedRepository) History(ctx context.Context, id int) ([]HistoryEntry, error) {
+	entries, err := r.UserRepository.History(ctx, id)
+	r.metrics.ObserveRepositoryOperation("history", err)
+	return entries, err
+}
@@ -0,0 +1,257 @@
+package webapi
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formatter 响应格式化器，同一份数据按客户端 Accept 头输出不同格式
+type Formatter interface {
+	ContentType() string
+	Format(w io.Writer, value interface{}) error
+}
+
+// JSONFormatter JSON格式
+type JSONFormatter struct{}
+
+func (JSONFormatter) ContentType() string { return "application/json" }
+
+func (JSONFormatter) Format(w io.Writer, value interface{}) error {
+	return json.NewEncoder(w).Encode(value)
+}
+
+// XMLFormatter XML格式，切片的根元素名取自 xmlRootNames，如 <users><user>...</user></users>
+type XMLFormatter struct{}
+
+func (XMLFormatter) ContentType() string { return "application/xml" }
+
+func (XMLFormatter) Format(w io.Writer, value interface{}) error {
+	io.WriteString(w, xml.Header)
+	encoder := xml.NewEncoder(w)
+
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Slice {
+		return encoder.EncodeElement(value, xml.StartElement{Name: xml.Name{Local: xmlElementName(v.Type())}})
+	}
+
+	name := xmlElementName(v.Type().Elem())
+	root := xml.StartElement{Name: xml.Name{Local: xmlRootName(v.Type().Elem())}}
+	if err := encoder.EncodeToken(root); err != nil {
+		return err
+	}
+	for i := 0; i < v.Len(); i++ {
+		if err := encoder.EncodeElement(v.Index(i).Interface(), xml.StartElement{Name: xml.Name{Local: name}}); err != nil {
+			return err
+		}
+	}
+	if err := encoder.EncodeToken(root.End()); err != nil {
+		return err
+	}
+	return encoder.Flush()
+}
+
+// xmlElementName 元素名取类型名的小写形式
+func xmlElementName(t reflect.Type) string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return strings.ToLower(t.Name())
+}
+
+// xmlRootNames 列表响应的根元素名，英文复数无法从类型名机械推导，需要显式登记
+var xmlRootNames = map[reflect.Type]string{
+	reflect.TypeOf(User{}):         "users",
+	reflect.TypeOf(HistoryEntry{}): "history",
+}
+
+// xmlRootName 切片元素类型对应的根元素名，未登记的类型使用 items
+func xmlRootName(t reflect.Type) string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if name, ok := xmlRootNames[t]; ok {
+		return name
+	}
+	return "items"
+}
+
+// CSVFormatter CSV格式，仅支持用户和用户列表，首行为表头
+type CSVFormatter struct{}
+
+func (CSVFormatter) ContentType() string { return CSVContentType }
+
+func (CSVFormatter) Format(w io.Writer, value interface{}) error {
+	var users []User
+	switch v := value.(type) {
+	case []User:
+		users = v
+	case User:
+		users = []User{v}
+	case *User:
+		users = []User{*v}
+	default:
+		return fmt.Errorf("CSV不支持的类型: %T", value)
+	}
+
+	writer := csv.NewWriter(w)
+	writer.Write(csvColumns)
+	for _, user := range users {
+		writer.Write(userCSVRecord(user))
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// userCSVRecord 按 csvColumns 的顺序输出用户字段，未删除用户的 deleted_at 为空
+func userCSVRecord(user User) []string {
+	deletedAt := ""
+	if user.DeletedAt != nil {
+		deletedAt = user.DeletedAt.Format(time.RFC3339Nano)
+	}
+	return []string{
+		strconv.Itoa(user.ID),
+		user.Name,
+		user.Email,
+		strconv.Itoa(user.Age),
+		strconv.Itoa(user.Version),
+		user.CreatedAt.Format(time.RFC3339Nano),
+		user.UpdatedAt.Format(time.RFC3339Nano),
+		deletedAt,
+	}
+}
+
+// userFormatters /users 资源支持的响应格式，第一个为默认格式
+var userFormatters = []Formatter{JSONFormatter{}, XMLFormatter{}, CSVFormatter{}}
+
+// historyFormatters 变更历史支持的响应格式，历史记录不是用户资源，CSV无法表示
+var historyFormatters = []Formatter{JSONFormatter{}, XMLFormatter{}}
+
+const formatterKey contextKey = "formatter"
+
+// mediaRange Accept 头中的一项
+type mediaRange struct {
+	mediaType string
+	q         float64
+}
+
+// parseAccept 解析 Accept 类头部（含 q 参数），按 q 值降序排列
+func parseAccept(header string) []mediaRange {
+	var ranges []mediaRange
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(fields[0]))
+		if mediaType == "" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range fields[1:] {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(key, "q") {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		ranges = append(ranges, mediaRange{mediaType: mediaType, q: q})
+	}
+
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].q > ranges[j].q })
+	return ranges
+}
+
+// acceptQuality 计算媒体类型在 Accept 中的q值，取最具体的匹配项（精确 > type/* > */*）
+func acceptQuality(ranges []mediaRange, mediaType string) float64 {
+	mainType, _, _ := strings.Cut(mediaType, "/")
+	quality, specificity := 0.0, -1
+	for _, r := range ranges {
+		level := -1
+		switch r.mediaType {
+		case mediaType:
+			level = 2
+		case mainType + "/*":
+			level = 1
+		case "*/*":
+			level = 0
+		}
+		if level > specificity {
+			quality, specificity = r.q, level
+		}
+	}
+	return quality
+}
+
+// negotiate 按 Accept 头选择格式化器，没有可接受的格式时返回 false
+//
+// 未提供 Accept 时使用第一个格式化器；q 值相同时按 formatters 的顺序优先。
+func negotiate(accept string, formatters []Formatter) (Formatter, bool) {
+	if strings.TrimSpace(accept) == "" {
+		return formatters[0], true
+	}
+
+	ranges := parseAccept(accept)
+	var best Formatter
+	bestQ := 0.0
+	for _, formatter := range formatters {
+		if q := acceptQuality(ranges, formatter.ContentType()); q > bestQ {
+			best, bestQ = formatter, q
+		}
+	}
+	return best, best != nil
+}
+
+// FormatterFromContext 获取内容协商选中的格式化器，未协商时返回JSON
+func FormatterFromContext(ctx context.Context) Formatter {
+	if formatter, ok := ctx.Value(formatterKey).(Formatter); ok {
+		return formatter
+	}
+	return JSONFormatter{}
+}
+
+// negotiationMiddleware 按 Accept 头选择响应格式，无法满足时在执行处理器之前返回406
+func (s *Server) negotiationMiddleware(formatters []Formatter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// 删除操作没有响应体，不需要协商
+			if r.Method == http.MethodDelete {
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Add("Vary", "Accept")
+
+			formatter, ok := negotiate(r.Header.Get("Accept"), formatters)
+			if !ok {
+				available := make([]string, len(formatters))
+				for i, f := range formatters {
+					available[i] = f.ContentType()
+				}
+				writeProblem(w, r, NewProblem(http.StatusNotAcceptable, CodeNotAcceptable,
+					"可用的响应格式: "+strings.Join(available, ", ")))
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), formatterKey, formatter)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// render 按协商的格式输出响应
+func render(w http.ResponseWriter, r *http.Request, status int, value interface{}) {
+	formatter := FormatterFromContext(r.Context())
+	w.Header().Set("Content-Type", formatter.ContentType())
+	w.WriteHeader(status)
+	if err := formatter.Format(w, value); err != nil {
+		LoggerFromContext(r.Context()).Error("编码响应失败", "error", err)
+	}
+}
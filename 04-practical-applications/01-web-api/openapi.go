@@ -0,0 +1,865 @@
+package webapi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang-examples/03-practical-examples/01-package-management/stringutils"
+)
+
+// maxValidatedBodySize 请求校验时读取请求体的上限
+const maxValidatedBodySize = 1 << 20
+
+// Parameter 操作参数描述
+type Parameter struct {
+	Name        string
+	In          string // path 或 query
+	Description string
+	Type        string // integer 或 string
+	Required    bool
+}
+
+// Response 操作响应描述，Body 为响应体样例值，用于反射生成schema
+type Response struct {
+	Description string
+	Body        interface{}
+	ContentType string // 为空时默认 application/json
+}
+
+// Operation API操作描述，OpenAPI文档和启动时端点列表由已注册路由对应的操作生成
+type Operation struct {
+	Method      string
+	Path        string // OpenAPI路径模板，如 /users/{id}
+	Summary     string
+	Auth        bool        // 是否需要Bearer令牌
+	Role        string      // 需要的角色，为空表示任意已认证用户
+	Formatters  []Formatter // 支持内容协商时可输出的格式，为空表示只输出JSON
+	Parameters  []Parameter
+	RequestBody map[string]interface{} // 媒体类型 -> 请求体样例值
+	Responses   map[int]Response
+
+	// Bulk 请求体为批量条目：请求校验只检查是否为数组，不限制大小，
+	// 逐条校验交给处理器，单个条目无效时仍能返回207和逐条结果
+	Bulk bool
+}
+
+var userIDParameter = Parameter{Name: "id", In: "path", Description: "用户ID", Type: "integer", Required: true}
+
+// problemResponse 问题详情响应
+func problemResponse(description string) Response {
+	return Response{Description: description, Body: Problem{}, ContentType: "application/problem+json"}
+}
+
+// routeOperation 已注册路由对应的操作，请求体schema预先生成供校验使用
+type routeOperation struct {
+	Operation
+	bodySchemas map[string]*Schema // 媒体类型 -> 请求体schema
+}
+
+// operationTable 由路由表派生的操作表，每个服务器只构建一次
+type operationTable struct {
+	operations []*routeOperation // 按路由注册顺序
+	byRoute    map[RouteInfo]*routeOperation
+	registry   *schemaRegistry // 构建后只读，可供并发校验使用
+}
+
+// Operations 按路由注册顺序返回服务器注册的全部API操作
+//
+// 操作由 Router 中注册的路由派生，没有文档描述的路由（如根路径）不列出。
+func (s *Server) Operations() []Operation {
+	table := s.operationTable()
+	operations := make([]Operation, len(table.operations))
+	for i, op := range table.operations {
+		operations[i] = op.Operation
+	}
+	return operations
+}
+
+// operationTable 返回服务器的操作表，首次调用时由路由表构建
+func (s *Server) operationTable() *operationTable {
+	s.operationsOnce.Do(func() {
+		s.operations = s.buildOperationTable()
+	})
+	return s.operations
+}
+
+// buildOperationTable 为每条注册的路由查找文档描述，并生成请求体schema
+func (s *Server) buildOperationTable() *operationTable {
+	docs := make(map[RouteInfo]Operation)
+	for _, op := range s.operationDocs() {
+		docs[RouteInfo{Method: op.Method, Pattern: op.Path}] = op
+	}
+
+	table := &operationTable{
+		byRoute:  make(map[RouteInfo]*routeOperation),
+		registry: newSchemaRegistry(),
+	}
+	for _, route := range s.router().Routes() {
+		doc, ok := docs[route]
+		if !ok {
+			continue
+		}
+
+		op := &routeOperation{Operation: doc, bodySchemas: make(map[string]*Schema)}
+		for contentType, body := range doc.RequestBody {
+			op.bodySchemas[contentType] = table.registry.schemaOf(reflect.TypeOf(body))
+		}
+		table.operations = append(table.operations, op)
+		table.byRoute[route] = op
+	}
+	return table
+}
+
+// operationDocs 各路由的文档描述，按方法和路径模板与注册的路由对应
+func (s *Server) operationDocs() []Operation {
+	auth := s.config.Auth != nil
+
+	operations := []Operation{
+		{
+			Method:     http.MethodGet,
+			Path:       "/users",
+			Summary:    "获取用户列表（支持分页、排序和过滤）",
+			Auth:       auth,
+			Formatters: userFormatters,
+			Parameters: []Parameter{
+				{Name: "page", In: "query", Description: "页码，从1开始", Type: "integer"},
+				{Name: "per_page", In: "query", Description: fmt.Sprintf("每页数量，最大 %d", maxPerPage), Type: "integer"},
+				{Name: "sort", In: "query", Description: "排序字段，逗号分隔，前缀 - 表示降序", Type: "string"},
+				{Name: "name_contains", In: "query", Description: "按用户名过滤（不区分大小写）", Type: "string"},
+				{Name: "email_contains", In: "query", Description: "按邮箱过滤（不区分大小写）", Type: "string"},
+				{Name: "min_age", In: "query", Description: "最小年龄", Type: "integer"},
+				{Name: "max_age", In: "query", Description: "最大年龄", Type: "integer"},
+				{Name: "deleted", In: "query", Description: "已删除用户: exclude（默认）、include 或 only", Type: "string"},
+			},
+			Responses: map[int]Response{
+				http.StatusOK:         {Description: "用户列表，分页信息见 X-Total-Count 和 Link 响应头", Body: []User{}},
+				http.StatusBadRequest: problemResponse("查询参数无效"),
+			},
+		},
+		{
+			Method:      http.MethodPost,
+			Path:        "/users",
+			Summary:     "创建用户",
+			Auth:        auth,
+			Formatters:  userFormatters,
+			RequestBody: map[string]interface{}{"application/json": User{}},
+			Responses: map[int]Response{
+				http.StatusCreated:    {Description: "创建成功", Body: User{}},
+				http.StatusBadRequest: problemResponse("请求数据校验失败"),
+			},
+		},
+		{
+			Method:      http.MethodPost,
+			Path:        "/users:batch",
+			Summary:     fmt.Sprintf("批量创建用户（最多 %d 个，允许部分成功）", maxBatchSize),
+			Auth:        auth,
+			Bulk:        true,
+			RequestBody: map[string]interface{}{"application/json": []User{}},
+			Responses: map[int]Response{
+				http.StatusCreated:               {Description: "全部创建成功", Body: BatchResponse{}},
+				http.StatusMultiStatus:           {Description: "部分或全部失败，见各条目的 status", Body: BatchResponse{}},
+				http.StatusBadRequest:            problemResponse("请求体不是合法的用户数组"),
+				http.StatusRequestEntityTooLarge: problemResponse("条目数超过上限"),
+			},
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/users/export",
+			Summary: "流式导出全部用户（NDJSON 或 CSV）",
+			Auth:    auth,
+			Parameters: []Parameter{
+				{Name: "format", In: "query", Description: "ndjson（默认）或 csv，也可通过 Accept 头指定", Type: "string"},
+			},
+			Responses: map[int]Response{
+				http.StatusOK: {Description: "每行一个用户；CSV 首行为表头", Body: User{}, ContentType: NDJSONContentType},
+			},
+		},
+		{
+			Method:  http.MethodPost,
+			Path:    "/users/import",
+			Summary: "从 NDJSON 或 CSV 导入用户（允许部分成功）",
+			Auth:    auth,
+			Bulk:    true,
+			RequestBody: map[string]interface{}{
+				NDJSONContentType: User{},
+				CSVContentType:    "",
+			},
+			Responses: map[int]Response{
+				http.StatusCreated:               {Description: "全部导入成功", Body: BatchResponse{}},
+				http.StatusMultiStatus:           {Description: "部分或全部失败，见各条目的 status", Body: BatchResponse{}},
+				http.StatusBadRequest:            problemResponse("上传内容无法解析"),
+				http.StatusRequestEntityTooLarge: problemResponse("条目数超过上限"),
+				http.StatusUnsupportedMediaType:  problemResponse("不支持的上传格式"),
+			},
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    eventsPath,
+			Summary: "订阅用户变更事件（Server-Sent Events）",
+			Auth:    auth,
+			Parameters: []Parameter{
+				{Name: "Last-Event-ID", In: "header", Description: "断线重连时最后收到的事件ID，补发之后的事件", Type: "integer"},
+			},
+			Responses: map[int]Response{
+				http.StatusOK:         {Description: "事件流，data 为 JSON 编码的事件；reset 事件表示需要重新拉取用户列表", Body: UserEvent{}, ContentType: EventStreamContentType},
+				http.StatusBadRequest: problemResponse("Last-Event-ID 无效"),
+			},
+		},
+		{
+			Method:     http.MethodGet,
+			Path:       "/users/{id}",
+			Summary:    "获取单个用户",
+			Auth:       auth,
+			Formatters: userFormatters,
+			Parameters: []Parameter{userIDParameter},
+			Responses: map[int]Response{
+				http.StatusOK:          {Description: "用户详情，ETag 由当前版本和响应格式决定", Body: User{}},
+				http.StatusNotModified: {Description: "If-None-Match 命中"},
+				http.StatusNotFound:    problemResponse("用户不存在"),
+			},
+		},
+		{
+			Method:      http.MethodPut,
+			Path:        "/users/{id}",
+			Summary:     "更新用户",
+			Auth:        auth,
+			Formatters:  userFormatters,
+			Parameters:  []Parameter{userIDParameter},
+			RequestBody: map[string]interface{}{"application/json": User{}},
+			Responses: map[int]Response{
+				http.StatusOK:                 {Description: "更新成功", Body: User{}},
+				http.StatusBadRequest:         problemResponse("请求数据校验失败"),
+				http.StatusNotFound:           problemResponse("用户不存在"),
+				http.StatusPreconditionFailed: problemResponse("If-Match 与当前版本不匹配"),
+			},
+		},
+		{
+			Method:     http.MethodPatch,
+			Path:       "/users/{id}",
+			Summary:    "部分更新用户（merge-patch / json-patch）",
+			Auth:       auth,
+			Formatters: userFormatters,
+			Parameters: []Parameter{userIDParameter},
+			RequestBody: map[string]interface{}{
+				MergePatchContentType: map[string]interface{}{},
+				JSONPatchContentType:  []PatchOperation{},
+			},
+			Responses: map[int]Response{
+				http.StatusOK:                   {Description: "更新成功", Body: User{}},
+				http.StatusBadRequest:           problemResponse("补丁无效或结果校验失败"),
+				http.StatusNotFound:             problemResponse("用户不存在"),
+				http.StatusConflict:             problemResponse("补丁无法应用"),
+				http.StatusPreconditionFailed:   problemResponse("If-Match 与当前版本不匹配"),
+				http.StatusUnsupportedMediaType: problemResponse("不支持的补丁类型"),
+			},
+		},
+		{
+			Method:     http.MethodDelete,
+			Path:       "/users/{id}",
+			Summary:    "删除用户（软删除，可恢复）",
+			Auth:       auth,
+			Role:       "admin",
+			Parameters: []Parameter{userIDParameter},
+			Responses: map[int]Response{
+				http.StatusNoContent:          {Description: "删除成功"},
+				http.StatusNotFound:           problemResponse("用户不存在"),
+				http.StatusPreconditionFailed: problemResponse("If-Match 与当前版本不匹配"),
+			},
+		},
+		{
+			Method:     http.MethodPost,
+			Path:       "/users/{id}/restore",
+			Summary:    "恢复已删除的用户",
+			Auth:       auth,
+			Role:       "admin",
+			Formatters: userFormatters,
+			Parameters: []Parameter{userIDParameter},
+			Responses: map[int]Response{
+				http.StatusOK:       {Description: "恢复成功", Body: User{}},
+				http.StatusNotFound: problemResponse("用户不存在"),
+				http.StatusConflict: problemResponse("用户未被删除"),
+			},
+		},
+		{
+			Method:     http.MethodGet,
+			Path:       "/users/{id}/history",
+			Summary:    "获取用户的变更历史（包括已删除用户）",
+			Auth:       auth,
+			Formatters: historyFormatters,
+			Parameters: []Parameter{userIDParameter},
+			Responses: map[int]Response{
+				http.StatusOK:       {Description: "按版本升序的变更记录", Body: []HistoryEntry{}},
+				http.StatusNotFound: problemResponse("用户不存在"),
+			},
+		},
+	}
+
+	if auth {
+		operations = append(operations, Operation{
+			Method:      http.MethodPost,
+			Path:        "/auth/login",
+			Summary:     "登录获取JWT令牌",
+			RequestBody: map[string]interface{}{"application/json": LoginRequest{}},
+			Responses: map[int]Response{
+				http.StatusOK:           {Description: "登录成功", Body: LoginResponse{}},
+				http.StatusUnauthorized: problemResponse("用户名或密码错误"),
+			},
+		})
+	}
+
+	return append(operations,
+		Operation{
+			Method:    http.MethodGet,
+			Path:      "/health",
+			Summary:   "健康检查",
+			Responses: map[int]Response{http.StatusOK: {Description: "服务健康"}},
+		},
+		Operation{
+			Method:  http.MethodGet,
+			Path:    "/metrics",
+			Summary: "Prometheus指标",
+			Responses: map[int]Response{
+				http.StatusOK: {Description: "Prometheus文本格式指标", ContentType: "text/plain"},
+			},
+		},
+		Operation{
+			Method:  http.MethodGet,
+			Path:    "/openapi.json",
+			Summary: "OpenAPI文档",
+			Responses: map[int]Response{
+				http.StatusOK: {Description: "OpenAPI 3 文档"},
+			},
+		},
+	)
+}
+
+// findOperation 查找 Router 分发请求时匹配的路由对应的操作
+func (s *Server) findOperation(r *http.Request) (*routeOperation, bool) {
+	method := r.Method
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+	op, ok := s.operationTable().byRoute[RouteInfo{Method: method, Pattern: r.Pattern}]
+	return op, ok
+}
+
+// Schema JSON Schema（OpenAPI 3.0 子集）
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	ReadOnly             bool               `json:"readOnly,omitempty"`
+	AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+}
+
+// schemaRegistry 由Go类型反射生成schema，具名结构体注册为可复用组件
+type schemaRegistry struct {
+	components map[string]*Schema
+}
+
+func newSchemaRegistry() *schemaRegistry {
+	return &schemaRegistry{components: make(map[string]*Schema)}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaOf 返回类型对应的schema，具名结构体返回 $ref
+func (g *schemaRegistry) schemaOf(t reflect.Type) *Schema {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return g.schemaOf(t.Elem())
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: g.schemaOf(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object"}
+	case reflect.Struct:
+		if t == timeType {
+			return &Schema{Type: "string", Format: "date-time"}
+		}
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+		if _, ok := g.components[t.Name()]; !ok {
+			g.components[t.Name()] = nil // 占位，防止递归类型无限展开
+			g.components[t.Name()] = g.structSchema(t)
+		}
+		return &Schema{Ref: "#/components/schemas/" + t.Name()}
+	default:
+		// interface{} 等任意值
+		return &Schema{}
+	}
+}
+
+// structSchema 由结构体字段生成对象schema
+//
+// 字段名取自 json 标签，约束取自 validate 标签（规则见 parseValidateTag）。
+func (g *schemaRegistry) structSchema(t reflect.Type) *Schema {
+	closed := false
+	schema := &Schema{Type: "object", Properties: make(map[string]*Schema), AdditionalProperties: &closed}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, ok := jsonFieldName(field)
+		if !field.IsExported() || !ok {
+			continue
+		}
+
+		property := g.schemaOf(field.Type)
+		if property.Ref == "" {
+			for _, rule := range parseValidateTag(field.Tag.Get("validate")) {
+				if applyRule(property, rule) {
+					schema.Required = append(schema.Required, name)
+				}
+			}
+		}
+		schema.Properties[name] = property
+	}
+	return schema
+}
+
+// applyRule 将一条 validate 规则应用到schema，返回该字段是否必填
+func applyRule(schema *Schema, rule validationRule) bool {
+	key, value := rule.Key, rule.Value
+	switch key {
+	case "required":
+		return true
+	case "email":
+		schema.Format = "email"
+	case "readonly":
+		schema.ReadOnly = true
+	case "oneof":
+		schema.Enum = strings.Fields(value)
+	case "min", "max":
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return false
+		}
+		switch {
+		case schema.Type == "string" && key == "min":
+			length := int(n)
+			schema.MinLength = &length
+		case schema.Type == "string":
+			length := int(n)
+			schema.MaxLength = &length
+		case key == "min":
+			schema.Minimum = &n
+		default:
+			schema.Maximum = &n
+		}
+	}
+	return false
+}
+
+// resolve 解析 $ref 引用
+func (g *schemaRegistry) resolve(schema *Schema) *Schema {
+	for schema != nil && schema.Ref != "" {
+		schema = g.components[strings.TrimPrefix(schema.Ref, "#/components/schemas/")]
+	}
+	return schema
+}
+
+// validate 按schema校验已解码的JSON值，错误以JSON Pointer风格的字段路径记录
+func (g *schemaRegistry) validate(value interface{}, schema *Schema, field string, verr *ValidationError) {
+	schema = g.resolve(schema)
+	if schema == nil || schema.Type == "" {
+		return
+	}
+
+	label := field
+	if label == "" {
+		label = "请求体"
+	}
+
+	switch schema.Type {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			verr.Add(field, label+" 必须是对象")
+			return
+		}
+		for _, name := range schema.Required {
+			if _, ok := object[name]; !ok {
+				verr.Add(joinField(field, name), joinField(field, name)+" 是必填字段")
+			}
+		}
+		names := make([]string, 0, len(object))
+		for name := range object {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			property, ok := schema.Properties[name]
+			if !ok {
+				if schema.AdditionalProperties != nil && !*schema.AdditionalProperties {
+					verr.Add(joinField(field, name), "未知字段: "+joinField(field, name))
+				}
+				continue
+			}
+			// 只读字段由服务端维护，客户端回传的值会被忽略
+			if g.resolve(property).ReadOnly {
+				continue
+			}
+			g.validate(object[name], property, joinField(field, name), verr)
+		}
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			verr.Add(field, label+" 必须是数组")
+			return
+		}
+		for i, item := range items {
+			g.validate(item, schema.Items, joinField(field, strconv.Itoa(i)), verr)
+		}
+	case "string":
+		s, ok := value.(string)
+		if !ok {
+			verr.Add(field, label+" 必须是字符串")
+			return
+		}
+		length := len([]rune(s))
+		if schema.MinLength != nil && length < *schema.MinLength {
+			verr.Add(field, fmt.Sprintf("%s 长度不能少于 %d", label, *schema.MinLength))
+		}
+		if schema.MaxLength != nil && length > *schema.MaxLength {
+			verr.Add(field, fmt.Sprintf("%s 长度不能超过 %d", label, *schema.MaxLength))
+		}
+		if schema.Format == "email" && !stringutils.IsEmail(s) {
+			verr.Add(field, label+" 邮箱格式不正确")
+		}
+		if len(schema.Enum) > 0 && !containsString(schema.Enum, s) {
+			verr.Add(field, fmt.Sprintf("%s 必须是 %s 之一", label, strings.Join(schema.Enum, ", ")))
+		}
+	case "integer", "number":
+		n, ok := value.(float64)
+		if !ok {
+			verr.Add(field, label+" 必须是数字")
+			return
+		}
+		if schema.Type == "integer" && n != math.Trunc(n) {
+			verr.Add(field, label+" 必须是整数")
+			return
+		}
+		if schema.Minimum != nil && n < *schema.Minimum {
+			verr.Add(field, fmt.Sprintf("%s 不能小于 %s", label, formatFloat(*schema.Minimum)))
+		}
+		if schema.Maximum != nil && n > *schema.Maximum {
+			verr.Add(field, fmt.Sprintf("%s 不能大于 %s", label, formatFloat(*schema.Maximum)))
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			verr.Add(field, label+" 必须是布尔值")
+		}
+	}
+}
+
+// isJSONMediaType 判断是否为JSON媒体类型（含 +json 后缀），只有JSON请求体会被校验
+func isJSONMediaType(contentType string) bool {
+	return contentType == "application/json" || strings.HasSuffix(contentType, "+json")
+}
+
+func joinField(parent, name string) string {
+	if parent == "" {
+		return name
+	}
+	return parent + "." + name
+}
+
+func containsString(values []string, target string) bool {
+	for _, value := range values {
+		if value == target {
+			return true
+		}
+	}
+	return false
+}
+
+// OpenAPI 文档根对象
+type OpenAPI struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       OpenAPIInfo                             `json:"info"`
+	Paths      map[string]map[string]*OpenAPIOperation `json:"paths"`
+	Components OpenAPIComponents                       `json:"components"`
+}
+
+// OpenAPIInfo 文档元信息
+type OpenAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+// OpenAPIComponents 可复用组件
+type OpenAPIComponents struct {
+	Schemas         map[string]*Schema           `json:"schemas"`
+	SecuritySchemes map[string]map[string]string `json:"securitySchemes,omitempty"`
+}
+
+// OpenAPIOperation 文档中的一个操作
+type OpenAPIOperation struct {
+	OperationID string                     `json:"operationId"`
+	Summary     string                     `json:"summary"`
+	Parameters  []OpenAPIParameter         `json:"parameters,omitempty"`
+	RequestBody *OpenAPIRequestBody        `json:"requestBody,omitempty"`
+	Responses   map[string]OpenAPIResponse `json:"responses"`
+	Security    []map[string][]string      `json:"security,omitempty"`
+}
+
+// OpenAPIParameter 文档中的参数
+type OpenAPIParameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+// OpenAPIRequestBody 文档中的请求体
+type OpenAPIRequestBody struct {
+	Required bool                        `json:"required"`
+	Content  map[string]OpenAPIMediaType `json:"content"`
+}
+
+// OpenAPIResponse 文档中的响应
+type OpenAPIResponse struct {
+	Description string                      `json:"description"`
+	Content     map[string]OpenAPIMediaType `json:"content,omitempty"`
+}
+
+// OpenAPIMediaType 媒体类型及其schema
+type OpenAPIMediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+// OpenAPIDocument 由注册的操作和模型结构体标签生成OpenAPI 3文档
+func (s *Server) OpenAPIDocument() OpenAPI {
+	registry := newSchemaRegistry()
+	doc := OpenAPI{
+		OpenAPI: "3.0.3",
+		Info:    OpenAPIInfo{Title: "User API", Version: "1.0.0"},
+		Paths:   make(map[string]map[string]*OpenAPIOperation),
+	}
+
+	for _, op := range s.Operations() {
+		operation := &OpenAPIOperation{
+			OperationID: operationID(op),
+			Summary:     op.Summary,
+			Responses:   make(map[string]OpenAPIResponse),
+		}
+
+		for _, param := range op.Parameters {
+			operation.Parameters = append(operation.Parameters, OpenAPIParameter{
+				Name:        param.Name,
+				In:          param.In,
+				Description: param.Description,
+				Required:    param.Required,
+				Schema:      &Schema{Type: param.Type},
+			})
+		}
+
+		if len(op.RequestBody) > 0 {
+			operation.RequestBody = &OpenAPIRequestBody{Required: true, Content: make(map[string]OpenAPIMediaType)}
+			for contentType, body := range op.RequestBody {
+				operation.RequestBody.Content[contentType] = OpenAPIMediaType{Schema: registry.schemaOf(reflect.TypeOf(body))}
+			}
+		}
+
+		for status, response := range op.Responses {
+			item := OpenAPIResponse{Description: response.Description}
+			if response.Body != nil {
+				schema := registry.schemaOf(reflect.TypeOf(response.Body))
+				item.Content = make(map[string]OpenAPIMediaType)
+				if response.ContentType == "" && len(op.Formatters) > 0 {
+					for _, formatter := range op.Formatters {
+						item.Content[formatter.ContentType()] = OpenAPIMediaType{Schema: schema}
+					}
+				} else if response.ContentType != "" {
+					item.Content[response.ContentType] = OpenAPIMediaType{Schema: schema}
+				} else {
+					item.Content["application/json"] = OpenAPIMediaType{Schema: schema}
+				}
+			}
+			operation.Responses[strconv.Itoa(status)] = item
+		}
+		if len(op.Formatters) > 0 {
+			operation.Responses[strconv.Itoa(http.StatusNotAcceptable)] = OpenAPIResponse{
+				Description: "Accept 头中没有可用的响应格式",
+				Content: map[string]OpenAPIMediaType{
+					"application/problem+json": {Schema: registry.schemaOf(reflect.TypeOf(Problem{}))},
+				},
+			}
+		}
+
+		if op.Auth {
+			operation.Security = []map[string][]string{{"bearerAuth": {}}}
+			operation.Responses[strconv.Itoa(http.StatusUnauthorized)] = OpenAPIResponse{
+				Description: "缺少或无效的认证令牌",
+				Content: map[string]OpenAPIMediaType{
+					"application/problem+json": {Schema: registry.schemaOf(reflect.TypeOf(Problem{}))},
+				},
+			}
+		}
+		if op.Role != "" {
+			operation.Summary += "（需要 " + op.Role + " 角色）"
+			operation.Responses[strconv.Itoa(http.StatusForbidden)] = OpenAPIResponse{
+				Description: "权限不足",
+				Content: map[string]OpenAPIMediaType{
+					"application/problem+json": {Schema: registry.schemaOf(reflect.TypeOf(Problem{}))},
+				},
+			}
+		}
+
+		if doc.Paths[op.Path] == nil {
+			doc.Paths[op.Path] = make(map[string]*OpenAPIOperation)
+		}
+		doc.Paths[op.Path][strings.ToLower(op.Method)] = operation
+	}
+
+	doc.Components.Schemas = registry.components
+	if s.config.Auth != nil {
+		doc.Components.SecuritySchemes = map[string]map[string]string{
+			"bearerAuth": {"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+		}
+	}
+	return doc
+}
+
+// operationID 由方法和路径生成操作ID，如 GET /users/{id} -> getUsersById
+func operationID(op Operation) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(op.Method))
+	for _, segment := range strings.Split(strings.Trim(op.Path, "/"), "/") {
+		if param, ok := strings.CutPrefix(segment, "{"); ok {
+			b.WriteString("By")
+			segment = strings.TrimSuffix(param, "}")
+		}
+		for _, word := range strings.FieldsFunc(segment, func(r rune) bool { return r == '.' || r == '_' || r == ':' }) {
+			b.WriteString(strings.ToUpper(word[:1]) + word[1:])
+		}
+	}
+	return b.String()
+}
+
+// openAPIHandler 输出OpenAPI文档
+func (s *Server) openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.OpenAPIDocument())
+}
+
+// validationMiddleware 按OpenAPI文档中的schema校验请求体，校验失败返回400
+//
+// 未开启 ValidateRequests 时直接放行；文档中未声明的媒体类型交给处理器自行处理。
+// 批量操作只检查请求体是数组，逐条校验由处理器完成。
+func (s *Server) validationMiddleware(next http.Handler) http.Handler {
+	if !s.config.ValidateRequests {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		op, ok := s.findOperation(r)
+		if !ok || len(op.bodySchemas) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		schema, declared := op.bodySchemas[contentType]
+		if !declared || !isJSONMediaType(contentType) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if op.Bulk {
+			body := bufio.NewReader(r.Body)
+			if !startsWithArray(body) {
+				writeProblem(w, r, NewProblem(http.StatusBadRequest, CodeInvalidJSON, "请求体必须是JSON数组"))
+				return
+			}
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{body, r.Body}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxValidatedBodySize))
+		if err != nil {
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				writeProblem(w, r, NewProblem(http.StatusRequestEntityTooLarge, CodeBodyTooLarge,
+					fmt.Sprintf("请求体超过 %d 字节", maxValidatedBodySize)))
+				return
+			}
+			writeProblem(w, r, NewProblem(http.StatusBadRequest, CodeInvalidJSON, "读取请求体失败"))
+			return
+		}
+
+		var value interface{}
+		if err := json.Unmarshal(data, &value); err != nil {
+			writeProblem(w, r, NewProblem(http.StatusBadRequest, CodeInvalidJSON, "无效的JSON数据"))
+			return
+		}
+
+		verr := &ValidationError{}
+		s.operationTable().registry.validate(value, schema, "", verr)
+		if verr.HasErrors() {
+			writeError(w, r, verr)
+			return
+		}
+
+		// 请求体已被读取，替换为副本供后续处理器解码
+		r.Body = io.NopCloser(bytes.NewReader(data))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// startsWithArray 跳过前导空白后检查请求体是否以 '[' 开头，'[' 留给后续解码
+func startsWithArray(body *bufio.Reader) bool {
+	for {
+		c, err := body.ReadByte()
+		if err != nil {
+			return false
+		}
+		switch c {
+		case ' ', '\t', '\r', '\n':
+			continue
+		case '[':
+			body.UnreadByte()
+			return true
+		default:
+			return false
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package webapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// PATCH 请求支持的媒体类型
+const (
+	MergePatchContentType = "application/merge-patch+json" // RFC 7396
+	JSONPatchContentType  = "application/json-patch+json"  // RFC 6902
+)
+
+// PatchOperation JSON Patch 中的一个操作
+type PatchOperation struct {
+	Op    string      `json:"op" validate:"required,oneof=add remove replace move copy test"`
+	Path  string      `json:"path" validate:"required"`
+	From  string      `json:"from,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// applyPatch 按媒体类型对文档应用补丁
+func applyPatch(contentType string, doc, patch []byte) ([]byte, error) {
+	var target interface{}
+	if err := json.Unmarshal(doc, &target); err != nil {
+		return nil, err
+	}
+
+	var result interface{}
+	switch contentType {
+	case MergePatchContentType:
+		var mergePatch interface{}
+		if err := json.Unmarshal(patch, &mergePatch); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+		}
+		result = MergePatch(target, mergePatch)
+	case JSONPatchContentType:
+		var operations []PatchOperation
+		if err := json.Unmarshal(patch, &operations); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+		}
+		var err error
+		if result, err = ApplyJSONPatch(target, operations); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("不支持的补丁类型: %s", contentType)
+	}
+
+	return json.Marshal(result)
+}
+
+// MergePatch 按 RFC 7396 合并补丁：null 删除字段，对象递归合并，其他值直接替换
+func MergePatch(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+			continue
+		}
+		targetObject[key] = MergePatch(targetObject[key], value)
+	}
+	return targetObject
+}
+
+// ApplyJSONPatch 按 RFC 6902 依次执行补丁操作，任一操作失败则整个补丁失败
+func ApplyJSONPatch(doc interface{}, operations []PatchOperation) (interface{}, error) {
+	var err error
+	for i, op := range operations {
+		if doc, err = applyOperation(doc, op); err != nil {
+			return nil, fmt.Errorf("第 %d 个操作(%s %s)失败: %w", i+1, op.Op, op.Path, err)
+		}
+	}
+	return doc, nil
+}
+
+func applyOperation(doc interface{}, op PatchOperation) (interface{}, error) {
+	switch op.Op {
+	case "add":
+		return pointerAdd(doc, op.Path, op.Value)
+	case "remove":
+		doc, _, err := pointerRemove(doc, op.Path)
+		return doc, err
+	case "replace":
+		doc, _, err := pointerRemove(doc, op.Path)
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, op.Path, op.Value)
+	case "move":
+		if strings.HasPrefix(op.Path, op.From+"/") {
+			return nil, fmt.Errorf("%w: 不能移动到自身的子路径", ErrInvalidPatch)
+		}
+		doc, value, err := pointerRemove(doc, op.From)
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, op.Path, value)
+	case "copy":
+		value, err := pointerGet(doc, op.From)
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, op.Path, deepCopy(value))
+	case "test":
+		value, err := pointerGet(doc, op.Path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(value, op.Value) {
+			return nil, fmt.Errorf("%w: 值不相等", ErrPatchConflict)
+		}
+		return doc, nil
+	default:
+		return nil, fmt.Errorf("%w: 不支持的操作 %q", ErrInvalidPatch, op.Op)
+	}
+}
+
+// parsePointer 解析 RFC 6901 JSON Pointer
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("%w: 无效的JSON Pointer %q", ErrInvalidPatch, pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+func pointerGet(doc interface{}, pointer string) (interface{}, error) {
+	tokens, err := parsePointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+
+	current := doc
+	for _, token := range tokens {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("%w: 路径不存在 %s", ErrPatchConflict, pointer)
+			}
+			current = value
+		case []interface{}:
+			index, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			current = node[index]
+		default:
+			return nil, fmt.Errorf("%w: 路径不存在 %s", ErrPatchConflict, pointer)
+		}
+	}
+	return current, nil
+}
+
+// pointerAdd 在指定位置添加值，返回新的根文档
+func pointerAdd(doc interface{}, pointer string, value interface{}) (interface{}, error) {
+	tokens, err := parsePointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return value, nil
+	}
+
+	parentPointer := pointer[:strings.LastIndex(pointer, "/")]
+	parent, err := pointerGet(doc, parentPointer)
+	if err != nil {
+		return nil, err
+	}
+
+	last := tokens[len(tokens)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[last] = value
+		return doc, nil
+	case []interface{}:
+		index, err := arrayIndex(last, len(node), true)
+		if err != nil {
+			return nil, err
+		}
+		node = append(node, nil)
+		copy(node[index+1:], node[index:])
+		node[index] = value
+		return pointerReplaceNode(doc, parentPointer, node)
+	default:
+		return nil, fmt.Errorf("%w: 父路径不是对象或数组 %s", ErrPatchConflict, pointer)
+	}
+}
+
+// pointerRemove 删除指定位置的值，返回新的根文档和被删除的值
+func pointerRemove(doc interface{}, pointer string) (interface{}, interface{}, error) {
+	tokens, err := parsePointer(pointer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, doc, nil
+	}
+
+	parentPointer := pointer[:strings.LastIndex(pointer, "/")]
+	parent, err := pointerGet(doc, parentPointer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	last := tokens[len(tokens)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		value, ok := node[last]
+		if !ok {
+			return nil, nil, fmt.Errorf("%w: 路径不存在 %s", ErrPatchConflict, pointer)
+		}
+		delete(node, last)
+		return doc, value, nil
+	case []interface{}:
+		index, err := arrayIndex(last, len(node), false)
+		if err != nil {
+			return nil, nil, err
+		}
+		value := node[index]
+		node = append(node[:index:index], node[index+1:]...)
+		doc, err = pointerReplaceNode(doc, parentPointer, node)
+		return doc, value, err
+	default:
+		return nil, nil, fmt.Errorf("%w: 路径不存在 %s", ErrPatchConflict, pointer)
+	}
+}
+
+// pointerReplaceNode 用新切片替换数组节点（切片追加/删除后可能是新的底层数组）
+func pointerReplaceNode(doc interface{}, pointer string, node interface{}) (interface{}, error) {
+	tokens, _ := parsePointer(pointer)
+	if len(tokens) == 0 {
+		return node, nil
+	}
+
+	parent, err := pointerGet(doc, pointer[:strings.LastIndex(pointer, "/")])
+	if err != nil {
+		return nil, err
+	}
+
+	last := tokens[len(tokens)-1]
+	switch p := parent.(type) {
+	case map[string]interface{}:
+		p[last] = node
+	case []interface{}:
+		index, _ := strconv.Atoi(last)
+		p[index] = node
+	}
+	return doc, nil
+}
+
+// arrayIndex 解析数组下标，allowEnd 为 true 时允许 "-" 和 len（追加到末尾）
+func arrayIndex(token string, length int, allowEnd bool) (int, error) {
+	if token == "-" && allowEnd {
+		return length, nil
+	}
+
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, fmt.Errorf("%w: 无效的数组下标 %q", ErrInvalidPatch, token)
+	}
+
+	limit := length - 1
+	if allowEnd {
+		limit = length
+	}
+	if index > limit {
+		return 0, fmt.Errorf("%w: 数组下标越界 %d", ErrPatchConflict, index)
+	}
+	return index, nil
+}
+
+func deepCopy(value interface{}) interface{} {
+	data, _ := json.Marshal(value)
+	var copied interface{}
+	json.Unmarshal(data, &copied)
+	return copied
+}
@@ -0,0 +1,277 @@
+package webapi
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultPerPage = 20
+	maxPerPage     = 100
+)
+
+// SortField 排序字段，Desc 为 true 表示降序
+type SortField struct {
+	Field string
+	Desc  bool
+}
+
+// 已删除用户的过滤方式
+const (
+	DeletedExclude = "exclude" // 默认，不返回已删除用户
+	DeletedInclude = "include" // 同时返回已删除和未删除用户
+	DeletedOnly    = "only"    // 只返回已删除用户
+)
+
+// UserFilter 用户过滤条件，零值表示不过滤（已删除用户除外）
+type UserFilter struct {
+	NameContains  string
+	EmailContains string
+	MinAge        *int
+	MaxAge        *int
+	IDAfter       int    // 仅返回ID大于该值的用户，用于按ID游标遍历
+	Deleted       string // DeletedExclude、DeletedInclude 或 DeletedOnly，为空等同于 DeletedExclude
+}
+
+// Match 判断用户是否满足过滤条件（字符串匹配不区分大小写）
+func (f UserFilter) Match(user User) bool {
+	if f.NameContains != "" && !containsFold(user.Name, f.NameContains) {
+		return false
+	}
+	if f.EmailContains != "" && !containsFold(user.Email, f.EmailContains) {
+		return false
+	}
+	if f.MinAge != nil && user.Age < *f.MinAge {
+		return false
+	}
+	if f.MaxAge != nil && user.Age > *f.MaxAge {
+		return false
+	}
+	if user.ID <= f.IDAfter {
+		return false
+	}
+	switch f.Deleted {
+	case DeletedInclude:
+	case DeletedOnly:
+		return user.DeletedAt != nil
+	default:
+		return user.DeletedAt == nil
+	}
+	return true
+}
+
+// UserQuery 用户列表查询对象
+type UserQuery struct {
+	Page    int
+	PerPage int
+	Sort    []SortField
+	Filter  UserFilter
+}
+
+// UserPage 分页查询结果
+type UserPage struct {
+	Users   []User
+	Total   int
+	Page    int
+	PerPage int
+}
+
+// TotalPages 总页数
+func (p UserPage) TotalPages() int {
+	if p.PerPage <= 0 {
+		return 0
+	}
+	return (p.Total + p.PerPage - 1) / p.PerPage
+}
+
+// userSortFields 可排序字段及其比较函数
+var userSortFields = map[string]func(a, b User) int{
+	"id":         func(a, b User) int { return compareInt(a.ID, b.ID) },
+	"name":       func(a, b User) int { return strings.Compare(a.Name, b.Name) },
+	"email":      func(a, b User) int { return strings.Compare(a.Email, b.Email) },
+	"age":        func(a, b User) int { return compareInt(a.Age, b.Age) },
+	"created_at": func(a, b User) int { return a.CreatedAt.Compare(b.CreatedAt) },
+	"updated_at": func(a, b User) int { return a.UpdatedAt.Compare(b.UpdatedAt) },
+}
+
+// ParseUserQuery 从URL查询参数解析查询对象
+//
+// 支持的参数: page, per_page, sort(如 "age,-created_at"),
+// name_contains, email_contains, min_age, max_age, deleted(exclude、include、only)
+func ParseUserQuery(values url.Values) (UserQuery, error) {
+	var query UserQuery
+	verr := &ValidationError{}
+
+	query.Page = parsePositiveInt(values, "page", verr)
+	query.PerPage = parsePositiveInt(values, "per_page", verr)
+	if query.PerPage > maxPerPage {
+		verr.Add("per_page", fmt.Sprintf("per_page 不能超过 %d", maxPerPage))
+	}
+
+	if raw := values.Get("sort"); raw != "" {
+		for _, part := range strings.Split(raw, ",") {
+			part = strings.TrimSpace(part)
+			field := SortField{Field: strings.TrimPrefix(part, "-"), Desc: strings.HasPrefix(part, "-")}
+			if _, ok := userSortFields[field.Field]; !ok {
+				verr.Add("sort", "不支持的排序字段: "+field.Field)
+				continue
+			}
+			query.Sort = append(query.Sort, field)
+		}
+	}
+
+	query.Filter.NameContains = values.Get("name_contains")
+	query.Filter.EmailContains = values.Get("email_contains")
+	query.Filter.MinAge = parseOptionalInt(values, "min_age", verr)
+	query.Filter.MaxAge = parseOptionalInt(values, "max_age", verr)
+
+	switch deleted := values.Get("deleted"); deleted {
+	case "", DeletedExclude, DeletedInclude, DeletedOnly:
+		query.Filter.Deleted = deleted
+	default:
+		verr.Add("deleted", "deleted 必须是 exclude、include 或 only")
+	}
+
+	if verr.HasErrors() {
+		return query, verr
+	}
+	return query, nil
+}
+
+// Apply 对用户集合执行过滤、排序和分页
+//
+// 供 UserRepository 实现复用，未设置的分页参数使用默认值，
+// 未指定排序时按ID升序，保证分页结果稳定。
+func (q UserQuery) Apply(users []User) UserPage {
+	page, perPage := q.Page, q.PerPage
+	if page < 1 {
+		page = 1
+	}
+	if perPage < 1 {
+		perPage = defaultPerPage
+	}
+	if perPage > maxPerPage {
+		perPage = maxPerPage
+	}
+
+	filtered := make([]User, 0, len(users))
+	for _, user := range users {
+		if q.Filter.Match(user) {
+			filtered = append(filtered, user)
+		}
+	}
+
+	sortFields := make([]SortField, 0, len(q.Sort)+1)
+	sortFields = append(sortFields, q.Sort...)
+	sortFields = append(sortFields, SortField{Field: "id"})
+	sort.SliceStable(filtered, func(i, j int) bool {
+		for _, field := range sortFields {
+			compare, ok := userSortFields[field.Field]
+			if !ok {
+				continue
+			}
+			c := compare(filtered[i], filtered[j])
+			if c == 0 {
+				continue
+			}
+			if field.Desc {
+				return c > 0
+			}
+			return c < 0
+		}
+		return false
+	})
+
+	// 先比较页码再相乘，超大的页码相乘会溢出为负数
+	start := len(filtered)
+	if page-1 <= len(filtered)/perPage {
+		start = (page - 1) * perPage
+	}
+	if start > len(filtered) {
+		start = len(filtered)
+	}
+	end := start + perPage
+	if end > len(filtered) {
+		end = len(filtered)
+	}
+
+	return UserPage{
+		Users:   filtered[start:end],
+		Total:   len(filtered),
+		Page:    page,
+		PerPage: perPage,
+	}
+}
+
+// paginationLinks 生成RFC 8288格式的Link头（first/prev/next/last）
+func paginationLinks(u *url.URL, page UserPage) string {
+	pageURL := func(n int) string {
+		values := u.Query()
+		values.Set("page", strconv.Itoa(n))
+		values.Set("per_page", strconv.Itoa(page.PerPage))
+		return u.Path + "?" + values.Encode()
+	}
+
+	last := page.TotalPages()
+	if last < 1 {
+		last = 1
+	}
+
+	links := []string{fmt.Sprintf(`<%s>; rel="first"`, pageURL(1))}
+	if page.Page > 1 {
+		prev := page.Page - 1
+		if prev > last {
+			prev = last
+		}
+		links = append(links, fmt.Sprintf(`<%s>; rel="prev"`, pageURL(prev)))
+	}
+	if page.Page < last {
+		links = append(links, fmt.Sprintf(`<%s>; rel="next"`, pageURL(page.Page+1)))
+	}
+	links = append(links, fmt.Sprintf(`<%s>; rel="last"`, pageURL(last)))
+
+	return strings.Join(links, ", ")
+}
+
+func parsePositiveInt(values url.Values, key string, verr *ValidationError) int {
+	raw := values.Get(key)
+	if raw == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 1 {
+		verr.Add(key, key+" 必须是正整数")
+		return 0
+	}
+	return n
+}
+
+func parseOptionalInt(values url.Values, key string, verr *ValidationError) *int {
+	raw := values.Get(key)
+	if raw == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil {
+		verr.Add(key, key+" 必须是整数")
+		return nil
+	}
+	return &n
+}
+
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+func compareInt(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
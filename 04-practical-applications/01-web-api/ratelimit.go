@@ -0,0 +1,215 @@
+package webapi
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit 令牌桶限流规则：每秒补充 Rate 个令牌，桶容量为 Burst
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// RouteRateLimit 针对特定路由的限流规则，Method 为空表示匹配所有方法
+type RouteRateLimit struct {
+	Method     string
+	PathPrefix string
+	Limit      RateLimit
+}
+
+// RateLimitConfig 限流配置
+type RateLimitConfig struct {
+	Default RateLimit        // 未匹配任何路由规则时使用
+	Routes  []RouteRateLimit // 按顺序匹配，第一个匹配的规则生效
+	IdleTTL time.Duration    // 桶空闲超过该时间后被回收，默认10分钟
+
+	// TrustForwardedFor 为 true 时使用 X-Forwarded-For 的第一个地址作为客户端IP，
+	// 仅应在可信反向代理之后开启
+	TrustForwardedFor bool
+}
+
+// DefaultRateLimitConfig 默认限流配置：每个客户端每秒10个请求，突发20个；登录接口更严格
+func DefaultRateLimitConfig() RateLimitConfig {
+	return RateLimitConfig{
+		Default: RateLimit{Rate: 10, Burst: 20},
+		Routes: []RouteRateLimit{
+			{Method: http.MethodPost, PathPrefix: "/auth/login", Limit: RateLimit{Rate: 1, Burst: 5}},
+		},
+		IdleTTL: 10 * time.Minute,
+	}
+}
+
+// tokenBucket 令牌桶，按时间差惰性补充令牌，不需要后台协程
+type tokenBucket struct {
+	tokens   float64
+	lastSeen time.Time
+	limit    RateLimit // 最近一次使用的规则，回收时据此判断是否已补满
+}
+
+// RateLimitResult 单次限流判断结果
+type RateLimitResult struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	RetryAfter time.Duration // 被拒绝时距离下一个令牌的时间
+	Reset      time.Duration // 桶重新装满所需时间
+}
+
+// RateLimiter 按 键+路由 维护令牌桶的限流器
+type RateLimiter struct {
+	config    RateLimitConfig
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	now       func() time.Time
+	mutex     sync.Mutex
+}
+
+// NewRateLimiter 创建限流器
+func NewRateLimiter(config RateLimitConfig) *RateLimiter {
+	if config.IdleTTL <= 0 {
+		config.IdleTTL = 10 * time.Minute
+	}
+	return &RateLimiter{
+		config:  config,
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+// limitFor 返回请求适用的规则及其名称（不同规则使用不同的桶）
+func (l *RateLimiter) limitFor(r *http.Request) (string, RateLimit) {
+	for _, route := range l.config.Routes {
+		if route.Method != "" && route.Method != r.Method {
+			continue
+		}
+		if strings.HasPrefix(r.URL.Path, route.PathPrefix) {
+			return route.Method + " " + route.PathPrefix, route.Limit
+		}
+	}
+	return "default", l.config.Default
+}
+
+// Allow 消耗指定键的一个令牌
+func (l *RateLimiter) Allow(key string, limit RateLimit) RateLimitResult {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	burst := float64(limit.Burst)
+	bucket, exists := l.buckets[key]
+	if !exists {
+		bucket = &tokenBucket{tokens: burst, lastSeen: now}
+		l.buckets[key] = bucket
+	} else {
+		elapsed := now.Sub(bucket.lastSeen).Seconds()
+		bucket.tokens = math.Min(burst, bucket.tokens+elapsed*limit.Rate)
+		bucket.lastSeen = now
+	}
+	bucket.limit = limit
+
+	result := RateLimitResult{Limit: limit.Burst}
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		result.Allowed = true
+	} else if limit.Rate > 0 {
+		result.RetryAfter = secondsToDuration((1 - bucket.tokens) / limit.Rate)
+	} else {
+		result.RetryAfter = l.config.IdleTTL
+	}
+
+	result.Remaining = int(bucket.tokens)
+	if limit.Rate > 0 {
+		result.Reset = secondsToDuration((burst - bucket.tokens) / limit.Rate)
+	}
+	return result
+}
+
+// sweep 回收空闲的桶，避免内存随客户端数量无限增长，必须持有锁
+//
+// 只回收空闲超过 IdleTTL 且已经补满的桶，删除后重新创建的效果完全相同；
+// 补充速度慢（Rate*IdleTTL < Burst）或不补充（Rate 为 0）的桶在补满前一直保留。
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.config.IdleTTL {
+		return
+	}
+	for key, bucket := range l.buckets {
+		idle := now.Sub(bucket.lastSeen)
+		if idle < l.config.IdleTTL {
+			continue
+		}
+		if bucket.tokens+idle.Seconds()*bucket.limit.Rate >= float64(bucket.limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// BucketCount 当前维护的桶数量
+func (l *RateLimiter) BucketCount() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return len(l.buckets)
+}
+
+// clientKey 限流键：已认证用户按主体限流，否则按客户端IP
+func (l *RateLimiter) clientKey(r *http.Request) string {
+	if user, ok := AuthUserFromContext(r.Context()); ok {
+		return "user:" + user.Username
+	}
+
+	if l.config.TrustForwardedFor {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			return "ip:" + strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// Middleware 限流中间件，超出限制时返回429
+func (l *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, limit := l.limitFor(r)
+		result := l.Allow(l.clientKey(r)+"|"+route, limit)
+
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(result.Limit))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		w.Header().Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+
+		if !result.Allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+			writeProblem(w, r, NewProblem(http.StatusTooManyRequests, CodeRateLimited, "请求过于频繁，请稍后重试"))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rateLimitMiddleware 服务器限流中间件，未配置限流时直接放行
+func (s *Server) rateLimitMiddleware(next http.Handler) http.Handler {
+	if s.limiter == nil {
+		return next
+	}
+	return s.limiter.Middleware(next)
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,223 @@
+package webapi
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Middleware HTTP中间件
+type Middleware func(http.Handler) http.Handler
+
+// RouteInfo 已注册路由的描述，用于路由内省
+type RouteInfo struct {
+	Method  string `json:"method"`
+	Pattern string `json:"pattern"`
+}
+
+// routeRecorderKey 上下文中记录匹配路由的键
+type routeRecorderKey struct{}
+
+// withRouteRecorder 在请求上下文中放入路由记录，Router 分发时写入匹配的路由
+//
+// 供在 Router 之外运行的中间件（如指标）在处理结束后读取匹配的路由模式；未匹配时保持零值。
+func withRouteRecorder(r *http.Request) (*http.Request, *RouteInfo) {
+	matched := &RouteInfo{}
+	return r.WithContext(context.WithValue(r.Context(), routeRecorderKey{}, matched)), matched
+}
+
+// route 一条路由，handler 已套上所属分组的中间件
+type route struct {
+	RouteInfo
+	segments []string
+	literals int // 字面量路径段数，用于在多条路由匹配时选择最具体的一条
+	handler  http.Handler
+}
+
+// Router 支持路径参数和按方法分发的路由器
+//
+// 模式中的 {name} 匹配单个非空路径段，处理器通过 r.PathValue(name) 读取，通过 r.Pattern 读取匹配的模式。
+// 同一路径可匹配多条路由时选择字面量段最多的一条，如 /users/events 优先于 /users/{id}。
+// 路径匹配但方法不匹配时返回405并在 Allow 头中列出允许的方法；
+// GET 路由同时处理 HEAD 请求，OPTIONS 请求自动返回 Allow。
+type Router struct {
+	routes []*route
+}
+
+// NewRouter 创建路由器
+func NewRouter() *Router {
+	return &Router{}
+}
+
+// Handle 注册路由，同一方法和模式重复注册时 panic
+func (rt *Router) Handle(method, pattern string, handler http.Handler) {
+	method = strings.ToUpper(method)
+	for _, existing := range rt.routes {
+		if existing.Method == method && existing.Pattern == pattern {
+			panic("webapi: 路由重复注册: " + method + " " + pattern)
+		}
+	}
+
+	segments := splitPath(pattern)
+	literals := 0
+	for _, segment := range segments {
+		if !isPathParam(segment) {
+			literals++
+		}
+	}
+	rt.routes = append(rt.routes, &route{
+		RouteInfo: RouteInfo{Method: method, Pattern: pattern},
+		segments:  segments,
+		literals:  literals,
+		handler:   handler,
+	})
+}
+
+// HandleFunc 注册处理函数
+func (rt *Router) HandleFunc(method, pattern string, handler http.HandlerFunc) {
+	rt.Handle(method, pattern, handler)
+}
+
+// Group 创建路由分组，组内路由共享路径前缀和中间件
+func (rt *Router) Group(prefix string, middleware ...Middleware) *RouteGroup {
+	return &RouteGroup{router: rt, prefix: prefix, middleware: middleware}
+}
+
+// Routes 按注册顺序返回全部路由
+func (rt *Router) Routes() []RouteInfo {
+	routes := make([]RouteInfo, len(rt.routes))
+	for i, r := range rt.routes {
+		routes[i] = r.RouteInfo
+	}
+	return routes
+}
+
+// ServeHTTP 分发请求
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	method := r.Method
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+
+	pathSegments := splitPath(r.URL.Path)
+	var best *route
+	var bestParams map[string]string
+	allowed := make(map[string]bool)
+	for _, candidate := range rt.routes {
+		params, ok := candidate.match(pathSegments)
+		if !ok {
+			continue
+		}
+		allowed[candidate.Method] = true
+		if candidate.Method == method && (best == nil || candidate.literals > best.literals) {
+			best, bestParams = candidate, params
+		}
+	}
+
+	if best != nil {
+		if matched, ok := r.Context().Value(routeRecorderKey{}).(*RouteInfo); ok {
+			*matched = best.RouteInfo
+		}
+		r.Pattern = best.Pattern
+		for name, value := range bestParams {
+			r.SetPathValue(name, value)
+		}
+		best.handler.ServeHTTP(w, r)
+		return
+	}
+
+	if len(allowed) == 0 {
+		writeProblem(w, r, NewProblem(http.StatusNotFound, CodeNotFound, "资源不存在: "+r.URL.Path))
+		return
+	}
+
+	w.Header().Set("Allow", allowHeader(allowed))
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	methodNotAllowed(w, r)
+}
+
+// match 判断路径是否匹配，返回提取的路径参数
+func (rt *route) match(pathSegments []string) (map[string]string, bool) {
+	if len(pathSegments) != len(rt.segments) {
+		return nil, false
+	}
+
+	var params map[string]string
+	for i, segment := range rt.segments {
+		if isPathParam(segment) {
+			if pathSegments[i] == "" {
+				return nil, false
+			}
+			if params == nil {
+				params = make(map[string]string)
+			}
+			params[segment[1:len(segment)-1]] = pathSegments[i]
+			continue
+		}
+		if segment != pathSegments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// RouteGroup 路由分组
+type RouteGroup struct {
+	router     *Router
+	prefix     string
+	middleware []Middleware
+}
+
+// Use 为分组追加中间件，只对之后注册的路由生效
+func (g *RouteGroup) Use(middleware ...Middleware) {
+	g.middleware = append(g.middleware, middleware...)
+}
+
+// Group 创建子分组，继承父分组的前缀和中间件
+func (g *RouteGroup) Group(prefix string, middleware ...Middleware) *RouteGroup {
+	combined := append(append([]Middleware{}, g.middleware...), middleware...)
+	return &RouteGroup{router: g.router, prefix: g.prefix + prefix, middleware: combined}
+}
+
+// Handle 在分组内注册路由，pattern 为相对分组前缀的路径（可为空）
+//
+// 中间件按注册顺序由外到内执行。
+func (g *RouteGroup) Handle(method, pattern string, handler http.Handler) {
+	for i := len(g.middleware) - 1; i >= 0; i-- {
+		handler = g.middleware[i](handler)
+	}
+	g.router.Handle(method, g.prefix+pattern, handler)
+}
+
+// HandleFunc 在分组内注册处理函数
+func (g *RouteGroup) HandleFunc(method, pattern string, handler http.HandlerFunc) {
+	g.Handle(method, pattern, handler)
+}
+
+// splitPath 按 "/" 拆分路径，保留末尾的空段以区分 /users 和 /users/
+func splitPath(path string) []string {
+	return strings.Split(strings.TrimPrefix(path, "/"), "/")
+}
+
+func isPathParam(segment string) bool {
+	return len(segment) > 2 && strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}")
+}
+
+// allowHeader 生成 Allow 响应头，GET 隐含 HEAD，始终包含 OPTIONS
+func allowHeader(allowed map[string]bool) string {
+	if allowed[http.MethodGet] {
+		allowed[http.MethodHead] = true
+	}
+	allowed[http.MethodOptions] = true
+
+	methods := make([]string, 0, len(allowed))
+	for method := range allowed {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	return strings.Join(methods, ", ")
+}
@@ -1,47 +1,80 @@
 package webapi
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"mime"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
+
+	security "golang-examples/04-practical-applications/07-security"
 )
 
 // User 用户模型
 type User struct {
-	ID        int       `json:"id"`
-	Name      string    `json:"name"`
-	Email     string    `json:"email"`
-	Age       int       `json:"age"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID        int        `json:"id" xml:"id" validate:"readonly"`
+	Name      string     `json:"name" xml:"name" validate:"required,min=1,max=100"`
+	Email     string     `json:"email" xml:"email" validate:"required,email,max=100"` // 不区分大小写唯一
+	Age       int        `json:"age" xml:"age" validate:"min=0,max=150"`
+	Version   int        `json:"version" xml:"version" validate:"readonly"` // 乐观锁版本号，每次修改递增
+	CreatedAt time.Time  `json:"created_at" xml:"created_at" validate:"readonly"`
+	UpdatedAt time.Time  `json:"updated_at" xml:"updated_at" validate:"readonly"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty" xml:"deleted_at,omitempty" validate:"readonly"` // 软删除时间，未删除时为nil
 }
 
 // UserRepository 用户仓库接口
+//
+// ctx 携带请求范围的数据（如请求ID），实现可以从中获取日志记录器。
+// 删除是软删除：已删除的用户对 GetAll、GetByID、Update 不可见，但保留在仓库中，可通过 Restore 恢复，
+// List 按 UserFilter.Deleted 决定是否包含已删除用户。每次修改都会记录一条变更历史。
 type UserRepository interface {
-	GetAll() []User
-	GetByID(id int) (*User, error)
-	Create(user *User) error
-	Update(user *User) error
-	Delete(id int) error
+	GetAll(ctx context.Context) ([]User, error)
+	List(ctx context.Context, query UserQuery) (UserPage, error)
+	// ForEach 按ID升序逐个遍历开始时存在的未删除用户，fn 返回错误时停止
+	ForEach(ctx context.Context, fn func(User) error) error
+	GetByID(ctx context.Context, id int) (*User, error)
+	Create(ctx context.Context, user *User) error
+	// Update 更新用户，user.Version 非0时必须等于当前版本，否则返回 ErrVersionConflict
+	Update(ctx context.Context, user *User) error
+	Delete(ctx context.Context, id int) error
+	// DeleteIfVersion 当前版本等于 expectedVersion 时才删除，expectedVersion 为0表示不检查
+	DeleteIfVersion(ctx context.Context, id, expectedVersion int) error
+	// Restore 恢复已删除的用户，用户未被删除时返回 ErrUserNotDeleted
+	Restore(ctx context.Context, id int) (*User, error)
+	// History 返回用户（包括已删除用户）的变更历史，按版本升序
+	History(ctx context.Context, id int) ([]HistoryEntry, error)
 }
 
 // InMemoryUserRepository 内存用户仓库实现
 type InMemoryUserRepository struct {
-	users  map[int]*User
-	nextID int
-	mutex  sync.RWMutex
+	users   map[int]*User
+	emails  emailIndex
+	history map[int][]HistoryEntry
+	nextID  int
+	mutex   sync.RWMutex
 }
 
 // NewInMemoryUserRepository 创建内存用户仓库
 func NewInMemoryUserRepository() *InMemoryUserRepository {
 	repo := &InMemoryUserRepository{
-		users:  make(map[int]*User),
-		nextID: 1,
+		users:   make(map[int]*User),
+		emails:  make(emailIndex),
+		history: make(map[int][]HistoryEntry),
+		nextID:  1,
 	}
 	
 	// 添加一些示例数据
@@ -49,36 +82,113 @@ func NewInMemoryUserRepository() *InMemoryUserRepository {
 	return repo
 }
 
-func (r *InMemoryUserRepository) seedData() {
-	users := []*User{
+// seedUsers 示例用户数据
+func seedUsers() []*User {
+	return []*User{
 		{Name: "张三", Email: "zhangsan@example.com", Age: 25},
 		{Name: "李四", Email: "lisi@example.com", Age: 30},
 		{Name: "王五", Email: "wangwu@example.com", Age: 28},
 	}
-	
-	for _, user := range users {
-		r.Create(user)
+}
+
+func (r *InMemoryUserRepository) seedData() {
+	for _, user := range seedUsers() {
+		r.Create(context.Background(), user)
 	}
 }
 
-func (r *InMemoryUserRepository) GetAll() []User {
+// GetAll 返回所有未删除的用户
+func (r *InMemoryUserRepository) GetAll(ctx context.Context) ([]User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	
 	r.mutex.RLock()
 	defer r.mutex.RUnlock()
 	
+	users := make([]User, 0, len(r.users))
+	for _, user := range r.users {
+		if user.DeletedAt == nil {
+			users = append(users, *user)
+		}
+	}
+	return users, nil
+}
+
+// List 按查询对象分页列出用户
+func (r *InMemoryUserRepository) List(ctx context.Context, query UserQuery) (UserPage, error) {
+	if err := ctx.Err(); err != nil {
+		return UserPage{}, err
+	}
+	
+	r.mutex.RLock()
 	users := make([]User, 0, len(r.users))
 	for _, user := range r.users {
 		users = append(users, *user)
 	}
-	return users
+	r.mutex.RUnlock()
+	
+	return query.Apply(users), nil
 }
 
-func (r *InMemoryUserRepository) GetByID(id int) (*User, error) {
+// ForEach 按ID升序遍历未删除的用户
+func (r *InMemoryUserRepository) ForEach(ctx context.Context, fn func(User) error) error {
+	return forEachUser(ctx, &r.mutex, r.users, fn)
+}
+
+// forEachUser 按ID升序遍历未删除的用户，用于两种仓库的 ForEach
+//
+// 开始时在读锁下取一次ID并排序，之后每次只在读锁下复制一页用户，
+// 调用 fn（如向慢客户端写出）时不持有锁，也不会每页都复制整张表。
+// 遍历期间被删除的用户会被跳过，新建的用户不在本次遍历之内。
+func forEachUser(ctx context.Context, mutex *sync.RWMutex, users map[int]*User, fn func(User) error) error {
+	mutex.RLock()
+	ids := make([]int, 0, len(users))
+	for id, user := range users {
+		if user.DeletedAt == nil {
+			ids = append(ids, id)
+		}
+	}
+	mutex.RUnlock()
+	sort.Ints(ids)
+	
+	page := make([]User, 0, maxPerPage)
+	for start := 0; start < len(ids); start += maxPerPage {
+		// 每页之间检查上下文，客户端断开或超时后不再继续读取
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		
+		end := min(start+maxPerPage, len(ids))
+		page = page[:0]
+		mutex.RLock()
+		for _, id := range ids[start:end] {
+			if user, exists := users[id]; exists && user.DeletedAt == nil {
+				page = append(page, *user)
+			}
+		}
+		mutex.RUnlock()
+		
+		for _, user := range page {
+			if err := fn(user); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *InMemoryUserRepository) GetByID(ctx context.Context, id int) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	
 	r.mutex.RLock()
 	defer r.mutex.RUnlock()
 	
 	user, exists := r.users[id]
-	if !exists {
-		return nil, fmt.Errorf("用户不存在: %d", id)
+	if !exists || user.DeletedAt != nil {
+		return nil, fmt.Errorf("%w: %d", ErrUserNotFound, id)
 	}
 	
 	// 返回副本
@@ -86,105 +196,316 @@ func (r *InMemoryUserRepository) GetByID(id int) (*User, error) {
 	return &userCopy, nil
 }
 
-func (r *InMemoryUserRepository) Create(user *User) error {
+func (r *InMemoryUserRepository) Create(ctx context.Context, user *User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 	
+	if err := r.emails.check(user.Email, 0); err != nil {
+		return err
+	}
+	
 	user.ID = r.nextID
+	user.Version = 1
 	user.CreatedAt = time.Now()
-	user.UpdatedAt = time.Now()
+	user.UpdatedAt = user.CreatedAt
+	user.DeletedAt = nil
 	
-	r.users[user.ID] = user
+	// 保存副本，避免调用方修改影响仓库数据
+	stored := *user
+	r.users[user.ID] = &stored
+	r.emails.replace(nil, &stored)
+	r.history[user.ID] = append(r.history[user.ID], newHistoryEntry(ctx, HistoryCreate, nil, &stored))
 	r.nextID++
 	
 	return nil
 }
 
-func (r *InMemoryUserRepository) Update(user *User) error {
+func (r *InMemoryUserRepository) Update(ctx context.Context, user *User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 	
 	existing, exists := r.users[user.ID]
-	if !exists {
-		return fmt.Errorf("用户不存在: %d", user.ID)
+	if !exists || existing.DeletedAt != nil {
+		return fmt.Errorf("%w: %d", ErrUserNotFound, user.ID)
+	}
+	
+	// 版本检查与写入在同一把锁内完成，保证原子性
+	if err := checkVersion(existing, user.Version); err != nil {
+		return err
+	}
+	if err := r.emails.check(user.Email, user.ID); err != nil {
+		return err
 	}
 	
 	// 保留创建时间，更新其他字段
+	user.Version = existing.Version + 1
 	user.CreatedAt = existing.CreatedAt
 	user.UpdatedAt = time.Now()
+	user.DeletedAt = nil
 	
-	r.users[user.ID] = user
+	stored := *user
+	r.users[user.ID] = &stored
+	r.emails.replace(existing, &stored)
+	r.history[user.ID] = append(r.history[user.ID], newHistoryEntry(ctx, HistoryUpdate, existing, &stored))
 	return nil
 }
 
-func (r *InMemoryUserRepository) Delete(id int) error {
+func (r *InMemoryUserRepository) Delete(ctx context.Context, id int) error {
+	return r.DeleteIfVersion(ctx, id, 0)
+}
+
+func (r *InMemoryUserRepository) DeleteIfVersion(ctx context.Context, id, expectedVersion int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 	
-	if _, exists := r.users[id]; !exists {
-		return fmt.Errorf("用户不存在: %d", id)
+	existing, exists := r.users[id]
+	if !exists || existing.DeletedAt != nil {
+		return fmt.Errorf("%w: %d", ErrUserNotFound, id)
+	}
+	
+	if err := checkVersion(existing, expectedVersion); err != nil {
+		return err
+	}
+	
+	deleted := softDeleted(existing)
+	r.users[id] = &deleted
+	r.emails.replace(existing, &deleted)
+	r.history[id] = append(r.history[id], newHistoryEntry(ctx, HistoryDelete, existing, &deleted))
+	return nil
+}
+
+// Restore 恢复已删除的用户
+func (r *InMemoryUserRepository) Restore(ctx context.Context, id int) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	
+	existing, exists := r.users[id]
+	if !exists {
+		return nil, fmt.Errorf("%w: %d", ErrUserNotFound, id)
+	}
+	if existing.DeletedAt == nil {
+		return nil, fmt.Errorf("%w: %d", ErrUserNotDeleted, id)
+	}
+	// 删除期间邮箱可能已被其他用户使用
+	if err := r.emails.check(existing.Email, id); err != nil {
+		return nil, err
+	}
+	
+	restored := restoredUser(existing)
+	r.users[id] = &restored
+	r.emails.replace(existing, &restored)
+	r.history[id] = append(r.history[id], newHistoryEntry(ctx, HistoryRestore, existing, &restored))
+	
+	userCopy := restored
+	return &userCopy, nil
+}
+
+// History 返回用户的变更历史
+func (r *InMemoryUserRepository) History(ctx context.Context, id int) ([]HistoryEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 	
-	delete(r.users, id)
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	
+	if _, exists := r.users[id]; !exists {
+		return nil, fmt.Errorf("%w: %d", ErrUserNotFound, id)
+	}
+	return append([]HistoryEntry(nil), r.history[id]...), nil
+}
+
+// softDeleted 返回标记为已删除的用户副本，版本号递增
+func softDeleted(user *User) User {
+	deleted := *user
+	now := time.Now()
+	deleted.DeletedAt = &now
+	deleted.UpdatedAt = now
+	deleted.Version++
+	return deleted
+}
+
+// restoredUser 返回清除删除标记的用户副本，版本号递增
+func restoredUser(user *User) User {
+	restored := *user
+	restored.DeletedAt = nil
+	restored.UpdatedAt = time.Now()
+	restored.Version++
+	return restored
+}
+
+// emailIndex 未删除用户的邮箱索引（规范化邮箱 -> 用户ID），实现不区分大小写的唯一约束
+//
+// 已删除的用户不占用邮箱，恢复时若邮箱已被他人使用则恢复失败。
+type emailIndex map[string]int
+
+// emailKey 比较邮箱时忽略大小写和首尾空白
+func emailKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// check 邮箱已被其他未删除用户使用时返回 ErrDuplicateEmail
+func (idx emailIndex) check(email string, id int) error {
+	if owner, taken := idx[emailKey(email)]; taken && owner != id {
+		return fmt.Errorf("%w: %s", ErrDuplicateEmail, email)
+	}
 	return nil
 }
 
+// replace 用户由 previous 变为 current 时更新索引，previous 为nil表示新建
+func (idx emailIndex) replace(previous, current *User) {
+	if previous != nil && previous.DeletedAt == nil {
+		delete(idx, emailKey(previous.Email))
+	}
+	if current.DeletedAt == nil {
+		idx[emailKey(current.Email)] = current.ID
+	}
+}
+
 // UserService 用户服务
 type UserService struct {
-	repo UserRepository
+	repo   UserRepository
+	events *EventBroker
+	
+	// publishMutex 在写入仓库到发布事件期间持有，保证事件按写入（版本）顺序发布
+	publishMutex sync.Mutex
 }
 
 // NewUserService 创建用户服务
 func NewUserService(repo UserRepository) *UserService {
-	return &UserService{repo: repo}
+	return &UserService{repo: repo, events: NewEventBroker(defaultEventBufferSize)}
+}
+
+// Events 返回用户变更事件中心，创建、更新、删除和恢复成功后按写入顺序发布事件
+func (s *UserService) Events() *EventBroker {
+	return s.events
+}
+
+func (s *UserService) GetAllUsers(ctx context.Context) ([]User, error) {
+	return s.repo.GetAll(ctx)
+}
+
+// ListUsers 分页、过滤和排序查询用户
+func (s *UserService) ListUsers(ctx context.Context, query UserQuery) (UserPage, error) {
+	return s.repo.List(ctx, query)
 }
 
-func (s *UserService) GetAllUsers() []User {
-	return s.repo.GetAll()
+func (s *UserService) GetUser(ctx context.Context, id int) (*User, error) {
+	return s.repo.GetByID(ctx, id)
 }
 
-func (s *UserService) GetUser(id int) (*User, error) {
-	return s.repo.GetByID(id)
+// ForEachUser 按ID升序遍历所有用户，fn 返回错误时停止
+//
+// 由仓库逐页复制用户，导出大量用户时不需要一次读出全部数据。
+func (s *UserService) ForEachUser(ctx context.Context, fn func(User) error) error {
+	return s.repo.ForEach(ctx, fn)
 }
 
-func (s *UserService) CreateUser(user *User) error {
+func (s *UserService) CreateUser(ctx context.Context, user *User) error {
 	// 验证用户数据
 	if err := s.validateUser(user); err != nil {
 		return err
 	}
 	
-	return s.repo.Create(user)
+	s.publishMutex.Lock()
+	defer s.publishMutex.Unlock()
+	
+	if err := s.repo.Create(ctx, user); err != nil {
+		return err
+	}
+	
+	s.events.Publish(EventUserCreated, user.ID, user)
+	LoggerFromContext(ctx).Debug("用户已创建", "user_id", user.ID)
+	return nil
 }
 
-func (s *UserService) UpdateUser(user *User) error {
+func (s *UserService) UpdateUser(ctx context.Context, user *User) error {
 	// 验证用户数据
 	if err := s.validateUser(user); err != nil {
 		return err
 	}
 	
-	return s.repo.Update(user)
+	s.publishMutex.Lock()
+	defer s.publishMutex.Unlock()
+	
+	if err := s.repo.Update(ctx, user); err != nil {
+		return err
+	}
+	
+	s.events.Publish(EventUserUpdated, user.ID, user)
+	LoggerFromContext(ctx).Debug("用户已更新", "user_id", user.ID, "version", user.Version)
+	return nil
 }
 
-func (s *UserService) DeleteUser(id int) error {
-	return s.repo.Delete(id)
+func (s *UserService) DeleteUser(ctx context.Context, id int) error {
+	return s.DeleteUserIfVersion(ctx, id, 0)
 }
 
-func (s *UserService) validateUser(user *User) error {
-	if user.Name == "" {
-		return fmt.Errorf("用户名不能为空")
-	}
-	if user.Email == "" {
-		return fmt.Errorf("邮箱不能为空")
-	}
-	if user.Age < 0 || user.Age > 150 {
-		return fmt.Errorf("年龄必须在0-150之间")
+// RestoreUser 恢复已删除的用户
+func (s *UserService) RestoreUser(ctx context.Context, id int) (*User, error) {
+	s.publishMutex.Lock()
+	defer s.publishMutex.Unlock()
+	
+	user, err := s.repo.Restore(ctx, id)
+	if err != nil {
+		return nil, err
 	}
-	if !strings.Contains(user.Email, "@") {
-		return fmt.Errorf("邮箱格式不正确")
+	
+	s.events.Publish(EventUserRestored, id, user)
+	LoggerFromContext(ctx).Debug("用户已恢复", "user_id", id, "version", user.Version)
+	return user, nil
+}
+
+// GetUserHistory 获取用户的变更历史
+func (s *UserService) GetUserHistory(ctx context.Context, id int) ([]HistoryEntry, error) {
+	return s.repo.History(ctx, id)
+}
+
+// DeleteUserIfVersion 仅当用户仍是期望版本时删除
+func (s *UserService) DeleteUserIfVersion(ctx context.Context, id, expectedVersion int) error {
+	s.publishMutex.Lock()
+	defer s.publishMutex.Unlock()
+	
+	if err := s.repo.DeleteIfVersion(ctx, id, expectedVersion); err != nil {
+		return err
 	}
+	
+	s.events.Publish(EventUserDeleted, id, nil)
+	LoggerFromContext(ctx).Debug("用户已删除", "user_id", id)
 	return nil
 }
 
+// validateUser 按 User 的 validate 标签校验用户数据，一次返回所有不合法的字段
+func (s *UserService) validateUser(user *User) error {
+	return ValidateStruct(user)
+}
+
+// pathUserID 读取路由器提取的 {id} 路径参数，无效时写出400并返回 false
+func pathUserID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeProblem(w, r, NewProblem(http.StatusBadRequest, CodeInvalidID, "无效的用户ID"))
+		return 0, false
+	}
+	return id, true
+}
+
 // UserHandler HTTP处理器
 type UserHandler struct {
 	service *UserService
@@ -195,202 +516,649 @@ func NewUserHandler(service *UserService) *UserHandler {
 	return &UserHandler{service: service}
 }
 
-// GetUsers 获取所有用户
+// GetUsers 获取用户列表，支持分页、过滤和排序
 func (h *UserHandler) GetUsers(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "方法不允许", http.StatusMethodNotAllowed)
+	query, err := ParseUserQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
 	
-	users := h.service.GetAllUsers()
-	
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(users); err != nil {
-		http.Error(w, "编码错误", http.StatusInternalServerError)
+	page, err := h.service.ListUsers(r.Context(), query)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
+	
+	// 分页信息通过响应头返回，响应体保持用户数组不变
+	w.Header().Set("X-Total-Count", strconv.Itoa(page.Total))
+	w.Header().Set("Link", paginationLinks(r.URL, page))
+	render(w, r, http.StatusOK, page.Users)
 }
 
-// GetUser 获取单个用户
+// GetUser 获取单个用户，响应携带ETag并支持 If-None-Match
 func (h *UserHandler) GetUser(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "方法不允许", http.StatusMethodNotAllowed)
+	id, ok := pathUserID(w, r)
+	if !ok {
 		return
 	}
 	
-	// 从URL路径中提取ID
-	path := strings.TrimPrefix(r.URL.Path, "/users/")
-	id, err := strconv.Atoi(path)
+	user, err := h.service.GetUser(r.Context(), id)
 	if err != nil {
-		http.Error(w, "无效的用户ID", http.StatusBadRequest)
+		writeError(w, r, err)
 		return
 	}
 	
-	user, err := h.service.GetUser(id)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+	// 客户端缓存的版本仍然有效时返回304
+	etag := representationETag(user, FormatterFromContext(r.Context()))
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Accept-Patch", MergePatchContentType+", "+JSONPatchContentType)
+	if match := r.Header.Get("If-None-Match"); match != "" && etagMatches(match, etag) {
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 	
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(user); err != nil {
-		http.Error(w, "编码错误", http.StatusInternalServerError)
-		return
-	}
+	render(w, r, http.StatusOK, user)
 }
 
 // CreateUser 创建用户
 func (h *UserHandler) CreateUser(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "方法不允许", http.StatusMethodNotAllowed)
+	var user User
+	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+		writeProblem(w, r, NewProblem(http.StatusBadRequest, CodeInvalidJSON, "无效的JSON数据"))
+		return
+	}
+	
+	if err := h.service.CreateUser(r.Context(), &user); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	
+	w.Header().Set("ETag", representationETag(&user, FormatterFromContext(r.Context())))
+	render(w, r, http.StatusCreated, user)
+}
+
+// UpdateUser 更新用户，支持 If-Match 乐观并发控制
+func (h *UserHandler) UpdateUser(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathUserID(w, r)
+	if !ok {
 		return
 	}
 	
 	var user User
 	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
-		http.Error(w, "无效的JSON数据", http.StatusBadRequest)
+		writeProblem(w, r, NewProblem(http.StatusBadRequest, CodeInvalidJSON, "无效的JSON数据"))
 		return
 	}
 	
-	if err := h.service.CreateUser(&user); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	// 期望版本只来自 If-Match，忽略请求体中的 version
+	expectedVersion, err := h.ifMatchVersion(r, id)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
 	
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	if err := json.NewEncoder(w).Encode(user); err != nil {
-		http.Error(w, "编码错误", http.StatusInternalServerError)
+	user.ID = id
+	user.Version = expectedVersion
+	if err := h.service.UpdateUser(r.Context(), &user); err != nil {
+		writeError(w, r, err)
 		return
 	}
+	
+	w.Header().Set("ETag", representationETag(&user, FormatterFromContext(r.Context())))
+	render(w, r, http.StatusOK, user)
 }
 
-// UpdateUser 更新用户
-func (h *UserHandler) UpdateUser(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPut {
-		http.Error(w, "方法不允许", http.StatusMethodNotAllowed)
+// PatchUser 部分更新用户，支持 JSON Merge Patch 和 JSON Patch
+func (h *UserHandler) PatchUser(w http.ResponseWriter, r *http.Request) {
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if contentType != MergePatchContentType && contentType != JSONPatchContentType {
+		w.Header().Set("Accept-Patch", MergePatchContentType+", "+JSONPatchContentType)
+		writeProblem(w, r, NewProblem(http.StatusUnsupportedMediaType, CodeUnsupportedMedia,
+			"PATCH 仅支持 "+MergePatchContentType+" 和 "+JSONPatchContentType))
+		return
+	}
+	
+	id, ok := pathUserID(w, r)
+	if !ok {
 		return
 	}
 	
-	// 从URL路径中提取ID
-	path := strings.TrimPrefix(r.URL.Path, "/users/")
-	id, err := strconv.Atoi(path)
+	expectedVersion, err := h.ifMatchVersion(r, id)
 	if err != nil {
-		http.Error(w, "无效的用户ID", http.StatusBadRequest)
+		writeError(w, r, err)
+		return
+	}
+	
+	patch, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeProblem(w, r, NewProblem(http.StatusBadRequest, CodeInvalidPatch, "读取请求体失败"))
+		return
+	}
+	
+	current, err := h.service.GetUser(r.Context(), id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	
+	original, err := json.Marshal(current)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	
+	patched, err := applyPatch(contentType, original, patch)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
 	
 	var user User
-	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
-		http.Error(w, "无效的JSON数据", http.StatusBadRequest)
+	if err := json.Unmarshal(patched, &user); err != nil {
+		writeError(w, r, fmt.Errorf("%w: 补丁结果不是有效的用户: %v", ErrInvalidPatch, err))
 		return
 	}
 	
-	user.ID = id
-	if err := h.service.UpdateUser(&user); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if user.ID != id {
+		verr := &ValidationError{}
+		verr.Add("id", "用户ID不可修改")
+		writeError(w, r, verr)
 		return
 	}
 	
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(user); err != nil {
-		http.Error(w, "编码错误", http.StatusInternalServerError)
+	// 有 If-Match 时以客户端确认过的版本写回，否则以读取到的版本写回；
+	// 期间若有其他修改则仓库返回412，避免覆盖
+	user.Version = current.Version
+	if expectedVersion != 0 {
+		user.Version = expectedVersion
+	}
+	if err := h.service.UpdateUser(r.Context(), &user); err != nil {
+		writeError(w, r, err)
 		return
 	}
+	
+	w.Header().Set("ETag", representationETag(&user, FormatterFromContext(r.Context())))
+	render(w, r, http.StatusOK, user)
 }
 
-// DeleteUser 删除用户
+// DeleteUser 删除用户，支持 If-Match 乐观并发控制
 func (h *UserHandler) DeleteUser(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodDelete {
-		http.Error(w, "方法不允许", http.StatusMethodNotAllowed)
+	id, ok := pathUserID(w, r)
+	if !ok {
 		return
 	}
 	
-	// 从URL路径中提取ID
-	path := strings.TrimPrefix(r.URL.Path, "/users/")
-	id, err := strconv.Atoi(path)
+	expectedVersion, err := h.ifMatchVersion(r, id)
 	if err != nil {
-		http.Error(w, "无效的用户ID", http.StatusBadRequest)
+		writeError(w, r, err)
 		return
 	}
 	
-	if err := h.service.DeleteUser(id); err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+	if err := h.service.DeleteUserIfVersion(r.Context(), id, expectedVersion); err != nil {
+		writeError(w, r, err)
 		return
 	}
 	
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// RestoreUser 恢复已删除的用户
+func (h *UserHandler) RestoreUser(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathUserID(w, r)
+	if !ok {
+		return
+	}
+	
+	user, err := h.service.RestoreUser(r.Context(), id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	
+	w.Header().Set("ETag", representationETag(user, FormatterFromContext(r.Context())))
+	render(w, r, http.StatusOK, user)
+}
+
+// GetUserHistory 获取用户的变更历史，已删除的用户同样可以查询
+func (h *UserHandler) GetUserHistory(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathUserID(w, r)
+	if !ok {
+		return
+	}
+	
+	entries, err := h.service.GetUserHistory(r.Context(), id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	
+	render(w, r, http.StatusOK, entries)
+}
+
+// 存储驱动
+const (
+	StorageMemory = "memory" // 内存存储，重启后数据丢失
+	StorageFile   = "file"   // 文件存储，见 FileUserRepository
+)
+
+// StorageConfig 用户仓库存储配置
+type StorageConfig struct {
+	Driver string // StorageMemory 或 StorageFile，为空时使用内存存储
+	Path   string // 文件存储的数据文件路径
+}
+
+// NewUserRepository 根据存储配置创建用户仓库
+func NewUserRepository(config StorageConfig) (UserRepository, error) {
+	switch config.Driver {
+	case "", StorageMemory:
+		return NewInMemoryUserRepository(), nil
+	case StorageFile:
+		if config.Path == "" {
+			return nil, fmt.Errorf("文件存储需要指定数据文件路径")
+		}
+		return NewFileUserRepository(config.Path)
+	default:
+		return nil, fmt.Errorf("不支持的存储驱动: %s", config.Driver)
+	}
+}
+
+// ServerConfig 服务器配置
+type ServerConfig struct {
+	Storage     StorageConfig         // 仅 NewServerFromConfig 使用
+	Auth        *security.AuthService // 为nil时不启用认证
+	RateLimit   *RateLimitConfig      // 为nil时不启用限流
+	Compression *CompressionConfig    // 为nil时不压缩响应
+	CORS        *CORSConfig           // 为nil时不允许跨域访问
+	TLS         *TLSConfig            // 为nil时使用明文HTTP
+	Metrics     *Metrics              // 为nil时由服务器自行创建
+	Logger      *slog.Logger          // 访问日志和请求范围日志，为nil时以JSON格式输出到标准错误
+	
+	// ValidateRequests 为 true 时按OpenAPI文档校验请求体，不合法的请求不会到达处理器
+	ValidateRequests bool
+	
+	RequestTimeout    time.Duration // 单个请求的处理截止时间，传递给服务层和仓库层，0 表示不限制
+	EventHeartbeat    time.Duration // 事件流空闲时的心跳间隔，0 表示不发送心跳
+	ReadTimeout       time.Duration // 读取整个请求（含请求体）的超时
+	ReadHeaderTimeout time.Duration // 读取请求头的超时
+	WriteTimeout      time.Duration // 写响应的超时
+	IdleTimeout       time.Duration // keep-alive 空闲连接超时
+	ShutdownTimeout   time.Duration // 优雅关闭时等待进行中请求的最长时间
+}
+
+// DefaultServerConfig 默认服务器配置
+func DefaultServerConfig() ServerConfig {
+	return ServerConfig{
+		RequestTimeout:    10 * time.Second,
+		EventHeartbeat:    15 * time.Second,
+		ReadTimeout:       10 * time.Second,
+		ReadHeaderTimeout: 5 * time.Second,
+		WriteTimeout:      15 * time.Second,
+		IdleTimeout:       60 * time.Second,
+		ShutdownTimeout:   10 * time.Second,
+	}
+}
+
 // Server Web服务器
 type Server struct {
 	handler *UserHandler
 	port    string
+	config  ServerConfig
+	limiter *RateLimiter
+	metrics *Metrics
+	logger  *slog.Logger
+
+	httpServer *http.Server
+	listener   net.Listener
+	closers    []io.Closer
+	mutex      sync.Mutex
+	
+	// 启用TLS时可选的HTTP到HTTPS重定向服务器
+	redirectServer   *http.Server
+	redirectListener net.Listener
+	
+	// stopping 在关闭时关闭，通知事件流等长连接退出，否则优雅关闭会一直等待它们
+	stopping chan struct{}
+	stopOnce sync.Once
+	
+	// 路由表和由它派生的操作表在首次使用时构建一次，之后复用
+	routes         *Router
+	routesOnce     sync.Once
+	operations     *operationTable
+	operationsOnce sync.Once
 }
 
-// NewServer 创建新服务器
+// NewServer 创建新服务器（使用默认配置）
 func NewServer(handler *UserHandler, port string) *Server {
-	return &Server{
+	return NewServerWithConfig(handler, port, DefaultServerConfig())
+}
+
+// NewServerWithConfig 使用指定配置创建服务器
+func NewServerWithConfig(handler *UserHandler, port string, config ServerConfig) *Server {
+	server := &Server{
 		handler: handler,
 		port:    port,
+		config:  config,
+		metrics: config.Metrics,
+		logger:  config.Logger,
+		
+		stopping: make(chan struct{}),
+	}
+	if server.metrics == nil {
+		server.metrics = NewMetrics()
+	}
+	if server.logger == nil {
+		server.logger = newDefaultLogger()
+	}
+	if config.RateLimit != nil {
+		server.limiter = NewRateLimiter(*config.RateLimit)
 	}
+	return server
 }
 
-// Start 启动服务器
-func (s *Server) Start() error {
-	mux := http.NewServeMux()
+// NewServerFromConfig 根据配置创建仓库、服务和处理器并组装服务器
+//
+// 服务器关闭时会一并关闭它创建的仓库（如文件存储）。
+func NewServerFromConfig(port string, config ServerConfig) (*Server, error) {
+	repo, err := NewUserRepository(config.Storage)
+	if err != nil {
+		return nil, err
+	}
 	
-	// 注册路由
-	mux.HandleFunc("/users", s.usersHandler)
-	mux.HandleFunc("/users/", s.userHandler)
-	mux.HandleFunc("/health", s.healthHandler)
-	mux.HandleFunc("/", s.rootHandler)
+	// 仓库操作计入服务器的 /metrics 指标
+	if config.Metrics == nil {
+		config.Metrics = NewMetrics()
+	}
+	instrumented := NewInstrumentedRepository(repo, config.Metrics)
 	
+	server := NewServerWithConfig(NewUserHandler(NewUserService(instrumented)), port, config)
+	if closer, ok := repo.(io.Closer); ok {
+		server.closers = append(server.closers, closer)
+	}
+	return server, nil
+}
+
+// Routes 构建带中间件的路由处理器
+func (s *Server) Routes() http.Handler {
 	// 添加中间件
-	handler := s.loggingMiddleware(s.corsMiddleware(mux))
+	return s.requestIDMiddleware(s.metricsMiddleware(s.loggingMiddleware(s.timeoutMiddleware(s.compressionMiddleware(s.corsMiddleware(s.router()))))))
+}
+
+// router 返回服务器的路由表，首次调用时构建
+func (s *Server) router() *Router {
+	s.routesOnce.Do(func() {
+		s.routes = s.buildRouter()
+	})
+	return s.routes
+}
+
+// buildRouter 注册全部路由
+func (s *Server) buildRouter() *Router {
+	router := NewRouter()
 	
-	fmt.Printf("🚀 服务器启动在端口 %s\n", s.port)
-	fmt.Println("API端点:")
-	fmt.Println("  GET    /users      - 获取所有用户")
-	fmt.Println("  POST   /users      - 创建用户")
-	fmt.Println("  GET    /users/{id} - 获取单个用户")
-	fmt.Println("  PUT    /users/{id} - 更新用户")
-	fmt.Println("  DELETE /users/{id} - 删除用户")
-	fmt.Println("  GET    /health     - 健康检查")
-	
-	return http.ListenAndServe(":"+s.port, handler)
-}
-
-func (s *Server) usersHandler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case http.MethodGet:
-		s.handler.GetUsers(w, r)
-	case http.MethodPost:
-		s.handler.CreateUser(w, r)
-	default:
-		http.Error(w, "方法不允许", http.StatusMethodNotAllowed)
+	// 限流在认证之后执行，已认证请求按用户限流，其余按客户端IP限流
+	api := router.Group("", s.authMiddleware, s.rateLimitMiddleware, s.validationMiddleware)
+	api.HandleFunc(http.MethodPost, "/users:batch", s.handler.CreateUsersBatch)
+	api.HandleFunc(http.MethodGet, "/users/export", s.handler.ExportUsers)
+	api.HandleFunc(http.MethodPost, "/users/import", s.handler.ImportUsers)
+	api.HandleFunc(http.MethodGet, eventsPath, s.eventsHandler)
+	
+	users := api.Group("/users", s.negotiationMiddleware(userFormatters))
+	users.HandleFunc(http.MethodGet, "", s.handler.GetUsers)
+	users.HandleFunc(http.MethodPost, "", s.handler.CreateUser)
+	users.HandleFunc(http.MethodGet, "/{id}", s.handler.GetUser)
+	users.HandleFunc(http.MethodPut, "/{id}", s.handler.UpdateUser)
+	users.HandleFunc(http.MethodPatch, "/{id}", s.handler.PatchUser)
+	// 只有管理员可以删除和恢复用户
+	users.HandleFunc(http.MethodDelete, "/{id}", s.requireRole("admin", s.handler.DeleteUser))
+	users.HandleFunc(http.MethodPost, "/{id}/restore", s.requireRole("admin", s.handler.RestoreUser))
+	
+	history := api.Group("/users", s.negotiationMiddleware(historyFormatters))
+	history.HandleFunc(http.MethodGet, "/{id}/history", s.handler.GetUserHistory)
+	
+	router.Handle(http.MethodPost, "/auth/login", s.rateLimitMiddleware(s.validationMiddleware(http.HandlerFunc(s.loginHandler))))
+	router.HandleFunc(http.MethodGet, "/health", s.healthHandler)
+	router.HandleFunc(http.MethodGet, "/metrics", s.metricsHandler)
+	router.HandleFunc(http.MethodGet, "/openapi.json", s.openAPIHandler)
+	router.HandleFunc(http.MethodGet, "/", s.rootHandler)
+	return router
+}
+
+// streamingPaths 不设置请求截止时间的路径：事件流是长连接，导入导出的耗时与数据量成正比
+var streamingPaths = map[string]bool{
+	eventsPath:      true,
+	"/users/export": true,
+	"/users/import": true,
+}
+
+// timeoutMiddleware 为请求上下文设置截止时间，超时后服务层和仓库层的操作返回 context.DeadlineExceeded
+//
+// 不使用 http.TimeoutHandler：它会缓冲整个响应，流式导出无法及时推送。
+// streamingPaths 中的路径不设置截止时间。
+func (s *Server) timeoutMiddleware(next http.Handler) http.Handler {
+	if s.config.RequestTimeout <= 0 {
+		return next
 	}
+	
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if streamingPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		
+		ctx, cancel := context.WithTimeout(r.Context(), s.config.RequestTimeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
 }
 
-func (s *Server) userHandler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case http.MethodGet:
-		s.handler.GetUser(w, r)
-	case http.MethodPut:
-		s.handler.UpdateUser(w, r)
-	case http.MethodDelete:
-		s.handler.DeleteUser(w, r)
-	default:
-		http.Error(w, "方法不允许", http.StatusMethodNotAllowed)
+// Listen 绑定监听端口并返回实际地址
+//
+// 端口为 "0" 时由系统分配临时端口，便于测试并行启动多个真实服务器。
+func (s *Server) Listen() (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	
+	if s.listener != nil {
+		return "", fmt.Errorf("服务器已在监听: %s", s.listener.Addr())
+	}
+	
+	// 先加载证书，证书无效时不占用端口
+	var tlsConfig *tls.Config
+	if s.config.TLS != nil {
+		var err error
+		if tlsConfig, err = buildTLSConfig(*s.config.TLS); err != nil {
+			return "", fmt.Errorf("TLS配置无效: %v", err)
+		}
+	}
+	
+	listener, err := net.Listen("tcp", ":"+s.port)
+	if err != nil {
+		return "", fmt.Errorf("监听端口失败: %v", err)
+	}
+	
+	if tlsConfig != nil && s.config.TLS.RedirectAddr != "" {
+		redirectListener, err := net.Listen("tcp", s.config.TLS.RedirectAddr)
+		if err != nil {
+			listener.Close()
+			return "", fmt.Errorf("监听重定向端口失败: %v", err)
+		}
+		_, httpsPort, _ := net.SplitHostPort(listener.Addr().String())
+		s.redirectListener = redirectListener
+		s.redirectServer = &http.Server{
+			Handler:           httpsRedirectHandler(httpsPort),
+			ReadHeaderTimeout: s.config.ReadHeaderTimeout,
+			IdleTimeout:       s.config.IdleTimeout,
+		}
 	}
+	
+	s.listener = listener
+	s.httpServer = &http.Server{
+		Handler:           s.Routes(),
+		TLSConfig:         tlsConfig,
+		ReadTimeout:       s.config.ReadTimeout,
+		ReadHeaderTimeout: s.config.ReadHeaderTimeout,
+		WriteTimeout:      s.config.WriteTimeout,
+		IdleTimeout:       s.config.IdleTimeout,
+	}
+	
+	return listener.Addr().String(), nil
 }
 
-func (s *Server) healthHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "方法不允许", http.StatusMethodNotAllowed)
-		return
+// RedirectAddr 返回HTTP重定向服务器的实际监听地址，未启用时返回空字符串
+func (s *Server) RedirectAddr() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	
+	if s.redirectListener == nil {
+		return ""
+	}
+	return s.redirectListener.Addr().String()
+}
+
+// Addr 返回实际监听地址，未监听时返回空字符串
+func (s *Server) Addr() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	
+	if s.listener == nil {
+		return ""
+	}
+	return s.listener.Addr().String()
+}
+
+// Serve 在已绑定的监听器上处理请求，直到服务器被关闭
+func (s *Server) Serve() error {
+	s.mutex.Lock()
+	httpServer, listener := s.httpServer, s.listener
+	redirectServer, redirectListener := s.redirectServer, s.redirectListener
+	s.mutex.Unlock()
+	
+	if httpServer == nil {
+		return fmt.Errorf("服务器尚未监听，请先调用 Listen")
+	}
+	
+	if redirectServer != nil {
+		go func() {
+			if err := redirectServer.Serve(redirectListener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				s.logger.Error("HTTP重定向服务器异常退出", "error", err)
+			}
+		}()
+	}
+	
+	var err error
+	if httpServer.TLSConfig != nil {
+		// 证书已在 TLSConfig 中，ServeTLS 还会启用 HTTP/2
+		err = httpServer.ServeTLS(listener, "", "")
+	} else {
+		err = httpServer.Serve(listener)
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Start 启动服务器（阻塞直到服务器关闭）
+func (s *Server) Start() error {
+	if err := s.listenAndAnnounce(); err != nil {
+		return err
+	}
+	return s.Serve()
+}
+
+// Run 启动服务器，在ctx结束时优雅关闭
+func (s *Server) Run(ctx context.Context) error {
+	if err := s.listenAndAnnounce(); err != nil {
+		return err
 	}
 	
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.Serve()
+	}()
+	
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+	
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.config.ShutdownTimeout)
+	defer cancel()
+	
+	if err := s.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	return <-errCh
+}
+
+func (s *Server) listenAndAnnounce() error {
+	addr, err := s.Listen()
+	if err != nil {
+		return err
+	}
+	
+	scheme := "http"
+	if s.config.TLS != nil {
+		scheme = "https"
+	}
+	fmt.Printf("🚀 服务器启动在 %s://%s\n", scheme, addr)
+	if redirect := s.RedirectAddr(); redirect != "" {
+		fmt.Printf("↪️  HTTP请求 %s 重定向到HTTPS\n", redirect)
+	}
+	fmt.Println("API端点:")
+	for _, op := range s.Operations() {
+		note := ""
+		if op.Role != "" {
+			note = "（需要" + op.Role + "角色）"
+		} else if op.Auth {
+			note = "（需要认证）"
+		}
+		fmt.Printf("  %-6s %-13s - %s%s\n", op.Method, op.Path, op.Summary, note)
+	}
+	return nil
+}
+
+// Shutdown 优雅关闭服务器：停止接受新连接，等待进行中的请求完成
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mutex.Lock()
+	httpServer, redirectServer := s.httpServer, s.redirectServer
+	s.mutex.Unlock()
+	
+	s.stopOnce.Do(func() { close(s.stopping) })
+	if redirectServer != nil {
+		if err := redirectServer.Shutdown(ctx); err != nil {
+			return fmt.Errorf("关闭重定向服务器失败: %v", err)
+		}
+	}
+	if httpServer != nil {
+		if err := httpServer.Shutdown(ctx); err != nil {
+			return fmt.Errorf("优雅关闭失败: %v", err)
+		}
+		fmt.Println("🛑 服务器已停止")
+	}
+	
+	return s.closeResources()
+}
+
+// closeResources 关闭服务器持有的资源
+func (s *Server) closeResources() error {
+	s.mutex.Lock()
+	closers := s.closers
+	s.closers = nil
+	s.mutex.Unlock()
+	
+	var errs []error
+	for _, closer := range closers {
+		if err := closer.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Server) healthHandler(w http.ResponseWriter, r *http.Request) {
 	response := map[string]interface{}{
 		"status":    "healthy",
 		"timestamp": time.Now(),
@@ -403,7 +1171,7 @@ func (s *Server) healthHandler(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) rootHandler(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path != "/" {
-		http.NotFound(w, r)
+		writeProblem(w, r, NewProblem(http.StatusNotFound, CodeNotFound, "资源不存在: "+r.URL.Path))
 		return
 	}
 	
@@ -411,96 +1179,129 @@ func (s *Server) rootHandler(w http.ResponseWriter, r *http.Request) {
 		"message": "欢迎使用用户API",
 		"version": "1.0.0",
 		"endpoints": map[string]string{
-			"users":  "/users",
-			"health": "/health",
+			"users":   "/users",
+			"events":  eventsPath,
+			"login":   "/auth/login",
+			"health":  "/health",
+			"metrics": "/metrics",
+			"openapi": "/openapi.json",
 		},
+		"routes": s.router().Routes(),
 	}
 	
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
-// 中间件
-
-// loggingMiddleware 日志中间件
-func (s *Server) loggingMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		
-		// 创建响应写入器包装器来捕获状态码
-		wrapper := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
-		
-		next.ServeHTTP(wrapper, r)
-		
-		duration := time.Since(start)
-		log.Printf("%s %s %d %v", r.Method, r.URL.Path, wrapper.statusCode, duration)
-	})
-}
-
-// corsMiddleware CORS中间件
-func (s *Server) corsMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-		
-		if r.Method == http.MethodOptions {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-		
-		next.ServeHTTP(w, r)
-	})
-}
-
-// responseWriter 响应写入器包装器
-type responseWriter struct {
-	http.ResponseWriter
-	statusCode int
-}
-
-func (rw *responseWriter) WriteHeader(code int) {
-	rw.statusCode = code
-	rw.ResponseWriter.WriteHeader(code)
-}
-
 // WebAPIExamples Web API示例
 func WebAPIExamples() {
 	fmt.Println("=== Web API 示例 ===")
 	
-	// 创建依赖
-	repo := NewInMemoryUserRepository()
-	service := NewUserService(repo)
-	handler := NewUserHandler(service)
-	server := NewServer(handler, "8080")
+	// 创建依赖，设置 WEBAPI_DATA_FILE 时使用文件存储，重启后数据不丢失
+	config := DefaultServerConfig()
+	if path := os.Getenv("WEBAPI_DATA_FILE"); path != "" {
+		config.Storage = StorageConfig{Driver: StorageFile, Path: path}
+	}
+	
+	// 使用 security 包的JWT认证服务保护 /users 路由
+	config.Auth = security.NewAuthService(security.NewJWTManager("webapi-demo-secret", "user-api", 24*time.Hour))
+	
+	// 按客户端限流，超出后返回429
+	rateLimit := DefaultRateLimitConfig()
+	config.RateLimit = &rateLimit
+	config.ValidateRequests = true
+	compression := DefaultCompressionConfig()
+	config.Compression = &compression
+	// 只允许本地前端和 example.com 的子域跨域访问
+	cors := DefaultCORSConfig("http://localhost:3000", "https://*.example.com")
+	config.CORS = &cors
+	
+	server, err := NewServerFromConfig("8080", config)
+	if err != nil {
+		log.Fatal("创建服务器失败:", err)
+	}
 	
 	fmt.Println("启动Web API服务器...")
 	fmt.Println("你可以使用以下命令测试API:")
 	fmt.Println()
+	fmt.Println("# 登录获取令牌（示例账号: admin/admin123 拥有admin角色，user1/user123 为普通用户）")
+	fmt.Println(`curl -X POST http://localhost:8080/auth/login \`)
+	fmt.Println(`  -d '{"username":"admin","password":"admin123"}'`)
+	fmt.Println(`export TOKEN=<返回的token>`)
+	fmt.Println()
 	fmt.Println("# 获取所有用户")
-	fmt.Println("curl http://localhost:8080/users")
+	fmt.Println(`curl -H "Authorization: Bearer $TOKEN" http://localhost:8080/users`)
+	fmt.Println()
+	fmt.Println("# 分页、排序和过滤")
+	fmt.Println(`curl -H "Authorization: Bearer $TOKEN" "http://localhost:8080/users?page=1&per_page=2&sort=age,-created_at&email_contains=example"`)
 	fmt.Println()
 	fmt.Println("# 获取单个用户")
-	fmt.Println("curl http://localhost:8080/users/1")
+	fmt.Println(`curl -H "Authorization: Bearer $TOKEN" http://localhost:8080/users/1`)
 	fmt.Println()
 	fmt.Println("# 创建用户")
 	fmt.Println(`curl -X POST http://localhost:8080/users \`)
+	fmt.Println(`  -H "Authorization: Bearer $TOKEN" \`)
 	fmt.Println(`  -H "Content-Type: application/json" \`)
 	fmt.Println(`  -d '{"name":"新用户","email":"new@example.com","age":25}'`)
 	fmt.Println()
 	fmt.Println("# 更新用户")
 	fmt.Println(`curl -X PUT http://localhost:8080/users/1 \`)
+	fmt.Println(`  -H "Authorization: Bearer $TOKEN" \`)
 	fmt.Println(`  -H "Content-Type: application/json" \`)
 	fmt.Println(`  -d '{"name":"更新用户","email":"updated@example.com","age":30}'`)
 	fmt.Println()
-	fmt.Println("# 删除用户")
-	fmt.Println("curl -X DELETE http://localhost:8080/users/1")
+	fmt.Println("# 部分更新用户（JSON Merge Patch）")
+	fmt.Println(`curl -X PATCH http://localhost:8080/users/1 \`)
+	fmt.Println(`  -H "Authorization: Bearer $TOKEN" \`)
+	fmt.Println(`  -H "Content-Type: application/merge-patch+json" \`)
+	fmt.Println(`  -d '{"age":31}'`)
+	fmt.Println()
+	fmt.Println("# 部分更新用户（JSON Patch）")
+	fmt.Println(`curl -X PATCH http://localhost:8080/users/1 \`)
+	fmt.Println(`  -H "Authorization: Bearer $TOKEN" \`)
+	fmt.Println(`  -H "Content-Type: application/json-patch+json" \`)
+	fmt.Println(`  -d '[{"op":"test","path":"/age","value":31},{"op":"replace","path":"/name","value":"新名字"}]'`)
+	fmt.Println()
+	fmt.Println("# 删除用户（需要admin角色）")
+	fmt.Println(`curl -X DELETE -H "Authorization: Bearer $TOKEN" http://localhost:8080/users/1`)
+	fmt.Println()
+	fmt.Println("# 查看已删除用户、恢复用户和变更历史")
+	fmt.Println(`curl -H "Authorization: Bearer $TOKEN" "http://localhost:8080/users?deleted=only"`)
+	fmt.Println(`curl -X POST -H "Authorization: Bearer $TOKEN" http://localhost:8080/users/1/restore`)
+	fmt.Println(`curl -H "Authorization: Bearer $TOKEN" http://localhost:8080/users/1/history`)
 	fmt.Println()
 	fmt.Println("# 健康检查")
 	fmt.Println("curl http://localhost:8080/health")
+	fmt.Println()
+	fmt.Println("# Prometheus指标")
+	fmt.Println("curl http://localhost:8080/metrics")
+	fmt.Println()
+	fmt.Println("# 批量创建用户（部分成功时返回207，逐条给出结果）")
+	fmt.Println(`curl -X POST http://localhost:8080/users:batch -H "Authorization: Bearer <token>" -H "Content-Type: application/json" -d '[{"name":"甲","email":"a@example.com","age":20},{"name":"乙","email":"b@example.com","age":21}]'`)
+	fmt.Println()
+	fmt.Println("# 导出用户（ndjson或csv）并重新导入")
+	fmt.Println(`curl -H "Authorization: Bearer <token>" "http://localhost:8080/users/export?format=csv" -o users.csv`)
+	fmt.Println(`curl -X POST http://localhost:8080/users/import -H "Authorization: Bearer <token>" -H "Content-Type: text/csv" --data-binary @users.csv`)
+	fmt.Println()
+	fmt.Println("# 以CSV或XML格式获取用户列表，并启用gzip压缩")
+	fmt.Println(`curl --compressed -H "Authorization: Bearer <token>" -H "Accept: text/csv" http://localhost:8080/users`)
+	fmt.Println(`curl -H "Authorization: Bearer <token>" -H "Accept: application/xml" http://localhost:8080/users/1`)
+	fmt.Println()
+	fmt.Println("# CORS预检（不在允许列表中的来源返回403）")
+	fmt.Println(`curl -i -X OPTIONS http://localhost:8080/users -H "Origin: http://localhost:3000" -H "Access-Control-Request-Method: POST"`)
+	fmt.Println()
+	fmt.Println("# OpenAPI文档")
+	fmt.Println("curl http://localhost:8080/openapi.json")
+	
+	fmt.Println()
+	fmt.Println("按 Ctrl+C 优雅关闭服务器")
+	
+	// 收到中断或终止信号时优雅关闭
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 	
-	// 启动服务器（这会阻塞）
-	if err := server.Start(); err != nil {
-		log.Fatal("服务器启动失败:", err)
+	// 启动服务器（这会阻塞直到收到信号）
+	if err := server.Run(ctx); err != nil {
+		log.Fatal("服务器运行失败:", err)
 	}
 }
@@ -1,423 +1,1205 @@
 package webapi
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/csv"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	security "golang-examples/04-practical-applications/07-security"
 )
 
-func TestInMemoryUserRepository(t *testing.T) {
-	repo := NewInMemoryUserRepository()
+// forEachRepository 对每种 UserRepository 实现分别运行测试
+func forEachRepository(t *testing.T, test func(t *testing.T, repo UserRepository)) {
+	t.Run("InMemory", func(t *testing.T) {
+		test(t, NewInMemoryUserRepository())
+	})
 
-	t.Run("GetAll", func(t *testing.T) {
-		users := repo.GetAll()
-		if len(users) != 3 { // 种子数据有3个用户
-			t.Errorf("Expected 3 users, got %d", len(users))
+	t.Run("File", func(t *testing.T) {
+		repo, err := NewFileUserRepository(filepath.Join(t.TempDir(), "users.db"))
+		if err != nil {
+			t.Fatalf("NewFileUserRepository failed: %v", err)
 		}
-		t.Log("GetAll测试通过")
+		defer repo.Close()
+		test(t, repo)
+	})
+}
+
+// serveRoute 经由路由器调用单个处理器，处理器像生产环境一样从路径参数读取用户ID
+func serveRoute(pattern string, handler http.HandlerFunc, w http.ResponseWriter, req *http.Request) {
+	router := NewRouter()
+	router.HandleFunc(req.Method, pattern, handler)
+	router.ServeHTTP(w, req)
+}
+
+// allUsers 读取仓库中的全部用户，失败时终止测试
+func allUsers(t *testing.T, repo UserRepository) []User {
+	t.Helper()
+	users, err := repo.GetAll(context.Background())
+	if err != nil {
+		t.Fatalf("GetAll failed: %v", err)
+	}
+	return users
+}
+
+func TestUserRepository(t *testing.T) {
+	ctx := context.Background()
+	forEachRepository(t, func(t *testing.T, repo UserRepository) {
+
+		t.Run("GetAll", func(t *testing.T) {
+			users, err := repo.GetAll(ctx)
+			if err != nil {
+				t.Fatalf("GetAll failed: %v", err)
+			}
+			if len(users) != 3 { // 种子数据有3个用户
+				t.Errorf("Expected 3 users, got %d", len(users))
+			}
+			t.Log("GetAll测试通过")
+		})
+
+		t.Run("Create", func(t *testing.T) {
+			user := &User{
+				Name:  "测试用户",
+				Email: "test@example.com",
+				Age:   25,
+			}
+
+			err := repo.Create(ctx, user)
+			if err != nil {
+				t.Errorf("Create failed: %v", err)
+			}
+
+			if user.ID == 0 {
+				t.Error("User ID should be set after creation")
+			}
+
+			if user.CreatedAt.IsZero() {
+				t.Error("CreatedAt should be set after creation")
+			}
+
+			t.Log("Create测试通过")
+		})
+
+		t.Run("GetByID", func(t *testing.T) {
+			// 创建用户
+			user := &User{Name: "查找用户", Email: "find@example.com", Age: 30}
+			repo.Create(ctx, user)
+
+			// 查找用户
+			found, err := repo.GetByID(ctx, user.ID)
+			if err != nil {
+				t.Errorf("GetByID failed: %v", err)
+			}
+
+			if found.Name != user.Name {
+				t.Errorf("Expected name %s, got %s", user.Name, found.Name)
+			}
+
+			// 查找不存在的用户
+			_, err = repo.GetByID(ctx, 9999)
+			if err == nil {
+				t.Error("GetByID should return error for non-existent user")
+			}
+
+			t.Log("GetByID测试通过")
+		})
+
+		t.Run("Update", func(t *testing.T) {
+			// 创建用户
+			user := &User{Name: "原始用户", Email: "original@example.com", Age: 25}
+			repo.Create(ctx, user)
+			originalCreatedAt := user.CreatedAt
+
+			// 更新用户
+			time.Sleep(time.Millisecond) // 确保时间不同
+			user.Name = "更新用户"
+			user.Age = 30
+			err := repo.Update(ctx, user)
+			if err != nil {
+				t.Errorf("Update failed: %v", err)
+			}
+
+			// 验证更新
+			updated, _ := repo.GetByID(ctx, user.ID)
+			if updated.Name != "更新用户" {
+				t.Errorf("Expected updated name, got %s", updated.Name)
+			}
+
+			if updated.CreatedAt != originalCreatedAt {
+				t.Error("CreatedAt should not change during update")
+			}
+
+			if updated.UpdatedAt.Equal(originalCreatedAt) {
+				t.Error("UpdatedAt should change during update")
+			}
+
+			t.Log("Update测试通过")
+		})
+
+		t.Run("Delete", func(t *testing.T) {
+			// 创建用户
+			user := &User{Name: "删除用户", Email: "delete@example.com", Age: 25}
+			repo.Create(ctx, user)
+
+			// 删除用户
+			err := repo.Delete(ctx, user.ID)
+			if err != nil {
+				t.Errorf("Delete failed: %v", err)
+			}
+
+			// 验证删除
+			_, err = repo.GetByID(ctx, user.ID)
+			if err == nil {
+				t.Error("User should not exist after deletion")
+			}
+
+			// 删除不存在的用户
+			err = repo.Delete(ctx, 9999)
+			if err == nil {
+				t.Error("Delete should return error for non-existent user")
+			}
+
+			t.Log("Delete测试通过")
+		})
 	})
+}
 
-	t.Run("Create", func(t *testing.T) {
-		user := &User{
-			Name:  "测试用户",
-			Email: "test@example.com",
-			Age:   25,
+func TestFileUserRepository(t *testing.T) {
+	ctx := context.Background()
+	t.Run("RecoverAfterReopen", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "users.db")
+		repo, err := NewFileUserRepository(path)
+		if err != nil {
+			t.Fatalf("NewFileUserRepository failed: %v", err)
 		}
 
-		err := repo.Create(user)
+		created := &User{Name: "持久用户", Email: "persist@example.com", Age: 40}
+		repo.Create(ctx, created)
+		repo.Delete(ctx, 1)
+		updated := &User{ID: 2, Name: "改名", Email: "lisi@example.com", Age: 31}
+		repo.Update(ctx, updated)
+		repo.Close()
+
+		reopened, err := NewFileUserRepository(path)
 		if err != nil {
-			t.Errorf("Create failed: %v", err)
+			t.Fatalf("Reopen failed: %v", err)
 		}
+		defer reopened.Close()
 
-		if user.ID == 0 {
-			t.Error("User ID should be set after creation")
+		if len(allUsers(t, reopened)) != 3 { // 3个种子用户 +1 -1，重新打开时不再写入种子数据
+			t.Errorf("Expected 3 users after reopen, got %d", len(allUsers(t, reopened)))
 		}
 
-		if user.CreatedAt.IsZero() {
-			t.Error("CreatedAt should be set after creation")
+		if _, err := reopened.GetByID(ctx, 1); err == nil {
+			t.Error("Deleted user should stay deleted")
 		}
 
-		t.Log("Create测试通过")
+		user, err := reopened.GetByID(ctx, 2)
+		if err != nil || user.Name != "改名" {
+			t.Errorf("Update should be recovered, got %+v %v", user, err)
+		}
+
+		next := &User{Name: "新用户", Email: "next@example.com", Age: 20}
+		reopened.Create(ctx, next)
+		if next.ID != created.ID+1 {
+			t.Errorf("IDs should not be reused, expected %d got %d", created.ID+1, next.ID)
+		}
+
+		t.Log("RecoverAfterReopen测试通过")
 	})
 
-	t.Run("GetByID", func(t *testing.T) {
-		// 创建用户
-		user := &User{Name: "查找用户", Email: "find@example.com", Age: 30}
-		repo.Create(user)
+	t.Run("TruncateTornTail", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "users.db")
+		repo, _ := NewFileUserRepository(path)
+		repo.Close()
 
-		// 查找用户
-		found, err := repo.GetByID(user.ID)
+		// 模拟写入一半时崩溃
+		file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+		file.WriteString(`{"op":"put","user":{"id":99,"na`)
+		file.Close()
+
+		reopened, err := NewFileUserRepository(path)
 		if err != nil {
-			t.Errorf("GetByID failed: %v", err)
+			t.Fatalf("Reopen with torn tail failed: %v", err)
 		}
 
-		if found.Name != user.Name {
-			t.Errorf("Expected name %s, got %s", user.Name, found.Name)
+		if len(allUsers(t, reopened)) != 3 {
+			t.Errorf("Expected 3 users, got %d", len(allUsers(t, reopened)))
 		}
 
-		// 查找不存在的用户
-		_, err = repo.GetByID(9999)
-		if err == nil {
-			t.Error("GetByID should return error for non-existent user")
+		// 残缺记录被截掉后追加的数据可以正常恢复
+		reopened.Create(ctx, &User{Name: "恢复后", Email: "after@example.com", Age: 22})
+		reopened.Close()
+
+		again, err := NewFileUserRepository(path)
+		if err != nil {
+			t.Fatalf("Second reopen failed: %v", err)
 		}
+		defer again.Close()
 
-		t.Log("GetByID测试通过")
+		if len(allUsers(t, again)) != 4 {
+			t.Errorf("Expected 4 users, got %d", len(allUsers(t, again)))
+		}
+
+		t.Log("TruncateTornTail测试通过")
 	})
 
-	t.Run("Update", func(t *testing.T) {
-		// 创建用户
-		user := &User{Name: "原始用户", Email: "original@example.com", Age: 25}
-		repo.Create(user)
-		originalCreatedAt := user.CreatedAt
+	t.Run("CorruptedMiddleRecord", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "users.db")
+		os.WriteFile(path, []byte("not json\n{\"op\":\"delete\",\"id\":1}\n"), 0o644)
 
-		// 更新用户
-		time.Sleep(time.Millisecond) // 确保时间不同
-		user.Name = "更新用户"
-		user.Age = 30
-		err := repo.Update(user)
-		if err != nil {
-			t.Errorf("Update failed: %v", err)
+		if _, err := NewFileUserRepository(path); err == nil {
+			t.Error("Corrupted record before the tail should be reported")
 		}
 
-		// 验证更新
-		updated, _ := repo.GetByID(user.ID)
-		if updated.Name != "更新用户" {
-			t.Errorf("Expected updated name, got %s", updated.Name)
+		t.Log("CorruptedMiddleRecord测试通过")
+	})
+
+	t.Run("Compaction", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "users.db")
+		repo, _ := NewFileUserRepository(path)
+
+		user := &User{Name: "频繁更新", Email: "busy@example.com", Age: 1}
+		repo.Create(ctx, user)
+		for i := 0; i < 3*minCompactRecords; i++ {
+			user.Age = i % 150
+			if err := repo.Update(ctx, user); err != nil {
+				t.Fatalf("Update failed: %v", err)
+			}
 		}
+		repo.Close()
 
-		if updated.CreatedAt != originalCreatedAt {
-			t.Error("CreatedAt should not change during update")
+		data, _ := os.ReadFile(path)
+		if lines := bytes.Count(data, []byte("\n")); lines > 2*minCompactRecords {
+			t.Errorf("Log should be compacted, got %d lines", lines)
 		}
 
-		if updated.UpdatedAt.Equal(originalCreatedAt) {
-			t.Error("UpdatedAt should change during update")
+		reopened, _ := NewFileUserRepository(path)
+		defer reopened.Close()
+
+		found, err := reopened.GetByID(ctx, user.ID)
+		if err != nil || found.Age != user.Age {
+			t.Errorf("Expected age %d after compaction, got %+v %v", user.Age, found, err)
 		}
 
-		t.Log("Update测试通过")
+		t.Log("Compaction测试通过")
 	})
 
-	t.Run("Delete", func(t *testing.T) {
-		// 创建用户
-		user := &User{Name: "删除用户", Email: "delete@example.com", Age: 25}
-		repo.Create(user)
+	t.Run("NewServerFromConfig", func(t *testing.T) {
+		config := DefaultServerConfig()
+		config.Storage = StorageConfig{Driver: StorageFile, Path: filepath.Join(t.TempDir(), "users.db")}
 
-		// 删除用户
-		err := repo.Delete(user.ID)
+		server, err := NewServerFromConfig("0", config)
 		if err != nil {
-			t.Errorf("Delete failed: %v", err)
+			t.Fatalf("NewServerFromConfig failed: %v", err)
 		}
 
-		// 验证删除
-		_, err = repo.GetByID(user.ID)
-		if err == nil {
-			t.Error("User should not exist after deletion")
+		instrumented, ok := server.handler.service.repo.(*instrumentedRepository)
+		if !ok {
+			t.Fatalf("Expected instrumented repository, got %T", server.handler.service.repo)
 		}
 
-		// 删除不存在的用户
-		err = repo.Delete(9999)
-		if err == nil {
-			t.Error("Delete should return error for non-existent user")
+		if _, ok := instrumented.UserRepository.(*FileUserRepository); !ok {
+			t.Errorf("Expected file repository, got %T", instrumented.UserRepository)
 		}
 
-		t.Log("Delete测试通过")
+		if err := server.Shutdown(context.Background()); err != nil {
+			t.Errorf("Shutdown should close the repository: %v", err)
+		}
+
+		if _, err := NewServerFromConfig("0", ServerConfig{Storage: StorageConfig{Driver: "redis"}}); err == nil {
+			t.Error("Unknown storage driver should be rejected")
+		}
+
+		t.Log("NewServerFromConfig测试通过")
 	})
 }
 
 func TestUserService(t *testing.T) {
-	repo := NewInMemoryUserRepository()
-	service := NewUserService(repo)
+	ctx := context.Background()
+	forEachRepository(t, func(t *testing.T, repo UserRepository) {
+		service := NewUserService(repo)
+
+		t.Run("ValidateUser", func(t *testing.T) {
+			// 有效用户
+			validUser := &User{
+				Name:  "有效用户",
+				Email: "valid@example.com",
+				Age:   25,
+			}
+
+			err := service.CreateUser(ctx, validUser)
+			if err != nil {
+				t.Errorf("Valid user should be created: %v", err)
+			}
+
+			// 无效用户 - 空名称
+			invalidUser1 := &User{
+				Name:  "",
+				Email: "test@example.com",
+				Age:   25,
+			}
+
+			err = service.CreateUser(ctx, invalidUser1)
+			if err == nil {
+				t.Error("Should return error for empty name")
+			}
+
+			// 无效用户 - 空邮箱
+			invalidUser2 := &User{
+				Name:  "测试",
+				Email: "",
+				Age:   25,
+			}
+
+			err = service.CreateUser(ctx, invalidUser2)
+			if err == nil {
+				t.Error("Should return error for empty email")
+			}
+
+			// 无效用户 - 无效年龄
+			invalidUser3 := &User{
+				Name:  "测试",
+				Email: "test@example.com",
+				Age:   -1,
+			}
+
+			err = service.CreateUser(ctx, invalidUser3)
+			if err == nil {
+				t.Error("Should return error for invalid age")
+			}
+
+			// 无效用户 - 无效邮箱格式
+			invalidUser4 := &User{
+				Name:  "测试",
+				Email: "invalid-email",
+				Age:   25,
+			}
+
+			err = service.CreateUser(ctx, invalidUser4)
+			if err == nil {
+				t.Error("Should return error for invalid email format")
+			}
+
+			t.Log("ValidateUser测试通过")
+		})
+	})
+}
 
-	t.Run("ValidateUser", func(t *testing.T) {
-		// 有效用户
-		validUser := &User{
-			Name:  "有效用户",
-			Email: "valid@example.com",
-			Age:   25,
+func TestValidation(t *testing.T) {
+	t.Run("UserTags", func(t *testing.T) {
+		fieldsOf := func(err error) []string {
+			var verr *ValidationError
+			if !errors.As(err, &verr) {
+				return nil
+			}
+			var fields []string
+			for _, fieldErr := range verr.Fields {
+				fields = append(fields, fieldErr.Field)
+			}
+			return fields
 		}
 
-		err := service.CreateUser(validUser)
-		if err != nil {
-			t.Errorf("Valid user should be created: %v", err)
+		cases := []struct {
+			name   string
+			user   User
+			fields []string
+		}{
+			{"Valid", User{Name: "张三", Email: "zhangsan@example.com", Age: 25}, nil},
+			{"BlankName", User{Name: "   ", Email: "zhangsan@example.com"}, []string{"name"}},
+			{"MissingEmail", User{Name: "张三"}, []string{"email"}},
+			{"ShortDomain", User{Name: "张三", Email: "a@b"}, []string{"email"}},
+			{"LongName", User{Name: strings.Repeat("名", 101), Email: "long@example.com"}, []string{"name"}},
+			{"AgeRange", User{Name: "张三", Email: "zhangsan@example.com", Age: 151}, []string{"age"}},
+			{"AllErrors", User{Age: -1}, []string{"name", "email", "age"}},
 		}
-
-		// 无效用户 - 空名称
-		invalidUser1 := &User{
-			Name:  "",
-			Email: "test@example.com",
-			Age:   25,
+		for _, tc := range cases {
+			if fields := fieldsOf(ValidateStruct(&tc.user)); !reflect.DeepEqual(fields, tc.fields) {
+				t.Errorf("%s: expected invalid fields %v, got %v", tc.name, tc.fields, fields)
+			}
 		}
 
-		err = service.CreateUser(invalidUser1)
-		if err == nil {
-			t.Error("Should return error for empty name")
+		// 100 个汉字按字符数计算，不超过上限
+		if err := ValidateStruct(User{Name: strings.Repeat("名", 100), Email: "long@example.com"}); err != nil {
+			t.Errorf("Length should count runes, got %v", err)
 		}
 
-		// 无效用户 - 空邮箱
-		invalidUser2 := &User{
-			Name:  "测试",
-			Email: "",
-			Age:   25,
-		}
+		t.Log("UserTags测试通过")
+	})
 
-		err = service.CreateUser(invalidUser2)
-		if err == nil {
-			t.Error("Should return error for empty email")
+	t.Run("NestedAndReadonly", func(t *testing.T) {
+		type item struct {
+			Name string `json:"name" validate:"required"`
+			Kind string `json:"kind" validate:"oneof=a b"`
 		}
-
-		// 无效用户 - 无效年龄
-		invalidUser3 := &User{
-			Name:  "测试",
-			Email: "test@example.com",
-			Age:   -1,
+		type order struct {
+			ID    int    `json:"id" validate:"readonly,min=1"`
+			Items []item `json:"items"`
 		}
 
-		err = service.CreateUser(invalidUser3)
-		if err == nil {
-			t.Error("Should return error for invalid age")
+		err := ValidateStruct(order{Items: []item{{Name: "ok", Kind: "a"}, {Kind: "c"}}})
+		var verr *ValidationError
+		if !errors.As(err, &verr) || len(verr.Fields) != 2 {
+			t.Fatalf("Expected 2 field errors, got %v", err)
+		}
+		if verr.Fields[0].Field != "items.1.name" || verr.Fields[1].Field != "items.1.kind" {
+			t.Errorf("Nested errors should use dotted JSON paths, got %+v", verr.Fields)
 		}
 
-		// 无效用户 - 无效邮箱格式
-		invalidUser4 := &User{
-			Name:  "测试",
-			Email: "invalid-email",
-			Age:   25,
+		t.Log("NestedAndReadonly测试通过")
+	})
+}
+
+func TestEmailUniqueness(t *testing.T) {
+	ctx := context.Background()
+
+	forEachRepository(t, func(t *testing.T, repo UserRepository) {
+		t.Run("Repository", func(t *testing.T) {
+			if err := repo.Create(ctx, &User{Name: "重复", Email: "ZhangSan@Example.com "}); !errors.Is(err, ErrDuplicateEmail) {
+				t.Errorf("Email comparison should ignore case and spaces, got %v", err)
+			}
+
+			lisi, _ := repo.GetByID(ctx, 2)
+			lisi.Email = "ZHANGSAN@example.com"
+			if err := repo.Update(ctx, lisi); !errors.Is(err, ErrDuplicateEmail) {
+				t.Errorf("Update should not take another user's email, got %v", err)
+			}
+
+			zhangsan, _ := repo.GetByID(ctx, 1)
+			zhangsan.Email = "ZhangSan@example.com"
+			if err := repo.Update(ctx, zhangsan); err != nil {
+				t.Errorf("User should keep its own email in a different case, got %v", err)
+			}
+
+			// 已删除用户释放邮箱，恢复时邮箱已被占用则失败
+			if err := repo.Delete(ctx, 1); err != nil {
+				t.Fatalf("Delete failed: %v", err)
+			}
+			if err := repo.Create(ctx, &User{Name: "新张三", Email: "zhangsan@example.com"}); err != nil {
+				t.Errorf("Deleted user's email should be reusable, got %v", err)
+			}
+			if _, err := repo.Restore(ctx, 1); !errors.Is(err, ErrDuplicateEmail) {
+				t.Errorf("Restore should fail when the email was taken, got %v", err)
+			}
+
+			t.Log("Repository测试通过")
+		})
+	})
+
+	t.Run("FileReopen", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "users.db")
+		repo, _ := NewFileUserRepository(path)
+		repo.Create(ctx, &User{Name: "持久化", Email: "persist@example.com"})
+		repo.Close()
+
+		reopened, err := NewFileUserRepository(path)
+		if err != nil {
+			t.Fatalf("Reopen failed: %v", err)
+		}
+		defer reopened.Close()
+		if err := reopened.Create(ctx, &User{Name: "重复", Email: "PERSIST@example.com"}); !errors.Is(err, ErrDuplicateEmail) {
+			t.Errorf("Email index should be rebuilt on reopen, got %v", err)
 		}
 
-		err = service.CreateUser(invalidUser4)
-		if err == nil {
-			t.Error("Should return error for invalid email format")
+		t.Log("FileReopen测试通过")
+	})
+
+	t.Run("HTTP", func(t *testing.T) {
+		routes := NewServer(NewUserHandler(NewUserService(NewInMemoryUserRepository())), "0").Routes()
+
+		req := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(`{"name":"重复","email":"LISI@example.com"}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		routes.ServeHTTP(w, req)
+
+		var problem Problem
+		json.NewDecoder(w.Body).Decode(&problem)
+		if w.Code != http.StatusConflict || problem.Code != CodeDuplicateEmail {
+			t.Errorf("Expected 409 duplicate_email, got %d %+v", w.Code, problem)
 		}
 
-		t.Log("ValidateUser测试通过")
+		t.Log("HTTP测试通过")
 	})
 }
 
 func TestUserHandler(t *testing.T) {
-	repo := NewInMemoryUserRepository()
-	service := NewUserService(repo)
-	handler := NewUserHandler(service)
+	forEachRepository(t, func(t *testing.T, repo UserRepository) {
+		service := NewUserService(repo)
+		handler := NewUserHandler(service)
 
-	t.Run("GetUsers", func(t *testing.T) {
-		req := httptest.NewRequest(http.MethodGet, "/users", nil)
-		w := httptest.NewRecorder()
+		t.Run("GetUsers", func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/users", nil)
+			w := httptest.NewRecorder()
 
-		handler.GetUsers(w, req)
+			handler.GetUsers(w, req)
 
-		if w.Code != http.StatusOK {
-			t.Errorf("Expected status 200, got %d", w.Code)
-		}
+			if w.Code != http.StatusOK {
+				t.Errorf("Expected status 200, got %d", w.Code)
+			}
 
-		var users []User
-		err := json.NewDecoder(w.Body).Decode(&users)
-		if err != nil {
-			t.Errorf("Failed to decode response: %v", err)
-		}
+			var users []User
+			err := json.NewDecoder(w.Body).Decode(&users)
+			if err != nil {
+				t.Errorf("Failed to decode response: %v", err)
+			}
 
-		if len(users) != 3 { // 种子数据
-			t.Errorf("Expected 3 users, got %d", len(users))
-		}
+			if len(users) != 3 { // 种子数据
+				t.Errorf("Expected 3 users, got %d", len(users))
+			}
 
-		t.Log("GetUsers测试通过")
-	})
+			t.Log("GetUsers测试通过")
+		})
 
-	t.Run("GetUser", func(t *testing.T) {
-		req := httptest.NewRequest(http.MethodGet, "/users/1", nil)
-		w := httptest.NewRecorder()
+		t.Run("GetUser", func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/users/1", nil)
+			w := httptest.NewRecorder()
 
-		handler.GetUser(w, req)
+			serveRoute("/users/{id}", handler.GetUser, w, req)
 
-		if w.Code != http.StatusOK {
-			t.Errorf("Expected status 200, got %d", w.Code)
-		}
+			if w.Code != http.StatusOK {
+				t.Errorf("Expected status 200, got %d", w.Code)
+			}
 
-		var user User
-		err := json.NewDecoder(w.Body).Decode(&user)
-		if err != nil {
-			t.Errorf("Failed to decode response: %v", err)
-		}
+			var user User
+			err := json.NewDecoder(w.Body).Decode(&user)
+			if err != nil {
+				t.Errorf("Failed to decode response: %v", err)
+			}
 
-		if user.ID != 1 {
-			t.Errorf("Expected user ID 1, got %d", user.ID)
-		}
+			if user.ID != 1 {
+				t.Errorf("Expected user ID 1, got %d", user.ID)
+			}
 
-		t.Log("GetUser测试通过")
-	})
+			t.Log("GetUser测试通过")
+		})
 
-	t.Run("GetUserNotFound", func(t *testing.T) {
-		req := httptest.NewRequest(http.MethodGet, "/users/9999", nil)
-		w := httptest.NewRecorder()
+		t.Run("GetUserNotFound", func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/users/9999", nil)
+			w := httptest.NewRecorder()
 
-		handler.GetUser(w, req)
+			serveRoute("/users/{id}", handler.GetUser, w, req)
 
-		if w.Code != http.StatusNotFound {
-			t.Errorf("Expected status 404, got %d", w.Code)
-		}
+			if w.Code != http.StatusNotFound {
+				t.Errorf("Expected status 404, got %d", w.Code)
+			}
+
+			t.Log("GetUserNotFound测试通过")
+		})
+
+		t.Run("CreateUser", func(t *testing.T) {
+			user := User{
+				Name:  "新用户",
+				Email: "new@example.com",
+				Age:   25,
+			}
+
+			jsonData, _ := json.Marshal(user)
+			req := httptest.NewRequest(http.MethodPost, "/users", bytes.NewBuffer(jsonData))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+
+			handler.CreateUser(w, req)
+
+			if w.Code != http.StatusCreated {
+				t.Errorf("Expected status 201, got %d", w.Code)
+			}
+
+			var createdUser User
+			err := json.NewDecoder(w.Body).Decode(&createdUser)
+			if err != nil {
+				t.Errorf("Failed to decode response: %v", err)
+			}
+
+			if createdUser.ID == 0 {
+				t.Error("Created user should have an ID")
+			}
+
+			if createdUser.Name != user.Name {
+				t.Errorf("Expected name %s, got %s", user.Name, createdUser.Name)
+			}
+
+			t.Log("CreateUser测试通过")
+		})
+
+		t.Run("CreateUserInvalidData", func(t *testing.T) {
+			user := User{
+				Name:  "", // 无效：空名称
+				Email: "test@example.com",
+				Age:   25,
+			}
+
+			jsonData, _ := json.Marshal(user)
+			req := httptest.NewRequest(http.MethodPost, "/users", bytes.NewBuffer(jsonData))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+
+			handler.CreateUser(w, req)
+
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("Expected status 400, got %d", w.Code)
+			}
 
-		t.Log("GetUserNotFound测试通过")
+			t.Log("CreateUserInvalidData测试通过")
+		})
+
+		t.Run("UpdateUser", func(t *testing.T) {
+			// 首先创建一个用户
+			user := User{
+				Name:  "更新前",
+				Email: "before@example.com",
+				Age:   25,
+			}
+
+			jsonData, _ := json.Marshal(user)
+			req := httptest.NewRequest(http.MethodPost, "/users", bytes.NewBuffer(jsonData))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			handler.CreateUser(w, req)
+
+			var createdUser User
+			json.NewDecoder(w.Body).Decode(&createdUser)
+
+			// 更新用户
+			updatedUser := User{
+				Name:  "更新后",
+				Email: "after@example.com",
+				Age:   30,
+			}
+
+			jsonData, _ = json.Marshal(updatedUser)
+			req = httptest.NewRequest(http.MethodPut, "/users/"+fmt.Sprintf("%d", createdUser.ID), bytes.NewBuffer(jsonData))
+			req.Header.Set("Content-Type", "application/json")
+			w = httptest.NewRecorder()
+
+			serveRoute("/users/{id}", handler.UpdateUser, w, req)
+
+			if w.Code != http.StatusOK {
+				t.Errorf("Expected status 200, got %d", w.Code)
+			}
+
+			var result User
+			err := json.NewDecoder(w.Body).Decode(&result)
+			if err != nil {
+				t.Errorf("Failed to decode response: %v", err)
+			}
+
+			if result.Name != "更新后" {
+				t.Errorf("Expected updated name, got %s", result.Name)
+			}
+
+			t.Log("UpdateUser测试通过")
+		})
+
+		t.Run("DeleteUser", func(t *testing.T) {
+			// 首先创建一个用户
+			user := User{
+				Name:  "待删除",
+				Email: "delete@example.com",
+				Age:   25,
+			}
+
+			jsonData, _ := json.Marshal(user)
+			req := httptest.NewRequest(http.MethodPost, "/users", bytes.NewBuffer(jsonData))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			handler.CreateUser(w, req)
+
+			var createdUser User
+			json.NewDecoder(w.Body).Decode(&createdUser)
+
+			// 删除用户
+			req = httptest.NewRequest(http.MethodDelete, "/users/"+fmt.Sprintf("%d", createdUser.ID), nil)
+			w = httptest.NewRecorder()
+
+			serveRoute("/users/{id}", handler.DeleteUser, w, req)
+
+			if w.Code != http.StatusNoContent {
+				t.Errorf("Expected status 204, got %d", w.Code)
+			}
+
+			// 验证用户已删除
+			req = httptest.NewRequest(http.MethodGet, "/users/"+fmt.Sprintf("%d", createdUser.ID), nil)
+			w = httptest.NewRecorder()
+			serveRoute("/users/{id}", handler.GetUser, w, req)
+
+			if w.Code != http.StatusNotFound {
+				t.Errorf("Expected status 404 after deletion, got %d", w.Code)
+			}
+
+			t.Log("DeleteUser测试通过")
+		})
+
+		t.Run("MethodNotAllowed", func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPatch, "/users", nil)
+			w := httptest.NewRecorder()
+
+			router := NewRouter()
+			router.HandleFunc(http.MethodGet, "/users", handler.GetUsers)
+			router.ServeHTTP(w, req)
+
+			if w.Code != http.StatusMethodNotAllowed {
+				t.Errorf("Expected status 405, got %d", w.Code)
+			}
+
+			t.Log("MethodNotAllowed测试通过")
+		})
 	})
+}
+
+func TestErrorResponses(t *testing.T) {
+	ctx := context.Background()
+	repo := NewInMemoryUserRepository()
+	service := NewUserService(repo)
+	handler := NewUserHandler(service)
 
-	t.Run("CreateUser", func(t *testing.T) {
-		user := User{
-			Name:  "新用户",
-			Email: "new@example.com",
-			Age:   25,
+	decodeProblem := func(t *testing.T, w *httptest.ResponseRecorder) Problem {
+		t.Helper()
+		if ct := w.Header().Get("Content-Type"); ct != "application/problem+json" {
+			t.Errorf("Expected problem+json content type, got %s", ct)
 		}
 
-		jsonData, _ := json.Marshal(user)
-		req := httptest.NewRequest(http.MethodPost, "/users", bytes.NewBuffer(jsonData))
-		req.Header.Set("Content-Type", "application/json")
+		var problem Problem
+		if err := json.NewDecoder(w.Body).Decode(&problem); err != nil {
+			t.Fatalf("Failed to decode problem: %v", err)
+		}
+
+		if problem.Status != w.Code {
+			t.Errorf("Problem status %d should match response status %d", problem.Status, w.Code)
+		}
+		return problem
+	}
+
+	t.Run("ValidationDetails", func(t *testing.T) {
+		body := `{"name":"","email":"bad","age":200}`
+		req := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(body))
 		w := httptest.NewRecorder()
 
 		handler.CreateUser(w, req)
 
-		if w.Code != http.StatusCreated {
-			t.Errorf("Expected status 201, got %d", w.Code)
+		problem := decodeProblem(t, w)
+		if w.Code != http.StatusBadRequest || problem.Code != CodeValidationFailed {
+			t.Fatalf("Expected 400 validation_failed, got %d %s", w.Code, problem.Code)
 		}
 
-		var createdUser User
-		err := json.NewDecoder(w.Body).Decode(&createdUser)
-		if err != nil {
-			t.Errorf("Failed to decode response: %v", err)
+		fields := map[string]bool{}
+		for _, fieldErr := range problem.Errors {
+			fields[fieldErr.Field] = true
+		}
+		for _, field := range []string{"name", "email", "age"} {
+			if !fields[field] {
+				t.Errorf("Expected field error for %s, got %+v", field, problem.Errors)
+			}
 		}
 
-		if createdUser.ID == 0 {
-			t.Error("Created user should have an ID")
+		t.Log("ValidationDetails测试通过")
+	})
+
+	t.Run("ErrorCodes", func(t *testing.T) {
+		cases := []struct {
+			name   string
+			route  string // 处理器注册的方法
+			method string
+			path   string
+			body   string
+			serve  http.HandlerFunc
+			status int
+			code   string
+		}{
+			{"NotFound", http.MethodGet, http.MethodGet, "/users/9999", "", handler.GetUser, http.StatusNotFound, CodeUserNotFound},
+			{"UpdateNotFound", http.MethodPut, http.MethodPut, "/users/9999", `{"name":"a","email":"a@b.cn","age":1}`, handler.UpdateUser, http.StatusNotFound, CodeUserNotFound},
+			{"InvalidID", http.MethodGet, http.MethodGet, "/users/abc", "", handler.GetUser, http.StatusBadRequest, CodeInvalidID},
+			{"InvalidJSON", http.MethodPost, http.MethodPost, "/users", "{", handler.CreateUser, http.StatusBadRequest, CodeInvalidJSON},
+			{"InvalidQuery", http.MethodGet, http.MethodGet, "/users?page=0", "", handler.GetUsers, http.StatusBadRequest, CodeValidationFailed},
+			{"MethodNotAllowed", http.MethodGet, http.MethodPatch, "/users", "", handler.GetUsers, http.StatusMethodNotAllowed, CodeMethodNotAllowed},
 		}
 
-		if createdUser.Name != user.Name {
-			t.Errorf("Expected name %s, got %s", user.Name, createdUser.Name)
+		for _, tc := range cases {
+			req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+			w := httptest.NewRecorder()
+			router := NewRouter()
+			router.HandleFunc(tc.route, "/users", tc.serve)
+			router.HandleFunc(tc.route, "/users/{id}", tc.serve)
+			router.ServeHTTP(w, req)
+
+			problem := decodeProblem(t, w)
+			if w.Code != tc.status || problem.Code != tc.code {
+				t.Errorf("%s: expected %d %s, got %d %s", tc.name, tc.status, tc.code, w.Code, problem.Code)
+			}
+
+			if problem.Instance != req.URL.Path || problem.Type == "" {
+				t.Errorf("%s: problem should carry type and instance, got %+v", tc.name, problem)
+			}
 		}
 
-		t.Log("CreateUser测试通过")
+		t.Log("ErrorCodes测试通过")
 	})
 
-	t.Run("CreateUserInvalidData", func(t *testing.T) {
-		user := User{
-			Name:  "", // 无效：空名称
-			Email: "test@example.com",
-			Age:   25,
+	t.Run("TypedRepositoryErrors", func(t *testing.T) {
+		_, err := repo.GetByID(ctx, 9999)
+		if !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("Expected ErrUserNotFound, got %v", err)
 		}
 
-		jsonData, _ := json.Marshal(user)
-		req := httptest.NewRequest(http.MethodPost, "/users", bytes.NewBuffer(jsonData))
-		req.Header.Set("Content-Type", "application/json")
-		w := httptest.NewRecorder()
+		err = service.CreateUser(ctx, &User{Name: "a", Email: "invalid", Age: 1})
+		var validationErr *ValidationError
+		if !errors.As(err, &validationErr) || validationErr.Fields[0].Field != "email" {
+			t.Errorf("Expected email ValidationError, got %v", err)
+		}
 
-		handler.CreateUser(w, req)
+		t.Log("TypedRepositoryErrors测试通过")
+	})
 
-		if w.Code != http.StatusBadRequest {
-			t.Errorf("Expected status 400, got %d", w.Code)
+	t.Run("InternalErrorHidden", func(t *testing.T) {
+		problem := problemFromError(context.Background(), fmt.Errorf("磁盘已满: /var/data"))
+		if problem.Status != http.StatusInternalServerError || strings.Contains(problem.Detail, "/var/data") {
+			t.Errorf("Internal error details should not leak, got %+v", problem)
 		}
 
-		t.Log("CreateUserInvalidData测试通过")
+		t.Log("InternalErrorHidden测试通过")
 	})
+}
 
-	t.Run("UpdateUser", func(t *testing.T) {
-		// 首先创建一个用户
-		user := User{
-			Name:  "更新前",
-			Email: "before@example.com",
-			Age:   25,
+func TestOptimisticConcurrency(t *testing.T) {
+	ctx := context.Background()
+	forEachRepository(t, func(t *testing.T, repo UserRepository) {
+		handler := NewUserHandler(NewUserService(repo))
+
+		do := func(method, path, body string, headers map[string]string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(method, path, strings.NewReader(body))
+			for key, value := range headers {
+				req.Header.Set(key, value)
+			}
+			w := httptest.NewRecorder()
+			switch method {
+			case http.MethodGet:
+				serveRoute("/users/{id}", handler.GetUser, w, req)
+			case http.MethodPut:
+				serveRoute("/users/{id}", handler.UpdateUser, w, req)
+			case http.MethodDelete:
+				serveRoute("/users/{id}", handler.DeleteUser, w, req)
+			}
+			return w
 		}
 
-		jsonData, _ := json.Marshal(user)
-		req := httptest.NewRequest(http.MethodPost, "/users", bytes.NewBuffer(jsonData))
-		req.Header.Set("Content-Type", "application/json")
-		w := httptest.NewRecorder()
-		handler.CreateUser(w, req)
+		t.Run("ETagAndNotModified", func(t *testing.T) {
+			w := do(http.MethodGet, "/users/1", "", nil)
+			etag := w.Header().Get("ETag")
+			if etag != `"v1"` {
+				t.Fatalf("Expected ETag \"v1\", got %s", etag)
+			}
 
-		var createdUser User
-		json.NewDecoder(w.Body).Decode(&createdUser)
+			w = do(http.MethodGet, "/users/1", "", map[string]string{"If-None-Match": etag})
+			if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+				t.Errorf("Expected empty 304, got %d", w.Code)
+			}
 
-		// 更新用户
-		updatedUser := User{
-			Name:  "更新后",
-			Email: "after@example.com",
-			Age:   30,
-		}
+			w = do(http.MethodGet, "/users/1", "", map[string]string{"If-None-Match": `"v0"`})
+			if w.Code != http.StatusOK {
+				t.Errorf("Expected status 200 for stale If-None-Match, got %d", w.Code)
+			}
 
-		jsonData, _ = json.Marshal(updatedUser)
-		req = httptest.NewRequest(http.MethodPut, "/users/"+fmt.Sprintf("%d", createdUser.ID), bytes.NewBuffer(jsonData))
-		req.Header.Set("Content-Type", "application/json")
-		w = httptest.NewRecorder()
+			t.Log("ETagAndNotModified测试通过")
+		})
 
-		handler.UpdateUser(w, req)
+		t.Run("IfMatchOnUpdate", func(t *testing.T) {
+			body := `{"name":"张三丰","email":"zhangsan@example.com","age":26}`
+			w := do(http.MethodPut, "/users/1", body, map[string]string{"If-Match": `"v1"`})
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d", w.Code)
+			}
+
+			if w.Header().Get("ETag") != `"v2"` {
+				t.Errorf("Expected new ETag \"v2\", got %s", w.Header().Get("ETag"))
+			}
+
+			// 另一个管理员仍持有旧版本
+			w = do(http.MethodPut, "/users/1", body, map[string]string{"If-Match": `"v1"`})
+			if w.Code != http.StatusPreconditionFailed {
+				t.Errorf("Expected status 412 for stale If-Match, got %d", w.Code)
+			}
+
+			w = do(http.MethodPut, "/users/1", body, map[string]string{"If-Match": "*"})
+			if w.Code != http.StatusOK {
+				t.Errorf("Expected If-Match * to succeed, got %d", w.Code)
+			}
+
+			t.Log("IfMatchOnUpdate测试通过")
+		})
 
-		if w.Code != http.StatusOK {
-			t.Errorf("Expected status 200, got %d", w.Code)
+		t.Run("IfMatchOnDelete", func(t *testing.T) {
+			w := do(http.MethodDelete, "/users/2", "", map[string]string{"If-Match": `"v9"`})
+			if w.Code != http.StatusPreconditionFailed {
+				t.Errorf("Expected status 412, got %d", w.Code)
+			}
+
+			w = do(http.MethodDelete, "/users/2", "", map[string]string{"If-Match": `"v0", "v1"`})
+			if w.Code != http.StatusNoContent {
+				t.Errorf("Expected status 204, got %d", w.Code)
+			}
+
+			t.Log("IfMatchOnDelete测试通过")
+		})
+
+		t.Run("AtomicVersionCheck", func(t *testing.T) {
+			user := &User{Name: "并发用户", Email: "race@example.com", Age: 20}
+			repo.Create(ctx, user)
+
+			const writers = 10
+			results := make(chan error, writers)
+			for i := 0; i < writers; i++ {
+				go func(age int) {
+					update := *user
+					update.Age = age
+					results <- repo.Update(ctx, &update)
+				}(i)
+			}
+
+			succeeded := 0
+			for i := 0; i < writers; i++ {
+				err := <-results
+				if err == nil {
+					succeeded++
+				} else if !errors.Is(err, ErrVersionConflict) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			}
+
+			if succeeded != 1 {
+				t.Errorf("Exactly one writer should win, got %d", succeeded)
+			}
+
+			if err := repo.DeleteIfVersion(ctx, user.ID, 1); !errors.Is(err, ErrVersionConflict) {
+				t.Errorf("Stale delete should conflict, got %v", err)
+			}
+
+			t.Log("AtomicVersionCheck测试通过")
+		})
+	})
+}
+
+func TestPatch(t *testing.T) {
+	ctx := context.Background()
+	decode := func(raw string) interface{} {
+		var value interface{}
+		json.Unmarshal([]byte(raw), &value)
+		return value
+	}
+
+	t.Run("MergePatch", func(t *testing.T) {
+		// RFC 7396 示例
+		target := decode(`{"title":"Goodbye!","author":{"givenName":"John","familyName":"Doe"},"tags":["example","sample"],"content":"This will be unchanged"}`)
+		patch := decode(`{"title":"Hello!","phoneNumber":"+01-123-456-7890","author":{"familyName":null},"tags":["example"]}`)
+		expected := decode(`{"title":"Hello!","author":{"givenName":"John"},"tags":["example"],"content":"This will be unchanged","phoneNumber":"+01-123-456-7890"}`)
+
+		if result := MergePatch(target, patch); !reflect.DeepEqual(result, expected) {
+			t.Errorf("Unexpected merge result: %v", result)
 		}
 
-		var result User
-		err := json.NewDecoder(w.Body).Decode(&result)
+		t.Log("MergePatch测试通过")
+	})
+
+	t.Run("JSONPatch", func(t *testing.T) {
+		doc := decode(`{"a":{"b":["x","y"]},"c":1,"d~/e":2}`)
+		var ops []PatchOperation
+		json.Unmarshal([]byte(`[
+			{"op":"test","path":"/c","value":1},
+			{"op":"add","path":"/a/b/1","value":"inserted"},
+			{"op":"add","path":"/a/b/-","value":"end"},
+			{"op":"remove","path":"/a/b/0"},
+			{"op":"replace","path":"/c","value":3},
+			{"op":"move","from":"/d~0~1e","path":"/moved"},
+			{"op":"copy","from":"/a","path":"/copied"}
+		]`), &ops)
+
+		result, err := ApplyJSONPatch(doc, ops)
 		if err != nil {
-			t.Errorf("Failed to decode response: %v", err)
+			t.Fatalf("ApplyJSONPatch failed: %v", err)
 		}
 
-		if result.Name != "更新后" {
-			t.Errorf("Expected updated name, got %s", result.Name)
+		expected := decode(`{"a":{"b":["inserted","y","end"]},"c":3,"moved":2,"copied":{"b":["inserted","y","end"]}}`)
+		if !reflect.DeepEqual(result, expected) {
+			t.Errorf("Unexpected patch result: %v", result)
 		}
 
-		t.Log("UpdateUser测试通过")
+		t.Log("JSONPatch测试通过")
 	})
 
-	t.Run("DeleteUser", func(t *testing.T) {
-		// 首先创建一个用户
-		user := User{
-			Name:  "待删除",
-			Email: "delete@example.com",
-			Age:   25,
+	t.Run("JSONPatchErrors", func(t *testing.T) {
+		cases := map[string]error{
+			`[{"op":"test","path":"/c","value":2}]`:    ErrPatchConflict,
+			`[{"op":"remove","path":"/missing"}]`:      ErrPatchConflict,
+			`[{"op":"add","path":"/a/b/5","value":1}]`: ErrPatchConflict,
+			`[{"op":"unknown","path":"/c"}]`:           ErrInvalidPatch,
+			`[{"op":"add","path":"c","value":1}]`:      ErrInvalidPatch,
 		}
 
-		jsonData, _ := json.Marshal(user)
-		req := httptest.NewRequest(http.MethodPost, "/users", bytes.NewBuffer(jsonData))
-		req.Header.Set("Content-Type", "application/json")
-		w := httptest.NewRecorder()
-		handler.CreateUser(w, req)
+		for raw, expected := range cases {
+			var ops []PatchOperation
+			json.Unmarshal([]byte(raw), &ops)
+			if _, err := ApplyJSONPatch(decode(`{"a":{"b":[]},"c":1}`), ops); !errors.Is(err, expected) {
+				t.Errorf("%s: expected %v, got %v", raw, expected, err)
+			}
+		}
 
-		var createdUser User
-		json.NewDecoder(w.Body).Decode(&createdUser)
+		t.Log("JSONPatchErrors测试通过")
+	})
 
-		// 删除用户
-		req = httptest.NewRequest(http.MethodDelete, "/users/"+fmt.Sprintf("%d", createdUser.ID), nil)
-		w = httptest.NewRecorder()
+	forEachRepository(t, func(t *testing.T, repo UserRepository) {
+		handler := NewUserHandler(NewUserService(repo))
+
+		patch := func(contentType, body string, headers map[string]string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodPatch, "/users/1", strings.NewReader(body))
+			req.Header.Set("Content-Type", contentType)
+			for key, value := range headers {
+				req.Header.Set(key, value)
+			}
+			w := httptest.NewRecorder()
+			serveRoute("/users/{id}", handler.PatchUser, w, req)
+			return w
+		}
 
-		handler.DeleteUser(w, req)
+		t.Run("MergePatchHandler", func(t *testing.T) {
+			w := patch(MergePatchContentType, `{"age":26}`, nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
 
-		if w.Code != http.StatusNoContent {
-			t.Errorf("Expected status 204, got %d", w.Code)
-		}
+			var user User
+			json.NewDecoder(w.Body).Decode(&user)
+			if user.Age != 26 || user.Name != "张三" || user.Version != 2 {
+				t.Errorf("Only age should change, got %+v", user)
+			}
 
-		// 验证用户已删除
-		req = httptest.NewRequest(http.MethodGet, "/users/"+fmt.Sprintf("%d", createdUser.ID), nil)
-		w = httptest.NewRecorder()
-		handler.GetUser(w, req)
+			t.Log("MergePatchHandler测试通过")
+		})
 
-		if w.Code != http.StatusNotFound {
-			t.Errorf("Expected status 404 after deletion, got %d", w.Code)
-		}
+		t.Run("JSONPatchHandler", func(t *testing.T) {
+			body := `[{"op":"test","path":"/age","value":26},{"op":"replace","path":"/name","value":"张小三"}]`
+			w := patch(JSONPatchContentType+"; charset=utf-8", body, map[string]string{"If-Match": `"v2"`})
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+
+			if w.Header().Get("ETag") != `"v3"` {
+				t.Errorf("Expected ETag \"v3\", got %s", w.Header().Get("ETag"))
+			}
+
+			t.Log("JSONPatchHandler测试通过")
+		})
 
-		t.Log("DeleteUser测试通过")
+		t.Run("PatchValidation", func(t *testing.T) {
+			cases := []struct {
+				contentType string
+				body        string
+				status      int
+			}{
+				{MergePatchContentType, `{"email":"not-an-email"}`, http.StatusBadRequest},
+				{MergePatchContentType, `{"name":null}`, http.StatusBadRequest},
+				{MergePatchContentType, `{"id":42}`, http.StatusBadRequest},
+				{MergePatchContentType, `{"age":"old"}`, http.StatusBadRequest},
+				{JSONPatchContentType, `[{"op":"test","path":"/age","value":99}]`, http.StatusConflict},
+				{"application/json", `{"age":30}`, http.StatusUnsupportedMediaType},
+			}
+
+			for _, tc := range cases {
+				if w := patch(tc.contentType, tc.body, nil); w.Code != tc.status {
+					t.Errorf("%s %s: expected %d, got %d", tc.contentType, tc.body, tc.status, w.Code)
+				}
+			}
+
+			user, _ := repo.GetByID(ctx, 1)
+			if user.Name != "张小三" || user.Age != 26 {
+				t.Errorf("Rejected patches should not modify the user, got %+v", user)
+			}
+
+			t.Log("PatchValidation测试通过")
+		})
 	})
 
-	t.Run("MethodNotAllowed", func(t *testing.T) {
-		req := httptest.NewRequest(http.MethodPatch, "/users", nil)
-		w := httptest.NewRecorder()
+	t.Run("IfMatchRace", func(t *testing.T) {
+		repo := &interleavingRepository{UserRepository: NewInMemoryUserRepository()}
+		handler := NewUserHandler(NewUserService(repo))
 
-		handler.GetUsers(w, req)
+		// If-Match 检查通过之后、补丁读取当前用户之前，另一个请求修改了用户
+		repo.afterFirstGet = func() {
+			user, _ := repo.UserRepository.GetByID(context.Background(), 1)
+			user.Age = 40
+			repo.UserRepository.Update(context.Background(), user)
+		}
 
-		if w.Code != http.StatusMethodNotAllowed {
-			t.Errorf("Expected status 405, got %d", w.Code)
+		req := httptest.NewRequest(http.MethodPatch, "/users/1", strings.NewReader(`{"name":"张小三"}`))
+		req.Header.Set("Content-Type", MergePatchContentType)
+		req.Header.Set("If-Match", `"v1"`)
+		w := httptest.NewRecorder()
+		serveRoute("/users/{id}", handler.PatchUser, w, req)
+
+		if w.Code != http.StatusPreconditionFailed {
+			t.Fatalf("Expected status 412 when the user changes after the If-Match check, got %d", w.Code)
+		}
+		if user, _ := repo.GetByID(context.Background(), 1); user.Name != "张三" || user.Version != 2 {
+			t.Errorf("Stale patch should not be applied, got %+v", user)
 		}
 
-		t.Log("MethodNotAllowed测试通过")
+		t.Log("IfMatchRace测试通过")
 	})
 }
 
+// pausingRepository 第一次 Update 写入后暂停：关闭 paused 并等待 resume 关闭后才返回
+type pausingRepository struct {
+	UserRepository
+	paused  chan struct{}
+	resume  chan struct{}
+	updates atomic.Int32
+}
+
+func (r *pausingRepository) Update(ctx context.Context, user *User) error {
+	err := r.UserRepository.Update(ctx, user)
+	if r.updates.Add(1) == 1 {
+		close(r.paused)
+		<-r.resume
+	}
+	return err
+}
+
+// interleavingRepository 在第一次 GetByID 之后执行 afterFirstGet，模拟并发写入
+type interleavingRepository struct {
+	UserRepository
+	afterFirstGet func()
+	gets          int
+}
+
+func (r *interleavingRepository) GetByID(ctx context.Context, id int) (*User, error) {
+	user, err := r.UserRepository.GetByID(ctx, id)
+	r.gets++
+	if r.gets == 1 && r.afterFirstGet != nil {
+		r.afterFirstGet()
+	}
+	return user, err
+}
+
 func TestServer(t *testing.T) {
 	repo := NewInMemoryUserRepository()
 	service := NewUserService(repo)
@@ -484,30 +1266,2300 @@ func TestServer(t *testing.T) {
 	})
 }
 
-func TestMiddleware(t *testing.T) {
-	repo := NewInMemoryUserRepository()
-	service := NewUserService(repo)
-	handler := NewUserHandler(service)
-	server := NewServer(handler, "8080")
+func TestServerLifecycle(t *testing.T) {
+	newTestServer := func() *Server {
+		repo := NewInMemoryUserRepository()
+		service := NewUserService(repo)
+		handler := NewUserHandler(service)
+		return NewServer(handler, "0")
+	}
 
-	t.Run("CORSMiddleware", func(t *testing.T) {
-		req := httptest.NewRequest(http.MethodOptions, "/users", nil)
-		w := httptest.NewRecorder()
+	t.Run("EphemeralPortAndShutdown", func(t *testing.T) {
+		t.Parallel()
+		server := newTestServer()
 
-		// 创建一个简单的处理器来测试CORS中间件
-		testHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			w.WriteHeader(http.StatusOK)
-		})
+		addr, err := server.Listen()
+		if err != nil {
+			t.Fatalf("Listen failed: %v", err)
+		}
 
-		corsHandler := server.corsMiddleware(testHandler)
-		corsHandler.ServeHTTP(w, req)
+		if strings.HasSuffix(addr, ":0") || server.Addr() != addr {
+			t.Errorf("Expected bound ephemeral address, got %s", addr)
+		}
 
-		if w.Code != http.StatusOK {
-			t.Errorf("Expected status 200, got %d", w.Code)
+		done := make(chan error, 1)
+		go func() { done <- server.Serve() }()
+
+		resp, err := http.Get("http://" + addr + "/health")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected status 200, got %d", resp.StatusCode)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			t.Errorf("Shutdown failed: %v", err)
+		}
+
+		if err := <-done; err != nil {
+			t.Errorf("Serve should return nil after shutdown, got %v", err)
+		}
+
+		if _, err := http.Get("http://" + addr + "/health"); err == nil {
+			t.Error("Request should fail after shutdown")
+		}
+
+		t.Log("EphemeralPortAndShutdown测试通过")
+	})
+
+	t.Run("RunUntilContextDone", func(t *testing.T) {
+		t.Parallel()
+		server := newTestServer()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() { done <- server.Run(ctx) }()
+
+		deadline := time.Now().Add(time.Second)
+		for server.Addr() == "" && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+
+		resp, err := http.Get("http://" + server.Addr() + "/users")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+
+		cancel()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("Run should return nil after graceful shutdown, got %v", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Run did not return after context cancellation")
+		}
+
+		t.Log("RunUntilContextDone测试通过")
+	})
+
+	t.Run("ServeBeforeListen", func(t *testing.T) {
+		server := newTestServer()
+		if err := server.Serve(); err == nil {
+			t.Error("Serve should fail before Listen")
+		}
+
+		if err := server.Shutdown(context.Background()); err != nil {
+			t.Errorf("Shutdown before Listen should be a no-op, got %v", err)
+		}
+
+		t.Log("ServeBeforeListen测试通过")
+	})
+
+	t.Run("ConfiguredTimeouts", func(t *testing.T) {
+		config := DefaultServerConfig()
+		config.ReadTimeout = 3 * time.Second
+		server := NewServerWithConfig(newTestServer().handler, "0", config)
+
+		if _, err := server.Listen(); err != nil {
+			t.Fatalf("Listen failed: %v", err)
+		}
+		defer server.Shutdown(context.Background())
+
+		if server.httpServer.ReadTimeout != 3*time.Second || server.httpServer.IdleTimeout != config.IdleTimeout {
+			t.Error("http.Server timeouts should come from ServerConfig")
+		}
+
+		t.Log("ConfiguredTimeouts测试通过")
+	})
+}
+
+func TestTLS(t *testing.T) {
+	serverCert, serverKey, err := GenerateSelfSignedCert(nil, time.Hour)
+	if err != nil {
+		t.Fatalf("GenerateSelfSignedCert failed: %v", err)
+	}
+	clientCert, clientKey, err := GenerateSelfSignedCert([]string{"billing-service"}, time.Hour)
+	if err != nil {
+		t.Fatalf("GenerateSelfSignedCert failed: %v", err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(serverCert)
+
+	startServer := func(t *testing.T, tlsConfig TLSConfig) *Server {
+		t.Helper()
+		config := DefaultServerConfig()
+		config.TLS = &tlsConfig
+		server := NewServerWithConfig(NewUserHandler(NewUserService(NewInMemoryUserRepository())), "0", config)
+		if _, err := server.Listen(); err != nil {
+			t.Fatalf("Listen failed: %v", err)
+		}
+		go server.Serve()
+		t.Cleanup(func() { server.Shutdown(context.Background()) })
+		return server
+	}
+
+	newClient := func(certificates ...tls.Certificate) *http.Client {
+		return &http.Client{
+			Timeout: 5 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig:   &tls.Config{RootCAs: roots, Certificates: certificates},
+				ForceAttemptHTTP2: true,
+			},
+		}
+	}
+	healthURL := func(server *Server) string {
+		_, port, _ := net.SplitHostPort(server.Addr())
+		return "https://localhost:" + port + "/health"
+	}
+
+	t.Run("PEM", func(t *testing.T) {
+		server := startServer(t, TLSConfig{CertPEM: serverCert, KeyPEM: serverKey})
+
+		resp, err := newClient().Get(healthURL(server))
+		if err != nil {
+			t.Fatalf("HTTPS request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || resp.TLS == nil || resp.ProtoMajor != 2 {
+			t.Errorf("Expected 200 over TLS with HTTP/2, got %d %s", resp.StatusCode, resp.Proto)
+		}
+
+		// 明文HTTP请求发到HTTPS端口会被拒绝
+		plain, err := http.Get("http://" + server.Addr() + "/health")
+		if err == nil {
+			plain.Body.Close()
+			if plain.StatusCode != http.StatusBadRequest {
+				t.Errorf("Plain HTTP to the TLS port should fail, got %d", plain.StatusCode)
+			}
+		}
+
+		t.Log("PEM测试通过")
+	})
+
+	t.Run("Files", func(t *testing.T) {
+		dir := t.TempDir()
+		certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+		os.WriteFile(certFile, serverCert, 0o644)
+		os.WriteFile(keyFile, serverKey, 0o600)
+
+		server := startServer(t, TLSConfig{CertFile: certFile, KeyFile: keyFile})
+		resp, err := newClient().Get(healthURL(server))
+		if err != nil {
+			t.Fatalf("HTTPS request failed: %v", err)
+		}
+		resp.Body.Close()
+
+		t.Log("Files测试通过")
+	})
+
+	t.Run("SelfSigned", func(t *testing.T) {
+		server := startServer(t, TLSConfig{SelfSigned: true, Hosts: []string{"dev.local", "127.0.0.1"}})
+
+		conn, err := tls.Dial("tcp", server.Addr(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("TLS dial failed: %v", err)
+		}
+		defer conn.Close()
+
+		leaf := conn.ConnectionState().PeerCertificates[0]
+		if err := leaf.VerifyHostname("dev.local"); err != nil {
+			t.Errorf("Self-signed certificate should cover configured hosts: %v", err)
+		}
+		if err := leaf.VerifyHostname("127.0.0.1"); err != nil {
+			t.Errorf("Self-signed certificate should include IP SANs: %v", err)
+		}
+
+		t.Log("SelfSigned测试通过")
+	})
+
+	t.Run("InvalidConfig", func(t *testing.T) {
+		cases := map[string]TLSConfig{
+			"NoCertificate": {},
+			"BadPEM":        {CertPEM: []byte("not a certificate"), KeyPEM: serverKey},
+			"MissingFile":   {CertFile: "/nonexistent/cert.pem", KeyFile: "/nonexistent/key.pem"},
+			"BadClientCA":   {CertPEM: serverCert, KeyPEM: serverKey, ClientCAPEM: []byte("garbage")},
+		}
+		for name, tlsConfig := range cases {
+			config := DefaultServerConfig()
+			config.TLS = &tlsConfig
+			server := NewServerWithConfig(nil, "0", config)
+			if _, err := server.Listen(); err == nil {
+				server.Shutdown(context.Background())
+				t.Errorf("%s: Listen should fail", name)
+			}
+			if server.Addr() != "" {
+				t.Errorf("%s: failed TLS setup should not bind the port", name)
+			}
+		}
+
+		t.Log("InvalidConfig测试通过")
+	})
+
+	t.Run("MutualTLS", func(t *testing.T) {
+		server := startServer(t, TLSConfig{CertPEM: serverCert, KeyPEM: serverKey, ClientCAPEM: clientCert})
+
+		if resp, err := newClient().Get(healthURL(server)); err == nil {
+			resp.Body.Close()
+			t.Error("Request without a client certificate should be rejected")
+		}
+
+		certificate, _ := tls.X509KeyPair(clientCert, clientKey)
+		resp, err := newClient(certificate).Get(healthURL(server))
+		if err != nil {
+			t.Fatalf("Request with a trusted client certificate failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected status 200, got %d", resp.StatusCode)
+		}
+
+		// 服务端证书不在客户端CA中，不能冒充客户端
+		untrusted, _ := tls.X509KeyPair(serverCert, serverKey)
+		if resp, err := newClient(untrusted).Get(healthURL(server)); err == nil {
+			resp.Body.Close()
+			t.Error("Untrusted client certificate should be rejected")
+		}
+
+		t.Log("MutualTLS测试通过")
+	})
+
+	t.Run("Redirect", func(t *testing.T) {
+		server := startServer(t, TLSConfig{CertPEM: serverCert, KeyPEM: serverKey, RedirectAddr: "127.0.0.1:0"})
+		_, httpsPort, _ := net.SplitHostPort(server.Addr())
+
+		client := &http.Client{
+			Timeout: 5 * time.Second,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		resp, err := client.Get("http://" + server.RedirectAddr() + "/users?page=2")
+		if err != nil {
+			t.Fatalf("Redirect request failed: %v", err)
+		}
+		resp.Body.Close()
+		if location := resp.Header.Get("Location"); resp.StatusCode != http.StatusMovedPermanently ||
+			location != "https://127.0.0.1:"+httpsPort+"/users?page=2" {
+			t.Errorf("Expected 301 to HTTPS, got %d %s", resp.StatusCode, location)
+		}
+
+		resp, err = client.Post("http://"+server.RedirectAddr()+"/users", "application/json", strings.NewReader("{}"))
+		if err != nil {
+			t.Fatalf("Redirect request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusPermanentRedirect {
+			t.Errorf("Non-GET requests should use 308, got %d", resp.StatusCode)
+		}
+
+		// 标准端口省略端口号，IPv6 地址加方括号
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/health", nil)
+		req.Host = "[::1]"
+		httpsRedirectHandler("443").ServeHTTP(w, req)
+		if location := w.Header().Get("Location"); location != "https://[::1]/health" {
+			t.Errorf("Unexpected location %s", location)
+		}
+
+		t.Log("Redirect测试通过")
+	})
+}
+
+func TestAuth(t *testing.T) {
+	config := DefaultServerConfig()
+	config.Auth = security.NewAuthService(security.NewJWTManager("test-secret", "test", time.Hour))
+	server := NewServerWithConfig(NewUserHandler(NewUserService(NewInMemoryUserRepository())), "0", config)
+	routes := server.Routes()
+
+	login := func(username, password string) (*httptest.ResponseRecorder, LoginResponse) {
+		body, _ := json.Marshal(LoginRequest{Username: username, Password: password})
+		req := httptest.NewRequest(http.MethodPost, "/auth/login", bytes.NewBuffer(body))
+		w := httptest.NewRecorder()
+		routes.ServeHTTP(w, req)
+
+		var resp LoginResponse
+		json.NewDecoder(w.Body).Decode(&resp)
+		return w, resp
+	}
+
+	request := func(method, path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		routes.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Login", func(t *testing.T) {
+		w, resp := login("admin", "admin123")
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", w.Code)
+		}
+
+		if resp.Token == "" || resp.TokenType != "Bearer" {
+			t.Errorf("Unexpected login response: %+v", resp)
+		}
+
+		if w, _ := login("admin", "wrong"); w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status 401 for wrong password, got %d", w.Code)
+		}
+
+		t.Log("Login测试通过")
+	})
+
+	t.Run("MissingOrInvalidToken", func(t *testing.T) {
+		w := request(http.MethodGet, "/users", "")
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status 401 without token, got %d", w.Code)
+		}
+
+		if !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Bearer") {
+			t.Error("401 response should carry WWW-Authenticate header")
+		}
+
+		if w := request(http.MethodGet, "/users/1", "not.a.token"); w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status 401 for invalid token, got %d", w.Code)
+		}
+
+		// 公开端点不需要令牌
+		if w := request(http.MethodGet, "/health", ""); w.Code != http.StatusOK {
+			t.Errorf("Health check should be public, got %d", w.Code)
+		}
+
+		t.Log("MissingOrInvalidToken测试通过")
+	})
+
+	t.Run("RoleGuard", func(t *testing.T) {
+		_, user := login("user1", "user123")
+		_, admin := login("admin", "admin123")
+
+		if w := request(http.MethodGet, "/users/2", user.Token); w.Code != http.StatusOK {
+			t.Errorf("Authenticated user should read users, got %d", w.Code)
+		}
+
+		if w := request(http.MethodDelete, "/users/2", user.Token); w.Code != http.StatusForbidden {
+			t.Errorf("Non-admin delete should be forbidden, got %d", w.Code)
+		}
+
+		if w := request(http.MethodDelete, "/users/2", admin.Token); w.Code != http.StatusNoContent {
+			t.Errorf("Admin delete should succeed, got %d", w.Code)
+		}
+
+		t.Log("RoleGuard测试通过")
+	})
+
+	t.Run("AuthDisabled", func(t *testing.T) {
+		open := NewServer(NewUserHandler(NewUserService(NewInMemoryUserRepository())), "0").Routes()
+		req := httptest.NewRequest(http.MethodDelete, "/users/1", nil)
+		w := httptest.NewRecorder()
+		open.ServeHTTP(w, req)
+
+		if w.Code != http.StatusNoContent {
+			t.Errorf("Routes should stay open without AuthService, got %d", w.Code)
+		}
+
+		t.Log("AuthDisabled测试通过")
+	})
+}
+
+func TestRateLimit(t *testing.T) {
+	clock := time.Unix(1700000000, 0)
+	newLimiter := func(config RateLimitConfig) *RateLimiter {
+		limiter := NewRateLimiter(config)
+		limiter.now = func() time.Time { return clock }
+		return limiter
+	}
+
+	t.Run("TokenBucket", func(t *testing.T) {
+		limiter := newLimiter(RateLimitConfig{})
+		limit := RateLimit{Rate: 2, Burst: 3}
+
+		for i := 0; i < 3; i++ {
+			if result := limiter.Allow("client", limit); !result.Allowed || result.Remaining != 2-i {
+				t.Fatalf("Request %d should be allowed, got %+v", i, result)
+			}
+		}
+
+		result := limiter.Allow("client", limit)
+		if result.Allowed || result.RetryAfter != 500*time.Millisecond {
+			t.Errorf("Burst exhausted, expected retry after 500ms, got %+v", result)
+		}
+
+		if other := limiter.Allow("other", limit); !other.Allowed {
+			t.Error("Buckets should be independent per key")
+		}
+
+		clock = clock.Add(500 * time.Millisecond)
+		if result := limiter.Allow("client", limit); !result.Allowed {
+			t.Error("A token should be refilled after 500ms")
+		}
+
+		t.Log("TokenBucket测试通过")
+	})
+
+	t.Run("IdleEviction", func(t *testing.T) {
+		limiter := newLimiter(RateLimitConfig{IdleTTL: time.Minute})
+		for i := 0; i < 100; i++ {
+			limiter.Allow(fmt.Sprintf("client-%d", i), RateLimit{Rate: 1, Burst: 1})
+		}
+
+		clock = clock.Add(2 * time.Minute)
+		limiter.Allow("fresh", RateLimit{Rate: 1, Burst: 1})
+
+		if count := limiter.BucketCount(); count != 1 {
+			t.Errorf("Idle buckets should be evicted, got %d buckets", count)
+		}
+
+		t.Log("IdleEviction测试通过")
+	})
+
+	t.Run("IdleEvictionKeepsDrainedBuckets", func(t *testing.T) {
+		limiter := newLimiter(RateLimitConfig{IdleTTL: time.Minute})
+		slow := RateLimit{Rate: 0.001, Burst: 5}
+		never := RateLimit{Rate: 0, Burst: 1}
+		for i := 0; i < 5; i++ {
+			limiter.Allow("slow", slow)
+		}
+		limiter.Allow("never", never)
+
+		// 空闲超过 IdleTTL 但尚未补满的桶不能回收，否则等于重置了限流
+		clock = clock.Add(2 * time.Minute)
+		limiter.Allow("fresh", RateLimit{Rate: 1, Burst: 1})
+		if count := limiter.BucketCount(); count != 3 {
+			t.Errorf("Drained buckets should be kept, got %d buckets", count)
+		}
+		if result := limiter.Allow("slow", slow); result.Allowed {
+			t.Error("Slow bucket should still be limited after IdleTTL")
+		}
+		if result := limiter.Allow("never", never); result.Allowed {
+			t.Error("Bucket without refill should stay exhausted")
+		}
+
+		t.Log("IdleEvictionKeepsDrainedBuckets测试通过")
+	})
+
+	t.Run("MiddlewareHeadersAndRoutes", func(t *testing.T) {
+		config := DefaultServerConfig()
+		config.RateLimit = &RateLimitConfig{
+			Default: RateLimit{Rate: 1, Burst: 2},
+			Routes: []RouteRateLimit{
+				{Method: http.MethodGet, PathPrefix: "/users/", Limit: RateLimit{Rate: 1, Burst: 1}},
+			},
+		}
+		server := NewServerWithConfig(NewUserHandler(NewUserService(NewInMemoryUserRepository())), "0", config)
+		server.limiter.now = func() time.Time { return clock }
+		routes := server.Routes()
+
+		get := func(path, remoteAddr string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			req.RemoteAddr = remoteAddr
+			w := httptest.NewRecorder()
+			routes.ServeHTTP(w, req)
+			return w
+		}
+
+		w := get("/users/1", "10.0.0.1:1234")
+		if w.Code != http.StatusOK || w.Header().Get("X-RateLimit-Limit") != "1" || w.Header().Get("X-RateLimit-Remaining") != "0" {
+			t.Errorf("Unexpected rate limit headers: %d %v", w.Code, w.Header())
+		}
+
+		w = get("/users/1", "10.0.0.1:5678")
+		if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+			t.Errorf("Expected 429 with Retry-After, got %d %v", w.Code, w.Header())
+		}
+
+		// 同一客户端访问其他路由使用独立的桶
+		if w := get("/users", "10.0.0.1:1234"); w.Code != http.StatusOK || w.Header().Get("X-RateLimit-Limit") != "2" {
+			t.Errorf("Default limit should apply to /users, got %d %v", w.Code, w.Header())
+		}
+
+		// 其他客户端不受影响
+		if w := get("/users/1", "10.0.0.2:1234"); w.Code != http.StatusOK {
+			t.Errorf("Other clients should not be limited, got %d", w.Code)
+		}
+
+		// 未配置限流的服务器不输出限流头
+		open := NewServer(server.handler, "0").Routes()
+		req := httptest.NewRequest(http.MethodGet, "/users", nil)
+		rec := httptest.NewRecorder()
+		open.ServeHTTP(rec, req)
+		if rec.Header().Get("X-RateLimit-Limit") != "" {
+			t.Error("Rate limiting should be disabled without config")
+		}
+
+		t.Log("MiddlewareHeadersAndRoutes测试通过")
+	})
+
+	t.Run("KeyByAuthenticatedSubject", func(t *testing.T) {
+		config := DefaultServerConfig()
+		config.Auth = security.NewAuthService(security.NewJWTManager("test-secret", "test", time.Hour))
+		config.RateLimit = &RateLimitConfig{Default: RateLimit{Rate: 1, Burst: 1}}
+		server := NewServerWithConfig(NewUserHandler(NewUserService(NewInMemoryUserRepository())), "0", config)
+		server.limiter.now = func() time.Time { return clock }
+		routes := server.Routes()
+
+		adminToken, _, _ := config.Auth.Login("admin", "admin123")
+		userToken, _, _ := config.Auth.Login("user1", "user123")
+
+		get := func(token string) int {
+			req := httptest.NewRequest(http.MethodGet, "/users", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			w := httptest.NewRecorder()
+			routes.ServeHTTP(w, req)
+			return w.Code
+		}
+
+		// 两个用户来自同一IP，但各自拥有独立的配额
+		if get(adminToken) != http.StatusOK || get(userToken) != http.StatusOK {
+			t.Error("Each subject should have its own bucket")
+		}
+
+		if get(adminToken) != http.StatusTooManyRequests {
+			t.Error("Second request from the same subject should be limited")
+		}
+
+		t.Log("KeyByAuthenticatedSubject测试通过")
+	})
+}
+
+func TestMetrics(t *testing.T) {
+	t.Run("Exposition", func(t *testing.T) {
+		server, err := NewServerFromConfig("0", DefaultServerConfig())
+		if err != nil {
+			t.Fatalf("NewServerFromConfig failed: %v", err)
+		}
+		routes := server.Routes()
+
+		for _, path := range []string{"/users", "/users/1", "/users/2", "/users/999"} {
+			routes.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		w := httptest.NewRecorder()
+		routes.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", w.Code)
+		}
+		if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+			t.Errorf("Unexpected content type %q", w.Header().Get("Content-Type"))
+		}
+
+		body := w.Body.String()
+		expected := []string{
+			"# TYPE http_requests_total counter",
+			`http_requests_total{method="GET",route="/users",status="200"} 1`,
+			// 用户ID被归一化为路由模板
+			`http_requests_total{method="GET",route="/users/{id}",status="200"} 2`,
+			`http_requests_total{method="GET",route="/users/{id}",status="404"} 1`,
+			"# TYPE http_request_duration_seconds histogram",
+			`http_request_duration_seconds_bucket{method="GET",route="/users/{id}",status="200",le="+Inf"} 2`,
+			`http_request_duration_seconds_count{method="GET",route="/users/{id}",status="200"} 2`,
+			`http_request_duration_seconds_sum{method="GET",route="/users/{id}",status="200"}`,
+			// 抓取请求本身仍在进行中
+			"http_requests_in_flight 1",
+			`user_repository_operations_total{operation="get",result="success"} 2`,
+			`user_repository_operations_total{operation="get",result="error"} 1`,
+			`user_repository_operations_total{operation="list",result="success"} 1`,
+			"process_uptime_seconds ",
+		}
+		for _, line := range expected {
+			if !strings.Contains(body, line) {
+				t.Errorf("Metrics output missing %q", line)
+			}
+		}
+		if strings.Contains(body, `route="/users/1"`) {
+			t.Error("Raw user IDs should not appear as route labels")
+		}
+
+		t.Log("Exposition测试通过")
+	})
+
+	t.Run("HistogramBuckets", func(t *testing.T) {
+		metrics := NewMetrics()
+		metrics.ObserveRequest(http.MethodPost, "/users", http.StatusCreated, 30*time.Millisecond)
+		metrics.ObserveRequest(http.MethodPost, "/users", http.StatusCreated, 2*time.Second)
+
+		var b strings.Builder
+		if _, err := metrics.WriteTo(&b); err != nil {
+			t.Fatalf("WriteTo failed: %v", err)
+		}
+
+		labels := `method="POST",route="/users",status="201"`
+		for le, count := range map[string]int{"0.025": 0, "0.05": 1, "1": 1, "2.5": 2, "+Inf": 2} {
+			line := fmt.Sprintf(`http_request_duration_seconds_bucket{%s,le="%s"} %d`, labels, le, count)
+			if !strings.Contains(b.String(), line+"\n") {
+				t.Errorf("Expected bucket line %q", line)
+			}
+		}
+		if !strings.Contains(b.String(), `http_request_duration_seconds_sum{`+labels+`} 2.03`) {
+			t.Error("Histogram sum not reported correctly")
+		}
+
+		t.Log("HistogramBuckets测试通过")
+	})
+
+	t.Run("RouteLabel", func(t *testing.T) {
+		server := NewServer(NewUserHandler(NewUserService(NewInMemoryUserRepository())), "0")
+		routes := server.Routes()
+		for _, req := range []struct{ method, path string }{
+			{http.MethodGet, "/users/42"},
+			{http.MethodGet, "/users/events/history"},
+			{http.MethodPost, "/users/1/restore"},
+			{http.MethodGet, "/random/abc"},
+			{http.MethodPut, "/health"},
+		} {
+			routes.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(req.method, req.path, nil))
+		}
+
+		var b strings.Builder
+		server.metrics.WriteTo(&b)
+		for _, line := range []string{
+			// 标签取自匹配的路由模式，而不是按路径前缀猜测
+			`http_requests_total{method="GET",route="/users/{id}",status="404"} 1`,
+			`http_requests_total{method="GET",route="/users/{id}/history",status="400"} 1`,
+			`http_requests_total{method="POST",route="/users/{id}/restore",status="409"} 1`,
+			// 未匹配任何路由的请求归为一类
+			`http_requests_total{method="GET",route="other",status="404"} 1`,
+			`http_requests_total{method="PUT",route="other",status="405"} 1`,
+		} {
+			if !strings.Contains(b.String(), line+"\n") {
+				t.Errorf("Expected metrics line %q, got:\n%s", line, b.String())
+			}
+		}
+
+		t.Log("RouteLabel测试通过")
+	})
+
+	t.Run("MethodNotAllowed", func(t *testing.T) {
+		server := NewServer(NewUserHandler(NewUserService(NewInMemoryUserRepository())), "0")
+		req := httptest.NewRequest(http.MethodPost, "/metrics", nil)
+		w := httptest.NewRecorder()
+		server.Routes().ServeHTTP(w, req)
+
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("Expected status 405, got %d", w.Code)
+		}
+
+		t.Log("MethodNotAllowed测试通过")
+	})
+}
+
+func TestOpenAPI(t *testing.T) {
+	newServer := func(config ServerConfig) *Server {
+		return NewServerWithConfig(NewUserHandler(NewUserService(NewInMemoryUserRepository())), "0", config)
+	}
+
+	t.Run("Document", func(t *testing.T) {
+		config := DefaultServerConfig()
+		config.Auth = security.NewAuthService(security.NewJWTManager("test-secret", "test", time.Hour))
+		server := newServer(config)
+
+		req := httptest.NewRequest(http.MethodGet, "/openapi.json", nil)
+		w := httptest.NewRecorder()
+		server.Routes().ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", w.Code)
+		}
+
+		var doc OpenAPI
+		if err := json.NewDecoder(w.Body).Decode(&doc); err != nil {
+			t.Fatalf("Failed to decode document: %v", err)
+		}
+
+		if doc.OpenAPI != "3.0.3" {
+			t.Errorf("Unexpected openapi version %q", doc.OpenAPI)
+		}
+		for path, methods := range map[string][]string{
+			"/users":      {"get", "post"},
+			"/users/{id}": {"get", "put", "patch", "delete"},
+			"/auth/login": {"post"},
+		} {
+			for _, method := range methods {
+				if doc.Paths[path][method] == nil {
+					t.Errorf("Missing operation %s %s", method, path)
+				}
+			}
+		}
+
+		deleteOp := doc.Paths["/users/{id}"]["delete"]
+		if deleteOp.OperationID != "deleteUsersById" || len(deleteOp.Security) != 1 {
+			t.Errorf("Unexpected delete operation: %+v", deleteOp)
+		}
+		if _, ok := deleteOp.Responses["403"]; !ok {
+			t.Error("Admin-only operation should document 403")
+		}
+		if doc.Paths["/auth/login"]["post"].Security != nil {
+			t.Error("Login should not require authentication")
+		}
+		if doc.Components.SecuritySchemes["bearerAuth"]["scheme"] != "bearer" {
+			t.Error("Bearer security scheme not declared")
+		}
+
+		// User schema 由结构体标签生成
+		user := doc.Components.Schemas["User"]
+		if user == nil {
+			t.Fatal("User schema not registered")
+		}
+		if !reflect.DeepEqual(user.Required, []string{"name", "email"}) {
+			t.Errorf("Expected required [name email], got %v", user.Required)
+		}
+		if user.Properties["email"].Format != "email" {
+			t.Error("Email should have email format")
+		}
+		if age := user.Properties["age"]; age.Type != "integer" || *age.Minimum != 0 || *age.Maximum != 150 {
+			t.Errorf("Unexpected age schema: %+v", age)
+		}
+		if !user.Properties["id"].ReadOnly || user.Properties["created_at"].Format != "date-time" {
+			t.Error("Server-managed fields should be read-only date-time/integer")
+		}
+
+		list := doc.Paths["/users"]["get"].Responses["200"].Content["application/json"].Schema
+		if list.Type != "array" || list.Items.Ref != "#/components/schemas/User" {
+			t.Errorf("List response should be an array of User, got %+v", list)
+		}
+
+		t.Log("Document测试通过")
+	})
+
+	t.Run("DocumentedRoutesAreServed", func(t *testing.T) {
+		server := newServer(DefaultServerConfig())
+		routes := server.Routes()
+
+		for _, op := range server.Operations() {
+			path := strings.ReplaceAll(op.Path, "{id}", "1")
+			req := httptest.NewRequest(op.Method, path, strings.NewReader("{}"))
+			if op.Responses[http.StatusOK].ContentType == EventStreamContentType {
+				// 事件流不会自行结束，用已取消的上下文让处理器写完响应头后立即返回
+				ctx, cancel := context.WithCancel(req.Context())
+				cancel()
+				req = req.WithContext(ctx)
+			}
+			w := httptest.NewRecorder()
+			routes.ServeHTTP(w, req)
+
+			var problem Problem
+			json.Unmarshal(w.Body.Bytes(), &problem)
+			if w.Code == http.StatusMethodNotAllowed || problem.Code == CodeNotFound {
+				t.Errorf("%s %s is documented but not routed (status %d)", op.Method, op.Path, w.Code)
+			}
+		}
+
+		// 操作按路由分发时匹配的模式查找，未经路由的请求没有对应操作
+		req := httptest.NewRequest(http.MethodHead, "/users/1", nil)
+		req.Pattern = "/users/{id}"
+		if op, ok := server.findOperation(req); !ok || op.Method != http.MethodGet || op.Path != "/users/{id}" {
+			t.Errorf("Expected GET /users/{id} operation for HEAD request, got %+v %v", op, ok)
+		}
+		if _, ok := server.findOperation(httptest.NewRequest(http.MethodGet, "/users/1/extra", nil)); ok {
+			t.Error("Unrouted request should have no operation")
+		}
+
+		t.Log("DocumentedRoutesAreServed测试通过")
+	})
+
+	t.Run("RequestValidation", func(t *testing.T) {
+		config := DefaultServerConfig()
+		config.ValidateRequests = true
+		routes := newServer(config).Routes()
+
+		send := func(method, path, contentType, body string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(method, path, strings.NewReader(body))
+			if contentType != "" {
+				req.Header.Set("Content-Type", contentType)
+			}
+			w := httptest.NewRecorder()
+			routes.ServeHTTP(w, req)
+			return w
+		}
+
+		fieldsOf := func(w *httptest.ResponseRecorder) []string {
+			var problem Problem
+			json.Unmarshal(w.Body.Bytes(), &problem)
+			var fields []string
+			for _, field := range problem.Errors {
+				fields = append(fields, field.Field)
+			}
+			return fields
+		}
+
+		w := send(http.MethodPost, "/users", "application/json",
+			`{"name":"","email":"invalid","age":200,"nickname":"x","id":99}`)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("Expected status 400, got %d", w.Code)
+		}
+		if fields := fieldsOf(w); !reflect.DeepEqual(fields, []string{"age", "email", "name", "nickname"}) {
+			t.Errorf("Unexpected invalid fields %v", fields)
+		}
+
+		w = send(http.MethodPost, "/users", "", `{"email":"a@example.com","age":"20"}`)
+		if fields := fieldsOf(w); !reflect.DeepEqual(fields, []string{"name", "age"}) {
+			t.Errorf("Expected missing name and mistyped age, got %v", fields)
+		}
+
+		w = send(http.MethodPatch, "/users/1", JSONPatchContentType, `[{"op":"rename","path":"/name"}]`)
+		if fields := fieldsOf(w); w.Code != http.StatusBadRequest || !reflect.DeepEqual(fields, []string{"0.op"}) {
+			t.Errorf("Expected invalid patch op, got %d %v", w.Code, fields)
+		}
+
+		// 合法请求的请求体在校验后仍可被处理器读取
+		w = send(http.MethodPost, "/users", "application/json", `{"name":"Valid","email":"valid@example.com","age":30}`)
+		if w.Code != http.StatusCreated {
+			t.Errorf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+		}
+
+		// 超过校验上限的普通请求体返回413
+		w = send(http.MethodPost, "/users", "application/json", `{"name":"`+strings.Repeat("a", maxValidatedBodySize)+`"}`)
+		if problem := decodeProblemBody(t, w); w.Code != http.StatusRequestEntityTooLarge || problem.Code != CodeBodyTooLarge {
+			t.Errorf("Expected 413 body_too_large, got %d %s", w.Code, problem.Code)
+		}
+
+		t.Log("RequestValidation测试通过")
+	})
+
+	t.Run("BulkValidation", func(t *testing.T) {
+		config := DefaultServerConfig()
+		config.ValidateRequests = true
+		routes := newServer(config).Routes()
+
+		send := func(body string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodPost, "/users:batch", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			routes.ServeHTTP(w, req)
+			return w
+		}
+
+		// 单个无效条目不影响其他条目，仍返回207和逐条结果
+		w := send(`[{"name":"批量有效","email":"bulk-valid@example.com","age":20},{"name":"","email":"bad","age":-1}]`)
+		var batch BatchResponse
+		json.NewDecoder(w.Body).Decode(&batch)
+		if w.Code != http.StatusMultiStatus || len(batch.Results) != 2 {
+			t.Errorf("Expected 207 with per-item results, got %d %+v", w.Code, batch)
+		}
+
+		// 批量请求体不受普通请求体的大小上限限制
+		var items []string
+		for i := 0; i < 8000; i++ {
+			items = append(items, fmt.Sprintf(`{"name":"批量用户%d","email":"bulk%d@example.com","age":20}`, i, i))
+		}
+		body := " [" + strings.Join(items, ",\n"+strings.Repeat(" ", 100)) + "]"
+		if len(body) <= maxValidatedBodySize {
+			t.Fatalf("Batch body should exceed the validation limit, got %d bytes", len(body))
+		}
+		if w := send(body); w.Code != http.StatusCreated {
+			t.Errorf("Expected 201 for a large batch, got %d: %.200s", w.Code, w.Body.String())
+		}
+
+		if w := send(`{"name":"不是数组"}`); w.Code != http.StatusBadRequest || decodeProblemBody(t, w).Code != CodeInvalidJSON {
+			t.Errorf("Non-array batch body should be rejected, got %d", w.Code)
+		}
+
+		t.Log("BulkValidation测试通过")
+	})
+
+	t.Run("ValidationDisabledByDefault", func(t *testing.T) {
+		routes := newServer(DefaultServerConfig()).Routes()
+		req := httptest.NewRequest(http.MethodPost, "/users",
+			strings.NewReader(`{"name":"Loose","email":"loose@example.com","nickname":"x"}`))
+		w := httptest.NewRecorder()
+		routes.ServeHTTP(w, req)
+
+		if w.Code != http.StatusCreated {
+			t.Errorf("Unknown fields should be ignored without validation, got %d", w.Code)
+		}
+
+		t.Log("ValidationDisabledByDefault测试通过")
+	})
+}
+
+func TestBulkOperations(t *testing.T) {
+	ctx := context.Background()
+	send := func(handler http.Handler, method, path, contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	decodeBatch := func(t *testing.T, w *httptest.ResponseRecorder) BatchResponse {
+		t.Helper()
+		var response BatchResponse
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatalf("Failed to decode batch response: %v", err)
+		}
+		return response
+	}
+
+	statusesOf := func(response BatchResponse) []int {
+		statuses := make([]int, len(response.Results))
+		for i, result := range response.Results {
+			statuses[i] = result.Status
+		}
+		return statuses
+	}
+
+	forEachRepository(t, func(t *testing.T, repo UserRepository) {
+		routes := NewServer(NewUserHandler(NewUserService(repo)), "0").Routes()
+
+		t.Run("BatchPartialSuccess", func(t *testing.T) {
+			body := `[
+				{"name":"Batch1","email":"batch1@example.com","age":20},
+				{"name":"NoEmail","age":20},
+				{"name":"BadAge","email":"bad@example.com","age":"x"},
+				{"name":"Batch2","email":"batch2@example.com","age":21}
+			]`
+			w := send(routes, http.MethodPost, "/users:batch", "application/json", body)
+			if w.Code != http.StatusMultiStatus {
+				t.Fatalf("Expected status 207, got %d", w.Code)
+			}
+
+			response := decodeBatch(t, w)
+			if response.Succeeded != 2 || response.Failed != 2 {
+				t.Errorf("Expected 2 succeeded and 2 failed, got %+v", response)
+			}
+			if statuses := statusesOf(response); !reflect.DeepEqual(statuses, []int{201, 400, 400, 201}) {
+				t.Errorf("Unexpected item statuses %v", statuses)
+			}
+			if response.Results[0].User == nil || response.Results[0].User.ID == 0 {
+				t.Error("Created item should include the stored user")
+			}
+			if response.Results[1].Error.Code != CodeValidationFailed {
+				t.Errorf("Expected validation_failed, got %+v", response.Results[1].Error)
+			}
+			if response.Results[2].Error.Errors[0].Field != "age" {
+				t.Errorf("Type error should point at age, got %+v", response.Results[2].Error)
+			}
+
+			t.Log("BatchPartialSuccess测试通过")
+		})
+
+		t.Run("BatchAllCreated", func(t *testing.T) {
+			w := send(routes, http.MethodPost, "/users:batch", "application/json",
+				`[{"name":"All1","email":"all1@example.com"},{"name":"All2","email":"all2@example.com"}]`)
+			if w.Code != http.StatusCreated {
+				t.Errorf("Expected status 201, got %d", w.Code)
+			}
+
+			w = send(routes, http.MethodPost, "/users:batch", "application/json", `{"name":"NotArray"}`)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("Non-array body should be rejected, got %d", w.Code)
+			}
+
+			t.Log("BatchAllCreated测试通过")
+		})
+
+		t.Run("BatchDuplicateEmail", func(t *testing.T) {
+			w := send(routes, http.MethodPost, "/users:batch", "application/json",
+				`[{"name":"Dup1","email":"dup@example.com"},{"name":"Dup2","email":"DUP@example.com"}]`)
+			response := decodeBatch(t, w)
+			if statuses := statusesOf(response); !reflect.DeepEqual(statuses, []int{201, 409}) {
+				t.Errorf("Unexpected item statuses %v", statuses)
+			}
+			if response.Results[1].Error == nil || response.Results[1].Error.Code != CodeDuplicateEmail {
+				t.Errorf("Expected duplicate_email, got %+v", response.Results[1].Error)
+			}
+
+			t.Log("BatchDuplicateEmail测试通过")
+		})
+
+		t.Run("ImportNDJSON", func(t *testing.T) {
+			body := `{"name":"Line1","email":"line1@example.com","age":30}
+
+not json
+{"name":"Line2","email":"line2@example.com","age":31}
+`
+			w := send(routes, http.MethodPost, "/users/import", NDJSONContentType, body)
+			response := decodeBatch(t, w)
+			if w.Code != http.StatusMultiStatus || !reflect.DeepEqual(statusesOf(response), []int{201, 400, 201}) {
+				t.Errorf("Unexpected import result %d %v", w.Code, statusesOf(response))
+			}
+
+			t.Log("ImportNDJSON测试通过")
+		})
+
+		t.Run("ImportCSV", func(t *testing.T) {
+			body := "email,name,age,note\ncsv1@example.com,CSV1,40,ignored\ncsv2@example.com,CSV2,old,\n"
+			w := send(routes, http.MethodPost, "/users/import", CSVContentType+"; charset=utf-8", body)
+			response := decodeBatch(t, w)
+			if !reflect.DeepEqual(statusesOf(response), []int{201, 400}) {
+				t.Fatalf("Unexpected import result %v", statusesOf(response))
+			}
+			if user := response.Results[0].User; user.Name != "CSV1" || user.Age != 40 {
+				t.Errorf("CSV columns should be mapped by header, got %+v", user)
+			}
+
+			w = send(routes, http.MethodPost, "/users/import", CSVContentType, "name,age\nx,1\n")
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("CSV without email column should be rejected, got %d", w.Code)
+			}
+
+			w = send(routes, http.MethodPost, "/users/import", "application/xml", "<users/>")
+			if w.Code != http.StatusUnsupportedMediaType {
+				t.Errorf("Expected status 415, got %d", w.Code)
+			}
+
+			t.Log("ImportCSV测试通过")
+		})
+
+		t.Run("Export", func(t *testing.T) {
+			// 超过一页，验证按游标分页遍历
+			var items []string
+			for i := 0; i < maxPerPage+50; i++ {
+				items = append(items, fmt.Sprintf(`{"name":"Export%d","email":"export%d@example.com","age":20}`, i, i))
+			}
+			send(routes, http.MethodPost, "/users:batch", "application/json", "["+strings.Join(items, ",")+"]")
+			total := len(allUsers(t, repo))
+
+			w := send(routes, http.MethodGet, "/users/export", "", "")
+			if w.Header().Get("Content-Type") != NDJSONContentType {
+				t.Errorf("Expected NDJSON by default, got %q", w.Header().Get("Content-Type"))
+			}
+
+			lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+			if len(lines) != total {
+				t.Fatalf("Expected %d NDJSON lines, got %d", total, len(lines))
+			}
+			lastID := 0
+			for _, line := range lines {
+				var user User
+				if err := json.Unmarshal([]byte(line), &user); err != nil {
+					t.Fatalf("Invalid NDJSON line %q: %v", line, err)
+				}
+				if user.ID <= lastID {
+					t.Fatalf("Export should be ordered by id, got %d after %d", user.ID, lastID)
+				}
+				lastID = user.ID
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/users/export", nil)
+			req.Header.Set("Accept", CSVContentType)
+			w = httptest.NewRecorder()
+			routes.ServeHTTP(w, req)
+
+			records, err := csv.NewReader(w.Body).ReadAll()
+			if err != nil {
+				t.Fatalf("Invalid CSV: %v", err)
+			}
+			if !reflect.DeepEqual(records[0], csvColumns) || len(records) != total+1 {
+				t.Errorf("Expected header and %d rows, got %d records", total, len(records))
+			}
+
+			w = send(routes, http.MethodGet, "/users/export?format=xml", "", "")
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("Unsupported format should be rejected, got %d", w.Code)
+			}
+
+			t.Log("Export测试通过")
+		})
+	})
+
+	t.Run("ExportImportRoundTrip", func(t *testing.T) {
+		source := NewServer(NewUserHandler(NewUserService(NewInMemoryUserRepository())), "0").Routes()
+		exported := send(source, http.MethodGet, "/users/export?format=csv", "", "").Body.String()
+
+		target := NewInMemoryUserRepository()
+		for _, user := range allUsers(t, target) {
+			target.Delete(ctx, user.ID)
+		}
+		routes := NewServer(NewUserHandler(NewUserService(target)), "0").Routes()
+
+		w := send(routes, http.MethodPost, "/users/import", CSVContentType, exported)
+		if w.Code != http.StatusCreated || len(allUsers(t, target)) != 3 {
+			t.Errorf("Expected all 3 seed users to be imported, got %d with %d users", w.Code, len(allUsers(t, target)))
+		}
+
+		t.Log("ExportImportRoundTrip测试通过")
+	})
+
+	t.Run("BatchTooLarge", func(t *testing.T) {
+		routes := NewServer(NewUserHandler(NewUserService(NewInMemoryUserRepository())), "0").Routes()
+
+		var b strings.Builder
+		b.WriteString("[")
+		for i := 0; i <= maxBatchSize; i++ {
+			if i > 0 {
+				b.WriteString(",")
+			}
+			fmt.Fprintf(&b, `{"name":"U%d","email":"u%d@example.com"}`, i, i)
+		}
+		b.WriteString("]")
+
+		w := send(routes, http.MethodPost, "/users:batch", "application/json", b.String())
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected status 413, got %d", w.Code)
+		}
+
+		// 超限的批量请求不应留下部分写入
+		w = send(routes, http.MethodGet, "/users", "", "")
+		if w.Header().Get("X-Total-Count") != "3" {
+			t.Errorf("Rejected batch should not create users, total %s", w.Header().Get("X-Total-Count"))
+		}
+
+		t.Log("BatchTooLarge测试通过")
+	})
+}
+
+// contextRecordingRepository 记录仓库调用时收到的请求ID
+type contextRecordingRepository struct {
+	UserRepository
+	requestIDs []string
+}
+
+func (r *contextRecordingRepository) Create(ctx context.Context, user *User) error {
+	r.requestIDs = append(r.requestIDs, RequestIDFromContext(ctx))
+	return r.UserRepository.Create(ctx, user)
+}
+
+func TestRequestID(t *testing.T) {
+	newServer := func(repo UserRepository, logs *bytes.Buffer) http.Handler {
+		config := DefaultServerConfig()
+		config.Logger = slog.New(slog.NewJSONHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+		return NewServerWithConfig(NewUserHandler(NewUserService(repo)), "0", config).Routes()
+	}
+
+	// logLines 解析JSON日志，按 msg 分组
+	logLines := func(t *testing.T, logs *bytes.Buffer) map[string][]map[string]interface{} {
+		t.Helper()
+		lines := make(map[string][]map[string]interface{})
+		for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+			var entry map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatalf("Log line is not JSON: %q", line)
+			}
+			msg, _ := entry["msg"].(string)
+			lines[msg] = append(lines[msg], entry)
+		}
+		return lines
+	}
+
+	t.Run("GeneratedAndHonored", func(t *testing.T) {
+		routes := newServer(NewInMemoryUserRepository(), &bytes.Buffer{})
+
+		w := httptest.NewRecorder()
+		routes.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+		generated := w.Header().Get(RequestIDHeader)
+		if len(generated) != 32 {
+			t.Errorf("Expected generated 32-char request ID, got %q", generated)
+		}
+
+		for header, honored := range map[string]bool{
+			"client-abc.123:xyz":             true,
+			"bad id\ninjected":               false,
+			strings.Repeat("a", 129):         false,
+			"ok_" + strings.Repeat("b", 125): true,
+		} {
+			req := httptest.NewRequest(http.MethodGet, "/health", nil)
+			req.Header.Set(RequestIDHeader, header)
+			w := httptest.NewRecorder()
+			routes.ServeHTTP(w, req)
+
+			got := w.Header().Get(RequestIDHeader)
+			if (got == header) != honored || got == "" {
+				t.Errorf("Request ID %q honored=%v, response header %q", header, honored, got)
+			}
+		}
+
+		t.Log("GeneratedAndHonored测试通过")
+	})
+
+	t.Run("PropagatedToRepositoryAndProblems", func(t *testing.T) {
+		repo := &contextRecordingRepository{UserRepository: NewInMemoryUserRepository()}
+		routes := newServer(repo, &bytes.Buffer{})
+
+		req := httptest.NewRequest(http.MethodPost, "/users",
+			strings.NewReader(`{"name":"Traced","email":"traced@example.com","age":30}`))
+		req.Header.Set(RequestIDHeader, "trace-1")
+		routes.ServeHTTP(httptest.NewRecorder(), req)
+
+		if !reflect.DeepEqual(repo.requestIDs, []string{"trace-1"}) {
+			t.Errorf("Repository should receive the request ID, got %v", repo.requestIDs)
+		}
+
+		req = httptest.NewRequest(http.MethodGet, "/users/999", nil)
+		req.Header.Set(RequestIDHeader, "trace-2")
+		w := httptest.NewRecorder()
+		routes.ServeHTTP(w, req)
+
+		var problem Problem
+		json.NewDecoder(w.Body).Decode(&problem)
+		if problem.RequestID != "trace-2" {
+			t.Errorf("Problem should carry the request ID, got %q", problem.RequestID)
+		}
+
+		t.Log("PropagatedToRepositoryAndProblems测试通过")
+	})
+
+	t.Run("StructuredAccessLog", func(t *testing.T) {
+		logs := &bytes.Buffer{}
+		routes := newServer(NewInMemoryUserRepository(), logs)
+
+		req := httptest.NewRequest(http.MethodPost, "/users?source=test",
+			strings.NewReader(`{"name":"Logged","email":"logged@example.com","age":30}`))
+		req.Header.Set(RequestIDHeader, "log-1")
+		req.Header.Set("User-Agent", "webapi-test/1.0")
+		req.RemoteAddr = "192.0.2.10:5555"
+		w := httptest.NewRecorder()
+		routes.ServeHTTP(w, req)
+
+		req = httptest.NewRequest(http.MethodGet, "/users/999", nil)
+		routes.ServeHTTP(httptest.NewRecorder(), req)
+
+		lines := logLines(t, logs)
+		access := lines["请求完成"]
+		if len(access) != 2 {
+			t.Fatalf("Expected 2 access log lines, got %d: %s", len(access), logs.String())
+		}
+
+		entry := access[0]
+		expected := map[string]interface{}{
+			"level":       "INFO",
+			"request_id":  "log-1",
+			"method":      "POST",
+			"path":        "/users",
+			"query":       "source=test",
+			"status":      float64(http.StatusCreated),
+			"bytes":       float64(w.Body.Len()),
+			"remote_addr": "192.0.2.10:5555",
+			"user_agent":  "webapi-test/1.0",
+		}
+		for key, value := range expected {
+			if entry[key] != value {
+				t.Errorf("Access log %s = %v, expected %v", key, entry[key], value)
+			}
+		}
+		if _, ok := entry["duration_ms"].(float64); !ok {
+			t.Error("Access log should include duration_ms")
+		}
+		if access[1]["level"] != "WARN" {
+			t.Errorf("4xx responses should be logged at WARN, got %v", access[1]["level"])
+		}
+
+		// 服务层日志与访问日志使用同一个请求ID
+		created := lines["用户已创建"]
+		if len(created) != 1 || created[0]["request_id"] != "log-1" {
+			t.Errorf("Service log should carry the request ID, got %v", created)
+		}
+
+		t.Log("StructuredAccessLog测试通过")
+	})
+
+	t.Run("StreamingThroughWrapper", func(t *testing.T) {
+		routes := newServer(NewInMemoryUserRepository(), &bytes.Buffer{})
+
+		var items []string
+		for i := 0; i < maxPerPage; i++ {
+			items = append(items, fmt.Sprintf(`{"name":"S%d","email":"s%d@example.com"}`, i, i))
+		}
+		routes.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/users:batch",
+			strings.NewReader("["+strings.Join(items, ",")+"]")))
+
+		w := httptest.NewRecorder()
+		routes.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/users/export", nil))
+		if !w.Flushed {
+			t.Error("Export should be able to flush through the middleware wrappers")
+		}
+
+		t.Log("StreamingThroughWrapper测试通过")
+	})
+}
+
+// slowRepository 模拟慢后端：读取操作一直阻塞到上下文结束
+type slowRepository struct {
+	UserRepository
+}
+
+func (r *slowRepository) GetByID(ctx context.Context, id int) (*User, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(5 * time.Second):
+		return r.UserRepository.GetByID(ctx, id)
+	}
+}
+
+func (r *slowRepository) ForEach(ctx context.Context, fn func(User) error) error {
+	return r.UserRepository.ForEach(ctx, func(user User) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(20 * time.Millisecond):
+			return fn(user)
+		}
+	})
+}
+
+func TestContextCancellation(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	forEachRepository(t, func(t *testing.T, repo UserRepository) {
+		t.Run("CanceledContext", func(t *testing.T) {
+			if _, err := repo.GetByID(canceled, 1); !errors.Is(err, context.Canceled) {
+				t.Errorf("GetByID should fail with context.Canceled, got %v", err)
+			}
+			if _, err := repo.List(canceled, UserQuery{}); !errors.Is(err, context.Canceled) {
+				t.Errorf("List should fail with context.Canceled, got %v", err)
+			}
+			if err := repo.Create(canceled, &User{Name: "Canceled", Email: "canceled@example.com"}); !errors.Is(err, context.Canceled) {
+				t.Errorf("Create should fail with context.Canceled, got %v", err)
+			}
+			if err := repo.Delete(canceled, 1); !errors.Is(err, context.Canceled) {
+				t.Errorf("Delete should fail with context.Canceled, got %v", err)
+			}
+
+			// 被取消的操作不应产生任何修改
+			if users := allUsers(t, repo); len(users) != 3 {
+				t.Errorf("Expected 3 users after canceled writes, got %d", len(users))
+			}
+
+			t.Log("CanceledContext测试通过")
+		})
+	})
+
+	t.Run("ForEachUserStops", func(t *testing.T) {
+		ctx := context.Background()
+		service := NewUserService(NewInMemoryUserRepository())
+		for i := 0; i < maxPerPage; i++ {
+			service.CreateUser(ctx, &User{Name: fmt.Sprintf("User%d", i), Email: fmt.Sprintf("user%d@example.com", i), Age: 20})
+		}
+
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		visited := 0
+		err := service.ForEachUser(ctx, func(User) error {
+			if visited++; visited == 1 {
+				cancel()
+			}
+			return nil
+		})
+
+		// 当前页处理完后停止，不再读取下一页
+		if !errors.Is(err, context.Canceled) || visited != maxPerPage {
+			t.Errorf("Expected to stop after first page with context.Canceled, got %v after %d users", err, visited)
+		}
+
+		t.Log("ForEachUserStops测试通过")
+	})
+
+	t.Run("RequestTimeout", func(t *testing.T) {
+		config := DefaultServerConfig()
+		config.RequestTimeout = 20 * time.Millisecond
+		config.Logger = slog.New(slog.NewJSONHandler(io.Discard, nil))
+		repo := &slowRepository{UserRepository: NewInMemoryUserRepository()}
+		routes := NewServerWithConfig(NewUserHandler(NewUserService(repo)), "0", config).Routes()
+
+		start := time.Now()
+		w := httptest.NewRecorder()
+		routes.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/users/1", nil))
+
+		var problem Problem
+		json.NewDecoder(w.Body).Decode(&problem)
+		if w.Code != http.StatusGatewayTimeout || problem.Code != CodeRequestTimeout {
+			t.Errorf("Expected 504 request_timeout, got %d %+v", w.Code, problem)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("Slow backend should be cancelled at the deadline, took %v", elapsed)
+		}
+
+		t.Log("RequestTimeout测试通过")
+	})
+
+	t.Run("ExportIgnoresRequestTimeout", func(t *testing.T) {
+		config := DefaultServerConfig()
+		config.RequestTimeout = 20 * time.Millisecond
+		config.Logger = slog.New(slog.NewJSONHandler(io.Discard, nil))
+		repo := &slowRepository{UserRepository: NewInMemoryUserRepository()}
+		routes := NewServerWithConfig(NewUserHandler(NewUserService(repo)), "0", config).Routes()
+
+		// 导出总耗时超过 RequestTimeout，仍应完整返回
+		w := httptest.NewRecorder()
+		routes.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/users/export", nil))
+
+		lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+		if w.Code != http.StatusOK || len(lines) != 3 {
+			t.Errorf("Expected full export despite timeout, got %d with %d lines", w.Code, len(lines))
+		}
+
+		t.Log("ExportIgnoresRequestTimeout测试通过")
+	})
+
+	t.Run("ClientDisconnect", func(t *testing.T) {
+		var logs bytes.Buffer
+		config := DefaultServerConfig()
+		config.Logger = slog.New(slog.NewJSONHandler(&logs, nil))
+		repo := NewInMemoryUserRepository()
+		routes := NewServerWithConfig(NewUserHandler(NewUserService(repo)), "0", config).Routes()
+
+		req := httptest.NewRequest(http.MethodPost, "/users",
+			strings.NewReader(`{"name":"Gone","email":"gone@example.com","age":30}`)).WithContext(canceled)
+		w := httptest.NewRecorder()
+		routes.ServeHTTP(w, req)
+
+		if w.Code != statusClientClosedRequest {
+			t.Errorf("Expected status 499, got %d", w.Code)
+		}
+		if users := allUsers(t, repo); len(users) != 3 {
+			t.Errorf("Canceled request should not create a user, got %d users", len(users))
+		}
+		if !strings.Contains(logs.String(), `"status":499`) || strings.Contains(logs.String(), "内部错误") {
+			t.Errorf("Cancellation should be logged as 499, not as an internal error: %s", logs.String())
+		}
+
+		t.Log("ClientDisconnect测试通过")
+	})
+}
+
+func TestSoftDelete(t *testing.T) {
+	ctx := context.Background()
+
+	forEachRepository(t, func(t *testing.T, repo UserRepository) {
+		t.Run("DeleteAndRestore", func(t *testing.T) {
+			if err := repo.Delete(ctx, 1); err != nil {
+				t.Fatalf("Delete failed: %v", err)
+			}
+
+			if _, err := repo.GetByID(ctx, 1); !errors.Is(err, ErrUserNotFound) {
+				t.Errorf("Deleted user should not be found, got %v", err)
+			}
+			if err := repo.Update(ctx, &User{ID: 1, Name: "Ghost", Email: "ghost@example.com"}); !errors.Is(err, ErrUserNotFound) {
+				t.Errorf("Deleted user should not be updatable, got %v", err)
+			}
+			if err := repo.Delete(ctx, 1); !errors.Is(err, ErrUserNotFound) {
+				t.Errorf("Deleting twice should return ErrUserNotFound, got %v", err)
+			}
+			if users := allUsers(t, repo); len(users) != 2 {
+				t.Errorf("GetAll should exclude deleted users, got %d", len(users))
+			}
+
+			only, _ := repo.List(ctx, UserQuery{Filter: UserFilter{Deleted: DeletedOnly}})
+			if only.Total != 1 || only.Users[0].ID != 1 || only.Users[0].DeletedAt == nil || only.Users[0].Version != 2 {
+				t.Errorf("Expected user 1 marked deleted at version 2, got %+v", only.Users)
+			}
+			if all, _ := repo.List(ctx, UserQuery{Filter: UserFilter{Deleted: DeletedInclude}}); all.Total != 3 {
+				t.Errorf("Expected 3 users including deleted, got %d", all.Total)
+			}
+
+			restored, err := repo.Restore(ctx, 1)
+			if err != nil || restored.DeletedAt != nil || restored.Version != 3 {
+				t.Fatalf("Restore failed: %+v %v", restored, err)
+			}
+			if _, err := repo.GetByID(ctx, 1); err != nil {
+				t.Errorf("Restored user should be visible, got %v", err)
+			}
+			if _, err := repo.Restore(ctx, 1); !errors.Is(err, ErrUserNotDeleted) {
+				t.Errorf("Restoring an active user should return ErrUserNotDeleted, got %v", err)
+			}
+			if _, err := repo.Restore(ctx, 999); !errors.Is(err, ErrUserNotFound) {
+				t.Errorf("Expected ErrUserNotFound, got %v", err)
+			}
+
+			t.Log("DeleteAndRestore测试通过")
+		})
+
+		t.Run("History", func(t *testing.T) {
+			actorCtx := context.WithValue(ctx, authUserKey, &security.User{Username: "auditor"})
+
+			user := &User{Name: "审计", Email: "audit@example.com", Age: 40}
+			repo.Create(actorCtx, user)
+			user.Age = 41
+			user.Email = "audit2@example.com"
+			repo.Update(actorCtx, user)
+			repo.Delete(ctx, user.ID)
+			repo.Restore(actorCtx, user.ID)
+
+			entries, err := repo.History(ctx, user.ID)
+			if err != nil || len(entries) != 4 {
+				t.Fatalf("Expected 4 history entries, got %d %v", len(entries), err)
+			}
+
+			actions := []string{HistoryCreate, HistoryUpdate, HistoryDelete, HistoryRestore}
+			for i, entry := range entries {
+				if entry.Action != actions[i] || entry.Version != i+1 || entry.Timestamp.IsZero() {
+					t.Errorf("Entry %d: unexpected %+v", i, entry)
+				}
+			}
+			if entries[0].Actor != "auditor" || entries[2].Actor != "" {
+				t.Errorf("Actor should come from the authenticated user, got %q %q", entries[0].Actor, entries[2].Actor)
+			}
+
+			// 只记录实际变化的字段，元数据字段不计入
+			expected := []FieldChange{
+				{Field: "email", Old: "audit@example.com", New: "audit2@example.com"},
+				{Field: "age", Old: 40, New: 41},
+			}
+			if !reflect.DeepEqual(entries[1].Changes, expected) {
+				t.Errorf("Unexpected update changes %+v", entries[1].Changes)
+			}
+			if len(entries[2].Changes) != 1 || entries[2].Changes[0].Field != "deleted_at" || entries[2].Changes[0].Old != nil {
+				t.Errorf("Delete should record deleted_at, got %+v", entries[2].Changes)
+			}
+
+			if _, err := repo.History(ctx, 999); !errors.Is(err, ErrUserNotFound) {
+				t.Errorf("Expected ErrUserNotFound, got %v", err)
+			}
+
+			t.Log("History测试通过")
+		})
+	})
+
+	t.Run("FileHistoryPersistence", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "users.db")
+		repo, _ := NewFileUserRepository(path)
+		repo.Update(ctx, &User{ID: 2, Name: "李四", Email: "lisi@example.com", Age: 31})
+		repo.Delete(ctx, 2)
+		repo.Close()
+
+		// 模拟写入历史时崩溃留下的残缺记录
+		file, _ := os.OpenFile(path+".history", os.O_WRONLY|os.O_APPEND, 0o644)
+		file.WriteString(`{"id":2,"entry":{"vers`)
+		file.Close()
+
+		reopened, err := NewFileUserRepository(path)
+		if err != nil {
+			t.Fatalf("Reopen failed: %v", err)
+		}
+		if _, err := reopened.GetByID(ctx, 2); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("Soft delete should survive reopen, got %v", err)
+		}
+		reopened.Restore(ctx, 2)
+		reopened.Close()
+
+		again, err := NewFileUserRepository(path)
+		if err != nil {
+			t.Fatalf("Torn history tail should be truncated, got %v", err)
+		}
+		defer again.Close()
+
+		entries, _ := again.History(ctx, 2)
+		if len(entries) != 4 || entries[3].Action != HistoryRestore {
+			t.Errorf("Expected create/update/delete/restore history after reopen, got %+v", entries)
+		}
+
+		t.Log("FileHistoryPersistence测试通过")
+	})
+
+	t.Run("Endpoints", func(t *testing.T) {
+		config := DefaultServerConfig()
+		config.Auth = security.NewAuthService(security.NewJWTManager("test-secret", "test", time.Hour))
+		routes := NewServerWithConfig(NewUserHandler(NewUserService(NewInMemoryUserRepository())), "0", config).Routes()
+
+		token := func(username, password string) string {
+			body, _ := json.Marshal(LoginRequest{Username: username, Password: password})
+			w := httptest.NewRecorder()
+			routes.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/auth/login", bytes.NewBuffer(body)))
+			var resp LoginResponse
+			json.NewDecoder(w.Body).Decode(&resp)
+			return resp.Token
+		}
+		admin, user := token("admin", "admin123"), token("user1", "user123")
+
+		request := func(method, path, token string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(method, path, nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			w := httptest.NewRecorder()
+			routes.ServeHTTP(w, req)
+			return w
+		}
+
+		if w := request(http.MethodDelete, "/users/1", admin); w.Code != http.StatusNoContent {
+			t.Fatalf("Expected 204, got %d", w.Code)
+		}
+		if w := request(http.MethodGet, "/users/1", admin); w.Code != http.StatusNotFound {
+			t.Errorf("Deleted user should return 404, got %d", w.Code)
+		}
+
+		w := request(http.MethodGet, "/users?deleted=only", admin)
+		var deleted []User
+		json.NewDecoder(w.Body).Decode(&deleted)
+		if len(deleted) != 1 || deleted[0].ID != 1 || deleted[0].DeletedAt == nil {
+			t.Errorf("Expected deleted user 1, got %+v", deleted)
+		}
+		if w := request(http.MethodGet, "/users?deleted=maybe", admin); w.Code != http.StatusBadRequest {
+			t.Errorf("Invalid deleted filter should return 400, got %d", w.Code)
+		}
+
+		if w := request(http.MethodPost, "/users/1/restore", user); w.Code != http.StatusForbidden {
+			t.Errorf("Restore should require admin role, got %d", w.Code)
+		}
+		w = request(http.MethodPost, "/users/1/restore", admin)
+		var restored User
+		json.NewDecoder(w.Body).Decode(&restored)
+		if w.Code != http.StatusOK || restored.DeletedAt != nil || w.Header().Get("ETag") != `"v3"` {
+			t.Errorf("Expected restored user, got %d %+v", w.Code, restored)
+		}
+
+		w = request(http.MethodPost, "/users/1/restore", admin)
+		var problem Problem
+		json.NewDecoder(w.Body).Decode(&problem)
+		if w.Code != http.StatusConflict || problem.Code != CodeUserNotDeleted {
+			t.Errorf("Expected 409 user_not_deleted, got %d %+v", w.Code, problem)
+		}
+
+		w = request(http.MethodGet, "/users/1/history", user)
+		var entries []HistoryEntry
+		json.NewDecoder(w.Body).Decode(&entries)
+		if w.Code != http.StatusOK || len(entries) != 3 || entries[1].Actor != "admin" || entries[2].Action != HistoryRestore {
+			t.Errorf("Unexpected history %d %+v", w.Code, entries)
+		}
+
+		if w := request(http.MethodGet, "/users/999/history", admin); w.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 for unknown user history, got %d", w.Code)
+		}
+
+		t.Log("Endpoints测试通过")
+	})
+}
+
+func TestUserEvents(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Broker", func(t *testing.T) {
+		broker := NewEventBroker(3)
+		for i := 1; i <= 5; i++ {
+			broker.Publish(EventUserUpdated, i, &User{ID: i})
+		}
+
+		sub := broker.Subscribe(3)
+		if sub.Reset || len(sub.Missed) != 2 || sub.Missed[0].ID != 4 || sub.LastID != 5 {
+			t.Errorf("Expected events 4 and 5 to be replayed, got %+v", sub)
+		}
+		sub.Close()
+
+		if sub := broker.Subscribe(1); !sub.Reset || len(sub.Missed) != 0 {
+			t.Errorf("Events evicted from the buffer should require a reset, got %+v", sub)
+		}
+		if sub := broker.Subscribe(99); !sub.Reset {
+			t.Error("Unknown future ID (server restarted) should require a reset")
+		}
+		if sub := broker.Subscribe(5); sub.Reset || len(sub.Missed) != 0 {
+			t.Errorf("Up-to-date client should get nothing to replay, got %+v", sub)
+		}
+
+		live := broker.Subscribe(0)
+		event := broker.Publish(EventUserCreated, 6, &User{ID: 6, Name: "新用户"})
+		if received := <-live.Events; received.ID != event.ID || received.User.Name != "新用户" {
+			t.Errorf("Expected live event %+v, got %+v", event, received)
+		}
+		live.Close()
+		live.Close()
+
+		// 不读取事件的订阅者在积压超过上限后被断开，不阻塞发布者
+		slow := broker.Subscribe(0)
+		for i := 0; i <= subscriberEventCapacity; i++ {
+			broker.Publish(EventUserUpdated, 1, nil)
+		}
+		count := 0
+		for range slow.Events {
+			count++
+		}
+		if count != subscriberEventCapacity {
+			t.Errorf("Expected %d buffered events before disconnect, got %d", subscriberEventCapacity, count)
+		}
+
+		t.Log("Broker测试通过")
+	})
+
+	forEachRepository(t, func(t *testing.T, repo UserRepository) {
+		t.Run("ServicePublishes", func(t *testing.T) {
+			service := NewUserService(repo)
+			sub := service.Events().Subscribe(0)
+			defer sub.Close()
+
+			user := &User{Name: "事件", Email: "event@example.com", Age: 20}
+			service.CreateUser(ctx, user)
+			user.Age = 21
+			service.UpdateUser(ctx, user)
+			service.UpdateUser(ctx, &User{ID: 999, Name: "不存在", Email: "none@example.com"})
+			service.DeleteUser(ctx, user.ID)
+			service.RestoreUser(ctx, user.ID)
+
+			expected := []string{EventUserCreated, EventUserUpdated, EventUserDeleted, EventUserRestored}
+			for i, eventType := range expected {
+				event := <-sub.Events
+				if event.Type != eventType || event.UserID != user.ID || event.ID != int64(i+1) {
+					t.Errorf("Event %d: expected %s for user %d, got %+v", i, eventType, user.ID, event)
+				}
+				if (event.User == nil) != (eventType == EventUserDeleted) {
+					t.Errorf("Only delete events should omit the user, got %+v", event)
+				}
+			}
+			if len(sub.Events) != 0 {
+				t.Error("Failed operations should not publish events")
+			}
+
+			t.Log("ServicePublishes测试通过")
+		})
+
+		t.Run("PublishOrder", func(t *testing.T) {
+			paused := &pausingRepository{UserRepository: repo, paused: make(chan struct{}), resume: make(chan struct{})}
+			service := NewUserService(paused)
+			user := &User{Name: "顺序", Email: "order@example.com", Age: 20}
+			if err := service.CreateUser(ctx, user); err != nil {
+				t.Fatalf("CreateUser failed: %v", err)
+			}
+			sub := service.Events().Subscribe(0)
+			defer sub.Close()
+
+			// 第一次更新写入后、发布之前暂停，第二次更新不能抢先发布
+			first, second := *user, *user
+			first.Age, second.Age = 21, 22
+			first.Version, second.Version = 0, 0
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				service.UpdateUser(ctx, &first)
+			}()
+			<-paused.paused
+
+			secondDone := make(chan struct{})
+			go func() {
+				defer wg.Done()
+				defer close(secondDone)
+				service.UpdateUser(ctx, &second)
+			}()
+			select {
+			case <-secondDone:
+			case <-time.After(50 * time.Millisecond):
+			}
+			close(paused.resume)
+			wg.Wait()
+
+			for _, version := range []int{2, 3} {
+				if event := <-sub.Events; event.User == nil || event.User.Version != version {
+					t.Errorf("Expected event for version %d, got %+v", version, event)
+				}
+			}
+
+			t.Log("PublishOrder测试通过")
+		})
+	})
+
+	// readEvent 读取一个SSE事件块，返回字段名到取值的映射，注释行记为 ":"
+	readEvent := func(t *testing.T, reader *bufio.Reader) map[string]string {
+		t.Helper()
+		fields := make(map[string]string)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("Failed to read event stream: %v", err)
+			}
+			line = strings.TrimSuffix(line, "\n")
+			if line == "" {
+				return fields
+			}
+			if strings.HasPrefix(line, ":") {
+				fields[":"] = strings.TrimSpace(line[1:])
+				continue
+			}
+			name, value, _ := strings.Cut(line, ": ")
+			fields[name] = value
+		}
+	}
+
+	startServer := func(t *testing.T, config ServerConfig) (*Server, *UserService, string) {
+		t.Helper()
+		service := NewUserService(NewInMemoryUserRepository())
+		server := NewServerWithConfig(NewUserHandler(service), "0", config)
+		addr, err := server.Listen()
+		if err != nil {
+			t.Fatalf("Listen failed: %v", err)
+		}
+		go server.Serve()
+		t.Cleanup(func() { server.Shutdown(context.Background()) })
+		return server, service, "http://" + addr
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	connect := func(t *testing.T, base, lastEventID string) (*http.Response, *bufio.Reader) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, base+"/users/events", nil)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Connect failed: %v", err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp, bufio.NewReader(resp.Body)
+	}
+
+	t.Run("Stream", func(t *testing.T) {
+		config := DefaultServerConfig()
+		config.RequestTimeout = 50 * time.Millisecond
+		config.EventHeartbeat = 20 * time.Millisecond
+		_, service, base := startServer(t, config)
+
+		resp, reader := connect(t, base, "")
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != EventStreamContentType {
+			t.Fatalf("Expected event stream, got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		if first := readEvent(t, reader); first["retry"] != "3000" {
+			t.Errorf("Stream should start with a retry hint, got %v", first)
+		}
+
+		// 超过 RequestTimeout 后连接仍然保持，空闲期间收到心跳
+		time.Sleep(100 * time.Millisecond)
+		if heartbeat := readEvent(t, reader); heartbeat[":"] != "heartbeat" {
+			t.Errorf("Expected heartbeat comment, got %v", heartbeat)
+		}
+
+		user := &User{Name: "推送", Email: "push@example.com", Age: 30}
+		service.CreateUser(ctx, user)
+		event := readEvent(t, reader)
+		for event[":"] != "" && event["event"] == "" {
+			event = readEvent(t, reader)
+		}
+
+		var payload UserEvent
+		json.Unmarshal([]byte(event["data"]), &payload)
+		if event["event"] != EventUserCreated || event["id"] != "1" || payload.User == nil || payload.User.Email != "push@example.com" {
+			t.Errorf("Unexpected event %v", event)
+		}
+
+		t.Log("Stream测试通过")
+	})
+
+	t.Run("Resume", func(t *testing.T) {
+		_, service, base := startServer(t, DefaultServerConfig())
+		for i := 1; i <= 3; i++ {
+			service.CreateUser(ctx, &User{Name: fmt.Sprintf("续传%d", i), Email: fmt.Sprintf("resume%d@example.com", i)})
+		}
+
+		_, reader := connect(t, base, "1")
+		readEvent(t, reader)
+		for _, id := range []string{"2", "3"} {
+			if event := readEvent(t, reader); event["id"] != id || event["event"] != EventUserCreated {
+				t.Errorf("Expected replayed event %s, got %v", id, event)
+			}
+		}
+
+		// 服务端重启后客户端携带的旧ID无法续传，先收到 reset
+		_, reader = connect(t, base, "42")
+		readEvent(t, reader)
+		if event := readEvent(t, reader); event["event"] != "reset" || event["id"] != "3" {
+			t.Errorf("Expected reset pointing at the latest event, got %v", event)
+		}
+
+		if resp, _ := connect(t, base, "abc"); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Invalid Last-Event-ID should return 400, got %d", resp.StatusCode)
+		}
+
+		t.Log("Resume测试通过")
+	})
+
+	t.Run("ShutdownClosesStreams", func(t *testing.T) {
+		server, service, base := startServer(t, DefaultServerConfig())
+		_, reader := connect(t, base, "")
+		readEvent(t, reader)
+
+		shutdownCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			t.Errorf("Shutdown should not wait for open streams: %v", err)
+		}
+		if _, err := reader.ReadString('\n'); err == nil {
+			t.Error("Stream should end after shutdown")
+		}
+		if service.Events().Subscribers() != 0 {
+			t.Errorf("Subscriptions should be released, got %d", service.Events().Subscribers())
+		}
+
+		t.Log("ShutdownClosesStreams测试通过")
+	})
+}
+
+func TestContentNegotiation(t *testing.T) {
+	get := func(handler http.Handler, method, path, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Negotiate", func(t *testing.T) {
+		cases := map[string]string{
+			"":                                      "application/json",
+			"application/xml":                       "application/xml",
+			"text/csv;q=0.5, application/xml;q=0.9": "application/xml",
+			"application/*":                         "application/json",
+			"*/*;q=0.1, text/csv":                   "text/csv",
+			"application/json;q=0, */*":             "application/xml",
+			"image/png":                             "",
+		}
+		for accept, expected := range cases {
+			formatter, ok := negotiate(accept, userFormatters)
+			got := ""
+			if ok {
+				got = formatter.ContentType()
+			}
+			if got != expected {
+				t.Errorf("negotiate(%q) = %q, expected %q", accept, got, expected)
+			}
+		}
+
+		t.Log("Negotiate测试通过")
+	})
+
+	t.Run("Formats", func(t *testing.T) {
+		routes := NewServer(NewUserHandler(NewUserService(NewInMemoryUserRepository())), "0").Routes()
+
+		w := get(routes, http.MethodGet, "/users", "application/xml")
+		if w.Header().Get("Content-Type") != "application/xml" || !strings.Contains(w.Header().Get("Vary"), "Accept") {
+			t.Errorf("Unexpected headers %v", w.Header())
+		}
+		var list struct {
+			XMLName xml.Name `xml:"users"`
+			Users   []User   `xml:"user"`
+		}
+		if err := xml.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list.Users) != 3 || list.Users[0].Name != "张三" {
+			t.Errorf("Failed to decode XML list (%v): %s", err, w.Body.String())
+		}
+
+		w = get(routes, http.MethodGet, "/users/1", "application/xml")
+		if !strings.Contains(w.Body.String(), "<user><id>1</id><name>张三</name>") {
+			t.Errorf("Unexpected XML user: %s", w.Body.String())
+		}
+
+		w = get(routes, http.MethodGet, "/users/1", "text/csv")
+		records, err := csv.NewReader(w.Body).ReadAll()
+		if err != nil || len(records) != 2 || !reflect.DeepEqual(records[0], csvColumns) || records[1][1] != "张三" {
+			t.Errorf("Unexpected CSV user (%v): %v", err, records)
+		}
+
+		t.Log("Formats测试通过")
+	})
+
+	t.Run("RepresentationETag", func(t *testing.T) {
+		routes := NewServer(NewUserHandler(NewUserService(NewInMemoryUserRepository())), "0").Routes()
+
+		etags := map[string]string{}
+		for _, accept := range []string{"application/json", "application/xml", "text/csv"} {
+			etags[accept] = get(routes, http.MethodGet, "/users/1", accept).Header().Get("ETag")
+		}
+		if etags["application/json"] != `"v1"` || etags["application/xml"] != `"v1-xml"` || etags["text/csv"] != `"v1-csv"` {
+			t.Errorf("Each representation should have its own ETag, got %v", etags)
+		}
+
+		// JSON表示的ETag不能让XML请求命中304
+		req := httptest.NewRequest(http.MethodGet, "/users/1", nil)
+		req.Header.Set("Accept", "application/xml")
+		req.Header.Set("If-None-Match", `"v1"`)
+		w := httptest.NewRecorder()
+		routes.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("JSON ETag should not validate the XML representation, got %d", w.Code)
+		}
+
+		req.Header.Set("If-None-Match", `"v1-xml"`)
+		w = httptest.NewRecorder()
+		routes.ServeHTTP(w, req)
+		if w.Code != http.StatusNotModified {
+			t.Errorf("Expected 304 for matching XML ETag, got %d", w.Code)
+		}
+
+		// If-Match 比较资源版本，任意表示的ETag都可以
+		req = httptest.NewRequest(http.MethodPut, "/users/1",
+			strings.NewReader(`{"name":"张三","email":"zhangsan@example.com","age":26}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept", "text/csv")
+		req.Header.Set("If-Match", `"v1-xml"`)
+		w = httptest.NewRecorder()
+		routes.ServeHTTP(w, req)
+		if w.Code != http.StatusOK || w.Header().Get("ETag") != `"v2-csv"` {
+			t.Errorf("Expected update with XML ETag to succeed with CSV ETag, got %d %q", w.Code, w.Header().Get("ETag"))
+		}
+
+		t.Log("RepresentationETag测试通过")
+	})
+
+	t.Run("History", func(t *testing.T) {
+		routes := NewServer(NewUserHandler(NewUserService(NewInMemoryUserRepository())), "0").Routes()
+
+		w := get(routes, http.MethodGet, "/users/1/history", "application/xml")
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/xml" ||
+			!strings.Contains(w.Body.String(), "<history><historyentry><version>1</version><action>create</action>") {
+			t.Errorf("Expected XML history, got %d %q: %s", w.Code, w.Header().Get("Content-Type"), w.Body.String())
+		}
+
+		// 历史记录无法用CSV表示，协商失败返回406而不是忽略 Accept 输出JSON
+		w = get(routes, http.MethodGet, "/users/1/history", "text/csv")
+		var problem Problem
+		json.NewDecoder(w.Body).Decode(&problem)
+		if w.Code != http.StatusNotAcceptable || problem.Code != CodeNotAcceptable {
+			t.Errorf("Expected 406 for CSV history, got %d %+v", w.Code, problem)
+		}
+
+		t.Log("History测试通过")
+	})
+
+	t.Run("NotAcceptable", func(t *testing.T) {
+		routes := NewServer(NewUserHandler(NewUserService(NewInMemoryUserRepository())), "0").Routes()
+
+		req := httptest.NewRequest(http.MethodPost, "/users",
+			strings.NewReader(`{"name":"Image","email":"image@example.com","age":20}`))
+		req.Header.Set("Accept", "image/png")
+		w := httptest.NewRecorder()
+		routes.ServeHTTP(w, req)
+
+		var problem Problem
+		json.NewDecoder(w.Body).Decode(&problem)
+		if w.Code != http.StatusNotAcceptable || problem.Code != CodeNotAcceptable {
+			t.Errorf("Expected 406 not_acceptable, got %d %+v", w.Code, problem)
+		}
+
+		// 协商失败发生在处理器之前，用户不应被创建
+		if total := get(routes, http.MethodGet, "/users", "").Header().Get("X-Total-Count"); total != "3" {
+			t.Errorf("User should not be created, total %s", total)
+		}
+
+		if w := get(routes, http.MethodDelete, "/users/1", "image/png"); w.Code != http.StatusNoContent {
+			t.Errorf("DELETE has no body and should not be negotiated, got %d", w.Code)
+		}
+
+		t.Log("NotAcceptable测试通过")
+	})
+}
+
+func TestCompression(t *testing.T) {
+	newRoutes := func(minSize int) http.Handler {
+		config := DefaultServerConfig()
+		config.Compression = &CompressionConfig{MinSize: minSize, Level: gzip.DefaultCompression}
+		return NewServerWithConfig(NewUserHandler(NewUserService(NewInMemoryUserRepository())), "0", config).Routes()
+	}
+
+	request := func(handler http.Handler, path, encoding string, headers ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if encoding != "" {
+			req.Header.Set("Accept-Encoding", encoding)
+		}
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("NegotiateEncoding", func(t *testing.T) {
+		cases := map[string]string{
+			"":                    "",
+			"gzip":                "gzip",
+			"deflate":             "deflate",
+			"gzip, deflate, br":   "gzip",
+			"gzip;q=0.5, deflate": "deflate",
+			"gzip;q=0, *":         "deflate",
+			"identity":            "",
+			"*":                   "gzip",
+		}
+		for header, expected := range cases {
+			if got := negotiateEncoding(header); got != expected {
+				t.Errorf("negotiateEncoding(%q) = %q, expected %q", header, got, expected)
+			}
+		}
+
+		t.Log("NegotiateEncoding测试通过")
+	})
+
+	t.Run("GzipAndDeflate", func(t *testing.T) {
+		routes := newRoutes(100)
+		plain := request(routes, "/users", "").Body.String()
+
+		w := request(routes, "/users", "gzip")
+		if w.Header().Get("Content-Encoding") != "gzip" || !strings.Contains(w.Header().Get("Vary"), "Accept-Encoding") {
+			t.Fatalf("Expected gzip response, got headers %v", w.Header())
+		}
+		reader, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatalf("Invalid gzip stream: %v", err)
+		}
+		if body, _ := io.ReadAll(reader); string(body) != plain {
+			t.Errorf("Decompressed body mismatch:\n%s\n%s", body, plain)
+		}
+
+		w = request(routes, "/users", "deflate")
+		if w.Header().Get("Content-Encoding") != "deflate" {
+			t.Fatalf("Expected deflate response, got %q", w.Header().Get("Content-Encoding"))
+		}
+		zr, err := zlib.NewReader(w.Body)
+		if err != nil {
+			t.Fatalf("deflate should use the zlib format: %v", err)
+		}
+		if body, _ := io.ReadAll(zr); string(body) != plain {
+			t.Error("Deflate body mismatch")
+		}
+
+		t.Log("GzipAndDeflate测试通过")
+	})
+
+	t.Run("BelowThresholdAndNotModified", func(t *testing.T) {
+		routes := newRoutes(1024)
+
+		w := request(routes, "/health", "gzip")
+		if w.Header().Get("Content-Encoding") != "" || !strings.Contains(w.Body.String(), "healthy") {
+			t.Errorf("Small responses should not be compressed, got %v", w.Header())
+		}
+
+		w = request(routes, "/users/1", "gzip", "If-None-Match", `"v1"`)
+		if w.Code != http.StatusNotModified || w.Header().Get("Content-Encoding") != "" {
+			t.Errorf("304 should pass through uncompressed, got %d %v", w.Code, w.Header())
+		}
+
+		if w := request(NewServer(NewUserHandler(NewUserService(NewInMemoryUserRepository())), "0").Routes(), "/users", "gzip"); w.Header().Get("Content-Encoding") != "" {
+			t.Error("Compression should be disabled without config")
+		}
+
+		t.Log("BelowThresholdAndNotModified测试通过")
+	})
+
+	t.Run("DefaultLevel", func(t *testing.T) {
+		server := NewServerWithConfig(nil, "0", ServerConfig{Compression: &CompressionConfig{MinSize: 1}})
+		body := strings.Repeat("compressible ", 1000)
+		handler := server.compressionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, body)
+		}))
+
+		// Level 为0时使用默认级别，而不是 gzip/zlib 的0级（只存储不压缩）
+		for _, encoding := range []string{"gzip", "deflate"} {
+			w := request(handler, "/", encoding)
+			if w.Header().Get("Content-Encoding") != encoding || w.Body.Len() >= len(body)/10 {
+				t.Errorf("%s: expected compressed body, got %d bytes for %d", encoding, w.Body.Len(), len(body))
+			}
+		}
+
+		// 无效级别在构建中间件时回退为默认级别，而不是让每个压缩响应失败
+		for _, level := range []int{42, -5} {
+			server := NewServerWithConfig(nil, "0", ServerConfig{Compression: &CompressionConfig{MinSize: 1, Level: level}})
+			handler := server.compressionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, body)
+			}))
+			w := request(handler, "/", "gzip")
+			reader, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatalf("Level %d: invalid gzip stream: %v", level, err)
+			}
+			if decoded, _ := io.ReadAll(reader); string(decoded) != body {
+				t.Errorf("Level %d: decompressed body mismatch", level)
+			}
+		}
+
+		// 编码器创建失败时原样输出，不声明 Content-Encoding
+		w := httptest.NewRecorder()
+		cw := &compressWriter{ResponseWriter: w, encoding: "gzip", config: CompressionConfig{MinSize: 1, Level: 42}}
+		cw.Write([]byte(body))
+		if err := cw.close(); err != nil || w.Header().Get("Content-Encoding") != "" || w.Body.String() != body {
+			t.Errorf("Failed encoder should fall back to passthrough, got %v %v", err, w.Header())
+		}
+
+		t.Log("DefaultLevel测试通过")
+	})
+
+	t.Run("EncodedETag", func(t *testing.T) {
+		routes := newRoutes(100)
+
+		w := request(routes, "/users/1", "gzip")
+		if w.Header().Get("Content-Encoding") != "gzip" || w.Header().Get("ETag") != `"v1-gzip"` {
+			t.Fatalf("Compressed response should have its own strong ETag, got %q %q", w.Header().Get("Content-Encoding"), w.Header().Get("ETag"))
+		}
+		if w := request(routes, "/users/1", ""); w.Header().Get("ETag") != `"v1"` {
+			t.Errorf("Uncompressed response should keep the original ETag, got %q", w.Header().Get("ETag"))
+		}
+
+		// 缓存的压缩表示可用于条件请求
+		w = request(routes, "/users/1", "gzip", "If-None-Match", `"v1-gzip"`)
+		if w.Code != http.StatusNotModified || w.Header().Get("ETag") != `"v1-gzip"` {
+			t.Errorf("Expected 304 with the encoded ETag, got %d %q", w.Code, w.Header().Get("ETag"))
+		}
+		w = request(routes, "/users/1", "gzip", "If-None-Match", `"v1"`)
+		if w.Code != http.StatusNotModified || w.Header().Get("ETag") != `"v1"` {
+			t.Errorf("Expected 304 with the plain ETag, got %d %q", w.Code, w.Header().Get("ETag"))
+		}
+
+		req := httptest.NewRequest(http.MethodPut, "/users/1", strings.NewReader(`{"name":"张三","email":"zhangsan@example.com","age":26}`))
+		req.Header.Set("Accept-Encoding", "gzip")
+		req.Header.Set("If-Match", `"v1-gzip"`)
+		w = httptest.NewRecorder()
+		routes.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("If-Match with the encoded ETag should succeed, got %d", w.Code)
+		}
+
+		t.Log("EncodedETag测试通过")
+	})
+
+	t.Run("FlushStartsCompression", func(t *testing.T) {
+		server := NewServerWithConfig(nil, "0", ServerConfig{Compression: &CompressionConfig{MinSize: 1024}})
+		handler := server.compressionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "first\n")
+			w.(http.Flusher).Flush()
+			io.WriteString(w, "second\n")
+		}))
+
+		w := request(handler, "/stream", "gzip")
+		if !w.Flushed || w.Header().Get("Content-Encoding") != "gzip" {
+			t.Fatalf("Flush should start compression below threshold, got %v", w.Header())
+		}
+		reader, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatalf("Invalid gzip stream: %v", err)
+		}
+		if body, _ := io.ReadAll(reader); string(body) != "first\nsecond\n" {
+			t.Errorf("Unexpected streamed body %q", body)
+		}
+
+		t.Log("FlushStartsCompression测试通过")
+	})
+}
+
+func TestMiddleware(t *testing.T) {
+	repo := NewInMemoryUserRepository()
+	service := NewUserService(repo)
+	handler := NewUserHandler(service)
+	server := NewServer(handler, "8080")
+
+	t.Run("CORSMiddleware", func(t *testing.T) {
+		// 安全评审要求不再默认返回 "*"，跨域访问需要显式配置允许的来源
+		cors := DefaultCORSConfig("https://app.example.com")
+		server := NewServerWithConfig(handler, "8080", ServerConfig{CORS: &cors})
+
+		req := httptest.NewRequest(http.MethodOptions, "/users", nil)
+		req.Header.Set("Origin", "https://app.example.com")
+		req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		w := httptest.NewRecorder()
+
+		// 创建一个简单的处理器来测试CORS中间件
+		testHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+
+		corsHandler := server.corsMiddleware(testHandler)
+		corsHandler.ServeHTTP(w, req)
+
+		if w.Code != http.StatusNoContent {
+			t.Errorf("Expected status 204, got %d", w.Code)
 		}
 
 		// 检查CORS头
-		if w.Header().Get("Access-Control-Allow-Origin") != "*" {
+		if w.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" {
 			t.Error("CORS Allow-Origin header not set correctly")
 		}
 
@@ -515,82 +3567,536 @@ func TestMiddleware(t *testing.T) {
 			t.Error("CORS Allow-Methods header not set correctly")
 		}
 
+		if w.Header().Get("Access-Control-Max-Age") != "600" || !strings.Contains(strings.Join(w.Header().Values("Vary"), ","), "Origin") {
+			t.Errorf("Unexpected preflight headers %v", w.Header())
+		}
+
 		t.Log("CORSMiddleware测试通过")
 	})
+
+	t.Run("CORSPolicy", func(t *testing.T) {
+		cors := DefaultCORSConfig("https://app.example.com", "https://*.example.org", "http://localhost:3000")
+		cors.AllowCredentials = true
+		cors.ExposedHeaders = []string{"ETag", "X-Total-Count"}
+		routes := NewServerWithConfig(NewUserHandler(NewUserService(NewInMemoryUserRepository())), "0",
+			ServerConfig{CORS: &cors}).Routes()
+
+		send := func(method, origin string, headers ...string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(method, "/users", nil)
+			if origin != "" {
+				req.Header.Set("Origin", origin)
+			}
+			for i := 0; i+1 < len(headers); i += 2 {
+				req.Header.Set(headers[i], headers[i+1])
+			}
+			w := httptest.NewRecorder()
+			routes.ServeHTTP(w, req)
+			return w
+		}
+
+		allowed := map[string]bool{
+			"https://app.example.com":      true,
+			"HTTPS://APP.EXAMPLE.COM":      true,
+			"https://api.example.org":      true,
+			"https://a.b.example.org":      true,
+			"http://localhost:3000":        true,
+			"https://example.org":          false,
+			"https://evilexample.org":      false,
+			"http://api.example.org":       false,
+			"https://app.example.com.evil": false,
+			"http://localhost:3001":        false,
+			"null":                         false,
+		}
+		for origin, expected := range allowed {
+			w := send(http.MethodGet, origin)
+			got := w.Header().Get("Access-Control-Allow-Origin") != ""
+			if w.Code != http.StatusOK || got != expected {
+				t.Errorf("Origin %s: expected allowed=%v, got %v (status %d)", origin, expected, got, w.Code)
+			}
+		}
+
+		w := send(http.MethodGet, "https://api.example.org")
+		if w.Header().Get("Access-Control-Allow-Origin") != "https://api.example.org" ||
+			w.Header().Get("Access-Control-Allow-Credentials") != "true" ||
+			w.Header().Get("Access-Control-Expose-Headers") != "ETag, X-Total-Count" {
+			t.Errorf("Unexpected actual request headers %v", w.Header())
+		}
+
+		// 不带 Origin 的同源请求不受影响，但仍需 Vary: Origin 避免缓存串用
+		w = send(http.MethodGet, "")
+		if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "" || w.Header().Get("Vary") == "" {
+			t.Errorf("Unexpected same-origin response %d %v", w.Code, w.Header())
+		}
+
+		rejected := [][]string{
+			{"https://evil.com", http.MethodGet, ""},
+			{"https://app.example.com", "TRACE", ""},
+			{"https://app.example.com", http.MethodPost, "Content-Type, X-Custom"},
+		}
+		for _, c := range rejected {
+			w := send(http.MethodOptions, c[0], "Access-Control-Request-Method", c[1], "Access-Control-Request-Headers", c[2])
+			var problem Problem
+			json.NewDecoder(w.Body).Decode(&problem)
+			if w.Code != http.StatusForbidden || problem.Code != CodeCORSRejected || w.Header().Get("Access-Control-Allow-Origin") != "" {
+				t.Errorf("Preflight %v should be rejected, got %d %+v", c, w.Code, problem)
+			}
+		}
+
+		w = send(http.MethodOptions, "https://app.example.com",
+			"Access-Control-Request-Method", http.MethodPatch, "Access-Control-Request-Headers", "content-type, if-match")
+		if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Credentials") != "true" {
+			t.Errorf("Preflight should succeed, got %d %v", w.Code, w.Header())
+		}
+
+		t.Log("CORSPolicy测试通过")
+	})
+
+	t.Run("CORSWildcard", func(t *testing.T) {
+		open := DefaultCORSConfig("*")
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/health", nil)
+		req.Header.Set("Origin", "https://anywhere.test")
+		NewServerWithConfig(handler, "0", ServerConfig{CORS: &open}).Routes().ServeHTTP(w, req)
+		if w.Header().Get("Access-Control-Allow-Origin") != "*" {
+			t.Errorf("Expected wildcard origin, got %q", w.Header().Get("Access-Control-Allow-Origin"))
+		}
+
+		// 允许凭证时 "*" 不生效
+		open.AllowCredentials = true
+		w = httptest.NewRecorder()
+		NewServerWithConfig(handler, "0", ServerConfig{CORS: &open}).Routes().ServeHTTP(w, req)
+		if w.Header().Get("Access-Control-Allow-Origin") != "" {
+			t.Error("Wildcard origin must not be combined with credentials")
+		}
+
+		// 未配置时不发送任何CORS头
+		w = httptest.NewRecorder()
+		server.Routes().ServeHTTP(w, req)
+		if w.Header().Get("Access-Control-Allow-Origin") != "" {
+			t.Error("CORS headers should not be sent without config")
+		}
+
+		t.Log("CORSWildcard测试通过")
+	})
 }
 
-// 集成测试
-func TestIntegration(t *testing.T) {
+func TestRouter(t *testing.T) {
+	// record 返回把标识写入响应的处理器，便于断言命中了哪条路由
+	record := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s id=%s", name, r.PathValue("id"))
+		}
+	}
+	serve := func(handler http.Handler, method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+
+	t.Run("PathParamsAndSpecificity", func(t *testing.T) {
+		router := NewRouter()
+		router.HandleFunc(http.MethodGet, "/users/{id}", record("user"))
+		router.HandleFunc(http.MethodGet, "/users/events", record("events"))
+		router.HandleFunc(http.MethodGet, "/users/{id}/history", record("history"))
+		router.HandleFunc(http.MethodPost, "/users:batch", record("batch"))
+
+		cases := map[string]string{
+			"GET /users/42":         "user id=42",
+			"GET /users/events":     "events id=",
+			"GET /users/7/history":  "history id=7",
+			"POST /users:batch":     "batch id=",
+			"HEAD /users/42":        "user id=42",
+			"GET /users/42/extra":   "",
+			"GET /users/":           "",
+			"GET /users//history":   "",
+			"GET /unknown/resource": "",
+		}
+		for request, expected := range cases {
+			method, path, _ := strings.Cut(request, " ")
+			w := serve(router, method, path)
+			if expected == "" {
+				if w.Code != http.StatusNotFound || decodeProblemBody(t, w).Code != CodeNotFound {
+					t.Errorf("%s: expected 404 not_found, got %d", request, w.Code)
+				}
+				continue
+			}
+			if w.Body.String() != expected {
+				t.Errorf("%s: expected %q, got %q", request, expected, w.Body.String())
+			}
+		}
+
+		t.Log("PathParamsAndSpecificity测试通过")
+	})
+
+	t.Run("MethodNotAllowed", func(t *testing.T) {
+		router := NewRouter()
+		router.HandleFunc(http.MethodGet, "/users/{id}", record("get"))
+		router.HandleFunc(http.MethodDelete, "/users/{id}", record("delete"))
+		router.HandleFunc(http.MethodPut, "/users/{id}", record("put"))
+
+		w := serve(router, http.MethodPost, "/users/1")
+		if w.Code != http.StatusMethodNotAllowed || decodeProblemBody(t, w).Code != CodeMethodNotAllowed {
+			t.Errorf("Expected 405 method_not_allowed, got %d", w.Code)
+		}
+		if allow := w.Header().Get("Allow"); allow != "DELETE, GET, HEAD, OPTIONS, PUT" {
+			t.Errorf("Unexpected Allow header %q", allow)
+		}
+
+		w = serve(router, http.MethodOptions, "/users/1")
+		if w.Code != http.StatusNoContent || w.Header().Get("Allow") == "" {
+			t.Errorf("OPTIONS should return 204 with Allow, got %d %q", w.Code, w.Header().Get("Allow"))
+		}
+
+		t.Log("MethodNotAllowed测试通过")
+	})
+
+	t.Run("Groups", func(t *testing.T) {
+		var order []string
+		tag := func(name string) Middleware {
+			return func(next http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					order = append(order, name)
+					next.ServeHTTP(w, r)
+				})
+			}
+		}
+
+		router := NewRouter()
+		api := router.Group("/api", tag("api"))
+		users := api.Group("/users", tag("users"))
+		users.HandleFunc(http.MethodGet, "/{id}", record("user"))
+		api.Use(tag("late"))
+		api.HandleFunc(http.MethodGet, "/health", record("health"))
+		router.HandleFunc(http.MethodGet, "/public", record("public"))
+
+		if w := serve(router, http.MethodGet, "/api/users/3"); w.Body.String() != "user id=3" {
+			t.Errorf("Group prefixes should combine, got %q", w.Body.String())
+		}
+		if !reflect.DeepEqual(order, []string{"api", "users"}) {
+			t.Errorf("Middleware should run outer group first, got %v", order)
+		}
+
+		order = nil
+		serve(router, http.MethodGet, "/api/health")
+		serve(router, http.MethodGet, "/public")
+		if !reflect.DeepEqual(order, []string{"api", "late"}) {
+			t.Errorf("Group middleware should only wrap the group's routes, got %v", order)
+		}
+
+		expected := []RouteInfo{
+			{Method: http.MethodGet, Pattern: "/api/users/{id}"},
+			{Method: http.MethodGet, Pattern: "/api/health"},
+			{Method: http.MethodGet, Pattern: "/public"},
+		}
+		if routes := router.Routes(); !reflect.DeepEqual(routes, expected) {
+			t.Errorf("Unexpected routes %+v", routes)
+		}
+
+		defer func() {
+			if recover() == nil {
+				t.Error("Duplicate registration should panic")
+			}
+			t.Log("Groups测试通过")
+		}()
+		router.HandleFunc(http.MethodGet, "/public", record("again"))
+	})
+
+	t.Run("ServerRoutes", func(t *testing.T) {
+		server := NewServer(NewUserHandler(NewUserService(NewInMemoryUserRepository())), "0")
+		routes := server.Routes()
+
+		w := serve(routes, http.MethodPut, "/users")
+		if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET, HEAD, OPTIONS, POST" {
+			t.Errorf("Expected 405 with Allow for /users, got %d %q", w.Code, w.Header().Get("Allow"))
+		}
+		// HEAD 由路由分派到 GET 处理器，处理器本身不再检查方法
+		for _, path := range []string{"/users", "/users/1", "/users/1/history", "/health", "/metrics", "/openapi.json"} {
+			if w := serve(routes, http.MethodHead, path); w.Code != http.StatusOK {
+				t.Errorf("HEAD %s: expected 200, got %d", path, w.Code)
+			}
+		}
+		if w := serve(routes, http.MethodGet, "/users/abc"); decodeProblemBody(t, w).Code != CodeInvalidID {
+			t.Errorf("Non-numeric id should be rejected by the handler, got %d", w.Code)
+		}
+
+		w = serve(routes, http.MethodGet, "/")
+		var root struct {
+			Routes []RouteInfo `json:"routes"`
+		}
+		json.NewDecoder(w.Body).Decode(&root)
+		found := false
+		for _, route := range root.Routes {
+			found = found || (route.Method == http.MethodPost && route.Pattern == "/users/{id}/restore")
+		}
+		if !found {
+			t.Errorf("Root endpoint should list registered routes, got %+v", root.Routes)
+		}
+
+		// 路由表只构建一次，根路径等处理器复用同一份
+		if server.router() != server.router() {
+			t.Error("Router should be built once and reused")
+		}
+
+		// 操作由路由派生：每条描述都对应一条路由，除根路径和未启用认证时的登录外，路由都有描述
+		registered := make(map[RouteInfo]bool)
+		for _, route := range server.router().Routes() {
+			registered[route] = true
+		}
+		for _, op := range server.operationDocs() {
+			if !registered[RouteInfo{Method: op.Method, Pattern: op.Path}] {
+				t.Errorf("Operation %s %s has no route", op.Method, op.Path)
+			}
+		}
+		documented := make(map[RouteInfo]bool)
+		for _, op := range server.Operations() {
+			documented[RouteInfo{Method: op.Method, Pattern: op.Path}] = true
+		}
+		for route := range registered {
+			if !documented[route] && route.Pattern != "/" && route.Pattern != "/auth/login" {
+				t.Errorf("Route %s %s has no operation", route.Method, route.Pattern)
+			}
+		}
+		if server.operationTable() != server.operationTable() {
+			t.Error("Operation table should be built once and reused")
+		}
+
+		t.Log("ServerRoutes测试通过")
+	})
+}
+
+// decodeProblemBody 解析问题详情响应体
+func decodeProblemBody(t *testing.T, w *httptest.ResponseRecorder) Problem {
+	t.Helper()
+	var problem Problem
+	if err := json.NewDecoder(w.Body).Decode(&problem); err != nil {
+		t.Fatalf("Failed to decode problem: %v", err)
+	}
+	return problem
+}
+
+func TestUserQuery(t *testing.T) {
+	t.Run("ParseUserQuery", func(t *testing.T) {
+		values, _ := url.ParseQuery("page=2&per_page=5&sort=age,-created_at&email_contains=EXAMPLE&min_age=20")
+		query, err := ParseUserQuery(values)
+		if err != nil {
+			t.Fatalf("ParseUserQuery failed: %v", err)
+		}
+
+		if query.Page != 2 || query.PerPage != 5 {
+			t.Errorf("Expected page 2 per_page 5, got %d %d", query.Page, query.PerPage)
+		}
+
+		if len(query.Sort) != 2 || query.Sort[0].Field != "age" || query.Sort[0].Desc || !query.Sort[1].Desc {
+			t.Errorf("Unexpected sort fields: %+v", query.Sort)
+		}
+
+		if query.Filter.MinAge == nil || *query.Filter.MinAge != 20 || query.Filter.MaxAge != nil {
+			t.Errorf("Unexpected age filter: %+v", query.Filter)
+		}
+
+		t.Log("ParseUserQuery测试通过")
+	})
+
+	t.Run("ParseUserQueryInvalid", func(t *testing.T) {
+		invalid := []string{"page=0", "per_page=abc", "per_page=1000", "sort=password", "min_age=x"}
+		for _, raw := range invalid {
+			values, _ := url.ParseQuery(raw)
+			if _, err := ParseUserQuery(values); err == nil {
+				t.Errorf("Expected error for %q", raw)
+			}
+		}
+
+		t.Log("ParseUserQueryInvalid测试通过")
+	})
+
+	t.Run("Apply", func(t *testing.T) {
+		users := []User{
+			{ID: 1, Name: "A", Email: "a@example.com", Age: 30},
+			{ID: 2, Name: "B", Email: "b@test.com", Age: 25},
+			{ID: 3, Name: "C", Email: "c@example.com", Age: 25},
+			{ID: 4, Name: "D", Email: "d@example.com", Age: 40},
+		}
+
+		query := UserQuery{
+			PerPage: 2,
+			Sort:    []SortField{{Field: "age"}, {Field: "id", Desc: true}},
+			Filter:  UserFilter{EmailContains: "Example"},
+		}
+
+		page := query.Apply(users)
+		if page.Total != 3 {
+			t.Errorf("Expected total 3, got %d", page.Total)
+		}
+
+		if len(page.Users) != 2 || page.Users[0].ID != 3 || page.Users[1].ID != 1 {
+			t.Errorf("Unexpected first page: %+v", page.Users)
+		}
+
+		query.Page = 2
+		page = query.Apply(users)
+		if len(page.Users) != 1 || page.Users[0].ID != 4 {
+			t.Errorf("Unexpected second page: %+v", page.Users)
+		}
+
+		query.Page = 10
+		page = query.Apply(users)
+		if len(page.Users) != 0 || page.Users == nil {
+			t.Errorf("Expected empty non-nil page, got %+v", page.Users)
+		}
+
+		query.Page = math.MaxInt
+		page = query.Apply(users)
+		if len(page.Users) != 0 || page.Total != 3 {
+			t.Errorf("Expected empty page for huge page number, got %+v", page)
+		}
+
+		t.Log("Apply测试通过")
+	})
+}
+
+func TestGetUsersPagination(t *testing.T) {
 	repo := NewInMemoryUserRepository()
 	service := NewUserService(repo)
 	handler := NewUserHandler(service)
 
-	t.Run("CompleteUserLifecycle", func(t *testing.T) {
-		// 1. 创建用户
-		user := User{
-			Name:  "集成测试用户",
-			Email: "integration@example.com",
-			Age:   25,
+	t.Run("PageWithLinks", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/users?page=2&per_page=1&sort=-age", nil)
+		w := httptest.NewRecorder()
+
+		handler.GetUsers(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", w.Code)
 		}
 
-		jsonData, _ := json.Marshal(user)
-		req := httptest.NewRequest(http.MethodPost, "/users", bytes.NewBuffer(jsonData))
-		req.Header.Set("Content-Type", "application/json")
-		w := httptest.NewRecorder()
+		if w.Header().Get("X-Total-Count") != "3" {
+			t.Errorf("Expected X-Total-Count 3, got %s", w.Header().Get("X-Total-Count"))
+		}
 
-		handler.CreateUser(w, req)
+		link := w.Header().Get("Link")
+		for _, rel := range []string{`rel="first"`, `rel="prev"`, `rel="next"`, `rel="last"`} {
+			if !strings.Contains(link, rel) {
+				t.Errorf("Link header missing %s: %s", rel, link)
+			}
+		}
 
-		if w.Code != http.StatusCreated {
-			t.Fatalf("Failed to create user: status %d", w.Code)
+		var users []User
+		json.NewDecoder(w.Body).Decode(&users)
+		if len(users) != 1 || users[0].Age != 28 { // 种子数据年龄: 30, 28, 25
+			t.Errorf("Expected second oldest user, got %+v", users)
 		}
 
-		var createdUser User
-		json.NewDecoder(w.Body).Decode(&createdUser)
+		t.Log("PageWithLinks测试通过")
+	})
 
-		// 2. 获取用户
-		req = httptest.NewRequest(http.MethodGet, "/users/"+fmt.Sprintf("%d", createdUser.ID), nil)
-		w = httptest.NewRecorder()
+	t.Run("HugePage", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/users?page=9223372036854775807", nil)
+		w := httptest.NewRecorder()
 
-		handler.GetUser(w, req)
+		handler.GetUsers(w, req)
 
 		if w.Code != http.StatusOK {
-			t.Fatalf("Failed to get user: status %d", w.Code)
+			t.Fatalf("Expected status 200, got %d", w.Code)
+		}
+		var users []User
+		json.NewDecoder(w.Body).Decode(&users)
+		if len(users) != 0 {
+			t.Errorf("Expected empty page, got %+v", users)
+		}
+		if link := w.Header().Get("Link"); strings.Contains(link, `rel="next"`) {
+			t.Errorf("Page past the end should not link to a next page: %s", link)
 		}
 
-		// 3. 更新用户
-		createdUser.Name = "更新的集成测试用户"
-		jsonData, _ = json.Marshal(createdUser)
-		req = httptest.NewRequest(http.MethodPut, "/users/"+fmt.Sprintf("%d", createdUser.ID), bytes.NewBuffer(jsonData))
-		req.Header.Set("Content-Type", "application/json")
-		w = httptest.NewRecorder()
+		t.Log("HugePage测试通过")
+	})
 
-		handler.UpdateUser(w, req)
+	t.Run("InvalidQuery", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/users?sort=unknown", nil)
+		w := httptest.NewRecorder()
 
-		if w.Code != http.StatusOK {
-			t.Fatalf("Failed to update user: status %d", w.Code)
+		handler.GetUsers(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d", w.Code)
 		}
 
-		// 4. 删除用户
-		req = httptest.NewRequest(http.MethodDelete, "/users/"+fmt.Sprintf("%d", createdUser.ID), nil)
-		w = httptest.NewRecorder()
+		t.Log("InvalidQuery测试通过")
+	})
+}
 
-		handler.DeleteUser(w, req)
+// 集成测试
+func TestIntegration(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo UserRepository) {
+		service := NewUserService(repo)
+		handler := NewUserHandler(service)
 
-		if w.Code != http.StatusNoContent {
-			t.Fatalf("Failed to delete user: status %d", w.Code)
-		}
+		t.Run("CompleteUserLifecycle", func(t *testing.T) {
+			// 1. 创建用户
+			user := User{
+				Name:  "集成测试用户",
+				Email: "integration@example.com",
+				Age:   25,
+			}
 
-		// 5. 验证用户已删除
-		req = httptest.NewRequest(http.MethodGet, "/users/"+fmt.Sprintf("%d", createdUser.ID), nil)
-		w = httptest.NewRecorder()
+			jsonData, _ := json.Marshal(user)
+			req := httptest.NewRequest(http.MethodPost, "/users", bytes.NewBuffer(jsonData))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
 
-		handler.GetUser(w, req)
+			handler.CreateUser(w, req)
 
-		if w.Code != http.StatusNotFound {
-			t.Fatalf("User should be deleted: status %d", w.Code)
-		}
+			if w.Code != http.StatusCreated {
+				t.Fatalf("Failed to create user: status %d", w.Code)
+			}
+
+			var createdUser User
+			json.NewDecoder(w.Body).Decode(&createdUser)
+
+			// 2. 获取用户
+			req = httptest.NewRequest(http.MethodGet, "/users/"+fmt.Sprintf("%d", createdUser.ID), nil)
+			w = httptest.NewRecorder()
+
+			serveRoute("/users/{id}", handler.GetUser, w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("Failed to get user: status %d", w.Code)
+			}
+
+			// 3. 更新用户
+			createdUser.Name = "更新的集成测试用户"
+			jsonData, _ = json.Marshal(createdUser)
+			req = httptest.NewRequest(http.MethodPut, "/users/"+fmt.Sprintf("%d", createdUser.ID), bytes.NewBuffer(jsonData))
+			req.Header.Set("Content-Type", "application/json")
+			w = httptest.NewRecorder()
+
+			serveRoute("/users/{id}", handler.UpdateUser, w, req)
 
-		t.Log("CompleteUserLifecycle测试通过")
+			if w.Code != http.StatusOK {
+				t.Fatalf("Failed to update user: status %d", w.Code)
+			}
+
+			// 4. 删除用户
+			req = httptest.NewRequest(http.MethodDelete, "/users/"+fmt.Sprintf("%d", createdUser.ID), nil)
+			w = httptest.NewRecorder()
+
+			serveRoute("/users/{id}", handler.DeleteUser, w, req)
+
+			if w.Code != http.StatusNoContent {
+				t.Fatalf("Failed to delete user: status %d", w.Code)
+			}
+
+			// 5. 验证用户已删除
+			req = httptest.NewRequest(http.MethodGet, "/users/"+fmt.Sprintf("%d", createdUser.ID), nil)
+			w = httptest.NewRecorder()
+
+			serveRoute("/users/{id}", handler.GetUser, w, req)
+
+			if w.Code != http.StatusNotFound {
+				t.Fatalf("User should be deleted: status %d", w.Code)
+			}
+
+			t.Log("CompleteUserLifecycle测试通过")
+		})
 	})
 }
 
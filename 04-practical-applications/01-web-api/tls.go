@@ -0,0 +1,183 @@
+package webapi
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	security "golang-examples/04-practical-applications/07-security"
+)
+
+// TLSConfig HTTPS配置
+//
+// 证书来源按优先级依次为：CertPEM/KeyPEM、CertFile/KeyFile、SelfSigned 自动生成。
+// 配置了客户端CA时启用双向TLS，客户端必须出示由该CA签发的证书。
+type TLSConfig struct {
+	CertFile string // PEM证书文件，可包含中间证书链
+	KeyFile  string // PEM私钥文件（PKCS#1、PKCS#8 或 EC）
+	CertPEM  []byte // 直接提供的PEM证书，如由 security.RSAKeyPair 导出的密钥签发
+	KeyPEM   []byte
+
+	// SelfSigned 为 true 且未提供证书时自动生成自签名证书，仅用于本地开发
+	SelfSigned bool
+	Hosts      []string // 自签名证书的主机名和IP，为空时使用 localhost、127.0.0.1 和 ::1
+
+	ClientCAFile string             // 校验客户端证书的CA文件（PEM）
+	ClientCAPEM  []byte             // 直接提供的客户端CA证书
+	ClientAuth   tls.ClientAuthType // 客户端证书策略，配置了CA且为零值时要求并校验客户端证书
+
+	MinVersion uint16 // 最低TLS版本，0 表示 TLS 1.2
+
+	// RedirectAddr 非空时额外监听该地址的HTTP请求并重定向到HTTPS，如 ":8080"
+	RedirectAddr string
+}
+
+// selfSignedValidity 自签名证书的有效期
+const selfSignedValidity = 365 * 24 * time.Hour
+
+// GenerateSelfSignedCert 生成自签名证书和私钥（PEM格式）
+//
+// 密钥由 security.GenerateRSAKeyPair 生成并以其导出的PKCS#8格式保存。
+// 证书同时可用于服务端和客户端认证，也可作为CA校验自身，便于本地测试双向TLS。
+func GenerateSelfSignedCert(hosts []string, validFor time.Duration) (certPEM, keyPEM []byte, err error) {
+	if len(hosts) == 0 {
+		hosts = []string{"localhost", "127.0.0.1", "::1"}
+	}
+
+	keyPair, err := security.GenerateRSAKeyPair(2048)
+	if err != nil {
+		return nil, nil, err
+	}
+	privateKeyPEM, err := keyPair.ExportPrivateKeyPEM()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, fmt.Errorf("生成证书序列号失败: %v", err)
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hosts[0], Organization: []string{"webapi 开发证书"}},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(validFor),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, keyPair.PublicKey, keyPair.PrivateKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("生成自签名证书失败: %v", err)
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return certPEM, []byte(privateKeyPEM), nil
+}
+
+// buildTLSConfig 根据配置加载证书和客户端CA
+func buildTLSConfig(config TLSConfig) (*tls.Config, error) {
+	certificate, err := loadCertificate(config)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   config.MinVersion,
+		ClientAuth:   config.ClientAuth,
+	}
+	if tlsConfig.MinVersion == 0 {
+		tlsConfig.MinVersion = tls.VersionTLS12
+	}
+
+	caPEM := config.ClientCAPEM
+	if len(caPEM) == 0 && config.ClientCAFile != "" {
+		if caPEM, err = os.ReadFile(config.ClientCAFile); err != nil {
+			return nil, fmt.Errorf("读取客户端CA失败: %v", err)
+		}
+	}
+	if len(caPEM) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, errors.New("客户端CA中没有有效的PEM证书")
+		}
+		tlsConfig.ClientCAs = pool
+		if tlsConfig.ClientAuth == tls.NoClientCert {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// loadCertificate 按优先级加载服务端证书
+func loadCertificate(config TLSConfig) (tls.Certificate, error) {
+	switch {
+	case len(config.CertPEM) > 0 || len(config.KeyPEM) > 0:
+		certificate, err := tls.X509KeyPair(config.CertPEM, config.KeyPEM)
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("解析PEM证书失败: %v", err)
+		}
+		return certificate, nil
+	case config.CertFile != "" || config.KeyFile != "":
+		certificate, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("加载证书文件失败: %v", err)
+		}
+		return certificate, nil
+	case config.SelfSigned:
+		certPEM, keyPEM, err := GenerateSelfSignedCert(config.Hosts, selfSignedValidity)
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		return tls.X509KeyPair(certPEM, keyPEM)
+	default:
+		return tls.Certificate{}, errors.New("启用TLS需要提供证书或开启 SelfSigned")
+	}
+}
+
+// httpsRedirectHandler 将HTTP请求重定向到同一主机的HTTPS端口
+//
+// GET 和 HEAD 使用301；其他方法使用308，要求客户端保留方法和请求体重新发送。
+func httpsRedirectHandler(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = strings.Trim(r.Host, "[]") // 请求未携带端口
+		}
+		switch {
+		case httpsPort != "443":
+			host = net.JoinHostPort(host, httpsPort)
+		case strings.Contains(host, ":"):
+			host = "[" + host + "]" // IPv6地址
+		}
+
+		status := http.StatusPermanentRedirect
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			status = http.StatusMovedPermanently
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), status)
+	})
+}
@@ -0,0 +1,175 @@
+package webapi
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"golang-examples/03-practical-examples/01-package-management/stringutils"
+)
+
+// validationRule validate 标签中的一条规则，如 "max=100" 解析为 {Key: "max", Value: "100"}
+type validationRule struct {
+	Key   string
+	Value string
+}
+
+// parseValidateTag 解析 validate 标签，规则之间以逗号分隔
+//
+// 支持的规则: required, min=N, max=N（数值为取值范围，字符串为长度）, email, oneof=a b c, readonly。
+// OpenAPI schema 生成和 ValidateStruct 共用同一套规则，文档与服务端校验保持一致。
+func parseValidateTag(tag string) []validationRule {
+	var rules []validationRule
+	for _, part := range strings.Split(tag, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if key != "" {
+			rules = append(rules, validationRule{Key: key, Value: value})
+		}
+	}
+	return rules
+}
+
+// jsonFieldName 返回字段的JSON名称，json:"-" 的字段返回 false
+func jsonFieldName(field reflect.StructField) (string, bool) {
+	tag := field.Tag.Get("json")
+	if tag == "-" {
+		return "", false
+	}
+	if name, _, _ := strings.Cut(tag, ","); name != "" {
+		return name, true
+	}
+	return field.Name, true
+}
+
+// ValidateStruct 按 validate 标签校验结构体，返回包含全部不合法字段的 *ValidationError
+//
+// 字段路径使用JSON名称，嵌套结构体和切片元素以 "." 连接（如 items.0.name）；
+// readonly 字段由服务端维护，不做校验。
+func ValidateStruct(value interface{}) error {
+	verr := &ValidationError{}
+	validateValue(reflect.ValueOf(value), "", verr)
+	if verr.HasErrors() {
+		return verr
+	}
+	return nil
+}
+
+// validateValue 递归校验结构体字段以及切片中的结构体
+func validateValue(v reflect.Value, path string, verr *ValidationError) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			validateValue(v.Index(i), joinField(path, strconv.Itoa(i)), verr)
+		}
+	case reflect.Struct:
+		if v.Type() == timeType {
+			return
+		}
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, ok := jsonFieldName(field)
+			if !field.IsExported() || !ok {
+				continue
+			}
+
+			rules := parseValidateTag(field.Tag.Get("validate"))
+			if hasRule(rules, "readonly") {
+				continue
+			}
+			fieldPath := joinField(path, name)
+			validateField(v.Field(i), fieldPath, rules, verr)
+			validateValue(v.Field(i), fieldPath, verr)
+		}
+	}
+}
+
+// validateField 对单个字段应用规则，必填字段缺失时不再检查其他规则
+func validateField(v reflect.Value, field string, rules []validationRule, verr *ValidationError) {
+	if hasRule(rules, "required") && isBlank(v) {
+		verr.Add(field, field+" 是必填字段")
+		return
+	}
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+
+	for _, rule := range rules {
+		switch rule.Key {
+		case "email":
+			if s := v.String(); v.Kind() == reflect.String && s != "" && !stringutils.IsEmail(s) {
+				verr.Add(field, field+" 邮箱格式不正确")
+			}
+		case "oneof":
+			options := strings.Fields(rule.Value)
+			if v.Kind() == reflect.String && !containsString(options, v.String()) {
+				verr.Add(field, fmt.Sprintf("%s 必须是 %s 之一", field, strings.Join(options, ", ")))
+			}
+		case "min", "max":
+			limit, err := strconv.ParseFloat(rule.Value, 64)
+			if err != nil {
+				continue
+			}
+			checkBound(v, field, rule.Key, limit, verr)
+		}
+	}
+}
+
+// checkBound 检查 min/max：字符串比较字符数，数值比较取值
+func checkBound(v reflect.Value, field, key string, limit float64, verr *ValidationError) {
+	var n float64
+	switch v.Kind() {
+	case reflect.String:
+		length := float64(len([]rune(v.String())))
+		if key == "min" && length < limit {
+			verr.Add(field, fmt.Sprintf("%s 长度不能少于 %s", field, formatFloat(limit)))
+		}
+		if key == "max" && length > limit {
+			verr.Add(field, fmt.Sprintf("%s 长度不能超过 %s", field, formatFloat(limit)))
+		}
+		return
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n = float64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n = float64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		n = v.Float()
+	default:
+		return
+	}
+
+	if key == "min" && n < limit {
+		verr.Add(field, fmt.Sprintf("%s 不能小于 %s", field, formatFloat(limit)))
+	}
+	if key == "max" && n > limit {
+		verr.Add(field, fmt.Sprintf("%s 不能大于 %s", field, formatFloat(limit)))
+	}
+}
+
+// isBlank 判断必填字段是否缺失：字符串去掉空白后为空，其他类型为零值
+func isBlank(v reflect.Value) bool {
+	if v.Kind() == reflect.String {
+		return strings.TrimSpace(v.String()) == ""
+	}
+	return v.IsZero()
+}
+
+func hasRule(rules []validationRule, key string) bool {
+	for _, rule := range rules {
+		if rule.Key == key {
+			return true
+		}
+	}
+	return false
+}
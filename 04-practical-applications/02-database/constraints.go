@@ -0,0 +1,96 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ConstraintProductCategory 产品分类外键约束：products.category_id 引用 categories.id
+//
+// CategoryID 为0表示产品未分类（相当于NULL），不受约束检查。
+const ConstraintProductCategory = "fk_products_category"
+
+// 约束错误，通过 errors.Is 判断违反的约束类型
+var (
+	ErrForeignKeyViolation = errors.New("违反外键约束: 引用的记录不存在")
+	ErrRestrictViolation   = errors.New("违反外键约束: 记录仍被引用")
+)
+
+// ConstraintError 违反约束的详细信息
+type ConstraintError struct {
+	Constraint  string // 约束名，如 ConstraintProductCategory
+	Table       string // 引用方表名
+	Column      string // 引用方列名
+	Value       int    // 外键值，即被引用记录的ID
+	Referencing []int  // 违反 RESTRICT 时仍引用该记录的行ID，升序排列
+	err         error
+}
+
+// Error 实现 error 接口
+func (e *ConstraintError) Error() string {
+	if len(e.Referencing) > 0 {
+		return fmt.Sprintf("%v (%s): %s.%s = %d 被 %d 行引用", e.err, e.Constraint, e.Table, e.Column, e.Value, len(e.Referencing))
+	}
+	return fmt.Sprintf("%v (%s): %s.%s = %d", e.err, e.Constraint, e.Table, e.Column, e.Value)
+}
+
+// Unwrap 返回 ErrForeignKeyViolation 或 ErrRestrictViolation
+func (e *ConstraintError) Unwrap() error {
+	return e.err
+}
+
+// ReferentialAction 删除被引用记录时对引用方的处理方式
+type ReferentialAction int
+
+const (
+	OnDeleteRestrict ReferentialAction = iota // 仍被引用时拒绝删除
+	OnDeleteCascade                           // 同时删除引用方
+	OnDeleteSetNull                           // 将引用方的外键置为0（未分类）
+)
+
+// String 返回处理方式的SQL名称
+func (a ReferentialAction) String() string {
+	switch a {
+	case OnDeleteRestrict:
+		return "RESTRICT"
+	case OnDeleteCascade:
+		return "CASCADE"
+	case OnDeleteSetNull:
+		return "SET NULL"
+	default:
+		return fmt.Sprintf("ReferentialAction(%d)", int(a))
+	}
+}
+
+// checkProductCategory 检查产品引用的分类是否存在
+func checkProductCategory(product *SimpleProduct, categoryExists func(id int) bool) error {
+	if product.CategoryID == 0 || categoryExists(product.CategoryID) {
+		return nil
+	}
+	return &ConstraintError{
+		Constraint: ConstraintProductCategory,
+		Table:      "products",
+		Column:     "category_id",
+		Value:      product.CategoryID,
+		err:        ErrForeignKeyViolation,
+	}
+}
+
+// restrictError 分类仍被产品引用时的错误
+func restrictError(categoryID int, productIDs map[int]struct{}) error {
+	referencing := make([]int, 0, len(productIDs))
+	for id := range productIDs {
+		referencing = append(referencing, id)
+	}
+	sort.Ints(referencing)
+
+	return &ConstraintError{
+		Constraint:  ConstraintProductCategory,
+		Table:       "products",
+		Column:      "category_id",
+		Value:       categoryID,
+		Referencing: referencing,
+		err:         ErrRestrictViolation,
+	}
+}
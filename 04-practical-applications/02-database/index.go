@@ -0,0 +1,120 @@
+package database
+
+import (
+	"sort"
+	"strings"
+)
+
+// secondaryIndex 二级索引
+//
+// 索引与表由同一把写锁保护，只在 applyOp 中维护，因此普通写入、事务提交和恢复重放都会同步更新索引。
+// 事务读取的是表的快照，不使用这些索引。
+type secondaryIndex struct {
+	productsByCategory map[int]map[int]struct{}    // 分类ID -> 产品ID集合
+	usersByEmail       map[string]map[int]struct{} // 规范化邮箱 -> 用户ID集合，邮箱不要求唯一
+	productsByPrice    []priceEntry                // 按价格（相同时按ID）升序排列
+}
+
+// priceEntry 价格索引中的一项
+type priceEntry struct {
+	price float64
+	id    int
+}
+
+// less 按价格、ID排序
+func (e priceEntry) less(other priceEntry) bool {
+	if e.price != other.price {
+		return e.price < other.price
+	}
+	return e.id < other.id
+}
+
+func newSecondaryIndex() secondaryIndex {
+	return secondaryIndex{
+		productsByCategory: make(map[int]map[int]struct{}),
+		usersByEmail:       make(map[string]map[int]struct{}),
+	}
+}
+
+// emailKey 邮箱的索引键，不区分大小写
+func emailKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// addUser 将用户加入索引
+func (idx *secondaryIndex) addUser(user *SimpleUser) {
+	key := emailKey(user.Email)
+	if key == "" {
+		return
+	}
+	addToSet(idx.usersByEmail, key, user.ID)
+}
+
+// removeUser 从索引中移除用户
+func (idx *secondaryIndex) removeUser(user *SimpleUser) {
+	removeFromSet(idx.usersByEmail, emailKey(user.Email), user.ID)
+}
+
+// addProduct 将产品加入分类索引和价格索引
+func (idx *secondaryIndex) addProduct(product *SimpleProduct) {
+	addToSet(idx.productsByCategory, product.CategoryID, product.ID)
+
+	entry := priceEntry{price: product.Price, id: product.ID}
+	i := idx.searchPrice(entry)
+	idx.productsByPrice = append(idx.productsByPrice, priceEntry{})
+	copy(idx.productsByPrice[i+1:], idx.productsByPrice[i:])
+	idx.productsByPrice[i] = entry
+}
+
+// removeProduct 从分类索引和价格索引中移除产品
+func (idx *secondaryIndex) removeProduct(product *SimpleProduct) {
+	removeFromSet(idx.productsByCategory, product.CategoryID, product.ID)
+
+	entry := priceEntry{price: product.Price, id: product.ID}
+	if i := idx.searchPrice(entry); i < len(idx.productsByPrice) && idx.productsByPrice[i] == entry {
+		idx.productsByPrice = append(idx.productsByPrice[:i], idx.productsByPrice[i+1:]...)
+	}
+}
+
+// searchPrice 返回价格索引中第一个不小于 entry 的位置
+func (idx *secondaryIndex) searchPrice(entry priceEntry) int {
+	return sort.Search(len(idx.productsByPrice), func(i int) bool {
+		return !idx.productsByPrice[i].less(entry)
+	})
+}
+
+// priceRange 返回价格在 [minPrice, maxPrice] 内的产品ID，按价格升序
+func (idx *secondaryIndex) priceRange(minPrice, maxPrice float64) []int {
+	start := sort.Search(len(idx.productsByPrice), func(i int) bool {
+		return idx.productsByPrice[i].price >= minPrice
+	})
+
+	var ids []int
+	for _, entry := range idx.productsByPrice[start:] {
+		if entry.price > maxPrice {
+			break
+		}
+		ids = append(ids, entry.id)
+	}
+	return ids
+}
+
+func addToSet[K comparable](sets map[K]map[int]struct{}, key K, id int) {
+	set, exists := sets[key]
+	if !exists {
+		set = make(map[int]struct{})
+		sets[key] = set
+	}
+	set[id] = struct{}{}
+}
+
+func removeFromSet[K comparable](sets map[K]map[int]struct{}, key K, id int) {
+	set, exists := sets[key]
+	if !exists {
+		return
+	}
+	delete(set, id)
+	if len(set) == 0 {
+		delete(sets, key)
+	}
+}
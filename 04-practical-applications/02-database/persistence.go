@@ -0,0 +1,536 @@
+package database
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// 持久化文件名
+const (
+	walFileName      = "wal.log"
+	snapshotFileName = "snapshot.db"
+)
+
+// defaultSnapshotEvery 默认每追加多少条WAL记录生成一次快照
+const defaultSnapshotEvery = 1000
+
+// 记录帧格式：4字节小端长度 + 4字节小端CRC32C校验和（覆盖长度和负载） + JSON负载
+const (
+	frameHeaderSize = 8
+	maxFrameSize    = 64 << 20
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// 持久化错误
+var (
+	ErrWALCorrupt     = errors.New("WAL文件损坏")
+	ErrDatabaseClosed = errors.New("数据库已关闭")
+)
+
+// WAL操作类型
+const (
+	walPutUser        = "user.put"
+	walDeleteUser     = "user.delete"
+	walPutCategory    = "category.put"
+	walDeleteCategory = "category.delete"
+	walPutProduct     = "product.put"
+	walDeleteProduct  = "product.delete"
+)
+
+// PersistenceConfig 持久化配置
+type PersistenceConfig struct {
+	Dir string // 数据目录，不存在时自动创建
+
+	// SnapshotEvery 每追加多少条WAL记录生成一次快照并清空WAL，
+	// 0 表示使用默认值，负数表示只在调用 Snapshot 或 Close 时生成
+	SnapshotEvery int
+
+	// ErrorLog 记录写入之后自动快照失败等不影响写入结果的错误，nil 表示使用 log 包的默认 Logger
+	ErrorLog *log.Logger
+}
+
+// walOp 对一行数据的写入或删除，行为nil时表示删除
+type walOp struct {
+	Op       string          `json:"op"`
+	ID       int             `json:"id"`
+	User     *SimpleUser     `json:"user,omitempty"`
+	Category *SimpleCategory `json:"category,omitempty"`
+	Product  *SimpleProduct  `json:"product,omitempty"`
+}
+
+func userOp(id int, user *SimpleUser) walOp {
+	if user == nil {
+		return walOp{Op: walDeleteUser, ID: id}
+	}
+	return walOp{Op: walPutUser, ID: id, User: user}
+}
+
+func categoryOp(id int, category *SimpleCategory) walOp {
+	if category == nil {
+		return walOp{Op: walDeleteCategory, ID: id}
+	}
+	return walOp{Op: walPutCategory, ID: id, Category: category}
+}
+
+func productOp(id int, product *SimpleProduct) walOp {
+	if product == nil {
+		return walOp{Op: walDeleteProduct, ID: id}
+	}
+	return walOp{Op: walPutProduct, ID: id, Product: product}
+}
+
+// walRecord WAL中的一条记录，一次修改或一个事务的全部写入，恢复时整体应用或整体丢弃
+type walRecord struct {
+	LSN        uint64  `json:"lsn"`
+	NextUserID int     `json:"next_user_id"`
+	NextCatID  int     `json:"next_category_id"`
+	NextProdID int     `json:"next_product_id"`
+	Ops        []walOp `json:"ops"`
+}
+
+// snapshot 某个LSN时刻的全部数据
+type snapshot struct {
+	LSN        uint64            `json:"lsn"`
+	NextUserID int               `json:"next_user_id"`
+	NextCatID  int               `json:"next_category_id"`
+	NextProdID int               `json:"next_product_id"`
+	Users      []*SimpleUser     `json:"users"`
+	Categories []*SimpleCategory `json:"categories"`
+	Products   []*SimpleProduct  `json:"products"`
+}
+
+// writeAheadLog 预写日志状态，所有字段由 SimpleDatabaseManager 的写锁保护
+type writeAheadLog struct {
+	dir           string
+	file          *os.File
+	lsn           uint64 // 最后一条已写入记录的LSN
+	records       int    // 上次快照之后追加的记录数
+	snapshotEvery int
+	errorLog      *log.Logger
+}
+
+// logf 记录后台错误
+func (w *writeAheadLog) logf(format string, args ...any) {
+	if w.errorLog != nil {
+		w.errorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// OpenSimpleDatabaseManager 打开（或创建）持久化的数据库管理器
+//
+// 每次修改先以带校验和的记录追加到WAL并fsync，再应用到内存；
+// 定期将全部数据写入快照文件并清空WAL。打开时加载快照并重放WAL，
+// 崩溃导致的残缺末尾记录会被截掉；WAL中间的记录损坏则返回 ErrWALCorrupt。
+// 新建的数据目录为空，不写入内存模式的示例数据。
+//
+// 恢复需要读取文件，可能失败，因此不作为 NewSimpleDatabaseManager 的选项：
+// 后者没有错误返回值，内存模式也不需要。
+func OpenSimpleDatabaseManager(config PersistenceConfig) (*SimpleDatabaseManager, error) {
+	if config.Dir == "" {
+		return nil, errors.New("持久化需要指定数据目录")
+	}
+	if err := os.MkdirAll(config.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("创建数据目录失败: %v", err)
+	}
+
+	snapshotEvery := config.SnapshotEvery
+	if snapshotEvery == 0 {
+		snapshotEvery = defaultSnapshotEvery
+	}
+
+	dm := newSimpleDatabaseManager()
+	wal := &writeAheadLog{dir: config.Dir, snapshotEvery: snapshotEvery, errorLog: config.ErrorLog}
+
+	if err := dm.loadSnapshot(wal); err != nil {
+		return nil, err
+	}
+	if err := dm.replayWAL(wal); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(filepath.Join(config.Dir, walFileName), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("打开WAL文件失败: %v", err)
+	}
+	wal.file = file
+	dm.wal = wal
+	return dm, nil
+}
+
+// loadSnapshot 加载快照文件，快照不存在时不做任何事
+func (dm *SimpleDatabaseManager) loadSnapshot(wal *writeAheadLog) error {
+	data, err := os.ReadFile(filepath.Join(wal.dir, snapshotFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("读取快照失败: %v", err)
+	}
+
+	// 快照通过原子重命名写入，不会出现残缺，校验失败说明文件已损坏
+	payload, err := decodeFrame(data)
+	if err != nil {
+		return fmt.Errorf("快照文件损坏: %v", err)
+	}
+	var snap snapshot
+	if err := json.Unmarshal(payload, &snap); err != nil {
+		return fmt.Errorf("快照文件损坏: %v", err)
+	}
+
+	for _, user := range snap.Users {
+		dm.applyOp(userOp(user.ID, user))
+	}
+	for _, category := range snap.Categories {
+		dm.applyOp(categoryOp(category.ID, category))
+	}
+	for _, product := range snap.Products {
+		dm.applyOp(productOp(product.ID, product))
+	}
+	dm.advanceSequences(snap.NextUserID, snap.NextCatID, snap.NextProdID)
+	wal.lsn = snap.LSN
+	return nil
+}
+
+// replayWAL 重放快照之后的WAL记录并截掉残缺的末尾
+func (dm *SimpleDatabaseManager) replayWAL(wal *writeAheadLog) error {
+	path := filepath.Join(wal.dir, walFileName)
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("打开WAL文件失败: %v", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("读取WAL文件信息失败: %v", err)
+	}
+	size := info.Size()
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	for offset < size {
+		// 记录头不完整：写入时崩溃留下的残缺记录
+		if size-offset < frameHeaderSize {
+			break
+		}
+		var header [frameHeaderSize]byte
+		if _, err := io.ReadFull(reader, header[:]); err != nil {
+			return fmt.Errorf("读取WAL失败: %v", err)
+		}
+		length := int64(binary.LittleEndian.Uint32(header[:4]))
+		if length > maxFrameSize {
+			return fmt.Errorf("%w: 偏移 %d 处的记录长度 %d 超出上限", ErrWALCorrupt, offset, length)
+		}
+		end := offset + frameHeaderSize + length
+		if end > size {
+			// 只有最后一条记录才可能是残缺的；之后还有完整记录说明是长度字段损坏
+			rest, err := io.ReadAll(reader)
+			if err != nil {
+				return fmt.Errorf("读取WAL失败: %v", err)
+			}
+			if containsFrame(rest) {
+				return fmt.Errorf("%w: 偏移 %d 处的记录长度 %d 超出文件末尾", ErrWALCorrupt, offset, length)
+			}
+			break
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return fmt.Errorf("读取WAL失败: %v", err)
+		}
+		var record walRecord
+		if frameChecksum(header[:4], payload) != binary.LittleEndian.Uint32(header[4:]) {
+			// 最后一条记录校验失败同样是写入未完成，之后还有数据则是真正的损坏
+			if end == size {
+				break
+			}
+			return fmt.Errorf("%w: 偏移 %d 处的记录校验和不匹配", ErrWALCorrupt, offset)
+		}
+		if err := json.Unmarshal(payload, &record); err != nil {
+			return fmt.Errorf("%w: 偏移 %d 处的记录无法解码: %v", ErrWALCorrupt, offset, err)
+		}
+
+		// 快照之后、清空WAL之前崩溃时，WAL中会留有快照已包含的记录
+		if record.LSN > wal.lsn {
+			for _, op := range record.Ops {
+				dm.applyOp(op)
+			}
+			dm.advanceSequences(record.NextUserID, record.NextCatID, record.NextProdID)
+			wal.lsn = record.LSN
+			wal.records++
+		}
+		offset = end
+	}
+
+	if offset < size {
+		if err := file.Truncate(offset); err != nil {
+			return fmt.Errorf("截断WAL失败: %v", err)
+		}
+		if err := file.Sync(); err != nil {
+			return fmt.Errorf("同步WAL失败: %v", err)
+		}
+	}
+	return nil
+}
+
+// write 先将操作追加到WAL再应用到内存，必须持有写锁
+//
+// WAL写入失败时内存数据保持不变；内存模式下直接应用。
+func (dm *SimpleDatabaseManager) write(ops ...walOp) error {
+	if len(ops) == 0 {
+		return nil
+	}
+
+	if dm.wal != nil {
+		record := walRecord{
+			LSN:        dm.wal.lsn + 1,
+			NextUserID: dm.nextUserID,
+			NextCatID:  dm.nextCatID,
+			NextProdID: dm.nextProdID,
+			Ops:        ops,
+		}
+		if err := dm.wal.append(record); err != nil {
+			return err
+		}
+	}
+
+	for _, op := range ops {
+		dm.applyOp(op)
+	}
+
+	// 修改已经落盘，快照失败不影响数据正确性，记录错误后下次写入时再试
+	if dm.wal != nil && dm.wal.snapshotEvery > 0 && dm.wal.records >= dm.wal.snapshotEvery {
+		if err := dm.snapshot(); err != nil {
+			dm.wal.logf("自动快照失败，WAL将继续增长: %v", err)
+		}
+	}
+	return nil
+}
+
+// applyOp 将操作应用到内存数据，保存行的副本并维护二级索引和ID序列，必须持有写锁
+func (dm *SimpleDatabaseManager) applyOp(op walOp) {
+	switch op.Op {
+	case walPutUser, walDeleteUser:
+		if existing, exists := dm.users[op.ID]; exists {
+			dm.index.removeUser(existing)
+			delete(dm.users, op.ID)
+		}
+		if op.Op == walPutUser {
+			stored := *op.User
+			dm.users[op.ID] = &stored
+			dm.index.addUser(&stored)
+			dm.advanceSequences(op.ID+1, 0, 0)
+		}
+	case walPutCategory:
+		stored := *op.Category
+		dm.categories[op.ID] = &stored
+		dm.advanceSequences(0, op.ID+1, 0)
+	case walDeleteCategory:
+		delete(dm.categories, op.ID)
+	case walPutProduct, walDeleteProduct:
+		if existing, exists := dm.products[op.ID]; exists {
+			dm.index.removeProduct(existing)
+			delete(dm.products, op.ID)
+		}
+		if op.Op == walPutProduct {
+			stored := *op.Product
+			dm.products[op.ID] = &stored
+			dm.index.addProduct(&stored)
+			dm.advanceSequences(0, 0, op.ID+1)
+		}
+	}
+}
+
+// advanceSequences 将ID序列推进到不小于给定值
+func (dm *SimpleDatabaseManager) advanceSequences(nextUserID, nextCatID, nextProdID int) {
+	dm.nextUserID = max(dm.nextUserID, nextUserID)
+	dm.nextCatID = max(dm.nextCatID, nextCatID)
+	dm.nextProdID = max(dm.nextProdID, nextProdID)
+}
+
+// append 追加一条记录并fsync
+func (w *writeAheadLog) append(record walRecord) error {
+	if w.file == nil {
+		return ErrDatabaseClosed
+	}
+
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("编码WAL记录失败: %v", err)
+	}
+	info, err := w.file.Stat()
+	if err != nil {
+		return fmt.Errorf("读取WAL文件信息失败: %v", err)
+	}
+
+	if _, err := w.file.Write(encodeFrame(payload)); err != nil {
+		// 截掉写了一半的记录，避免后续记录接在残缺记录后面
+		w.file.Truncate(info.Size())
+		return fmt.Errorf("写入WAL失败: %v", err)
+	}
+	if err := w.file.Sync(); err != nil {
+		w.file.Truncate(info.Size())
+		return fmt.Errorf("同步WAL失败: %v", err)
+	}
+
+	w.lsn = record.LSN
+	w.records++
+	return nil
+}
+
+// Snapshot 立即生成快照并清空WAL，内存模式下不做任何事
+func (dm *SimpleDatabaseManager) Snapshot() error {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+
+	if dm.wal == nil {
+		return nil
+	}
+	if dm.wal.file == nil {
+		return ErrDatabaseClosed
+	}
+	return dm.snapshot()
+}
+
+// snapshot 将全部数据写入临时文件，原子替换快照文件后清空WAL，必须持有写锁
+func (dm *SimpleDatabaseManager) snapshot() error {
+	snap := snapshot{
+		LSN:        dm.wal.lsn,
+		NextUserID: dm.nextUserID,
+		NextCatID:  dm.nextCatID,
+		NextProdID: dm.nextProdID,
+	}
+	for _, user := range dm.users {
+		snap.Users = append(snap.Users, user)
+	}
+	for _, category := range dm.categories {
+		snap.Categories = append(snap.Categories, category)
+	}
+	for _, product := range dm.products {
+		snap.Products = append(snap.Products, product)
+	}
+
+	payload, err := json.Marshal(snap)
+	if err != nil {
+		return fmt.Errorf("编码快照失败: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(dm.wal.dir, snapshotFileName+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("创建临时文件失败: %v", err)
+	}
+	defer os.Remove(tmp.Name()) // 重命名成功后删除不会生效
+
+	if _, err := tmp.Write(encodeFrame(payload)); err != nil {
+		tmp.Close()
+		return fmt.Errorf("写入快照失败: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("同步快照失败: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("关闭快照失败: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(dm.wal.dir, snapshotFileName)); err != nil {
+		return fmt.Errorf("替换快照失败: %v", err)
+	}
+	syncDir(dm.wal.dir)
+
+	// 快照已包含全部记录；在清空之前崩溃也无妨，重放时会跳过快照LSN之前的记录
+	if err := dm.wal.file.Truncate(0); err != nil {
+		return fmt.Errorf("清空WAL失败: %v", err)
+	}
+	if err := dm.wal.file.Sync(); err != nil {
+		return fmt.Errorf("同步WAL失败: %v", err)
+	}
+	dm.wal.records = 0
+	return nil
+}
+
+// Close 生成最终快照并关闭WAL，之后的写入返回 ErrDatabaseClosed；内存模式下不做任何事
+func (dm *SimpleDatabaseManager) Close() error {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+
+	if dm.wal == nil || dm.wal.file == nil {
+		return nil
+	}
+
+	snapshotErr := dm.snapshot()
+	err := dm.wal.file.Close()
+	dm.wal.file = nil
+	if snapshotErr != nil {
+		return snapshotErr
+	}
+	return err
+}
+
+// encodeFrame 为负载加上长度和校验和
+func encodeFrame(payload []byte) []byte {
+	frame := make([]byte, frameHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(frame[:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(frame[4:8], frameChecksum(frame[:4], payload))
+	copy(frame[frameHeaderSize:], payload)
+	return frame
+}
+
+// decodeFrame 校验并取出单个完整帧的负载
+func decodeFrame(data []byte) ([]byte, error) {
+	if len(data) < frameHeaderSize {
+		return nil, errors.New("数据不完整")
+	}
+	length := binary.LittleEndian.Uint32(data[:4])
+	if length > maxFrameSize || int(length) != len(data)-frameHeaderSize {
+		return nil, errors.New("长度不匹配")
+	}
+	payload := data[frameHeaderSize:]
+	if frameChecksum(data[:4], payload) != binary.LittleEndian.Uint32(data[4:8]) {
+		return nil, errors.New("校验和不匹配")
+	}
+	return payload, nil
+}
+
+// frameChecksum 记录的校验和，同时覆盖长度字段和负载，长度字段被篡改同样能被发现
+func frameChecksum(length, payload []byte) uint32 {
+	return crc32.Update(crc32.Checksum(length, crcTable), crcTable, payload)
+}
+
+// containsFrame 判断数据中是否从任意位置开始包含一条完整且校验通过的记录
+//
+// 用于区分长度超出文件末尾的记录是写入时崩溃留下的残缺末尾，还是后面仍有记录、长度字段被损坏。
+func containsFrame(data []byte) bool {
+	for i := 0; i+frameHeaderSize <= len(data); i++ {
+		length := binary.LittleEndian.Uint32(data[i : i+4])
+		if length == 0 || length > maxFrameSize || int(length) > len(data)-i-frameHeaderSize {
+			continue
+		}
+		payload := data[i+frameHeaderSize : i+frameHeaderSize+int(length)]
+		if frameChecksum(data[i:i+4], payload) == binary.LittleEndian.Uint32(data[i+4:i+8]) {
+			return true
+		}
+	}
+	return false
+}
+
+// syncDir 同步目录项，确保重命名本身也已落盘（部分平台不支持，忽略错误）
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
@@ -0,0 +1,768 @@
+package database
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrInvalidQuery 查询引用了不存在的表、列或使用了不支持的运算符
+var ErrInvalidQuery = errors.New("无效的查询")
+
+// Row 查询结果中的一行，键为列名或聚合别名
+//
+// 值保持原始类型（int、float64、string、time.Time），左连接未匹配的列为nil。
+type Row map[string]any
+
+// SortOrder 排序方向
+type SortOrder int
+
+const (
+	Asc SortOrder = iota
+	Desc
+)
+
+// Aggregate 聚合函数，由 Count、Sum、Avg、Min、Max 创建
+type Aggregate struct {
+	fn     string
+	column string
+	alias  string
+}
+
+// Count 统计行数；column 为 "*" 时统计全部行，否则只统计该列非nil的行
+func Count(column string) Aggregate { return Aggregate{fn: "count", column: column} }
+
+// Sum 求和，列全部为整数时结果为 int，否则为 float64
+func Sum(column string) Aggregate { return Aggregate{fn: "sum", column: column} }
+
+// Avg 求平均值，结果为 float64
+func Avg(column string) Aggregate { return Aggregate{fn: "avg", column: column} }
+
+// Min 求最小值
+func Min(column string) Aggregate { return Aggregate{fn: "min", column: column} }
+
+// Max 求最大值
+func Max(column string) Aggregate { return Aggregate{fn: "max", column: column} }
+
+// As 设置聚合结果的列名，默认为 "fn(column)"，如 "sum(products.stock)"
+func (a Aggregate) As(alias string) Aggregate {
+	a.alias = alias
+	return a
+}
+
+func (a Aggregate) name() string {
+	if a.alias != "" {
+		return a.alias
+	}
+	return a.fn + "(" + a.column + ")"
+}
+
+// Query 内存表上的查询构建器，由 SimpleDatabaseManager.Query 创建
+//
+// 列名可以写成 "表.列"，在参与查询的表中唯一时也可以省略表名。
+// 多个 Where 条件之间为 AND 关系。有 GroupBy 或 Aggregate 时为分组查询，
+// 输出分组列和聚合结果；否则输出 Select 指定的列，未指定时输出全部列
+// （有连接时键为 "表.列"，否则为列名）。
+// 查询在读锁下对表做全表扫描，看到的是执行时刻一致的数据。
+//
+// 每次执行都通过反射把参与查询的表整体转换为 map[string]any 的行，
+// 即使条件可以由二级索引回答也不使用索引；按分类、邮箱或价格区间的查找
+// 应优先使用 GetProductsByCategory、GetUserByEmail、GetProductsByPriceRange。
+type Query struct {
+	dm         *SimpleDatabaseManager
+	from       string
+	joins      []queryJoin
+	conditions []condition
+	selects    []string
+	groupBy    []string
+	aggregates []Aggregate
+	orderBy    []ordering
+	limit      int
+	offset     int
+}
+
+type queryJoin struct {
+	table string
+	left  bool
+}
+
+type condition struct {
+	column string
+	op     string
+	value  any
+}
+
+type ordering struct {
+	column string
+	order  SortOrder
+}
+
+// Query 创建以 table 为主表的查询，可查询 users、categories 和 products
+func (dm *SimpleDatabaseManager) Query(table string) *Query {
+	return &Query{dm: dm, from: table}
+}
+
+// Join 按外键内连接另一张表，如 products.category_id = categories.id
+func (q *Query) Join(table string) *Query {
+	q.joins = append(q.joins, queryJoin{table: table})
+	return q
+}
+
+// LeftJoin 按外键左连接另一张表，未匹配的行保留，连接表的列为nil
+func (q *Query) LeftJoin(table string) *Query {
+	q.joins = append(q.joins, queryJoin{table: table, left: true})
+	return q
+}
+
+// Where 添加过滤条件
+//
+// 支持的运算符：=、!=、<、<=、>、>=、in（value 为切片）、contains（字符串包含）。
+// 数值之间比较时不区分 int 和 float64。
+func (q *Query) Where(column, op string, value any) *Query {
+	q.conditions = append(q.conditions, condition{column: column, op: op, value: value})
+	return q
+}
+
+// Select 指定非分组查询输出的列
+func (q *Query) Select(columns ...string) *Query {
+	q.selects = append(q.selects, columns...)
+	return q
+}
+
+// GroupBy 按列分组
+func (q *Query) GroupBy(columns ...string) *Query {
+	q.groupBy = append(q.groupBy, columns...)
+	return q
+}
+
+// Aggregate 添加聚合结果列，没有 GroupBy 时对全部行聚合为一行
+func (q *Query) Aggregate(aggregates ...Aggregate) *Query {
+	q.aggregates = append(q.aggregates, aggregates...)
+	return q
+}
+
+// OrderBy 添加排序列，nil 排在最前；分组查询只能按分组列或聚合别名排序
+func (q *Query) OrderBy(column string, order SortOrder) *Query {
+	q.orderBy = append(q.orderBy, ordering{column: column, order: order})
+	return q
+}
+
+// Limit 限制返回的行数，不大于0表示不限制
+func (q *Query) Limit(n int) *Query {
+	q.limit = n
+	return q
+}
+
+// Offset 跳过前 n 行
+func (q *Query) Offset(n int) *Query {
+	q.offset = n
+	return q
+}
+
+// Run 执行查询
+//
+// 条件的运算符和值在扫描之前检查，表为空时无效的条件同样返回 ErrInvalidQuery。
+func (q *Query) Run() ([]Row, error) {
+	for _, cond := range q.conditions {
+		if err := cond.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	rows, scope, err := q.load()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, cond := range q.conditions {
+		column, err := scope.resolve(cond.column)
+		if err != nil {
+			return nil, err
+		}
+		var filtered []map[string]any
+		for _, row := range rows {
+			if cond.match(row[column]) {
+				filtered = append(filtered, row)
+			}
+		}
+		rows = filtered
+	}
+
+	var result []Row
+	if len(q.groupBy) > 0 || len(q.aggregates) > 0 {
+		result, err = q.group(rows, scope)
+	} else {
+		result, err = q.project(rows, scope)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if q.offset > 0 {
+		result = result[min(q.offset, len(result)):]
+	}
+	if q.limit > 0 && len(result) > q.limit {
+		result = result[:q.limit]
+	}
+	return result, nil
+}
+
+// load 在读锁下复制主表和连接表的数据，行的键为 "表.列"
+func (q *Query) load() ([]map[string]any, *queryScope, error) {
+	q.dm.mutex.RLock()
+	defer q.dm.mutex.RUnlock()
+
+	from, exists := queryTables[q.from]
+	if !exists {
+		return nil, nil, fmt.Errorf("%w: 未知的表 %s", ErrInvalidQuery, q.from)
+	}
+	scope := &queryScope{tables: []string{q.from}}
+	rows := from.rows(q.dm)
+
+	for _, join := range q.joins {
+		table, exists := queryTables[join.table]
+		if !exists {
+			return nil, nil, fmt.Errorf("%w: 未知的表 %s", ErrInvalidQuery, join.table)
+		}
+		leftColumn, rightColumn, err := scope.joinColumns(join.table)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		matches := make(map[any][]map[string]any)
+		for _, row := range table.rows(q.dm) {
+			key := row[rightColumn]
+			matches[key] = append(matches[key], row)
+		}
+
+		var joined []map[string]any
+		for _, row := range rows {
+			found := matches[row[leftColumn]]
+			if len(found) == 0 && join.left {
+				joined = append(joined, row) // 连接表的列缺失，读取时为nil
+			}
+			for _, match := range found {
+				combined := make(map[string]any, len(row)+len(match))
+				for key, value := range row {
+					combined[key] = value
+				}
+				for key, value := range match {
+					combined[key] = value
+				}
+				joined = append(joined, combined)
+			}
+		}
+		rows = joined
+		scope.tables = append(scope.tables, join.table)
+	}
+
+	return rows, scope, nil
+}
+
+// group 分组并计算聚合，分组按首次出现的顺序输出
+func (q *Query) group(rows []map[string]any, scope *queryScope) ([]Row, error) {
+	if len(q.selects) > 0 {
+		return nil, fmt.Errorf("%w: 分组查询的输出列由 GroupBy 和 Aggregate 决定，不能使用 Select", ErrInvalidQuery)
+	}
+
+	groupColumns := make([]string, len(q.groupBy))
+	for i, name := range q.groupBy {
+		column, err := scope.resolve(name)
+		if err != nil {
+			return nil, err
+		}
+		groupColumns[i] = column
+	}
+	aggregateColumns := make([]string, len(q.aggregates))
+	for i, aggregate := range q.aggregates {
+		if aggregate.column == "*" {
+			if aggregate.fn != "count" {
+				return nil, fmt.Errorf("%w: %s 不支持 *", ErrInvalidQuery, aggregate.fn)
+			}
+			continue
+		}
+		column, err := scope.resolve(aggregate.column)
+		if err != nil {
+			return nil, err
+		}
+		aggregateColumns[i] = column
+	}
+
+	type group struct {
+		values       []any
+		accumulators []*accumulator
+	}
+	newGroup := func(values []any) *group {
+		g := &group{values: values, accumulators: make([]*accumulator, len(q.aggregates))}
+		for i := range g.accumulators {
+			g.accumulators[i] = &accumulator{allInt: true}
+		}
+		return g
+	}
+	var groups []*group
+	index := make(map[string]*group)
+	for _, row := range rows {
+		values := make([]any, len(groupColumns))
+		for i, column := range groupColumns {
+			values[i] = row[column]
+		}
+		key := fmt.Sprintf("%#v", values)
+		g, exists := index[key]
+		if !exists {
+			g = newGroup(values)
+			index[key] = g
+			groups = append(groups, g)
+		}
+		for i, aggregate := range q.aggregates {
+			var value any = row
+			if aggregateColumns[i] != "" {
+				value = row[aggregateColumns[i]]
+			}
+			if err := g.accumulators[i].add(aggregate, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// 没有分组列时即使没有行也输出一行聚合结果
+	if len(groups) == 0 && len(groupColumns) == 0 {
+		groups = append(groups, newGroup(nil))
+	}
+
+	result := make([]Row, len(groups))
+	for i, g := range groups {
+		row := make(Row, len(q.groupBy)+len(q.aggregates))
+		for j, name := range q.groupBy {
+			row[name] = g.values[j]
+		}
+		for j, aggregate := range q.aggregates {
+			row[aggregate.name()] = g.accumulators[j].result(aggregate)
+		}
+		result[i] = row
+	}
+
+	// 排序列可以是输出列名，也可以是与分组列等价的其他写法（如省略表名）
+	outputs := make(map[string]bool)
+	for _, name := range q.groupBy {
+		outputs[name] = true
+	}
+	for _, aggregate := range q.aggregates {
+		outputs[aggregate.name()] = true
+	}
+	keys := make([]string, len(q.orderBy))
+	for i, order := range q.orderBy {
+		keys[i] = order.column
+		if outputs[order.column] {
+			continue
+		}
+		column, err := scope.resolve(order.column)
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		for j, groupColumn := range groupColumns {
+			if groupColumn == column {
+				keys[i], found = q.groupBy[j], true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%w: 分组查询只能按分组列或聚合结果排序: %s", ErrInvalidQuery, order.column)
+		}
+	}
+	q.sort(len(result), func(i int, key int) any { return result[i][keys[key]] }, func(i, j int) {
+		result[i], result[j] = result[j], result[i]
+	})
+	return result, nil
+}
+
+// project 排序后输出选择的列，排序列不必出现在输出中
+func (q *Query) project(rows []map[string]any, scope *queryScope) ([]Row, error) {
+	orderColumns := make([]string, len(q.orderBy))
+	for i, order := range q.orderBy {
+		column, err := scope.resolve(order.column)
+		if err != nil {
+			return nil, err
+		}
+		orderColumns[i] = column
+	}
+	q.sort(len(rows), func(i int, key int) any { return rows[i][orderColumns[key]] }, func(i, j int) {
+		rows[i], rows[j] = rows[j], rows[i]
+	})
+
+	names, columns := q.selects, make([]string, len(q.selects))
+	for i, name := range q.selects {
+		column, err := scope.resolve(name)
+		if err != nil {
+			return nil, err
+		}
+		columns[i] = column
+	}
+	if len(names) == 0 {
+		names, columns = scope.allColumns()
+	}
+
+	result := make([]Row, len(rows))
+	for i, row := range rows {
+		projected := make(Row, len(columns))
+		for j, column := range columns {
+			projected[names[j]] = row[column]
+		}
+		result[i] = projected
+	}
+	return result, nil
+}
+
+// sort 按 OrderBy 稳定排序，value(i, k) 返回第 i 行第 k 个排序列的值
+func (q *Query) sort(n int, value func(i, key int) any, swap func(i, j int)) {
+	if len(q.orderBy) == 0 {
+		return
+	}
+	sort.Stable(sortable{n: n, swap: swap, less: func(i, j int) bool {
+		for k, order := range q.orderBy {
+			c := compareForSort(value(i, k), value(j, k))
+			if c == 0 {
+				continue
+			}
+			if order.order == Desc {
+				return c > 0
+			}
+			return c < 0
+		}
+		return false
+	}})
+}
+
+type sortable struct {
+	n    int
+	swap func(i, j int)
+	less func(i, j int) bool
+}
+
+func (s sortable) Len() int           { return s.n }
+func (s sortable) Swap(i, j int)      { s.swap(i, j) }
+func (s sortable) Less(i, j int) bool { return s.less(i, j) }
+
+// validate 检查运算符是否支持以及值的形式：in 需要切片，contains 需要字符串
+func (c condition) validate() error {
+	switch c.op {
+	case "=", "!=", "<", "<=", ">", ">=":
+	case "in":
+		if kind := reflect.ValueOf(c.value).Kind(); kind != reflect.Slice && kind != reflect.Array {
+			return fmt.Errorf("%w: in 的值必须是切片: %s", ErrInvalidQuery, c.column)
+		}
+	case "contains":
+		if _, ok := c.value.(string); !ok {
+			return fmt.Errorf("%w: contains 的值必须是字符串: %s", ErrInvalidQuery, c.column)
+		}
+	default:
+		return fmt.Errorf("%w: 不支持的运算符 %q", ErrInvalidQuery, c.op)
+	}
+	return nil
+}
+
+// match 判断值是否满足条件，条件已通过 validate 检查
+func (c condition) match(value any) bool {
+	switch c.op {
+	case "=":
+		return valuesEqual(value, c.value)
+	case "!=":
+		return !valuesEqual(value, c.value)
+	case "<", "<=", ">", ">=":
+		result, ok := compareValues(value, c.value)
+		if !ok {
+			return false
+		}
+		switch c.op {
+		case "<":
+			return result < 0
+		case "<=":
+			return result <= 0
+		case ">":
+			return result > 0
+		default:
+			return result >= 0
+		}
+	case "in":
+		list := reflect.ValueOf(c.value)
+		for i := 0; i < list.Len(); i++ {
+			if valuesEqual(value, list.Index(i).Interface()) {
+				return true
+			}
+		}
+		return false
+	default:
+		text, ok := value.(string)
+		return ok && strings.Contains(text, c.value.(string))
+	}
+}
+
+// accumulator 一个分组中一个聚合函数的中间结果
+type accumulator struct {
+	count    int
+	sum      float64
+	allInt   bool
+	min, max any
+}
+
+// add 累加一个值，Count("*") 时 value 为整行
+func (a *accumulator) add(aggregate Aggregate, value any) error {
+	if value == nil {
+		return nil
+	}
+	a.count++
+
+	switch aggregate.fn {
+	case "count":
+	case "sum", "avg":
+		number, ok := toFloat(value)
+		if !ok {
+			return fmt.Errorf("%w: %s 只能用于数值列: %s", ErrInvalidQuery, aggregate.fn, aggregate.column)
+		}
+		if _, isInt := value.(int); !isInt {
+			a.allInt = false
+		}
+		a.sum += number
+	case "min", "max":
+		if a.count == 1 {
+			a.min, a.max = value, value
+			return nil
+		}
+		c, ok := compareValues(value, a.min)
+		if !ok {
+			return fmt.Errorf("%w: %s 的值无法比较: %s", ErrInvalidQuery, aggregate.fn, aggregate.column)
+		}
+		if c < 0 {
+			a.min = value
+		}
+		if c, _ := compareValues(value, a.max); c > 0 {
+			a.max = value
+		}
+	default:
+		return fmt.Errorf("%w: 不支持的聚合函数 %s", ErrInvalidQuery, aggregate.fn)
+	}
+	return nil
+}
+
+// result 聚合结果，除 count 外没有值时为nil
+func (a *accumulator) result(aggregate Aggregate) any {
+	if aggregate.fn == "count" {
+		return a.count
+	}
+	if a.count == 0 {
+		return nil
+	}
+	switch aggregate.fn {
+	case "sum":
+		if a.allInt {
+			return int(a.sum)
+		}
+		return a.sum
+	case "avg":
+		return a.sum / float64(a.count)
+	case "min":
+		return a.min
+	default:
+		return a.max
+	}
+}
+
+// toFloat 将数值转换为 float64
+func toFloat(value any) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	default:
+		return 0, false
+	}
+}
+
+// compareValues 比较两个同类值，数值之间不区分类型；无法比较时返回 false
+func compareValues(a, b any) (int, bool) {
+	if x, ok := toFloat(a); ok {
+		if y, ok := toFloat(b); ok {
+			return cmp.Compare(x, y), true
+		}
+		return 0, false
+	}
+	switch x := a.(type) {
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), true
+		}
+	case time.Time:
+		if y, ok := b.(time.Time); ok {
+			return x.Compare(y), true
+		}
+	}
+	return 0, false
+}
+
+func valuesEqual(a, b any) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	c, ok := compareValues(a, b)
+	return ok && c == 0
+}
+
+// compareForSort 排序用的比较，nil 最小，无法比较的值视为相等
+func compareForSort(a, b any) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+	c, _ := compareValues(a, b)
+	return c
+}
+
+// queryTable 可查询的表：列名来自结构体的 json 标签
+type queryTable struct {
+	columns []string
+	rows    func(dm *SimpleDatabaseManager) []map[string]any
+}
+
+// foreignKey 表之间的外键关系，用于自动推断连接条件
+type foreignKey struct {
+	table, column       string
+	refTable, refColumn string
+}
+
+var queryTables = map[string]queryTable{
+	"users":      newQueryTable("users", func(dm *SimpleDatabaseManager) map[int]*SimpleUser { return dm.users }),
+	"categories": newQueryTable("categories", func(dm *SimpleDatabaseManager) map[int]*SimpleCategory { return dm.categories }),
+	"products":   newQueryTable("products", func(dm *SimpleDatabaseManager) map[int]*SimpleProduct { return dm.products }),
+}
+
+var foreignKeys = []foreignKey{
+	{table: "products", column: "category_id", refTable: "categories", refColumn: "id"},
+}
+
+// newQueryTable 通过反射把表中的记录转换为 "表.列" 为键的行，按ID升序
+func newQueryTable[T any](name string, table func(dm *SimpleDatabaseManager) map[int]*T) queryTable {
+	typ := reflect.TypeFor[T]()
+	var fields []int
+	var columns []string
+	for i := 0; i < typ.NumField(); i++ {
+		tag, _, _ := strings.Cut(typ.Field(i).Tag.Get("json"), ",")
+		if tag == "" || tag == "-" {
+			continue
+		}
+		fields = append(fields, i)
+		columns = append(columns, tag)
+	}
+
+	return queryTable{
+		columns: columns,
+		rows: func(dm *SimpleDatabaseManager) []map[string]any {
+			records := table(dm)
+			ids := make([]int, 0, len(records))
+			for id := range records {
+				ids = append(ids, id)
+			}
+			sort.Ints(ids)
+
+			rows := make([]map[string]any, len(ids))
+			for i, id := range ids {
+				record := reflect.ValueOf(records[id]).Elem()
+				row := make(map[string]any, len(fields))
+				for j, field := range fields {
+					row[name+"."+columns[j]] = record.Field(field).Interface()
+				}
+				rows[i] = row
+			}
+			return rows
+		},
+	}
+}
+
+// queryScope 查询中已参与的表，用于解析列名
+type queryScope struct {
+	tables []string
+}
+
+// resolve 将列名解析为 "表.列"
+func (s *queryScope) resolve(name string) (string, error) {
+	if table, column, qualified := strings.Cut(name, "."); qualified {
+		for _, scoped := range s.tables {
+			if scoped == table && hasColumn(table, column) {
+				return name, nil
+			}
+		}
+		return "", fmt.Errorf("%w: 未知的列 %s", ErrInvalidQuery, name)
+	}
+
+	var matches []string
+	for _, table := range s.tables {
+		if hasColumn(table, name) {
+			matches = append(matches, table+"."+name)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("%w: 未知的列 %s", ErrInvalidQuery, name)
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("%w: 列名 %s 不明确，可以是 %s", ErrInvalidQuery, name, strings.Join(matches, "、"))
+	}
+}
+
+// joinColumns 查找已参与的表与 table 之间的外键，返回两侧的连接列
+func (s *queryScope) joinColumns(table string) (left, right string, err error) {
+	for _, scoped := range s.tables {
+		if scoped == table {
+			return "", "", fmt.Errorf("%w: 表 %s 已在查询中", ErrInvalidQuery, table)
+		}
+	}
+	for _, scoped := range s.tables {
+		for _, fk := range foreignKeys {
+			switch {
+			case fk.table == scoped && fk.refTable == table:
+				return fk.table + "." + fk.column, fk.refTable + "." + fk.refColumn, nil
+			case fk.refTable == scoped && fk.table == table:
+				return fk.refTable + "." + fk.refColumn, fk.table + "." + fk.column, nil
+			}
+		}
+	}
+	return "", "", fmt.Errorf("%w: 表 %s 与查询中的表之间没有外键关系", ErrInvalidQuery, table)
+}
+
+// allColumns 全部列的输出名和 "表.列"，只有一张表时输出名省略表名
+func (s *queryScope) allColumns() (names, columns []string) {
+	for _, table := range s.tables {
+		for _, column := range queryTables[table].columns {
+			qualified := table + "." + column
+			columns = append(columns, qualified)
+			if len(s.tables) == 1 {
+				names = append(names, column)
+			} else {
+				names = append(names, qualified)
+			}
+		}
+	}
+	return names, columns
+}
+
+func hasColumn(table, column string) bool {
+	for _, c := range queryTables[table].columns {
+		if c == column {
+			return true
+		}
+	}
+	return false
+}
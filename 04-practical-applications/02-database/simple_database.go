@@ -38,7 +38,11 @@ type SimpleCategory struct {
 	UpdatedAt   time.Time `json:"updated_at"`
 }
 
-// SimpleDatabaseManager 简化的数据库管理器（内存实现）
+// SimpleDatabaseManager 简化的数据库管理器（内存实现，可选WAL持久化）
+//
+// 已提交的记录不会被原地修改，写入总是替换为新的记录副本，
+// 事务因此可以通过浅拷贝各表得到一致的快照，见 Begin。
+// 所有修改都经过 write，持久化模式下先写WAL再修改内存，见 OpenSimpleDatabaseManager。
 type SimpleDatabaseManager struct {
 	users      map[int]*SimpleUser
 	categories map[int]*SimpleCategory
@@ -46,28 +50,38 @@ type SimpleDatabaseManager struct {
 	nextUserID int
 	nextCatID  int
 	nextProdID int
+	index      secondaryIndex
+	wal        *writeAheadLog // 内存模式下为nil
 	mutex      sync.RWMutex
 }
 
-// NewSimpleDatabaseManager 创建简化的数据库管理器
+// NewSimpleDatabaseManager 创建简化的数据库管理器（内存模式，退出后数据丢失）
+//
+// 需要持久化和崩溃恢复时使用 OpenSimpleDatabaseManager，恢复可能失败，因此单独提供返回错误的构造函数。
 func NewSimpleDatabaseManager() *SimpleDatabaseManager {
-	dm := &SimpleDatabaseManager{
+	dm := newSimpleDatabaseManager()
+	
+	// 初始化示例数据，内存模式下写入不会失败
+	dm.seedData()
+	
+	return dm
+}
+
+// newSimpleDatabaseManager 创建空的数据库管理器
+func newSimpleDatabaseManager() *SimpleDatabaseManager {
+	return &SimpleDatabaseManager{
 		users:      make(map[int]*SimpleUser),
 		categories: make(map[int]*SimpleCategory),
 		products:   make(map[int]*SimpleProduct),
 		nextUserID: 1,
 		nextCatID:  1,
 		nextProdID: 1,
+		index:      newSecondaryIndex(),
 	}
-	
-	// 初始化示例数据
-	dm.seedData()
-	
-	return dm
 }
 
 // seedData 初始化示例数据
-func (dm *SimpleDatabaseManager) seedData() {
+func (dm *SimpleDatabaseManager) seedData() error {
 	// 添加分类
 	categories := []*SimpleCategory{
 		{Name: "电子产品", Description: "各种电子设备和配件"},
@@ -76,7 +90,9 @@ func (dm *SimpleDatabaseManager) seedData() {
 	}
 	
 	for _, cat := range categories {
-		dm.CreateCategory(cat)
+		if err := dm.CreateCategory(cat); err != nil {
+			return err
+		}
 	}
 	
 	// 添加用户
@@ -87,7 +103,9 @@ func (dm *SimpleDatabaseManager) seedData() {
 	}
 	
 	for _, user := range users {
-		dm.CreateUser(user)
+		if err := dm.CreateUser(user); err != nil {
+			return err
+		}
 	}
 	
 	// 添加产品
@@ -99,8 +117,12 @@ func (dm *SimpleDatabaseManager) seedData() {
 	}
 	
 	for _, product := range products {
-		dm.CreateProduct(product)
+		if err := dm.CreateProduct(product); err != nil {
+			return err
+		}
 	}
+	
+	return nil
 }
 
 // 用户相关操作
@@ -110,13 +132,17 @@ func (dm *SimpleDatabaseManager) CreateUser(user *SimpleUser) error {
 	dm.mutex.Lock()
 	defer dm.mutex.Unlock()
 	
-	user.ID = dm.nextUserID
-	user.CreatedAt = time.Now()
-	user.UpdatedAt = time.Now()
-	
-	dm.users[user.ID] = user
-	dm.nextUserID++
+	// 写入成功后才回填 ID 和时间戳，失败时调用方的 user 保持原样
+	stored := *user
+	stored.ID = dm.nextUserID
+	stored.CreatedAt = time.Now()
+	stored.UpdatedAt = stored.CreatedAt
 	
+	// 保存副本，调用方之后修改 user 不会影响已提交的数据
+	if err := dm.write(userOp(stored.ID, &stored)); err != nil {
+		return err
+	}
+	*user = stored
 	return nil
 }
 
@@ -135,13 +161,37 @@ func (dm *SimpleDatabaseManager) GetUserByID(id int) (*SimpleUser, error) {
 	return &userCopy, nil
 }
 
+// GetUserByEmail 根据邮箱获取用户（不区分大小写），多个用户邮箱相同时返回ID最小的一个
+func (dm *SimpleDatabaseManager) GetUserByEmail(email string) (*SimpleUser, error) {
+	dm.mutex.RLock()
+	defer dm.mutex.RUnlock()
+	
+	found := 0
+	for id := range dm.index.usersByEmail[emailKey(email)] {
+		if found == 0 || id < found {
+			found = id
+		}
+	}
+	if found == 0 {
+		return nil, fmt.Errorf("用户不存在: %s", email)
+	}
+	
+	userCopy := *dm.users[found]
+	return &userCopy, nil
+}
+
 // GetAllUsers 获取所有用户
 func (dm *SimpleDatabaseManager) GetAllUsers() []SimpleUser {
 	dm.mutex.RLock()
 	defer dm.mutex.RUnlock()
 	
-	users := make([]SimpleUser, 0, len(dm.users))
-	for _, user := range dm.users {
+	return sortedUsers(dm.users)
+}
+
+// sortedUsers 复制表中的全部用户，按创建时间倒序排列
+func sortedUsers(table map[int]*SimpleUser) []SimpleUser {
+	users := make([]SimpleUser, 0, len(table))
+	for _, user := range table {
 		users = append(users, *user)
 	}
 	
@@ -164,10 +214,14 @@ func (dm *SimpleDatabaseManager) UpdateUser(user *SimpleUser) error {
 	}
 	
 	// 保留创建时间
-	user.CreatedAt = existing.CreatedAt
-	user.UpdatedAt = time.Now()
+	stored := *user
+	stored.CreatedAt = existing.CreatedAt
+	stored.UpdatedAt = time.Now()
 	
-	dm.users[user.ID] = user
+	if err := dm.write(userOp(stored.ID, &stored)); err != nil {
+		return err
+	}
+	*user = stored
 	return nil
 }
 
@@ -180,8 +234,7 @@ func (dm *SimpleDatabaseManager) DeleteUser(id int) error {
 		return fmt.Errorf("用户不存在: %d", id)
 	}
 	
-	delete(dm.users, id)
-	return nil
+	return dm.write(userOp(id, nil))
 }
 
 // 分类相关操作
@@ -191,23 +244,74 @@ func (dm *SimpleDatabaseManager) CreateCategory(category *SimpleCategory) error
 	dm.mutex.Lock()
 	defer dm.mutex.Unlock()
 	
-	category.ID = dm.nextCatID
-	category.CreatedAt = time.Now()
-	category.UpdatedAt = time.Now()
-	
-	dm.categories[category.ID] = category
-	dm.nextCatID++
+	stored := *category
+	stored.ID = dm.nextCatID
+	stored.CreatedAt = time.Now()
+	stored.UpdatedAt = stored.CreatedAt
 	
+	if err := dm.write(categoryOp(stored.ID, &stored)); err != nil {
+		return err
+	}
+	*category = stored
 	return nil
 }
 
+// DeleteCategory 删除分类，action 决定分类下仍有产品时的处理方式
+//
+// 分类和受影响产品的修改作为一次写入，持久化模式下同样要么全部生效要么全部不生效。
+func (dm *SimpleDatabaseManager) DeleteCategory(id int, action ReferentialAction) error {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	
+	if _, exists := dm.categories[id]; !exists {
+		return fmt.Errorf("分类不存在: %d", id)
+	}
+	
+	productIDs := dm.index.productsByCategory[id]
+	ops := make([]walOp, 0, len(productIDs)+1)
+	switch action {
+	case OnDeleteRestrict:
+		if len(productIDs) > 0 {
+			return restrictError(id, productIDs)
+		}
+	case OnDeleteCascade:
+		for productID := range productIDs {
+			ops = append(ops, productOp(productID, nil))
+		}
+	case OnDeleteSetNull:
+		now := time.Now()
+		for productID := range productIDs {
+			product := *dm.products[productID]
+			product.CategoryID = 0
+			product.UpdatedAt = now
+			ops = append(ops, productOp(productID, &product))
+		}
+	default:
+		return fmt.Errorf("不支持的删除方式: %v", action)
+	}
+	
+	ops = append(ops, categoryOp(id, nil))
+	return dm.write(ops...)
+}
+
+// categoryExists 判断分类是否存在，必须持有锁
+func (dm *SimpleDatabaseManager) categoryExists(id int) bool {
+	_, exists := dm.categories[id]
+	return exists
+}
+
 // GetAllCategories 获取所有分类
 func (dm *SimpleDatabaseManager) GetAllCategories() []SimpleCategory {
 	dm.mutex.RLock()
 	defer dm.mutex.RUnlock()
 	
-	categories := make([]SimpleCategory, 0, len(dm.categories))
-	for _, category := range dm.categories {
+	return sortedCategories(dm.categories)
+}
+
+// sortedCategories 复制表中的全部分类，按名称排序
+func sortedCategories(table map[int]*SimpleCategory) []SimpleCategory {
+	categories := make([]SimpleCategory, 0, len(table))
+	for _, category := range table {
 		categories = append(categories, *category)
 	}
 	
@@ -221,28 +325,113 @@ func (dm *SimpleDatabaseManager) GetAllCategories() []SimpleCategory {
 
 // 产品相关操作
 
-// CreateProduct 创建产品
+// CreateProduct 创建产品，引用的分类必须存在
 func (dm *SimpleDatabaseManager) CreateProduct(product *SimpleProduct) error {
 	dm.mutex.Lock()
 	defer dm.mutex.Unlock()
 	
-	product.ID = dm.nextProdID
-	product.CreatedAt = time.Now()
-	product.UpdatedAt = time.Now()
+	if err := checkProductCategory(product, dm.categoryExists); err != nil {
+		return err
+	}
 	
-	dm.products[product.ID] = product
-	dm.nextProdID++
+	stored := *product
+	stored.ID = dm.nextProdID
+	stored.CreatedAt = time.Now()
+	stored.UpdatedAt = stored.CreatedAt
 	
+	if err := dm.write(productOp(stored.ID, &stored)); err != nil {
+		return err
+	}
+	*product = stored
 	return nil
 }
 
-// GetProductsByCategory 根据分类获取产品
+// GetProductByID 根据ID获取产品
+func (dm *SimpleDatabaseManager) GetProductByID(id int) (*SimpleProduct, error) {
+	dm.mutex.RLock()
+	defer dm.mutex.RUnlock()
+	
+	product, exists := dm.products[id]
+	if !exists {
+		return nil, fmt.Errorf("产品不存在: %d", id)
+	}
+	
+	productCopy := *product
+	return &productCopy, nil
+}
+
+// UpdateProduct 更新产品，引用的分类必须存在
+func (dm *SimpleDatabaseManager) UpdateProduct(product *SimpleProduct) error {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	
+	existing, exists := dm.products[product.ID]
+	if !exists {
+		return fmt.Errorf("产品不存在: %d", product.ID)
+	}
+	if err := checkProductCategory(product, dm.categoryExists); err != nil {
+		return err
+	}
+	
+	// 保留创建时间
+	stored := *product
+	stored.CreatedAt = existing.CreatedAt
+	stored.UpdatedAt = time.Now()
+	
+	if err := dm.write(productOp(stored.ID, &stored)); err != nil {
+		return err
+	}
+	*product = stored
+	return nil
+}
+
+// DeleteProduct 删除产品
+func (dm *SimpleDatabaseManager) DeleteProduct(id int) error {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	
+	if _, exists := dm.products[id]; !exists {
+		return fmt.Errorf("产品不存在: %d", id)
+	}
+	
+	return dm.write(productOp(id, nil))
+}
+
+// GetProductsByCategory 根据分类获取产品，按名称排序
 func (dm *SimpleDatabaseManager) GetProductsByCategory(categoryID int) []SimpleProduct {
 	dm.mutex.RLock()
 	defer dm.mutex.RUnlock()
 	
+	// 通过分类索引只访问该分类下的产品
 	var products []SimpleProduct
-	for _, product := range dm.products {
+	for id := range dm.index.productsByCategory[categoryID] {
+		products = append(products, *dm.products[id])
+	}
+	
+	sort.Slice(products, func(i, j int) bool {
+		return products[i].Name < products[j].Name
+	})
+	
+	return products
+}
+
+// GetProductsByPriceRange 获取价格在 [minPrice, maxPrice] 内的产品，按价格升序排列
+func (dm *SimpleDatabaseManager) GetProductsByPriceRange(minPrice, maxPrice float64) []SimpleProduct {
+	dm.mutex.RLock()
+	defer dm.mutex.RUnlock()
+	
+	var products []SimpleProduct
+	for _, id := range dm.index.priceRange(minPrice, maxPrice) {
+		products = append(products, *dm.products[id])
+	}
+	
+	return products
+}
+
+// productsInCategory 全表扫描复制指定分类下的产品，按名称排序，用于没有索引的事务快照
+func productsInCategory(table map[int]*SimpleProduct, categoryID int) []SimpleProduct {
+	var products []SimpleProduct
+	for _, product := range table {
 		if product.CategoryID == categoryID {
 			products = append(products, *product)
 		}
@@ -288,36 +477,38 @@ func (dm *SimpleDatabaseManager) GetProductsWithCategory() []ProductWithCategory
 	return results
 }
 
-// TransferStock 库存转移（事务示例）
+// TransferStock 库存转移
+//
+// 扣减源产品库存并增加目标产品库存，两个产品写入同一条日志记录，要么都生效要么都不生效。
+// 只涉及两行，直接在写锁内完成，不开启需要复制整张表的事务；需要与其他操作组合时使用 Tx.TransferStock。
 func (dm *SimpleDatabaseManager) TransferStock(fromProductID, toProductID, quantity int) error {
 	dm.mutex.Lock()
 	defer dm.mutex.Unlock()
 	
-	// 检查源产品
 	fromProduct, exists := dm.products[fromProductID]
 	if !exists {
 		return fmt.Errorf("源产品不存在: %d", fromProductID)
 	}
-	
-	// 检查目标产品
 	toProduct, exists := dm.products[toProductID]
 	if !exists {
 		return fmt.Errorf("目标产品不存在: %d", toProductID)
 	}
-	
-	// 检查库存
 	if fromProduct.Stock < quantity {
 		return fmt.Errorf("库存不足: 需要 %d, 可用 %d", quantity, fromProduct.Stock)
 	}
+	if fromProductID == toProductID {
+		return nil
+	}
 	
-	// 执行转移
-	fromProduct.Stock -= quantity
-	fromProduct.UpdatedAt = time.Now()
-	
-	toProduct.Stock += quantity
-	toProduct.UpdatedAt = time.Now()
+	// 表中的行可能被事务快照引用，修改副本而不是原行
+	now := time.Now()
+	from, to := *fromProduct, *toProduct
+	from.Stock -= quantity
+	from.UpdatedAt = now
+	to.Stock += quantity
+	to.UpdatedAt = now
 	
-	return nil
+	return dm.write(productOp(from.ID, &from), productOp(to.ID, &to))
 }
 
 // CategoryStats 分类统计信息
@@ -345,13 +536,13 @@ func (dm *SimpleDatabaseManager) GetCategoryStats() []CategoryStats {
 			AvgPrice:     0,
 		}
 		
+		// 通过分类索引聚合，总开销与产品数成正比
 		var totalPrice float64
-		for _, product := range dm.products {
-			if product.CategoryID == category.ID {
-				stat.ProductCount++
-				stat.TotalStock += product.Stock
-				totalPrice += product.Price
-			}
+		for id := range dm.index.productsByCategory[category.ID] {
+			product := dm.products[id]
+			stat.ProductCount++
+			stat.TotalStock += product.Stock
+			totalPrice += product.Price
 		}
 		
 		if stat.ProductCount > 0 {
@@ -427,6 +618,22 @@ func DatabaseExamples() {
 			stat.CategoryName, stat.ProductCount, stat.TotalStock, stat.AvgPrice)
 	}
 	
+	// 查询构建器示例
+	fmt.Println("\n🔹 查询构建器示例")
+	rows, err := dm.Query("products").
+		Join("categories").
+		Where("products.price", "<", 1000).
+		GroupBy("categories.name").
+		Aggregate(Count("*").As("count"), Sum("products.stock").As("stock")).
+		OrderBy("stock", Desc).
+		Run()
+	if err != nil {
+		fmt.Printf("查询失败: %v\n", err)
+	}
+	for _, row := range rows {
+		fmt.Printf("  - %s: 千元以下产品数=%d, 总库存=%d\n", row["categories.name"], row["count"], row["stock"])
+	}
+	
 	// 事务示例
 	fmt.Println("\n🔹 事务操作示例")
 	fmt.Println("尝试库存转移...")
@@ -1,7 +1,16 @@
 package database
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -386,6 +395,1036 @@ func TestSimpleDatabaseManager_TransferStock(t *testing.T) {
 
 		t.Log("库存不足测试通过")
 	})
+
+	t.Run("SameProduct", func(t *testing.T) {
+		before, _ := dm.GetProductByID(1)
+		if err := dm.TransferStock(1, 1, 1); err != nil {
+			t.Fatalf("同一产品转移失败: %v", err)
+		}
+		if after, _ := dm.GetProductByID(1); after.Stock != before.Stock {
+			t.Errorf("同一产品转移后库存应不变: 期望 %d, 实际 %d", before.Stock, after.Stock)
+		}
+
+		t.Log("同一产品转移测试通过")
+	})
+
+	t.Run("TransactionSnapshot", func(t *testing.T) {
+		tx := dm.Begin()
+		before, _ := tx.GetProductByID(1)
+
+		// 不经过事务的转移写入新行，不修改事务快照引用的旧行
+		if err := dm.TransferStock(1, 2, 1); err != nil {
+			t.Fatalf("库存转移失败: %v", err)
+		}
+		if product, _ := tx.GetProductByID(1); product.Stock != before.Stock {
+			t.Errorf("事务快照不应看到转移: 期望 %d, 实际 %d", before.Stock, product.Stock)
+		}
+
+		before.Stock++
+		tx.UpdateProduct(before)
+		if err := tx.Commit(); !errors.Is(err, ErrTxConflict) {
+			t.Errorf("转移后提交修改同一产品的事务应冲突, 实际 %v", err)
+		}
+
+		t.Log("事务快照测试通过")
+	})
+}
+
+func TestSimpleDatabaseManager_Transaction(t *testing.T) {
+	t.Run("CommitAcrossTables", func(t *testing.T) {
+		dm := setupSimpleTestDB(t)
+		tx := dm.Begin()
+
+		category := &SimpleCategory{Name: "家居", Description: "家居用品"}
+		if err := tx.CreateCategory(category); err != nil {
+			t.Fatalf("创建分类失败: %v", err)
+		}
+		product := &SimpleProduct{Name: "台灯", Price: 199, CategoryID: category.ID, Stock: 10}
+		if err := tx.CreateProduct(product); err != nil {
+			t.Fatalf("创建产品失败: %v", err)
+		}
+		user, _ := tx.GetUserByID(1)
+		user.Age = 99
+		if err := tx.UpdateUser(user); err != nil {
+			t.Fatalf("更新用户失败: %v", err)
+		}
+		if err := tx.DeleteUser(2); err != nil {
+			t.Fatalf("删除用户失败: %v", err)
+		}
+
+		// 事务内读到自己的写入
+		if products, _ := tx.GetProductsByCategory(category.ID); len(products) != 1 || products[0].Name != "台灯" {
+			t.Errorf("事务内应能读到新建的产品: %+v", products)
+		}
+		if updated, _ := tx.GetUserByID(1); updated.Age != 99 {
+			t.Errorf("事务内应能读到更新: 年龄 %d", updated.Age)
+		}
+		if _, err := tx.GetUserByID(2); err == nil {
+			t.Error("事务内删除的用户不应再被读到")
+		}
+
+		// 提交前事务外看不到任何写入
+		if _, err := dm.GetProductByID(product.ID); err == nil {
+			t.Error("提交前事务外不应看到新产品")
+		}
+		if original, _ := dm.GetUserByID(1); original.Age == 99 {
+			t.Error("提交前事务外不应看到更新")
+		}
+
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("提交失败: %v", err)
+		}
+		if _, err := dm.GetProductByID(product.ID); err != nil {
+			t.Errorf("提交后应能读到新产品: %v", err)
+		}
+		if committed, _ := dm.GetUserByID(1); committed.Age != 99 {
+			t.Errorf("提交后用户年龄不正确: %d", committed.Age)
+		}
+		if _, err := dm.GetUserByID(2); err == nil {
+			t.Error("提交后用户2应已删除")
+		}
+		if len(dm.GetAllCategories()) != 4 {
+			t.Errorf("提交后分类数量不正确: %d", len(dm.GetAllCategories()))
+		}
+
+		t.Log("跨表提交测试通过")
+	})
+
+	t.Run("Rollback", func(t *testing.T) {
+		dm := setupSimpleTestDB(t)
+		tx := dm.Begin()
+		tx.CreateUser(&SimpleUser{Name: "回滚用户", Email: "rollback@example.com"})
+		tx.TransferStock(1, 2, 10)
+
+		if err := tx.Rollback(); err != nil {
+			t.Fatalf("回滚失败: %v", err)
+		}
+		if len(dm.GetAllUsers()) != 3 {
+			t.Errorf("回滚后不应新增用户: %d", len(dm.GetAllUsers()))
+		}
+		if product, _ := dm.GetProductByID(1); product.Stock != 100 {
+			t.Errorf("回滚后库存不应变化: %d", product.Stock)
+		}
+
+		if err := tx.Commit(); !errors.Is(err, ErrTxDone) {
+			t.Errorf("结束的事务提交应返回 ErrTxDone, 实际 %v", err)
+		}
+		if err := tx.CreateUser(&SimpleUser{Name: "迟到"}); !errors.Is(err, ErrTxDone) {
+			t.Errorf("结束的事务写入应返回 ErrTxDone, 实际 %v", err)
+		}
+		if _, err := tx.GetUserByID(1); !errors.Is(err, ErrTxDone) {
+			t.Errorf("结束的事务读取应返回 ErrTxDone, 实际 %v", err)
+		}
+
+		t.Log("回滚测试通过")
+	})
+
+	t.Run("SnapshotIsolation", func(t *testing.T) {
+		dm := setupSimpleTestDB(t)
+		tx := dm.Begin()
+		defer tx.Rollback()
+
+		user, _ := dm.GetUserByID(1)
+		user.Name = "外部修改"
+		dm.UpdateUser(user)
+		dm.CreateUser(&SimpleUser{Name: "外部新增", Email: "outside@example.com"})
+		dm.TransferStock(1, 2, 5)
+
+		if snapshot, _ := tx.GetUserByID(1); snapshot.Name != "张三" {
+			t.Errorf("事务应读到开始时的快照, 实际 %s", snapshot.Name)
+		}
+		if users, _ := tx.GetAllUsers(); len(users) != 3 {
+			t.Errorf("事务不应看到之后新增的用户: %d", len(users))
+		}
+		if product, _ := tx.GetProductByID(1); product.Stock != 100 {
+			t.Errorf("事务不应看到之后提交的库存变化: %d", product.Stock)
+		}
+
+		// 非事务写入保存副本，调用方修改传入的结构体不影响已提交数据
+		user.Name = "未提交的修改"
+		if stored, _ := dm.GetUserByID(1); stored.Name != "外部修改" {
+			t.Errorf("已提交数据不应被调用方修改: %s", stored.Name)
+		}
+
+		t.Log("快照隔离测试通过")
+	})
+
+	t.Run("WriteConflict", func(t *testing.T) {
+		dm := setupSimpleTestDB(t)
+		first, second := dm.Begin(), dm.Begin()
+
+		first.TransferStock(1, 2, 10)
+		second.TransferStock(3, 1, 20)
+		second.CreateUser(&SimpleUser{Name: "冲突事务用户", Email: "conflict@example.com"})
+
+		if err := first.Commit(); err != nil {
+			t.Fatalf("先提交的事务应成功: %v", err)
+		}
+		if err := second.Commit(); !errors.Is(err, ErrTxConflict) {
+			t.Fatalf("后提交的事务应返回写冲突, 实际 %v", err)
+		}
+
+		// 冲突事务的写入一个都不生效
+		if product, _ := dm.GetProductByID(3); product.Stock != 200 {
+			t.Errorf("冲突事务不应修改产品3: %d", product.Stock)
+		}
+		if len(dm.GetAllUsers()) != 3 {
+			t.Errorf("冲突事务不应新增用户: %d", len(dm.GetAllUsers()))
+		}
+
+		t.Log("写冲突测试通过")
+	})
+
+	t.Run("WithTransactionRetry", func(t *testing.T) {
+		dm := setupSimpleTestDB(t)
+		attempts := 0
+		err := dm.WithTransaction(func(tx *Tx) error {
+			attempts++
+			if err := tx.TransferStock(1, 2, 1); err != nil {
+				return err
+			}
+			if attempts == 1 {
+				// 模拟并发写入同一产品
+				dm.TransferStock(1, 3, 1)
+			}
+			return nil
+		})
+		if err != nil || attempts != 2 {
+			t.Fatalf("写冲突后应自动重试成功: 尝试 %d 次, 错误 %v", attempts, err)
+		}
+		if product, _ := dm.GetProductByID(1); product.Stock != 98 {
+			t.Errorf("两次转移后库存应为98, 实际 %d", product.Stock)
+		}
+
+		failed := dm.WithTransaction(func(tx *Tx) error {
+			tx.CreateUser(&SimpleUser{Name: "失败事务用户"})
+			return tx.TransferStock(1, 2, 99999)
+		})
+		if failed == nil || len(dm.GetAllUsers()) != 3 {
+			t.Error("函数返回错误时事务应回滚")
+		}
+
+		t.Log("自动重试测试通过")
+	})
+
+	t.Run("ConcurrentReaders", func(t *testing.T) {
+		dm := setupSimpleTestDB(t)
+		totalStock := func(products []SimpleProduct) int {
+			total := 0
+			for _, product := range products {
+				total += product.Stock
+			}
+			return total
+		}
+		expected := totalStock(dm.GetProductsByCategory(1))
+
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 50; j++ {
+					from, to := 1+(i+j)%2, 2-(i+j)%2
+					dm.TransferStock(from, to, 1)
+				}
+			}(i)
+		}
+
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+
+		for {
+			// 任何时刻读到的总库存都不变，不会看到只扣减了一边的中间状态
+			if total := totalStock(dm.GetProductsByCategory(1)); total != expected {
+				t.Fatalf("读到不一致的库存: 期望 %d, 实际 %d", expected, total)
+			}
+			tx := dm.Begin()
+			products, _ := tx.GetProductsByCategory(1)
+			tx.Rollback()
+			if total := totalStock(products); total != expected {
+				t.Fatalf("事务快照中的库存不一致: 期望 %d, 实际 %d", expected, total)
+			}
+
+			select {
+			case <-done:
+				t.Log("并发读取测试通过")
+				return
+			default:
+			}
+		}
+	})
+}
+
+// openDurableTestDB 在目录中打开持久化数据库，新建的目录写入示例数据，测试结束时关闭
+func openDurableTestDB(t *testing.T, dir string, snapshotEvery int) *SimpleDatabaseManager {
+	t.Helper()
+	_, statErr := os.Stat(filepath.Join(dir, walFileName))
+	dm, err := OpenSimpleDatabaseManager(PersistenceConfig{Dir: dir, SnapshotEvery: snapshotEvery})
+	if err != nil {
+		t.Fatalf("打开持久化数据库失败: %v", err)
+	}
+	t.Cleanup(func() { dm.Close() })
+	if errors.Is(statErr, os.ErrNotExist) {
+		if err := dm.seedData(); err != nil {
+			t.Fatalf("写入示例数据失败: %v", err)
+		}
+	}
+	return dm
+}
+
+func TestSimpleDatabaseManager_Persistence(t *testing.T) {
+	t.Run("RecoverFromWAL", func(t *testing.T) {
+		dir := t.TempDir()
+		dm := openDurableTestDB(t, dir, -1)
+
+		user := &SimpleUser{Name: "持久化用户", Email: "durable@example.com", Age: 33}
+		dm.CreateUser(user)
+		dm.DeleteUser(2)
+		dm.TransferStock(1, 2, 30)
+
+		// 不调用 Close 直接重新打开，模拟进程崩溃
+		recovered := openDurableTestDB(t, dir, -1)
+		if _, err := os.Stat(filepath.Join(dir, snapshotFileName)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("未关闭时不应生成快照, 数据应完全来自WAL: %v", err)
+		}
+		got, err := recovered.GetUserByID(user.ID)
+		if err != nil || got.Email != "durable@example.com" {
+			t.Errorf("重放后应恢复新用户: %+v, %v", got, err)
+		}
+		if _, err := recovered.GetUserByID(2); err == nil {
+			t.Error("重放后删除的用户不应存在")
+		}
+		if len(recovered.GetAllUsers()) != 3 {
+			t.Errorf("重放后的用户数不正确: %d", len(recovered.GetAllUsers()))
+		}
+		if product, _ := recovered.GetProductByID(1); product.Stock != 70 {
+			t.Errorf("重放后库存不正确: %d", product.Stock)
+		}
+
+		// ID序列同样恢复，不会复用已分配的ID
+		next := &SimpleUser{Name: "下一个用户"}
+		recovered.CreateUser(next)
+		if next.ID != user.ID+1 {
+			t.Errorf("恢复后的ID序列不正确: 期望 %d, 实际 %d", user.ID+1, next.ID)
+		}
+
+		t.Log("WAL恢复测试通过")
+	})
+
+	t.Run("EmptyStore", func(t *testing.T) {
+		dir := t.TempDir()
+		dm, err := OpenSimpleDatabaseManager(PersistenceConfig{Dir: dir})
+		if err != nil {
+			t.Fatalf("打开持久化数据库失败: %v", err)
+		}
+		defer dm.Close()
+
+		// 示例数据只属于内存模式，不能写进用户的数据目录
+		if len(dm.GetAllUsers()) != 0 || len(dm.GetAllCategories()) != 0 {
+			t.Errorf("新建的数据目录不应写入示例数据: %d 个用户, %d 个分类", len(dm.GetAllUsers()), len(dm.GetAllCategories()))
+		}
+		if info, _ := os.Stat(filepath.Join(dir, walFileName)); info.Size() != 0 {
+			t.Errorf("打开空目录不应写入WAL: %d 字节", info.Size())
+		}
+
+		t.Log("空数据目录测试通过")
+	})
+
+	t.Run("TornTail", func(t *testing.T) {
+		dir := t.TempDir()
+		dm := openDurableTestDB(t, dir, -1)
+		dm.CreateUser(&SimpleUser{Name: "完整记录", Email: "complete@example.com"})
+
+		walPath := filepath.Join(dir, walFileName)
+		info, _ := os.Stat(walPath)
+		intact := info.Size()
+
+		// 追加一条只写了一半的记录
+		frame := encodeFrame([]byte(`{"lsn":999,"ops":[{"op":"user.delete","id":1}]}`))
+		file, _ := os.OpenFile(walPath, os.O_WRONLY|os.O_APPEND, 0)
+		file.Write(frame[:len(frame)-5])
+		file.Close()
+
+		recovered := openDurableTestDB(t, dir, -1)
+		if len(recovered.GetAllUsers()) != 4 {
+			t.Errorf("残缺记录之前的数据应全部恢复: %d", len(recovered.GetAllUsers()))
+		}
+		if _, err := recovered.GetUserByID(1); err != nil {
+			t.Error("残缺记录不应被应用")
+		}
+		if info, _ := os.Stat(walPath); info.Size() != intact {
+			t.Errorf("残缺记录应被截掉: 期望 %d 字节, 实际 %d", intact, info.Size())
+		}
+
+		// 截断后追加的记录可以正常重放
+		recovered.CreateUser(&SimpleUser{Name: "截断后写入", Email: "after@example.com"})
+		if again := openDurableTestDB(t, dir, -1); len(again.GetAllUsers()) != 5 {
+			t.Errorf("截断后追加的记录应能重放: %d", len(again.GetAllUsers()))
+		}
+
+		t.Log("残缺末尾记录测试通过")
+	})
+
+	t.Run("CorruptRecord", func(t *testing.T) {
+		dir := t.TempDir()
+		dm := openDurableTestDB(t, dir, -1)
+		dm.CreateUser(&SimpleUser{Name: "被损坏的记录"})
+
+		// 篡改中间一条记录的负载，后面仍有完整记录
+		walPath := filepath.Join(dir, walFileName)
+		data, _ := os.ReadFile(walPath)
+		data[frameHeaderSize+10] ^= 0xff
+		os.WriteFile(walPath, data, 0o644)
+
+		if _, err := OpenSimpleDatabaseManager(PersistenceConfig{Dir: dir}); !errors.Is(err, ErrWALCorrupt) {
+			t.Errorf("中间记录损坏应返回 ErrWALCorrupt, 实际 %v", err)
+		}
+
+		t.Log("记录损坏测试通过")
+	})
+
+	t.Run("CorruptLength", func(t *testing.T) {
+		for name, length := range map[string]uint32{
+			"OverMaxFrameSize": maxFrameSize + 1,
+			"PastEndOfFile":    1 << 20,
+			"WithinFile":       10,
+		} {
+			dir := t.TempDir()
+			dm := openDurableTestDB(t, dir, -1)
+			dm.CreateUser(&SimpleUser{Name: "长度被损坏的记录之后", Email: "after-length@example.com"})
+
+			// 篡改第一条记录的长度字段，后面仍有完整记录，不能当作残缺末尾截掉
+			walPath := filepath.Join(dir, walFileName)
+			data, _ := os.ReadFile(walPath)
+			binary.LittleEndian.PutUint32(data[:4], length)
+			os.WriteFile(walPath, data, 0o644)
+
+			if _, err := OpenSimpleDatabaseManager(PersistenceConfig{Dir: dir}); !errors.Is(err, ErrWALCorrupt) {
+				t.Errorf("%s: 中间记录长度损坏应返回 ErrWALCorrupt, 实际 %v", name, err)
+			}
+			if info, _ := os.Stat(walPath); info.Size() != int64(len(data)) {
+				t.Errorf("%s: 损坏的WAL不应被截断: %d 字节", name, info.Size())
+			}
+		}
+
+		t.Log("记录长度损坏测试通过")
+	})
+
+	t.Run("PeriodicSnapshot", func(t *testing.T) {
+		dir := t.TempDir()
+		dm := openDurableTestDB(t, dir, 5)
+		for i := 0; i < 12; i++ {
+			dm.CreateUser(&SimpleUser{Name: fmt.Sprintf("快照用户%d", i), Email: fmt.Sprintf("snapshot%d@example.com", i)})
+		}
+
+		if _, err := os.Stat(filepath.Join(dir, snapshotFileName)); err != nil {
+			t.Fatalf("写入达到阈值后应生成快照: %v", err)
+		}
+		if dm.wal.records >= 5 {
+			t.Errorf("快照后WAL应被清空: 剩余 %d 条记录", dm.wal.records)
+		}
+
+		recovered := openDurableTestDB(t, dir, 5)
+		if len(recovered.GetAllUsers()) != 15 {
+			t.Errorf("从快照和WAL恢复的用户数不正确: %d", len(recovered.GetAllUsers()))
+		}
+
+		t.Log("定期快照测试通过")
+	})
+
+	t.Run("SnapshotFailureLogged", func(t *testing.T) {
+		dir := t.TempDir()
+		var logs bytes.Buffer
+		dm, err := OpenSimpleDatabaseManager(PersistenceConfig{Dir: dir, SnapshotEvery: 1, ErrorLog: log.New(&logs, "", 0)})
+		if err != nil {
+			t.Fatalf("打开持久化数据库失败: %v", err)
+		}
+
+		// 快照文件的位置被目录占用，替换快照失败
+		os.Mkdir(filepath.Join(dir, snapshotFileName), 0o755)
+		if err := dm.CreateUser(&SimpleUser{Name: "快照失败", Email: "snapshot-fail@example.com"}); err != nil {
+			t.Fatalf("快照失败不应影响已写入WAL的修改: %v", err)
+		}
+		if !strings.Contains(logs.String(), "自动快照失败") {
+			t.Errorf("自动快照失败应记录日志: %q", logs.String())
+		}
+		if err := dm.Close(); err == nil {
+			t.Error("关闭时快照失败应返回错误")
+		}
+
+		t.Log("快照失败日志测试通过")
+	})
+
+	t.Run("CrashBetweenSnapshotAndTruncate", func(t *testing.T) {
+		dir := t.TempDir()
+		dm := openDurableTestDB(t, dir, -1)
+		dm.CreateUser(&SimpleUser{Name: "快照前写入", Email: "before@example.com"})
+
+		walPath := filepath.Join(dir, walFileName)
+		stale, _ := os.ReadFile(walPath)
+		if err := dm.Snapshot(); err != nil {
+			t.Fatalf("生成快照失败: %v", err)
+		}
+		// 恢复快照已包含的WAL记录，相当于清空WAL之前崩溃
+		os.WriteFile(walPath, stale, 0o644)
+
+		recovered := openDurableTestDB(t, dir, -1)
+		if len(recovered.GetAllUsers()) != 4 {
+			t.Errorf("快照已包含的记录不应重复应用: %d", len(recovered.GetAllUsers()))
+		}
+
+		t.Log("快照与WAL交界测试通过")
+	})
+
+	t.Run("TransactionAtomicity", func(t *testing.T) {
+		dir := t.TempDir()
+		dm := openDurableTestDB(t, dir, -1)
+
+		walPath := filepath.Join(dir, walFileName)
+		before, _ := os.Stat(walPath)
+
+		tx := dm.Begin()
+		tx.CreateUser(&SimpleUser{Name: "事务用户", Email: "tx@example.com"})
+		tx.TransferStock(1, 2, 10)
+		tx.Rollback()
+		if after, _ := os.Stat(walPath); after.Size() != before.Size() {
+			t.Error("回滚的事务不应写入WAL")
+		}
+
+		tx = dm.Begin()
+		tx.CreateUser(&SimpleUser{Name: "事务用户", Email: "tx@example.com"})
+		tx.TransferStock(1, 2, 10)
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("提交失败: %v", err)
+		}
+
+		// 截掉事务记录的最后一个字节，整个事务都不应被恢复
+		committed, _ := os.Stat(walPath)
+		os.Truncate(walPath, committed.Size()-1)
+
+		recovered := openDurableTestDB(t, dir, -1)
+		if len(recovered.GetAllUsers()) != 3 {
+			t.Errorf("残缺的事务不应部分恢复用户: %d", len(recovered.GetAllUsers()))
+		}
+		if product, _ := recovered.GetProductByID(1); product.Stock != 100 {
+			t.Errorf("残缺的事务不应部分恢复库存: %d", product.Stock)
+		}
+
+		t.Log("事务持久化原子性测试通过")
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		dir := t.TempDir()
+		dm := openDurableTestDB(t, dir, -1)
+		if err := dm.Close(); err != nil {
+			t.Fatalf("关闭失败: %v", err)
+		}
+		rejected := &SimpleUser{Name: "关闭后写入"}
+		if err := dm.CreateUser(rejected); !errors.Is(err, ErrDatabaseClosed) {
+			t.Errorf("关闭后写入应返回 ErrDatabaseClosed, 实际 %v", err)
+		}
+		if rejected.ID != 0 || !rejected.CreatedAt.IsZero() {
+			t.Errorf("写入失败时不应回填调用方的记录: %+v", rejected)
+		}
+		category := &SimpleCategory{Name: "关闭后写入"}
+		if err := dm.CreateCategory(category); err == nil || category.ID != 0 {
+			t.Errorf("写入失败时不应回填分类ID: %v, %d", err, category.ID)
+		}
+		product := &SimpleProduct{Name: "关闭后写入", CategoryID: 1}
+		if err := dm.CreateProduct(product); err == nil || product.ID != 0 {
+			t.Errorf("写入失败时不应回填产品ID: %v, %d", err, product.ID)
+		}
+		existing, _ := dm.GetUserByID(1)
+		updated := *existing
+		if err := dm.UpdateUser(&updated); err == nil || !updated.UpdatedAt.Equal(existing.UpdatedAt) {
+			t.Errorf("更新失败时不应修改调用方的记录: %v", err)
+		}
+		if len(dm.GetAllUsers()) != 3 {
+			t.Errorf("写入失败时内存数据不应改变: %d", len(dm.GetAllUsers()))
+		}
+		if info, _ := os.Stat(filepath.Join(dir, walFileName)); info.Size() != 0 {
+			t.Errorf("关闭时应生成快照并清空WAL: %d 字节", info.Size())
+		}
+
+		if _, err := OpenSimpleDatabaseManager(PersistenceConfig{}); err == nil {
+			t.Error("未指定数据目录时应返回错误")
+		}
+
+		t.Log("关闭测试通过")
+	})
+}
+
+func TestSimpleDatabaseManager_SecondaryIndex(t *testing.T) {
+	t.Run("CategoryIndex", func(t *testing.T) {
+		dm := setupSimpleTestDB(t)
+
+		// 产品移到其他分类后，两个分类的查询和统计都随之变化
+		product, _ := dm.GetProductByID(1)
+		product.CategoryID = 3
+		dm.UpdateProduct(product)
+
+		if products := dm.GetProductsByCategory(1); len(products) != 1 || products[0].Name != "MacBook Pro" {
+			t.Errorf("原分类应只剩 MacBook Pro: %+v", products)
+		}
+		if products := dm.GetProductsByCategory(3); len(products) != 2 || products[0].Name != "Go语言编程" {
+			t.Errorf("新分类应有两个按名称排序的产品: %+v", products)
+		}
+
+		for _, stat := range dm.GetCategoryStats() {
+			if stat.CategoryID == 1 && (stat.ProductCount != 1 || stat.TotalStock != 50) {
+				t.Errorf("原分类统计不正确: %+v", stat)
+			}
+			if stat.CategoryID == 3 && (stat.ProductCount != 2 || stat.TotalStock != 250) {
+				t.Errorf("新分类统计不正确: %+v", stat)
+			}
+		}
+
+		t.Log("分类索引测试通过")
+	})
+
+	t.Run("EmailIndex", func(t *testing.T) {
+		dm := setupSimpleTestDB(t)
+
+		user, err := dm.GetUserByEmail("  LiSi@Example.com ")
+		if err != nil || user.Name != "李四" {
+			t.Fatalf("按邮箱查询应不区分大小写: %+v, %v", user, err)
+		}
+
+		user.Email = "lisi@new.example.com"
+		dm.UpdateUser(user)
+		if _, err := dm.GetUserByEmail("lisi@example.com"); err == nil {
+			t.Error("修改邮箱后旧邮箱不应再查到用户")
+		}
+		if found, err := dm.GetUserByEmail("lisi@new.example.com"); err != nil || found.ID != user.ID {
+			t.Errorf("修改邮箱后应能按新邮箱查到用户: %+v, %v", found, err)
+		}
+
+		// 邮箱不要求唯一，返回ID最小的用户；删除后返回下一个
+		duplicate := &SimpleUser{Name: "同邮箱用户", Email: "zhangsan@example.com"}
+		dm.CreateUser(duplicate)
+		if found, _ := dm.GetUserByEmail("zhangsan@example.com"); found.ID != 1 {
+			t.Errorf("邮箱重复时应返回ID最小的用户: %d", found.ID)
+		}
+		dm.DeleteUser(1)
+		if found, _ := dm.GetUserByEmail("zhangsan@example.com"); found.ID != duplicate.ID {
+			t.Errorf("删除后应返回另一个同邮箱用户: %d", found.ID)
+		}
+
+		t.Log("邮箱索引测试通过")
+	})
+
+	t.Run("PriceRange", func(t *testing.T) {
+		dm := setupSimpleTestDB(t)
+
+		products := dm.GetProductsByPriceRange(89, 5999)
+		if len(products) != 3 {
+			t.Fatalf("价格区间内应有3个产品: %d", len(products))
+		}
+		for i, name := range []string{"Go语言编程", "连衣裙", "iPhone 15"} {
+			if products[i].Name != name {
+				t.Errorf("第 %d 个产品应为 %s, 实际 %s", i, name, products[i].Name)
+			}
+		}
+
+		// 修改价格后移出区间
+		product, _ := dm.GetProductByID(3)
+		product.Price = 9999
+		dm.UpdateProduct(product)
+		if products := dm.GetProductsByPriceRange(89, 5999); len(products) != 2 {
+			t.Errorf("改价后区间内应有2个产品: %d", len(products))
+		}
+		dm.DeleteProduct(4)
+		if products := dm.GetProductsByPriceRange(0, 100); len(products) != 0 {
+			t.Errorf("删除的产品不应出现在价格区间中: %d", len(products))
+		}
+		if products := dm.GetProductsByCategory(3); len(products) != 0 {
+			t.Errorf("删除的产品不应出现在分类中: %d", len(products))
+		}
+		if products := dm.GetProductsByPriceRange(100, 50); len(products) != 0 {
+			t.Errorf("空区间不应返回产品: %d", len(products))
+		}
+
+		t.Log("价格区间测试通过")
+	})
+
+	t.Run("ConsistentWithFullScan", func(t *testing.T) {
+		dm := setupSimpleTestDB(t)
+
+		// 混合普通写入、事务提交和回滚后，索引查询与全表扫描结果一致
+		for i := 0; i < 50; i++ {
+			product := &SimpleProduct{Name: fmt.Sprintf("产品%02d", i), Price: float64(i % 7 * 100), CategoryID: i%3 + 1, Stock: 10}
+			dm.CreateProduct(product)
+			if i%4 == 0 {
+				dm.WithTransaction(func(tx *Tx) error {
+					product.CategoryID = (product.CategoryID % 3) + 1
+					product.Price += 50
+					return tx.UpdateProduct(product)
+				})
+			}
+			if i%5 == 0 {
+				tx := dm.Begin()
+				product.CategoryID = 99
+				tx.UpdateProduct(product)
+				tx.Rollback()
+			}
+		}
+
+		for categoryID := 1; categoryID <= 3; categoryID++ {
+			indexed := dm.GetProductsByCategory(categoryID)
+			scanned := productsInCategory(dm.products, categoryID)
+			if fmt.Sprint(indexed) != fmt.Sprint(scanned) {
+				t.Errorf("分类 %d 的索引结果与全表扫描不一致", categoryID)
+			}
+		}
+		if len(dm.GetProductsByCategory(99)) != 0 {
+			t.Error("回滚的修改不应进入索引")
+		}
+
+		inRange := 0
+		for _, product := range dm.products {
+			if product.Price >= 200 && product.Price <= 450 {
+				inRange++
+			}
+		}
+		if products := dm.GetProductsByPriceRange(200, 450); len(products) != inRange {
+			t.Errorf("价格索引结果与全表扫描不一致: 期望 %d, 实际 %d", inRange, len(products))
+		}
+
+		t.Log("索引一致性测试通过")
+	})
+
+	t.Run("RebuiltOnRecovery", func(t *testing.T) {
+		dir := t.TempDir()
+		dm := openDurableTestDB(t, dir, 3)
+		dm.CreateUser(&SimpleUser{Name: "恢复用户", Email: "recover@example.com"})
+		dm.CreateProduct(&SimpleProduct{Name: "恢复产品", Price: 1, CategoryID: 2})
+
+		recovered := openDurableTestDB(t, dir, 3)
+		if _, err := recovered.GetUserByEmail("recover@example.com"); err != nil {
+			t.Errorf("恢复后应能按邮箱查询: %v", err)
+		}
+		if products := recovered.GetProductsByCategory(2); len(products) != 2 {
+			t.Errorf("恢复后分类索引不正确: %d", len(products))
+		}
+		if products := recovered.GetProductsByPriceRange(0, 1); len(products) != 1 {
+			t.Errorf("恢复后价格索引不正确: %d", len(products))
+		}
+
+		t.Log("恢复后重建索引测试通过")
+	})
+}
+
+func TestSimpleDatabaseManager_ForeignKey(t *testing.T) {
+	t.Run("ProductCategoryMustExist", func(t *testing.T) {
+		dm := setupSimpleTestDB(t)
+
+		err := dm.CreateProduct(&SimpleProduct{Name: "无效分类产品", CategoryID: 99})
+		var constraintErr *ConstraintError
+		if !errors.As(err, &constraintErr) || !errors.Is(err, ErrForeignKeyViolation) {
+			t.Fatalf("引用不存在的分类应返回外键错误, 实际 %v", err)
+		}
+		if constraintErr.Constraint != ConstraintProductCategory || constraintErr.Value != 99 {
+			t.Errorf("约束错误信息不正确: %+v", constraintErr)
+		}
+		if len(dm.GetProductsByCategory(99)) != 0 {
+			t.Error("违反约束的产品不应被创建")
+		}
+
+		// CategoryID 为0表示未分类
+		if err := dm.CreateProduct(&SimpleProduct{Name: "未分类产品"}); err != nil {
+			t.Errorf("未分类的产品应允许创建: %v", err)
+		}
+
+		product, _ := dm.GetProductByID(1)
+		product.CategoryID = 42
+		if err := dm.UpdateProduct(product); !errors.Is(err, ErrForeignKeyViolation) {
+			t.Errorf("更新为不存在的分类应返回外键错误, 实际 %v", err)
+		}
+		if stored, _ := dm.GetProductByID(1); stored.CategoryID != 1 {
+			t.Errorf("违反约束的更新不应生效: %d", stored.CategoryID)
+		}
+
+		t.Log("外键校验测试通过")
+	})
+
+	t.Run("DeleteRestrict", func(t *testing.T) {
+		dm := setupSimpleTestDB(t)
+
+		err := dm.DeleteCategory(1, OnDeleteRestrict)
+		var constraintErr *ConstraintError
+		if !errors.As(err, &constraintErr) || !errors.Is(err, ErrRestrictViolation) {
+			t.Fatalf("分类仍有产品时应拒绝删除, 实际 %v", err)
+		}
+		if fmt.Sprint(constraintErr.Referencing) != "[1 2]" {
+			t.Errorf("应列出仍引用分类的产品: %v", constraintErr.Referencing)
+		}
+		if len(dm.GetAllCategories()) != 3 {
+			t.Error("拒绝删除时分类应保留")
+		}
+
+		empty := &SimpleCategory{Name: "空分类"}
+		dm.CreateCategory(empty)
+		if err := dm.DeleteCategory(empty.ID, OnDeleteRestrict); err != nil {
+			t.Errorf("没有产品的分类应能删除: %v", err)
+		}
+		if err := dm.DeleteCategory(empty.ID, OnDeleteRestrict); err == nil {
+			t.Error("删除不存在的分类应返回错误")
+		}
+
+		t.Log("RESTRICT 删除测试通过")
+	})
+
+	t.Run("DeleteCascade", func(t *testing.T) {
+		dm := setupSimpleTestDB(t)
+
+		if err := dm.DeleteCategory(1, OnDeleteCascade); err != nil {
+			t.Fatalf("级联删除失败: %v", err)
+		}
+		for _, id := range []int{1, 2} {
+			if _, err := dm.GetProductByID(id); err == nil {
+				t.Errorf("级联删除后产品 %d 不应存在", id)
+			}
+		}
+		if products := dm.GetProductsByPriceRange(5000, 20000); len(products) != 0 {
+			t.Errorf("级联删除的产品应从价格索引移除: %d", len(products))
+		}
+		if len(dm.GetAllCategories()) != 2 || len(dm.GetProductsWithCategory()) != 2 {
+			t.Error("其他分类和产品不应受影响")
+		}
+
+		t.Log("CASCADE 删除测试通过")
+	})
+
+	t.Run("DeleteSetNull", func(t *testing.T) {
+		dm := setupSimpleTestDB(t)
+
+		if err := dm.DeleteCategory(1, OnDeleteSetNull); err != nil {
+			t.Fatalf("置空删除失败: %v", err)
+		}
+		if products := dm.GetProductsByCategory(0); len(products) != 2 {
+			t.Errorf("原分类的产品应变为未分类: %d", len(products))
+		}
+		for _, pwc := range dm.GetProductsWithCategory() {
+			if pwc.Product.CategoryID == 0 && pwc.CategoryName != "未知分类" {
+				t.Errorf("未分类产品的分类名不正确: %s", pwc.CategoryName)
+			}
+		}
+
+		if err := dm.DeleteCategory(2, ReferentialAction(9)); err == nil {
+			t.Error("不支持的删除方式应返回错误")
+		}
+
+		t.Log("SET NULL 删除测试通过")
+	})
+
+	t.Run("TransactionRecheckOnCommit", func(t *testing.T) {
+		dm := setupSimpleTestDB(t)
+
+		tx := dm.Begin()
+		if err := tx.CreateProduct(&SimpleProduct{Name: "无效分类", CategoryID: 99}); !errors.Is(err, ErrForeignKeyViolation) {
+			t.Errorf("事务内引用不存在的分类应返回外键错误, 实际 %v", err)
+		}
+		if err := tx.CreateProduct(&SimpleProduct{Name: "新书", CategoryID: 3}); err != nil {
+			t.Fatalf("事务内创建产品失败: %v", err)
+		}
+
+		// 事务开始后分类被其他写入删除
+		dm.DeleteCategory(3, OnDeleteCascade)
+
+		if err := tx.Commit(); !errors.Is(err, ErrForeignKeyViolation) {
+			t.Fatalf("提交时应重新检查外键, 实际 %v", err)
+		}
+		if len(dm.GetProductsByCategory(3)) != 0 {
+			t.Error("违反约束的事务不应应用任何写入")
+		}
+
+		t.Log("事务外键检查测试通过")
+	})
+
+	t.Run("CascadeIsDurable", func(t *testing.T) {
+		dir := t.TempDir()
+		dm := openDurableTestDB(t, dir, -1)
+		dm.DeleteCategory(1, OnDeleteCascade)
+
+		recovered := openDurableTestDB(t, dir, -1)
+		if len(recovered.GetAllCategories()) != 2 || len(recovered.GetProductsWithCategory()) != 2 {
+			t.Errorf("恢复后级联删除结果不正确: 分类 %d, 产品 %d",
+				len(recovered.GetAllCategories()), len(recovered.GetProductsWithCategory()))
+		}
+
+		t.Log("级联删除持久化测试通过")
+	})
+}
+
+func TestSimpleDatabaseManager_Query(t *testing.T) {
+	t.Run("WhereOrderByLimit", func(t *testing.T) {
+		dm := setupSimpleTestDB(t)
+
+		rows, err := dm.Query("products").
+			Where("price", ">", 100).
+			Where("stock", ">=", 50).
+			Select("name", "price").
+			OrderBy("price", Desc).
+			Limit(2).
+			Run()
+		if err != nil {
+			t.Fatalf("查询失败: %v", err)
+		}
+		if len(rows) != 2 || rows[0]["name"] != "MacBook Pro" || rows[1]["name"] != "iPhone 15" {
+			t.Errorf("查询结果不正确: %v", rows)
+		}
+		if _, exists := rows[0]["stock"]; exists {
+			t.Error("未选择的列不应出现在结果中")
+		}
+
+		rows, _ = dm.Query("users").Where("id", "in", []int{1, 3}).OrderBy("age", Asc).Offset(1).Run()
+		if len(rows) != 1 || rows[0]["name"] != "王五" || rows[0]["email"] != "wangwu@example.com" {
+			t.Errorf("in 条件和偏移的结果不正确: %v", rows)
+		}
+
+		t.Log("过滤排序分页测试通过")
+	})
+
+	t.Run("JoinMatchesGetProductsWithCategory", func(t *testing.T) {
+		dm := setupSimpleTestDB(t)
+
+		rows, err := dm.Query("products").
+			Join("categories").
+			Select("products.name", "categories.name").
+			OrderBy("products.name", Asc).
+			Run()
+		if err != nil {
+			t.Fatalf("连接查询失败: %v", err)
+		}
+
+		expected := dm.GetProductsWithCategory()
+		if len(rows) != len(expected) {
+			t.Fatalf("连接查询行数不正确: 期望 %d, 实际 %d", len(expected), len(rows))
+		}
+		for i, pwc := range expected {
+			if rows[i]["products.name"] != pwc.Product.Name || rows[i]["categories.name"] != pwc.CategoryName {
+				t.Errorf("第 %d 行不一致: %v, 期望 %+v", i, rows[i], pwc)
+			}
+		}
+
+		// 反方向连接同样按外键推断条件
+		rows, _ = dm.Query("categories").Join("products").Where("categories.id", "=", 1).Run()
+		if len(rows) != 2 || rows[0]["products.category_id"] != 1 {
+			t.Errorf("从分类连接产品的结果不正确: %v", rows)
+		}
+
+		t.Log("连接查询测试通过")
+	})
+
+	t.Run("LeftJoin", func(t *testing.T) {
+		dm := setupSimpleTestDB(t)
+		dm.DeleteCategory(1, OnDeleteSetNull)
+
+		inner, _ := dm.Query("products").Join("categories").Run()
+		left, _ := dm.Query("products").LeftJoin("categories").Where("categories.id", "=", nil).Run()
+		if len(inner) != 2 || len(left) != 2 {
+			t.Errorf("内连接应丢弃未分类产品, 左连接应保留: 内连接 %d, 未匹配 %d", len(inner), len(left))
+		}
+		for _, row := range left {
+			if row["categories.name"] != nil || row["products.category_id"] != 0 {
+				t.Errorf("未匹配的行连接表的列应为nil: %v", row)
+			}
+		}
+
+		t.Log("左连接测试通过")
+	})
+
+	t.Run("GroupByMatchesGetCategoryStats", func(t *testing.T) {
+		dm := setupSimpleTestDB(t)
+		dm.CreateProduct(&SimpleProduct{Name: "Kindle", Price: 999, CategoryID: 1, Stock: 30})
+
+		rows, err := dm.Query("products").
+			Join("categories").
+			GroupBy("categories.id", "categories.name").
+			Aggregate(
+				Count("*").As("product_count"),
+				Sum("stock").As("total_stock"),
+				Avg("price").As("avg_price"),
+			).
+			OrderBy("categories.name", Asc).
+			Run()
+		if err != nil {
+			t.Fatalf("分组查询失败: %v", err)
+		}
+
+		stats := dm.GetCategoryStats()
+		if len(rows) != len(stats) {
+			t.Fatalf("分组数不正确: 期望 %d, 实际 %d", len(stats), len(rows))
+		}
+		for i, stat := range stats {
+			row := rows[i]
+			if row["categories.id"] != stat.CategoryID || row["categories.name"] != stat.CategoryName ||
+				row["product_count"] != stat.ProductCount || row["total_stock"] != stat.TotalStock ||
+				row["avg_price"] != stat.AvgPrice {
+				t.Errorf("第 %d 组与 GetCategoryStats 不一致: %v, 期望 %+v", i, row, stat)
+			}
+		}
+
+		t.Log("分组聚合测试通过")
+	})
+
+	t.Run("AggregateWithoutGroupBy", func(t *testing.T) {
+		dm := setupSimpleTestDB(t)
+
+		rows, _ := dm.Query("products").Aggregate(Count("*"), Min("price"), Max("name"), Sum("price")).Run()
+		if len(rows) != 1 {
+			t.Fatalf("没有分组列时应聚合为一行: %d", len(rows))
+		}
+		row := rows[0]
+		if row["count(*)"] != 4 || row["min(price)"] != 89.0 || row["max(name)"] != "连衣裙" || row["sum(price)"] != 19386.0 {
+			t.Errorf("聚合结果不正确: %v", row)
+		}
+
+		rows, _ = dm.Query("products").Where("stock", ">", 10000).Aggregate(Count("*"), Sum("stock")).Run()
+		if len(rows) != 1 || rows[0]["count(*)"] != 0 || rows[0]["sum(stock)"] != nil {
+			t.Errorf("没有匹配行时 count 应为0, sum 应为nil: %v", rows)
+		}
+
+		t.Log("全表聚合测试通过")
+	})
+
+	t.Run("InvalidQuery", func(t *testing.T) {
+		dm := setupSimpleTestDB(t)
+
+		queries := map[string]*Query{
+			"未知的表":      dm.Query("orders"),
+			"未知的列":      dm.Query("users").Where("phone", "=", "1"),
+			"列名不明确":     dm.Query("products").Join("categories").Select("name"),
+			"不支持的运算符":   dm.Query("users").Where("age", "~", 1),
+			"非数值求和":     dm.Query("users").Aggregate(Sum("name")),
+			"没有外键关系":    dm.Query("users").Join("products"),
+			"按非分组列排序":   dm.Query("products").GroupBy("category_id").Aggregate(Count("*")).OrderBy("price", Asc),
+			"分组查询使用选择列": dm.Query("products").GroupBy("category_id").Select("name"),
+		}
+		for name, query := range queries {
+			if _, err := query.Run(); !errors.Is(err, ErrInvalidQuery) {
+				t.Errorf("%s: 应返回 ErrInvalidQuery, 实际 %v", name, err)
+			}
+		}
+
+		// 没有行可以扫描时，无效的条件同样要报错
+		empty := newSimpleDatabaseManager()
+		conditions := map[string]*Query{
+			"不支持的运算符":         empty.Query("users").Where("age", "bogus", 1),
+			"in的值不是切片":        empty.Query("users").Where("age", "in", 1),
+			"contains的值不是字符串": empty.Query("users").Where("name", "contains", 1),
+		}
+		for name, query := range conditions {
+			if _, err := query.Run(); !errors.Is(err, ErrInvalidQuery) {
+				t.Errorf("空表%s: 应返回 ErrInvalidQuery, 实际 %v", name, err)
+			}
+		}
+
+		t.Log("无效查询测试通过")
+	})
 }
 
 func TestSimpleDatabaseManager_GetCategoryStats(t *testing.T) {
@@ -461,3 +1500,132 @@ func BenchmarkSimpleDatabaseManager_GetAllUsers(b *testing.B) {
 		_ = dm.GetAllUsers()
 	}
 }
+
+// setupLargeTestDB 创建包含大量数据的数据库，用于对比索引和全表扫描
+func setupLargeTestDB(b *testing.B) *SimpleDatabaseManager {
+	dm := setupSimpleTestDB(b)
+	for i := 0; i < 50; i++ {
+		dm.CreateCategory(&SimpleCategory{Name: fmt.Sprintf("基准分类%d", i)})
+	}
+	for i := 0; i < 20000; i++ {
+		dm.CreateProduct(&SimpleProduct{
+			Name:       fmt.Sprintf("基准产品%d", i),
+			Price:      float64(i % 10000),
+			CategoryID: i%50 + 4,
+			Stock:      i % 100,
+		})
+	}
+	for i := 0; i < 10000; i++ {
+		dm.CreateUser(&SimpleUser{Name: fmt.Sprintf("基准用户%d", i), Email: fmt.Sprintf("large%d@example.com", i)})
+	}
+	return dm
+}
+
+func BenchmarkSimpleDatabaseManager_GetProductsByCategory(b *testing.B) {
+	dm := setupLargeTestDB(b)
+
+	b.Run("Index", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_ = dm.GetProductsByCategory(i%50 + 4)
+		}
+	})
+	b.Run("FullScan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			dm.mutex.RLock()
+			_ = productsInCategory(dm.products, i%50+4)
+			dm.mutex.RUnlock()
+		}
+	})
+}
+
+func BenchmarkSimpleDatabaseManager_GetCategoryStats(b *testing.B) {
+	dm := setupLargeTestDB(b)
+
+	b.Run("Index", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_ = dm.GetCategoryStats()
+		}
+	})
+	b.Run("FullScan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			// 建立索引之前的实现：每个分类扫描一遍全部产品
+			dm.mutex.RLock()
+			for _, category := range dm.categories {
+				count, stock := 0, 0
+				for _, product := range dm.products {
+					if product.CategoryID == category.ID {
+						count++
+						stock += product.Stock
+					}
+				}
+				_, _ = count, stock
+			}
+			dm.mutex.RUnlock()
+		}
+	})
+}
+
+func BenchmarkSimpleDatabaseManager_GetUserByEmail(b *testing.B) {
+	dm := setupLargeTestDB(b)
+
+	b.Run("Index", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, _ = dm.GetUserByEmail(fmt.Sprintf("large%d@example.com", i%10000))
+		}
+	})
+	b.Run("FullScan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			email := fmt.Sprintf("large%d@example.com", i%10000)
+			dm.mutex.RLock()
+			for _, user := range dm.users {
+				if user.Email == email {
+					break
+				}
+			}
+			dm.mutex.RUnlock()
+		}
+	})
+}
+
+func BenchmarkSimpleDatabaseManager_GetProductsByPriceRange(b *testing.B) {
+	dm := setupLargeTestDB(b)
+
+	b.Run("Index", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_ = dm.GetProductsByPriceRange(1000, 1100)
+		}
+	})
+	b.Run("FullScan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			dm.mutex.RLock()
+			var products []SimpleProduct
+			for _, product := range dm.products {
+				if product.Price >= 1000 && product.Price <= 1100 {
+					products = append(products, *product)
+				}
+			}
+			sort.Slice(products, func(i, j int) bool {
+				return products[i].Price < products[j].Price
+			})
+			dm.mutex.RUnlock()
+		}
+	})
+}
+
+func BenchmarkSimpleDatabaseManager_TransferStock(b *testing.B) {
+	dm := setupLargeTestDB(b)
+
+	b.Run("Direct", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_ = dm.TransferStock(1, 2, 0)
+		}
+	})
+	b.Run("Transaction", func(b *testing.B) {
+		// 事务开始时复制整张表，开销与表大小成正比
+		for i := 0; i < b.N; i++ {
+			_ = dm.WithTransaction(func(tx *Tx) error {
+				return tx.TransferStock(1, 2, 0)
+			})
+		}
+	})
+}
@@ -0,0 +1,419 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// 事务错误
+var (
+	ErrTxDone     = errors.New("事务已提交或已回滚")
+	ErrTxConflict = errors.New("事务写冲突: 数据在事务开始后已被修改")
+)
+
+// maxTxRetries WithTransaction 遇到写冲突时的最大尝试次数
+const maxTxRetries = 3
+
+// txTable 一张表在事务中的状态
+//
+// rows 是事务开始时的快照副本，事务内的写入直接作用于副本，因此事务能读到自己的写入；
+// original 记录每个被写入的行在快照中的原值（新建的行为nil），提交时据此检测写冲突。
+type txTable[T any] struct {
+	rows     map[int]*T
+	original map[int]*T
+}
+
+// newTxTable 浅拷贝已提交的表作为快照，已提交的记录不会被原地修改，共享指针是安全的
+func newTxTable[T any](committed map[int]*T) *txTable[T] {
+	rows := make(map[int]*T, len(committed))
+	for id, row := range committed {
+		rows[id] = row
+	}
+	return &txTable[T]{rows: rows, original: make(map[int]*T)}
+}
+
+// put 写入行的副本
+func (t *txTable[T]) put(id int, row *T) {
+	t.touch(id)
+	stored := *row
+	t.rows[id] = &stored
+}
+
+// remove 删除行
+func (t *txTable[T]) remove(id int) {
+	t.touch(id)
+	delete(t.rows, id)
+}
+
+// touch 首次写入时记录行在快照中的原值
+func (t *txTable[T]) touch(id int) {
+	if _, written := t.original[id]; !written {
+		t.original[id] = t.rows[id]
+	}
+}
+
+// conflict 检查被写入的行在事务开始后是否已被其他写入修改，返回第一个冲突的ID
+func (t *txTable[T]) conflict(committed map[int]*T) (int, bool) {
+	for id, original := range t.original {
+		if committed[id] != original {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// ops 将事务内的写入转换为WAL操作，已删除的行以nil传给 op
+func (t *txTable[T]) ops(op func(id int, row *T) walOp) []walOp {
+	ops := make([]walOp, 0, len(t.original))
+	for id := range t.original {
+		ops = append(ops, op(id, t.rows[id]))
+	}
+	return ops
+}
+
+// Tx 数据库事务，不能在多个goroutine间共享
+//
+// 事务采用快照隔离：读取看到的是 Begin 时已提交的数据加上事务自己的写入，
+// 其他事务或非事务写入在提交前后都不会影响本事务的读取；
+// 写入缓冲在事务内，Commit 时一次性应用，其他读取者不会看到只应用了一半的修改。
+// 提交时若本事务写过的行已被他人修改，返回 ErrTxConflict 且不应用任何写入（先提交者胜出）。
+// 提交时还会按最新数据重新检查外键，违反时返回 *ConstraintError，同样不应用任何写入。
+type Tx struct {
+	dm         *SimpleDatabaseManager
+	users      *txTable[SimpleUser]
+	categories *txTable[SimpleCategory]
+	products   *txTable[SimpleProduct]
+	done       bool
+	mutex      sync.Mutex
+}
+
+// Begin 开始事务
+func (dm *SimpleDatabaseManager) Begin() *Tx {
+	dm.mutex.RLock()
+	defer dm.mutex.RUnlock()
+
+	return &Tx{
+		dm:         dm,
+		users:      newTxTable(dm.users),
+		categories: newTxTable(dm.categories),
+		products:   newTxTable(dm.products),
+	}
+}
+
+// WithTransaction 在事务中执行 fn，fn 返回nil时提交，否则回滚
+//
+// 提交遇到写冲突时用新的快照重新执行 fn，最多尝试 maxTxRetries 次。
+func (dm *SimpleDatabaseManager) WithTransaction(fn func(tx *Tx) error) error {
+	var err error
+	for attempt := 0; attempt < maxTxRetries; attempt++ {
+		tx := dm.Begin()
+		if err = fn(tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err = tx.Commit(); !errors.Is(err, ErrTxConflict) {
+			return err
+		}
+	}
+	return err
+}
+
+// Commit 提交事务
+func (tx *Tx) Commit() error {
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+
+	dm := tx.dm
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+
+	// 先检查全部冲突再应用，保证要么全部生效要么全部不生效
+	if id, found := tx.users.conflict(dm.users); found {
+		return fmt.Errorf("%w: 用户 %d", ErrTxConflict, id)
+	}
+	if id, found := tx.categories.conflict(dm.categories); found {
+		return fmt.Errorf("%w: 分类 %d", ErrTxConflict, id)
+	}
+	if id, found := tx.products.conflict(dm.products); found {
+		return fmt.Errorf("%w: 产品 %d", ErrTxConflict, id)
+	}
+
+	// 事务内的外键检查基于快照，提交前按合并后的数据重新检查，
+	// 防止引用的分类在事务开始后被其他写入删除
+	categoryExists := func(id int) bool {
+		if _, written := tx.categories.original[id]; written {
+			_, exists := tx.categories.rows[id]
+			return exists
+		}
+		return dm.categoryExists(id)
+	}
+	for id := range tx.products.original {
+		if product, exists := tx.products.rows[id]; exists {
+			if err := checkProductCategory(product, categoryExists); err != nil {
+				return err
+			}
+		}
+	}
+
+	// 全部写入作为一条WAL记录，崩溃恢复时同样要么全部生效要么全部不生效
+	ops := tx.users.ops(userOp)
+	ops = append(ops, tx.categories.ops(categoryOp)...)
+	ops = append(ops, tx.products.ops(productOp)...)
+	return dm.write(ops...)
+}
+
+// Rollback 回滚事务，丢弃全部写入；事务已结束时返回 ErrTxDone
+//
+// 事务中分配的ID不会回收，与数据库序列的行为一致。
+func (tx *Tx) Rollback() error {
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	return nil
+}
+
+// begin 事务内操作的公共前置：加锁并检查事务状态，返回解锁函数
+func (tx *Tx) begin() (func(), error) {
+	tx.mutex.Lock()
+	if tx.done {
+		tx.mutex.Unlock()
+		return nil, ErrTxDone
+	}
+	return tx.mutex.Unlock, nil
+}
+
+// nextID 从数据库的ID序列中分配ID
+func (tx *Tx) nextID(sequence *int) int {
+	tx.dm.mutex.Lock()
+	defer tx.dm.mutex.Unlock()
+
+	id := *sequence
+	*sequence++
+	return id
+}
+
+// 用户相关操作
+
+// CreateUser 在事务中创建用户
+func (tx *Tx) CreateUser(user *SimpleUser) error {
+	unlock, err := tx.begin()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	user.ID = tx.nextID(&tx.dm.nextUserID)
+	user.CreatedAt = time.Now()
+	user.UpdatedAt = user.CreatedAt
+	tx.users.put(user.ID, user)
+	return nil
+}
+
+// GetUserByID 在事务中根据ID获取用户
+func (tx *Tx) GetUserByID(id int) (*SimpleUser, error) {
+	unlock, err := tx.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	user, exists := tx.users.rows[id]
+	if !exists {
+		return nil, fmt.Errorf("用户不存在: %d", id)
+	}
+	userCopy := *user
+	return &userCopy, nil
+}
+
+// GetAllUsers 在事务中获取所有用户
+func (tx *Tx) GetAllUsers() ([]SimpleUser, error) {
+	unlock, err := tx.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return sortedUsers(tx.users.rows), nil
+}
+
+// UpdateUser 在事务中更新用户
+func (tx *Tx) UpdateUser(user *SimpleUser) error {
+	unlock, err := tx.begin()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	existing, exists := tx.users.rows[user.ID]
+	if !exists {
+		return fmt.Errorf("用户不存在: %d", user.ID)
+	}
+
+	user.CreatedAt = existing.CreatedAt
+	user.UpdatedAt = time.Now()
+	tx.users.put(user.ID, user)
+	return nil
+}
+
+// DeleteUser 在事务中删除用户
+func (tx *Tx) DeleteUser(id int) error {
+	unlock, err := tx.begin()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if _, exists := tx.users.rows[id]; !exists {
+		return fmt.Errorf("用户不存在: %d", id)
+	}
+	tx.users.remove(id)
+	return nil
+}
+
+// 分类相关操作
+
+// CreateCategory 在事务中创建分类
+func (tx *Tx) CreateCategory(category *SimpleCategory) error {
+	unlock, err := tx.begin()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	category.ID = tx.nextID(&tx.dm.nextCatID)
+	category.CreatedAt = time.Now()
+	category.UpdatedAt = category.CreatedAt
+	tx.categories.put(category.ID, category)
+	return nil
+}
+
+// GetAllCategories 在事务中获取所有分类
+func (tx *Tx) GetAllCategories() ([]SimpleCategory, error) {
+	unlock, err := tx.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return sortedCategories(tx.categories.rows), nil
+}
+
+// categoryExists 判断分类在事务视图中是否存在
+func (tx *Tx) categoryExists(id int) bool {
+	_, exists := tx.categories.rows[id]
+	return exists
+}
+
+// 产品相关操作
+
+// CreateProduct 在事务中创建产品，引用的分类必须存在
+func (tx *Tx) CreateProduct(product *SimpleProduct) error {
+	unlock, err := tx.begin()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := checkProductCategory(product, tx.categoryExists); err != nil {
+		return err
+	}
+
+	product.ID = tx.nextID(&tx.dm.nextProdID)
+	product.CreatedAt = time.Now()
+	product.UpdatedAt = product.CreatedAt
+	tx.products.put(product.ID, product)
+	return nil
+}
+
+// GetProductByID 在事务中根据ID获取产品
+func (tx *Tx) GetProductByID(id int) (*SimpleProduct, error) {
+	unlock, err := tx.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	product, exists := tx.products.rows[id]
+	if !exists {
+		return nil, fmt.Errorf("产品不存在: %d", id)
+	}
+	productCopy := *product
+	return &productCopy, nil
+}
+
+// GetProductsByCategory 在事务中根据分类获取产品
+func (tx *Tx) GetProductsByCategory(categoryID int) ([]SimpleProduct, error) {
+	unlock, err := tx.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return productsInCategory(tx.products.rows, categoryID), nil
+}
+
+// UpdateProduct 在事务中更新产品，引用的分类必须存在
+func (tx *Tx) UpdateProduct(product *SimpleProduct) error {
+	unlock, err := tx.begin()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	existing, exists := tx.products.rows[product.ID]
+	if !exists {
+		return fmt.Errorf("产品不存在: %d", product.ID)
+	}
+	if err := checkProductCategory(product, tx.categoryExists); err != nil {
+		return err
+	}
+
+	product.CreatedAt = existing.CreatedAt
+	product.UpdatedAt = time.Now()
+	tx.products.put(product.ID, product)
+	return nil
+}
+
+// TransferStock 在事务中转移库存
+func (tx *Tx) TransferStock(fromProductID, toProductID, quantity int) error {
+	unlock, err := tx.begin()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	fromProduct, exists := tx.products.rows[fromProductID]
+	if !exists {
+		return fmt.Errorf("源产品不存在: %d", fromProductID)
+	}
+	if _, exists := tx.products.rows[toProductID]; !exists {
+		return fmt.Errorf("目标产品不存在: %d", toProductID)
+	}
+	if fromProduct.Stock < quantity {
+		return fmt.Errorf("库存不足: 需要 %d, 可用 %d", quantity, fromProduct.Stock)
+	}
+
+	// 先写入源产品再读取目标产品，源和目标相同时库存保持不变
+	now := time.Now()
+	from := *fromProduct
+	from.Stock -= quantity
+	from.UpdatedAt = now
+	tx.products.put(from.ID, &from)
+
+	to := *tx.products.rows[toProductID]
+	to.Stock += quantity
+	to.UpdatedAt = now
+	tx.products.put(to.ID, &to)
+	return nil
+}